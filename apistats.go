@@ -0,0 +1,131 @@
+package main
+
+// Accounting of Google Drive API calls.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	gosync "sync"
+)
+
+// Types of Drive API calls.
+const (
+	apiList   = "list"
+	apiGet    = "get"
+	apiInsert = "insert"
+	apiUpdate = "update"
+	apiDelete = "delete"
+	apiUpload = "upload"
+)
+
+// Order in which call types are reported.
+var apiCallTypes = []string{apiList, apiGet, apiInsert, apiUpdate, apiDelete, apiUpload}
+
+// apiStats counts the Drive API calls made during the run, by type, and the
+// quota units they consumed. Drive quotas are counted in requests, so every
+// request sent counts as one unit, including the retries of rate limited
+// requests (see retryTransport). It is safe for concurrent use.
+type apiStats struct {
+	mu    gosync.Mutex
+	calls map[string]int64
+	units int64
+}
+
+// Drive API calls made in this run (see setupTransport).
+var apiCalls = newAPIStats()
+
+// Return an empty apiStats.
+func newAPIStats() *apiStats {
+	return &apiStats{calls: make(map[string]int64)}
+}
+
+// Return a copy of the number of calls by type, and the quota units used.
+//
+// Return:
+//   map[string]int64
+//   int64
+func (s *apiStats) totals() (map[string]int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := make(map[string]int64, len(s.calls))
+	for k, v := range s.calls {
+		calls[k] = v
+	}
+	return calls, s.units
+}
+
+// Log the number of Drive API calls made by type, and the quota units used,
+// if any. Units above the number of calls are retries.
+func (s *apiStats) report() {
+	calls, units := s.totals()
+	if units == 0 {
+		return
+	}
+	args := []any{"units", units}
+	for _, t := range apiCallTypes {
+		args = append(args, t, calls[t])
+	}
+	log.Info("Google Drive API calls", args...)
+}
+
+// Return the type of Drive API call made by req, or an empty string if req
+// is not a Drive API request (e.g. OAuth token refreshes).
+func apiCallType(req *http.Request) string {
+	p := req.URL.Path
+	if req.URL.Host != "www.googleapis.com" || !strings.HasPrefix(p, "/drive/") && !strings.HasPrefix(p, "/upload/drive/") {
+		return ""
+	}
+	// Chunks of resumable uploads.
+	if req.URL.Query().Get("upload_id") != "" {
+		return apiUpload
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		switch path.Base(p) {
+		case "files", "children", "parents", "changes", "revisions", "permissions":
+			return apiList
+		}
+		return apiGet
+	case http.MethodDelete:
+		return apiDelete
+	case http.MethodPost:
+		if path.Base(p) == "trash" {
+			return apiDelete
+		}
+		if path.Base(p) == "untrash" {
+			return apiUpdate
+		}
+		return apiInsert
+	}
+	return apiUpdate
+}
+
+// apiCounter is an http.RoundTripper counting the Drive API requests sent
+// through it. Above the retryTransport it counts calls, and below it, the
+// requests actually sent (quota units).
+type apiCounter struct {
+	base  http.RoundTripper
+	stats *apiStats
+	units bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *apiCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := apiCallType(req)
+	if t == "" {
+		return c.base.RoundTrip(req)
+	}
+	c.stats.mu.Lock()
+	if c.units {
+		c.stats.units++
+	} else {
+		c.stats.calls[t]++
+	}
+	c.stats.mu.Unlock()
+	return c.base.RoundTrip(req)
+}
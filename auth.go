@@ -0,0 +1,494 @@
+package main
+
+// Interactive authorization of Google Drive remotes (the auth command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strings"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+)
+
+const (
+	// Google OAuth endpoints.
+	oauthAuthURL  = "https://accounts.google.com/o/oauth2/auth"
+	oauthTokenURL = "https://accounts.google.com/o/oauth2/token"
+
+	// Redirect URI for installed applications that show the authorization
+	// code to the user, to be copied into gsync. Only used when the code is
+	// given with --code, or if the loopback redirect is not possible.
+	oobRedirectURL = "urn:ietf:wg:oauth:2.0:oob"
+
+	// Time to wait for the user to authorize gsync in the browser.
+	authTimeout = 10 * time.Minute
+
+	// Drive API endpoint returning the user owning a token, used to test new
+	// authorizations.
+	aboutURL = "https://www.googleapis.com/drive/v3/about?fields=user"
+)
+
+// OAuth client ID offered by the auth command when no credentials are
+// configured. Release builds can set it at build time, with:
+//
+//   go build -ldflags "-X main.defaultClientID=..."
+//
+// PKCE makes it safe to ship a client ID without its secret.
+var defaultClientID = ""
+
+// Return a new PKCE (RFC 7636) code verifier and its S256 challenge. The
+// challenge goes in the authorization request, and only the holder of the
+// verifier can exchange the resulting code for a token.
+//
+// Return:
+//   string: verifier
+//   string: challenge
+//   error
+func pkcePair() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Exchange the authorization code for a token at the token endpoint of
+// config, proving possession of the PKCE verifier (if not empty). The client
+// secret is only sent if set.
+//
+// Return:
+//   *oauth.Token
+//   error
+func exchangeCode(client *http.Client, config *oauth.Config, code string, verifier string) (*oauth.Token, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {config.RedirectURL},
+		"client_id":    {config.ClientId},
+	}
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	if verifier != "" {
+		form.Set("code_verifier", verifier)
+	}
+	resp, err := client.PostForm(config.TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to exchange the authorization code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tr struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Error        string `json:"error"`
+		Description  string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("Unable to decode the token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		if tr.Error != "" {
+			return nil, fmt.Errorf("Unable to exchange the authorization code: %s (%s)", tr.Error, tr.Description)
+		}
+		return nil, fmt.Errorf("Unable to exchange the authorization code: %s", resp.Status)
+	}
+	token := &oauth.Token{AccessToken: tr.AccessToken, RefreshToken: tr.RefreshToken}
+	if tr.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// Read a line from r after writing the prompt text to w. The default value
+// def (if any) is shown, masked if mask is set, and returned for empty
+// answers.
+//
+// Return:
+//   string
+//   error
+func prompt(r *bufio.Reader, w io.Writer, text string, def string, mask bool) (string, error) {
+	shown := def
+	if mask && len(def) > 4 {
+		shown = strings.Repeat("*", len(def)-4) + def[len(def)-4:]
+	}
+	if shown != "" {
+		fmt.Fprintf(w, "%s [%s]: ", text, shown)
+	} else {
+		fmt.Fprintf(w, "%s: ", text)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("Unable to read %s: %v", strings.ToLower(text), err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// Ask for the OAuth client ID and secret, unless given on the command line
+// (id and secret). The credentials saved in credfile, if any, or the client ID
+// built into gsync, are offered as defaults. The secret is optional, since
+// authorizations are protected by PKCE.
+//
+// Return:
+//   *GdriveCredentials
+//   error
+func promptCredentials(r *bufio.Reader, w io.Writer, credfile string, id string, secret string) (*GdriveCredentials, error) {
+	cred := &GdriveCredentials{ClientID: defaultClientID}
+	if _, err := os.Stat(credfile); err == nil {
+		if cred, err = handleCredentials(credfile, "", ""); err != nil {
+			return nil, err
+		}
+	}
+	if id != "" {
+		cred.ClientID = id
+	}
+	if secret != "" {
+		cred.ClientSecret = secret
+	}
+
+	var err error
+	if id == "" {
+		if cred.ClientID, err = prompt(r, w, "Client ID", cred.ClientID, false); err != nil {
+			return nil, err
+		}
+	}
+	if secret == "" {
+		if cred.ClientSecret, err = prompt(r, w, "Client secret (optional)", cred.ClientSecret, true); err != nil {
+			return nil, err
+		}
+	}
+	if cred.ClientID == "" {
+		return nil, fmt.Errorf("A client ID is required (see the Google Developers Console)")
+	}
+	return cred, nil
+}
+
+// Return the OAuth configuration used to authorize scope with cred.
+func oauthConfig(cred *GdriveCredentials, scope string) *oauth.Config {
+	return &oauth.Config{
+		ClientId:     cred.ClientID,
+		ClientSecret: cred.ClientSecret,
+		Scope:        scope,
+		AuthURL:      oauthAuthURL,
+		TokenURL:     oauthTokenURL,
+		RedirectURL:  oobRedirectURL,
+		AccessType:   "offline",
+	}
+}
+
+// Open url in the default web browser, without waiting for it.
+//
+// Return:
+//   error
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// authResult is the outcome of an authorization request, as received by an
+// authReceiver.
+type authResult struct {
+	code string
+	err  error
+}
+
+// authReceiver is a temporary HTTP server on the loopback interface, where
+// the browser is redirected with the authorization code once the user allows
+// access (the loopback redirect flow for installed applications). Requests
+// without the expected state are ignored.
+type authReceiver struct {
+	listener net.Listener
+	server   *http.Server
+	state    string
+	result   chan authResult
+}
+
+// Start an authReceiver listening on a random port of the loopback interface,
+// waiting for the authorization request identified by state.
+//
+// Return:
+//   *authReceiver
+//   error
+func newAuthReceiver(state string) (*authReceiver, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	a := &authReceiver{
+		listener: l,
+		state:    state,
+		result:   make(chan authResult, 1),
+	}
+	a.server = &http.Server{Handler: a, ReadHeaderTimeout: 10 * time.Second}
+	go a.server.Serve(l)
+	return a, nil
+}
+
+// Return the redirect URI leading the browser to the receiver.
+func (a *authReceiver) redirectURL() string {
+	return "http://" + a.listener.Addr().String() + "/"
+}
+
+// ServeHTTP handles the redirect from the consent page, passing on the
+// authorization code (or the error reported by Google) and showing the
+// result to the user.
+func (a *authReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.URL.Path != "/" || q.Get("state") != a.state {
+		http.Error(w, "Unknown authorization request", http.StatusBadRequest)
+		return
+	}
+	res := authResult{code: q.Get("code")}
+	msg := "gsync has been authorized. You can close this window."
+	if e := q.Get("error"); e != "" || res.code == "" {
+		res = authResult{err: fmt.Errorf("Authorization failed: %s", e)}
+		msg = "gsync was not authorized: " + e
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><p>%s</p></body></html>\n", html.EscapeString(msg))
+	select {
+	case a.result <- res:
+	default:
+	}
+}
+
+// Stop the receiver.
+func (a *authReceiver) close() {
+	a.server.Close()
+}
+
+// Extract the authorization code from line, which holds either the code or
+// the address the browser was redirected to (for browsers on other machines,
+// where the redirect to the loopback interface fails).
+//
+// Return:
+//   string
+//   error
+func parseAuthCode(line string, state string) (string, error) {
+	if !strings.Contains(line, "://") {
+		return line, nil
+	}
+	u, err := url.Parse(line)
+	if err != nil {
+		return "", fmt.Errorf("Invalid address \"%s\": %v", line, err)
+	}
+	q := u.Query()
+	if e := q.Get("error"); e != "" {
+		return "", fmt.Errorf("Authorization failed: %s", e)
+	}
+	if q.Get("state") != state || q.Get("code") == "" {
+		return "", fmt.Errorf("No authorization code for this request in \"%s\"", line)
+	}
+	return q.Get("code"), nil
+}
+
+// Wait for the authorization code, received by recv or typed by the user into
+// r, whichever comes first. Without a receiver, the code must be typed.
+//
+// Return:
+//   string
+//   error
+func readAuthCode(ctx context.Context, r *bufio.Reader, w io.Writer, recv *authReceiver, state string) (string, error) {
+	if recv == nil {
+		return prompt(r, w, "Authorization code", "", false)
+	}
+	fmt.Fprintln(w, "Waiting for the authorization in the browser. If the browser runs on another")
+	fmt.Fprintln(w, "machine, paste the address it was sent to after allowing access here.")
+
+	typed := make(chan authResult, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || strings.TrimSpace(line) == "") {
+			// Keep waiting for the browser.
+			return
+		}
+		code, err := parseAuthCode(strings.TrimSpace(line), state)
+		typed <- authResult{code: code, err: err}
+	}()
+
+	var res authResult
+	select {
+	case res = <-recv.result:
+	case res = <-typed:
+	case <-ctx.Done():
+		return "", fmt.Errorf("Timed out waiting for the authorization")
+	}
+	return res.code, res.err
+}
+
+// Return a random value identifying an authorization request.
+//
+// Return:
+//   string
+//   error
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Make a test API call with client, returning the email address of the Google
+// account it is authorized for.
+//
+// Return:
+//   string
+//   error
+func testAuthorization(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("Unable to test the authorization: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to test the authorization: %s", resp.Status)
+	}
+	var about struct {
+		User struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"user"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&about); err != nil {
+		return "", fmt.Errorf("Unable to decode the test response: %v", err)
+	}
+	return about.User.EmailAddress, nil
+}
+
+// Walk the user through the authorization of remote ("" for the default
+// remote) with the scope selected by --scope: ask for the OAuth credentials,
+// show the consent page, exchange the authorization code for a token and test
+// it with an API call. The credentials and token are only saved if the test
+// succeeds, so a failed attempt leaves a working setup alone.
+//
+// Return:
+//   error
+func runAuth(r io.Reader, w io.Writer, remote string) error {
+	if opt.impersonate != "" {
+		return fmt.Errorf("The auth command is not needed with --impersonate")
+	}
+	scope, ok := driveScopes[opt.scope]
+	if !ok {
+		return fmt.Errorf("Invalid scope \"%s\"", opt.scope)
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return err
+	}
+	if err = setupProxy(opt.proxy); err != nil {
+		return err
+	}
+	credfile := credentialsFileFor(usr.HomeDir, remote)
+	cachefile, err := tokens.open(tokenCacheFile(usr.HomeDir, remote, opt.scope))
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(r)
+	cred, err := promptCredentials(in, w, credfile, opt.clientID, opt.clientSecret)
+	if err != nil {
+		return err
+	}
+
+	config := oauthConfig(cred, scope)
+	state, err := randomState()
+	if err != nil {
+		return err
+	}
+
+	// The browser sends the code to a local receiver. Codes given with
+	// --code were issued for the copy and paste flow.
+	var recv *authReceiver
+	if opt.code == "" {
+		if recv, err = newAuthReceiver(state); err != nil {
+			log.Warn("unable to receive the authorization code from the browser; it must be copied by hand", "error", err)
+		} else {
+			defer recv.close()
+			config.RedirectURL = recv.redirectURL()
+		}
+	}
+
+	// Codes given with --code were requested without a PKCE challenge.
+	authURL := config.AuthCodeURL(state)
+	var verifier string
+	if opt.code == "" {
+		var challenge string
+		if verifier, challenge, err = pkcePair(); err != nil {
+			return err
+		}
+		authURL += "&" + url.Values{"code_challenge": {challenge}, "code_challenge_method": {"S256"}}.Encode()
+	}
+	fmt.Fprintf(w, "\nOpen this URL in your browser and allow gsync to access your Google Drive:\n\n  %s\n\n", authURL)
+	if err = openBrowser(authURL); err != nil {
+		log.Debug("unable to open the browser", "error", err)
+	}
+	code := opt.code
+	if code == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		defer cancel()
+		if code, err = readAuthCode(ctx, in, w, recv, state); err != nil {
+			return err
+		}
+	}
+	if code == "" {
+		return fmt.Errorf("No authorization code given")
+	}
+
+	token, err := exchangeCode(http.DefaultClient, config, code, verifier)
+	if err != nil {
+		return err
+	}
+	transport := &oauth.Transport{Config: config, Token: token, Transport: http.DefaultTransport}
+	email, err := testAuthorization(transport.Client(), aboutURL)
+	if err != nil {
+		return err
+	}
+
+	if err = saveCredentials(credfile, cred); err != nil {
+		return err
+	}
+	if err = oauth.CacheFile(cachefile).PutToken(token); err != nil {
+		return fmt.Errorf("Unable to save token to \"%s\": %v", cachefile, err)
+	}
+	name := remote
+	if name == "" {
+		name = "gdrive"
+	}
+	fmt.Fprintf(w, "Remote \"%s:\" is now authorized to access the Google Drive of %s (scope %s).\n", name, email, opt.scope)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Benchmark tests, in the order they run.
+const (
+	benchUpload   = "upload"
+	benchList     = "list"
+	benchStat     = "stat"
+	benchDownload = "download"
+	benchDelete   = "delete"
+)
+
+// benchResult holds the result of one benchmark test: the number of
+// operations (files written, entries listed, etc), the bytes transferred (for
+// uploads and downloads) and the total time taken.
+type benchResult struct {
+	Test     string        `json:"test"`
+	Ops      int           `json:"ops"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Return the throughput of r: bytes per second for transfers, and operations
+// per second (or the latency of each operation, for stats) otherwise.
+func (r benchResult) rate() string {
+	secs := r.Duration.Seconds()
+	switch {
+	case secs == 0 || r.Ops == 0:
+		return "-"
+	case r.Bytes > 0:
+		return fmt.Sprintf("%.2f MiB/s", float64(r.Bytes)/(1<<20)/secs)
+	case r.Test == benchStat:
+		return fmt.Sprintf("%v/op", (r.Duration / time.Duration(r.Ops)).Round(time.Microsecond))
+	}
+	return fmt.Sprintf("%.1f ops/s", float64(r.Ops)/secs)
+}
+
+// Measure the performance of fsys by writing nfiles synthetic files of size
+// bytes into a new directory under dir, listing the directory, reading the
+// information and contents of every file, and deleting them. The directory
+// is removed at the end, even on errors.
+//
+// Return:
+//   []benchResult: results of the tests completed so far
+//   error
+func runBench(ctx context.Context, fsys vfs.VFS, dir string, nfiles int, size int64) (results []benchResult, err error) {
+	if nfiles < 1 {
+		return nil, fmt.Errorf("The number of benchmark files must be positive")
+	}
+	benchdir := path.Join(dir, "gsync-bench-"+time.Now().Format("20060102-150405"))
+	if err = fsys.Mkdir(ctx, benchdir); err != nil {
+		return nil, err
+	}
+	var written []string
+	defer func() {
+		for _, fname := range written {
+			fsys.Delete(ctx, fname)
+		}
+		if derr := fsys.Delete(ctx, benchdir); derr != nil && err == nil {
+			err = fmt.Errorf("Unable to remove \"%s\": %v", benchdir, derr)
+		}
+	}()
+
+	// Run fn for each file, timing the whole test.
+	timed := func(test string, fn func(i int, fname string) (int64, error)) error {
+		r := benchResult{Test: test}
+		start := time.Now()
+		for i := 0; i < nfiles; i++ {
+			n, err := fn(i, path.Join(benchdir, fmt.Sprintf("file%05d", i)))
+			if err != nil {
+				return err
+			}
+			r.Ops++
+			r.Bytes += n
+		}
+		r.Duration = time.Since(start)
+		results = append(results, r)
+		log.Info("bench", "test", test, "ops", r.Ops, "bytes", r.Bytes, "duration", r.Duration)
+		return nil
+	}
+
+	// Random data, so compression doesn't skew the results.
+	err = timed(benchUpload, func(i int, fname string) (int64, error) {
+		data := io.LimitReader(rand.New(rand.NewSource(int64(i))), size)
+		if err := fsys.WriteToFile(ctx, fname, data); err != nil {
+			return 0, err
+		}
+		written = append(written, fname)
+		return size, nil
+	})
+	if err != nil {
+		return results, err
+	}
+
+	r := benchResult{Test: benchList}
+	start := time.Now()
+	err = fsys.Walk(ctx, benchdir, func(fi vfs.FileInfo, err error) error {
+		// Some backends visit the directory itself.
+		if err == nil && relPath(benchdir, fi.Path) != "" {
+			r.Ops++
+		}
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
+	r.Duration = time.Since(start)
+	results = append(results, r)
+	if r.Ops != nfiles {
+		return results, fmt.Errorf("Listing \"%s\" returned %d entries, expected %d", benchdir, r.Ops, nfiles)
+	}
+
+	err = timed(benchStat, func(_ int, fname string) (int64, error) {
+		_, err := fsys.Stat(ctx, fname)
+		return 0, err
+	})
+	if err != nil {
+		return results, err
+	}
+
+	err = timed(benchDownload, func(_ int, fname string) (int64, error) {
+		rc, err := fsys.ReadFromFile(ctx, fname)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		n, err := io.Copy(io.Discard, rc)
+		if err == nil && n != size {
+			err = fmt.Errorf("Read %d bytes from \"%s\", expected %d", n, fname, size)
+		}
+		return n, err
+	})
+	if err != nil {
+		return results, err
+	}
+
+	err = timed(benchDelete, func(_ int, fname string) (int64, error) {
+		return 0, fsys.Delete(ctx, fname)
+	})
+	written = nil
+	return results, err
+}
+
+// Print the benchmark results to w, as a table or, with asJSON, as a JSON
+// array.
+//
+// Return:
+//   error
+func printBench(w io.Writer, results []benchResult, asJSON bool) error {
+	if asJSON {
+		if results == nil {
+			results = []benchResult{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TEST\tOPS\tBYTES\tTIME\tRATE")
+	for _, r := range results {
+		bytes := "-"
+		if r.Bytes > 0 {
+			bytes = fmt.Sprint(r.Bytes)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%v\t%s\n", r.Test, r.Ops, bytes, r.Duration.Round(time.Microsecond), r.rate())
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,561 @@
+package main
+
+// On-disk cache of remote reads (cache: paths).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Prefix of cached paths, as in "cache:gdrive:Photos".
+	cachePrefix = "cache:"
+
+	// Default directory for the cache (--cache-dir), under the home
+	// directory.
+	defaultCacheDir = ".gsync-cache"
+
+	// Defaults for --cache-max-size and --cache-max-age.
+	defaultOptCacheMaxSize = 1 << 30
+	defaultOptCacheMaxAge  = 10 * time.Minute
+)
+
+// Check if pathname is a cached path. If so, return true and the path
+// without the prefix. Otherwise, return false and pathname unchanged.
+//
+// Returns:
+//   bool
+//   string
+func parseCachePath(pathname string) (bool, string) {
+	if !strings.HasPrefix(pathname, cachePrefix) {
+		return false, pathname
+	}
+	return true, strings.TrimPrefix(pathname, cachePrefix)
+}
+
+// Initializes a new cacheVfs wrapping fsys, with the cache directory and
+// limits set by --cache-dir, --cache-max-size and --cache-max-age.
+//
+// Returns:
+//   *cacheVfs
+//   error
+func initCacheVfs(fsys vfs.VFS, key string) (*cacheVfs, error) {
+	dir := opt.cacheDir
+	if dir == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(usr.HomeDir, defaultCacheDir)
+	}
+	return newCacheVfs(fsys, dir, key, int64(opt.cacheMaxSize), opt.cacheMaxAge)
+}
+
+// cachedWalk is the result of a complete walk, as saved in the cache.
+type cachedWalk struct {
+	Root    string
+	Time    time.Time
+	Entries []vfs.FileInfo
+
+	// Entries by cleaned path.
+	byPath map[string]vfs.FileInfo
+}
+
+// fresh returns true if the walk is younger than maxAge.
+func (w *cachedWalk) fresh(maxAge time.Duration) bool {
+	return time.Since(w.Time) < maxAge
+}
+
+// covers returns true if the cleaned path p is the root of the walk or is
+// under it.
+func (w *cachedWalk) covers(p string) bool {
+	root := path.Clean(w.Root)
+	return p == root || root == "/" && strings.HasPrefix(p, "/") || strings.HasPrefix(p, root+"/")
+}
+
+// cacheVfs wraps a remote vfs.VFS, keeping what is read from it on local disk
+// to speed up later runs reading the same trees (see --cache-dir). Complete
+// walks and checksums are reused for up to maxAge. The contents of files read
+// to the end are reused while the file keeps its size and modification time,
+// and evicted (least recently used first) to keep the cache under maxSize
+// bytes. Writes go to the underlying VFS, and discard all cached walks.
+type cacheVfs struct {
+	vfs.VFS
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu    gosync.Mutex
+	size  int64
+	walks map[string]*cachedWalk
+}
+
+// Return a new cacheVfs wrapping fsys. The cache is kept in a subdirectory of
+// cachedir named after key, which must identify the remote (such as its
+// name), so several remotes can share cachedir.
+//
+// Return:
+//   *cacheVfs
+//   error
+func newCacheVfs(fsys vfs.VFS, cachedir string, key string, maxSize int64, maxAge time.Duration) (*cacheVfs, error) {
+	c := &cacheVfs{
+		VFS:     fsys,
+		dir:     filepath.Join(cachedir, cacheHash(key)),
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		walks:   make(map[string]*cachedWalk),
+	}
+	for _, d := range []string{"data", "sums", "walks"} {
+		if err := os.MkdirAll(filepath.Join(c.dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "data"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		c.size += f.Size()
+	}
+	// Expired checksums are never used again.
+	sums, err := ioutil.ReadDir(filepath.Join(c.dir, "sums"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range sums {
+		if time.Since(f.ModTime()) >= maxAge {
+			os.Remove(filepath.Join(c.dir, "sums", f.Name()))
+		}
+	}
+	return c, nil
+}
+
+// Return the name of the cache file for the given fields.
+func cacheHash(fields ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Return the name of the cache file holding data about the version of a file
+// described by fi.
+func fileCacheKey(fi vfs.FileInfo) string {
+	return cacheHash(path.Clean(fi.Path), fmt.Sprint(fi.Size), fmt.Sprint(fi.Mtime.UnixNano()))
+}
+
+// Capabilities returns the capabilities of the underlying VFS. Server-side
+// copies are not available through the cache.
+func (c *cacheVfs) Capabilities() vfs.Capabilities {
+	caps := vfs.CapabilitiesOf(c.VFS)
+	caps.ServerSideCopy = false
+	return caps
+}
+
+// Return the cached walk covering fullpath, if any.
+func (c *cacheVfs) cachedWalk(fullpath string) *cachedWalk {
+	p := path.Clean(fullpath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.walks {
+		if w.fresh(c.maxAge) && w.covers(p) {
+			return w
+		}
+	}
+	return nil
+}
+
+// Load the walk of root saved in the cache, if it exists and is fresh. Walks
+// are only reused for the same root, so the paths of their entries match.
+func (c *cacheVfs) loadWalk(root string) *cachedWalk {
+	if w := c.cachedWalk(root); w != nil && w.Root == root {
+		return w
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, "walks", cacheHash(path.Clean(root))))
+	if err != nil {
+		return nil
+	}
+	w := &cachedWalk{}
+	if err = json.Unmarshal(data, w); err != nil || w.Root != root || !w.fresh(c.maxAge) {
+		return nil
+	}
+	c.addWalk(w)
+	return w
+}
+
+// Index w and make it available to Stat.
+func (c *cacheVfs) addWalk(w *cachedWalk) {
+	w.byPath = make(map[string]vfs.FileInfo, len(w.Entries))
+	for _, fi := range w.Entries {
+		w.byPath[path.Clean(fi.Path)] = fi
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.walks[path.Clean(w.Root)] = w
+}
+
+// Save the walk w in the cache.
+func (c *cacheVfs) saveWalk(w *cachedWalk) error {
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	c.addWalk(w)
+	return writeFileAtomic(filepath.Join(c.dir, "walks", cacheHash(path.Clean(w.Root))), data)
+}
+
+// Discard all cached walks, after a write to the underlying VFS.
+func (c *cacheVfs) invalidate() {
+	c.mu.Lock()
+	c.walks = make(map[string]*cachedWalk)
+	c.mu.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, "walks"))
+	if err != nil {
+		log.Warn("unable to clear cached walks", "error", err)
+		return
+	}
+	for _, f := range files {
+		os.Remove(filepath.Join(c.dir, "walks", f.Name()))
+	}
+}
+
+// Delete calls Delete in the underlying VFS.
+func (c *cacheVfs) Delete(ctx context.Context, fullpath string) error {
+	defer c.invalidate()
+	return c.VFS.Delete(ctx, fullpath)
+}
+
+// FileExists returns true if fullpath exists, using cached walks if possible.
+func (c *cacheVfs) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	if w := c.cachedWalk(fullpath); w != nil {
+		_, ok := w.byPath[path.Clean(fullpath)]
+		return ok, nil
+	}
+	return c.VFS.FileExists(ctx, fullpath)
+}
+
+// FileID returns the ID of fullpath if the underlying VFS supports IDs, or an
+// empty string otherwise.
+func (c *cacheVfs) FileID(ctx context.Context, fullpath string) (string, error) {
+	v, ok := c.VFS.(vfs.FileIDer)
+	if !ok {
+		return "", nil
+	}
+	return v.FileID(ctx, fullpath)
+}
+
+// MD5 returns the MD5 checksum of fullpath if the underlying VFS supports
+// checksums, or an empty string otherwise. Checksums are cached along with
+// the size and modification time of the file.
+func (c *cacheVfs) MD5(ctx context.Context, fullpath string) (string, error) {
+	v, ok := c.VFS.(vfs.MD5er)
+	if !ok {
+		return "", nil
+	}
+	fi, err := c.Stat(ctx, fullpath)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(c.dir, "sums", fileCacheKey(fi))
+	if st, err := os.Stat(name); err == nil && time.Since(st.ModTime()) < c.maxAge {
+		if data, err := ioutil.ReadFile(name); err == nil {
+			return string(data), nil
+		}
+	}
+	sum, err := v.MD5(ctx, fullpath)
+	if err != nil || sum == "" {
+		return sum, err
+	}
+	if err = writeFileAtomic(name, []byte(sum)); err != nil {
+		log.Warn("unable to cache checksum", "path", fullpath, "error", err)
+	}
+	return sum, nil
+}
+
+// MimeType returns the MIME type of fullpath if the underlying VFS keeps MIME
+// types, or an empty string otherwise.
+func (c *cacheVfs) MimeType(ctx context.Context, fullpath string) (string, error) {
+	v, ok := c.VFS.(vfs.MimeTyper)
+	if !ok {
+		return "", nil
+	}
+	return v.MimeType(ctx, fullpath)
+}
+
+// Revision returns the revision of fullpath if the underlying VFS supports
+// revisions, or an empty string otherwise.
+func (c *cacheVfs) Revision(ctx context.Context, fullpath string) (string, error) {
+	v, ok := c.VFS.(vfs.Revisioner)
+	if !ok {
+		return "", nil
+	}
+	return v.Revision(ctx, fullpath)
+}
+
+// Metadata returns the metadata of fullpath if the underlying VFS supports
+// it, or nil otherwise.
+func (c *cacheVfs) Metadata(ctx context.Context, fullpath string) (map[string]string, error) {
+	v, ok := c.VFS.(vfs.MetadataGetter)
+	if !ok {
+		return nil, nil
+	}
+	return v.Metadata(ctx, fullpath)
+}
+
+// Mkdir calls Mkdir in the underlying VFS.
+func (c *cacheVfs) Mkdir(ctx context.Context, fullpath string) error {
+	defer c.invalidate()
+	return c.VFS.Mkdir(ctx, fullpath)
+}
+
+// Move calls Move in the underlying VFS.
+func (c *cacheVfs) Move(ctx context.Context, srcpath string, dstpath string) error {
+	defer c.invalidate()
+	return c.VFS.Move(ctx, srcpath, dstpath)
+}
+
+// ReadDir calls ReadDir in the underlying VFS, if it can list single
+// directories.
+func (c *cacheVfs) ReadDir(ctx context.Context, fullpath string) ([]vfs.FileInfo, error) {
+	v, ok := c.VFS.(vfs.DirReader)
+	if !ok {
+		return nil, fmt.Errorf("Unable to list \"%s\": directory listings not supported", fullpath)
+	}
+	return v.ReadDir(ctx, fullpath)
+}
+
+// ReadFromFile returns a reader with the contents of fullpath, from the cache
+// if possible. Otherwise, the file is read from the underlying VFS and saved
+// in the cache if read to the end.
+func (c *cacheVfs) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	fi, err := c.Stat(ctx, fullpath)
+	if err != nil {
+		return nil, err
+	}
+	// Files of unknown size (such as Google Docs) are never cached.
+	if !fi.IsRegular() || fi.Size < 0 || fi.Size > c.maxSize {
+		return c.VFS.ReadFromFile(ctx, fullpath)
+	}
+
+	name := filepath.Join(c.dir, "data", fileCacheKey(fi))
+	if f, err := os.Open(name); err == nil {
+		if st, err := f.Stat(); err == nil && st.Size() == fi.Size {
+			// Modification times record the last use, for evictions.
+			now := time.Now()
+			os.Chtimes(name, now, now)
+			log.Debug("reading from cache", "path", fullpath)
+			return f, nil
+		}
+		f.Close()
+	}
+
+	rc, err := c.VFS.ReadFromFile(ctx, fullpath)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(c.dir, "data"), ".tmp-")
+	if err != nil {
+		log.Warn("unable to cache file", "path", fullpath, "error", err)
+		return rc, nil
+	}
+	return &cacheReader{rc: rc, tmp: tmp, name: name, size: fi.Size, cache: c}, nil
+}
+
+// cacheReader reads from a file in the underlying VFS, saving the data to a
+// temporary file, which replaces name in the cache if the file is read to the
+// end.
+type cacheReader struct {
+	rc    io.ReadCloser
+	tmp   *os.File
+	name  string
+	size  int64
+	read  int64
+	cache *cacheVfs
+}
+
+// Read reads from the underlying file, saving the data read.
+func (r *cacheReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 && r.tmp != nil {
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			log.Warn("unable to cache file", "path", r.name, "error", werr)
+			r.discard()
+		}
+		r.read += int64(n)
+	}
+	if err == io.EOF && r.tmp != nil {
+		r.commit()
+	}
+	return n, err
+}
+
+// Close closes the underlying file, discarding the saved data if the file
+// was not read to the end.
+func (r *cacheReader) Close() error {
+	r.discard()
+	return r.rc.Close()
+}
+
+// Move the saved data into the cache, if complete.
+func (r *cacheReader) commit() {
+	tmp := r.tmp.Name()
+	err := r.tmp.Close()
+	r.tmp = nil
+	if err == nil && r.read == r.size {
+		err = os.Rename(tmp, r.name)
+	} else if err == nil {
+		err = fmt.Errorf("Read %d bytes from \"%s\", expected %d", r.read, r.name, r.size)
+	}
+	if err != nil {
+		log.Warn("unable to cache file", "error", err)
+		os.Remove(tmp)
+		return
+	}
+	r.cache.added(r.size)
+}
+
+// Remove the saved data, if any.
+func (r *cacheReader) discard() {
+	if r.tmp != nil {
+		r.tmp.Close()
+		os.Remove(r.tmp.Name())
+		r.tmp = nil
+	}
+}
+
+// Record size bytes added to the cache, and evict the least recently used
+// files until the cache fits in maxSize.
+func (c *cacheVfs) added(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += size
+	if c.size <= c.maxSize {
+		return
+	}
+
+	dir := filepath.Join(c.dir, "data")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Warn("unable to evict files from the cache", "error", err)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	c.size = 0
+	for _, f := range files {
+		c.size += f.Size()
+	}
+	for _, f := range files {
+		if c.size <= c.maxSize {
+			break
+		}
+		// Files being downloaded.
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			continue
+		}
+		if err = os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			log.Warn("unable to evict file from the cache", "error", err)
+			continue
+		}
+		c.size -= f.Size()
+	}
+}
+
+// SetMtime calls SetMtime in the underlying VFS.
+func (c *cacheVfs) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	defer c.invalidate()
+	return c.VFS.SetMtime(ctx, fullpath, mtime)
+}
+
+// Stat returns information about fullpath, using cached walks if possible.
+func (c *cacheVfs) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	if w := c.cachedWalk(fullpath); w != nil {
+		fi, ok := w.byPath[path.Clean(fullpath)]
+		if !ok {
+			return vfs.FileInfo{}, fmt.Errorf("Stat \"%s\": %w", fullpath, vfs.ErrNotExist)
+		}
+		fi.Path = fullpath
+		return fi, nil
+	}
+	return c.VFS.Stat(ctx, fullpath)
+}
+
+// Walk calls walkFn for fullpath and every file and directory under it,
+// replaying a cached walk of fullpath if possible. Complete walks without
+// errors are saved in the cache.
+func (c *cacheVfs) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	if w := c.loadWalk(fullpath); w != nil {
+		log.Debug("using cached walk", "path", fullpath, "age", time.Since(w.Time))
+		for _, fi := range w.Entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := walkFn(fi, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := &cachedWalk{Root: fullpath, Time: time.Now()}
+	complete := true
+	err := c.VFS.Walk(ctx, fullpath, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			complete = false
+		} else {
+			w.Entries = append(w.Entries, fi)
+		}
+		return walkFn(fi, err)
+	})
+	if err != nil || !complete {
+		return err
+	}
+	if err = c.saveWalk(w); err != nil {
+		log.Warn("unable to cache walk", "path", fullpath, "error", err)
+	}
+	return nil
+}
+
+// WriteToFile calls WriteToFile in the underlying VFS.
+func (c *cacheVfs) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	defer c.invalidate()
+	return c.VFS.WriteToFile(ctx, fullpath, reader)
+}
+
+// Write data to name, replacing it atomically.
+//
+// Return:
+//   error
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
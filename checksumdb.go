@@ -0,0 +1,118 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// checksumEntry holds the MD5 checksum of a local file, along with the size,
+// modification time (in nanoseconds) and inode number of the file when the
+// checksum was computed.
+type checksumEntry struct {
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Inode uint64 `json:"inode,omitempty"`
+	MD5   string `json:"md5"`
+}
+
+// checksumDB is a persistent cache of the checksums of local files, keyed by
+// absolute path. Only the latest checksum of each path is kept. It implements
+// localvfs.HashCache, and is safe for concurrent use.
+type checksumDB struct {
+	mu    gosync.Mutex
+	fname string
+	dirty bool
+	Files map[string]*checksumEntry `json:"files"`
+}
+
+// Load the checksum database from fname. A missing file results in an empty
+// database. If fname is empty, checksums are only kept in memory.
+//
+// Return:
+//   *checksumDB
+//   error
+func openChecksumDB(fname string) (*checksumDB, error) {
+	db := &checksumDB{
+		fname: fname,
+		Files: make(map[string]*checksumEntry),
+	}
+	if fname == "" {
+		return db, nil
+	}
+
+	j, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(j, db)
+	return db, err
+}
+
+// Lookup returns the checksum stored for key, and true if the file is
+// unchanged since the checksum was computed.
+func (db *checksumDB) Lookup(key localvfs.HashKey) (string, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e, ok := db.Files[key.Path]
+	if !ok || e.Size != key.Size || e.Mtime != key.Mtime.UnixNano() || e.Inode != key.Inode {
+		return "", false
+	}
+	return e.MD5, true
+}
+
+// Store records the checksum of the file identified by key.
+func (db *checksumDB) Store(key localvfs.HashKey, sum string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.Files[key.Path] = &checksumEntry{
+		Size:  key.Size,
+		Mtime: key.Mtime.UnixNano(),
+		Inode: key.Inode,
+		MD5:   sum,
+	}
+	db.dirty = true
+}
+
+// Save the checksum database atomically to disk, if it has changed.
+//
+// Return:
+//   error
+func (db *checksumDB) save() error {
+	db.mu.Lock()
+	if db.fname == "" || !db.dirty {
+		db.mu.Unlock()
+		return nil
+	}
+	j, err := json.Marshal(db)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(db.fname), filepath.Base(db.fname))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(j)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.fname)
+}
@@ -0,0 +1,281 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Conflict resolution policies (--conflict).
+	conflictNewer  = "newer"
+	conflictLarger = "larger"
+	conflictSource = "source"
+	conflictDest   = "dest"
+	conflictRename = "rename"
+	conflictSkip   = "skip"
+	conflictAsk    = "ask"
+
+	// Suffix added to the names of conflicting copies, followed by a
+	// timestamp in conflictTimeFormat.
+	conflictSuffix     = ".conflict-"
+	conflictTimeFormat = "20060102-150405"
+)
+
+var conflictPolicies = []string{conflictNewer, conflictLarger, conflictSource, conflictDest, conflictRename, conflictSkip, conflictAsk}
+
+// Answers accepted by conflictPrompter, and the policies they select.
+// Capital letters apply the policy to all remaining conflicts.
+var conflictAnswers = map[string]string{
+	"s": conflictSource,
+	"d": conflictDest,
+	"r": conflictRename,
+	"k": conflictSkip,
+}
+
+// conflictPrompter asks the user how to resolve each conflict (--conflict=ask).
+// It is safe for concurrent use, so destinations planned concurrently don't
+// ask at the same time.
+type conflictPrompter struct {
+	mu  gosync.Mutex
+	in  *bufio.Reader
+	out io.Writer
+	// Policy chosen for all remaining conflicts, if any.
+	all string
+}
+
+// Asks for the resolution of conflicts (see --conflict=ask).
+var conflictPrompt *conflictPrompter
+
+// Return a conflictPrompter reading answers from r and writing questions to w.
+func newConflictPrompter(r io.Reader, w io.Writer) *conflictPrompter {
+	return &conflictPrompter{in: bufio.NewReader(r), out: w}
+}
+
+// Return a description of the file fullpath in fsys, described by fi: its
+// size, modification time and MD5 checksum (when available).
+func describeVersion(ctx context.Context, fsys vfs.VFS, fi vfs.FileInfo) string {
+	s := fmt.Sprintf("%d bytes, modified %s", fi.Size, fi.Mtime.Local().Format("2006-01-02 15:04:05"))
+	if fi.Size < 0 {
+		s = "unknown size, modified " + fi.Mtime.Local().Format("2006-01-02 15:04:05")
+	}
+	if v, ok := fsys.(vfs.MD5er); ok && vfs.CapabilitiesOf(fsys).Checksum {
+		if sum, err := v.MD5(ctx, fi.Path); err == nil && sum != "" {
+			s += ", md5 " + sum
+		}
+	}
+	return s
+}
+
+// Show both versions of a conflicting file (relpath, relative to the root of
+// the sync) and ask which one to keep. Unreadable answers (as when the input
+// is not a terminal) skip this and all remaining conflicts.
+//
+// Return:
+//   string: the conflict policy chosen.
+func (c *conflictPrompter) ask(ctx context.Context, relpath string, srcvfs vfs.VFS, srcfi vfs.FileInfo, dstvfs vfs.VFS, dstfi vfs.FileInfo) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.all != "" {
+		return c.all
+	}
+
+	fmt.Fprintf(c.out, "\nConflict: \"%s\" changed in both the source and the destination since the last sync.\n", relpath)
+	fmt.Fprintf(c.out, "  source:      %s\n", describeVersion(ctx, srcvfs, srcfi))
+	fmt.Fprintf(c.out, "  destination: %s\n", describeVersion(ctx, dstvfs, dstfi))
+	for {
+		answer, err := prompt(c.in, c.out, "Keep [s]ource, [d]estination, [r]ename the incoming copy or s[k]ip (capital letter for all conflicts)", "", false)
+		if err != nil {
+			log.Warn("unable to read the answer; skipping all conflicts", "error", err)
+			c.all = conflictSkip
+			return c.all
+		}
+		policy, ok := conflictAnswers[strings.ToLower(answer)]
+		if !ok {
+			fmt.Fprintf(c.out, "Invalid answer \"%s\".\n", answer)
+			continue
+		}
+		if answer != strings.ToLower(answer) {
+			c.all = policy
+		}
+		return policy
+	}
+}
+
+// Make sure policy is a valid conflict resolution policy.
+//
+// Return:
+//   error
+func checkConflictPolicy(policy string) error {
+	for _, p := range conflictPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid conflict policy \"%s\" (must be one of %v)", policy, conflictPolicies)
+}
+
+// Return the name used to set aside an incoming file that conflicts with
+// dstpath.
+func conflictName(dstpath string, now time.Time) string {
+	return dstpath + conflictSuffix + now.Format(conflictTimeFormat)
+}
+
+// Return true if dstpath in dstvfs changed since it was synced, according to
+// entry (the state recorded by the last sync). A missing destination is not
+// considered a change, since copying over it loses nothing. Object IDs,
+// revisions and checksums are compared when available, followed by sizes and
+// mtimes.
+//
+// Return:
+//   bool
+//   error
+func dstChanged(ctx context.Context, entry *stateEntry, dstvfs vfs.VFS, dstpath string) (bool, error) {
+	exists, err := dstvfs.FileExists(ctx, dstpath)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if v, ok := dstvfs.(vfs.FileIDer); ok && entry.DstID != "" {
+		id, err := v.FileID(ctx, dstpath)
+		if err != nil {
+			return false, err
+		}
+		if id != "" && id != entry.DstID {
+			return true, nil
+		}
+	}
+	if v, ok := dstvfs.(vfs.Revisioner); ok && entry.DstRev != "" {
+		rev, err := v.Revision(ctx, dstpath)
+		if err != nil {
+			return false, err
+		}
+		if rev != "" {
+			return rev != entry.DstRev, nil
+		}
+	}
+	if v, ok := dstvfs.(vfs.MD5er); ok && entry.MD5 != "" {
+		sum, err := v.MD5(ctx, dstpath)
+		if err != nil {
+			return false, err
+		}
+		if sum != "" {
+			return sum != entry.MD5, nil
+		}
+	}
+
+	fi, err := dstvfs.Stat(ctx, dstpath)
+	if err != nil {
+		return false, err
+	}
+	if fi.Size >= 0 && entry.Size >= 0 && fi.Size != entry.Size {
+		return true, nil
+	}
+	// The destination mtime was set from the source, possibly with less
+	// precision.
+	return !fi.Mtime.Truncate(time.Second).Equal(entry.Mtime.Truncate(time.Second)), nil
+}
+
+// Return true if the source file src (relpath, relative to the root of the
+// sync) and its destination dst both changed since the last sync. This can
+// only be detected with a state database (--state-db). Files deleted since the
+// last sync are compared with the state recorded in their tombstones. The
+// caller must have checked that the source changed.
+//
+// Return:
+//   bool
+//   error
+func (p *planner) conflict(relpath string, dst string) (bool, error) {
+	entry := p.state.lookup(p.root, relpath)
+	if entry == nil {
+		// Files deleted since the last sync and created again may still
+		// have their last synced version in the destination.
+		ts := p.state.tombstone(p.root, relpath)
+		if ts == nil {
+			return false, nil
+		}
+		entry = &ts.stateEntry
+	}
+	return dstChanged(p.ctx, entry, p.dstvfs, dst)
+}
+
+// Resolve a conflict between the source file described by srcfi and its
+// destination dst according to the conflict policy (--conflict). The "newer"
+// and "larger" policies keep the newer (or larger) file and fall back to
+// "rename" when both are the same. With "ask", the user chooses a policy for
+// each conflict. Returns the operations to execute and whether the
+// destination should be overwritten ("source" policy, or a newer or larger
+// source), in which case the caller plans a regular copy.
+//
+// Return:
+//   []syncOp
+//   bool
+//   error
+func (p *planner) resolveConflict(relpath string, srcfi vfs.FileInfo, dst string) ([]syncOp, bool, error) {
+	src := srcfi.Path
+	policy := opt.conflict
+	if policy == conflictNewer || policy == conflictLarger {
+		dstfi, err := p.dstvfs.Stat(p.ctx, dst)
+		if err != nil {
+			return nil, false, err
+		}
+		srcMtime := srcfi.Mtime.Truncate(time.Second)
+		dstMtime := dstfi.Mtime.Truncate(time.Second)
+		srcSize, dstSize := srcfi.Size, dstfi.Size
+
+		newer := policy == conflictNewer
+		policy = conflictRename
+		switch {
+		case newer && srcMtime.After(dstMtime):
+			policy = conflictSource
+		case newer && dstMtime.After(srcMtime):
+			policy = conflictDest
+		case !newer && srcSize >= 0 && dstSize >= 0:
+			if srcSize > dstSize {
+				policy = conflictSource
+			} else if dstSize > srcSize {
+				policy = conflictDest
+			}
+		}
+	}
+	if policy == conflictAsk {
+		dstfi, err := p.dstvfs.Stat(p.ctx, dst)
+		if err != nil {
+			return nil, false, err
+		}
+		policy = conflictPrompt.ask(p.ctx, relpath, p.srcvfs, srcfi, p.dstvfs, dstfi)
+	}
+
+	switch policy {
+	case conflictSource:
+		log.Warn("conflict: source and destination changed since last sync; overwriting destination", "path", dst)
+		return nil, true, nil
+
+	case conflictDest:
+		// Keep the destination and don't report the conflict again until
+		// the source changes.
+		log.Warn("conflict: source and destination changed since last sync; keeping destination", "path", dst)
+		return nil, false, p.state.updateSource(p.ctx, p.root, relpath, p.srcvfs, src)
+
+	case conflictSkip:
+		log.Warn("conflict: source and destination changed since last sync; skipping", "path", dst)
+		return nil, false, nil
+	}
+
+	// Rename: write the incoming file next to the destination.
+	aside := conflictName(dst, time.Now())
+	log.Warn("conflict: source and destination changed since last sync", "path", dst, "copy", aside)
+	ops := mkdirPending(path.Dir(dst), p.pending)
+	return append(ops, syncOp{Op: opCopy, Src: src, Dst: aside, Rel: relpath, Conflict: true}), false, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+// Copies of single files under a new name (copyto command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Copy the file srcpath in srcvfs to dstpath in dstvfs, which names the copy
+// (and not the directory to copy it to, as in a sync). Nothing is copied if
+// dstpath is up to date (see needToCopy). The directory holding dstpath must
+// exist (see --mkpath). The checksum of the file copied is added to mf.
+//
+// Return:
+//   error
+func copyTo(ctx context.Context, srcpath string, srcvfs vfs.VFS, dstpath string, dstvfs vfs.VFS, mf *manifest) error {
+	fi, err := srcvfs.Stat(ctx, srcpath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsRegular() {
+		return fmt.Errorf("Source \"%s\" is not a file (use a sync to copy directories)", srcpath)
+	}
+	dstfi, err := dstvfs.Stat(ctx, dstpath)
+	switch {
+	case err == nil && !dstfi.IsRegular():
+		return fmt.Errorf("Destination \"%s\" exists and is not a file", dstpath)
+	case errors.Is(err, vfs.ErrNotExist):
+		// In dry-run mode, --mkpath only reports the directories it
+		// would create.
+		parent := parentDir(dstvfs, dstpath)
+		exists, err := dstvfs.FileExists(ctx, parent)
+		if err != nil {
+			return err
+		}
+		if !exists && !(opt.mkpath && opt.dryrun) {
+			return fmt.Errorf("Destination directory \"%s\" does not exist (use --mkpath to create it)", parent)
+		}
+	case err != nil:
+		return err
+	}
+
+	copyNeeded, err := needToCopy(ctx, srcvfs, dstvfs, fi, dstpath, true)
+	if err != nil {
+		return err
+	}
+	if !copyNeeded {
+		log.Info("destination is up to date", "path", dstpath)
+		return nil
+	}
+	op := syncOp{Op: opCopy, Src: fi.Path, Dst: dstpath, Size: fi.Size}
+	skip, err := runOpRetries(ctx, op, srcvfs, dstvfs, mf)
+	var merr *mtimeError
+	if errors.As(err, &merr) {
+		mtimeFailed(dstpath, merr, nil)
+		err = nil
+	}
+	if err == nil && skip {
+		err = fmt.Errorf("Unable to copy \"%s\"", srcpath)
+	}
+	return err
+}
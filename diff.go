@@ -0,0 +1,180 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Diff status values
+const (
+	diffOnlyInSource = "only-in-source"
+	diffOnlyInDest   = "only-in-dest"
+	diffDiffers      = "differs"
+)
+
+// diffEntry represents a single difference between two trees. Reason is only
+// set for entries that exist in both trees and is one of "type", "size",
+// "mtime" or "hash".
+type diffEntry struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Return the path of fullpath relative to root. Both are expected to come from
+// the same VFS (as returned by Walk).
+func relPath(root string, fullpath string) string {
+	root = strings.TrimLeft(path.Clean(root), "/")
+	if root == "." {
+		root = ""
+	}
+	fullpath = strings.TrimLeft(path.Clean(fullpath), "/")
+	return strings.TrimPrefix(strings.TrimPrefix(fullpath, root), "/")
+}
+
+// List all objects under root in fsys, skipping excluded paths.
+//
+// Return:
+//   map[string]vfs.FileInfo: relative path -> file information
+//   error
+func listTree(ctx context.Context, root string, fsys vfs.VFS) (map[string]vfs.FileInfo, error) {
+	tree := make(map[string]vfs.FileInfo)
+	err := fsys.Walk(ctx, root, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(root, fi.Path)
+		skip, err := excluded(rel)
+		if err != nil || skip {
+			return err
+		}
+		tree[rel] = fi
+		return nil
+	})
+	return tree, err
+}
+
+// Compare the objects described by srcfi in srcvfs and dstfi in dstvfs, which
+// come from a listing of both trees. Return the reason why they differ, or an
+// empty string if they are considered equal.
+//
+// Return:
+//   string
+//   error
+func compareObjects(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcfi vfs.FileInfo, dstfi vfs.FileInfo) (string, error) {
+	if srcfi.IsDir() != dstfi.IsDir() {
+		return "type", nil
+	}
+	if srcfi.IsDir() {
+		return "", nil
+	}
+
+	// Negative sizes mean the size is not known.
+	if srcfi.Size >= 0 && dstfi.Size >= 0 && srcfi.Size != dstfi.Size {
+		return "size", nil
+	}
+	if !srcfi.Mtime.Truncate(time.Second).Equal(dstfi.Mtime.Truncate(time.Second)) {
+		return "mtime", nil
+	}
+
+	// Only compare checksums when both sides know them.
+	srcmd5, ok1 := srcvfs.(vfs.MD5er)
+	dstmd5, ok2 := dstvfs.(vfs.MD5er)
+	if ok1 && ok2 {
+		srcsum, err := srcmd5.MD5(ctx, srcfi.Path)
+		if err != nil {
+			return "", err
+		}
+		dstsum, err := dstmd5.MD5(ctx, dstfi.Path)
+		if err != nil {
+			return "", err
+		}
+		if srcsum != "" && dstsum != "" && srcsum != dstsum {
+			return "hash", nil
+		}
+	}
+	return "", nil
+}
+
+// Compare the trees under srcroot in srcvfs and dstroot in dstvfs and return
+// all differences, sorted by path. Unlike sync, the contents of both roots are
+// compared directly, whether or not srcroot ends in a slash. Nothing is
+// modified in either tree.
+//
+// Return:
+//   []diffEntry
+//   error
+func diffTrees(ctx context.Context, srcroot string, dstroot string, srcvfs vfs.VFS, dstvfs vfs.VFS) ([]diffEntry, error) {
+	var entries []diffEntry
+
+	srctree, err := listTree(ctx, srcroot, srcvfs)
+	if err != nil {
+		return nil, err
+	}
+	dsttree, err := listTree(ctx, dstroot, dstvfs)
+	if err != nil {
+		return nil, err
+	}
+
+	for rel, srcfi := range srctree {
+		dstfi, ok := dsttree[rel]
+		if !ok {
+			entries = append(entries, diffEntry{Path: rel, Status: diffOnlyInSource})
+			continue
+		}
+		reason, err := compareObjects(ctx, srcvfs, dstvfs, srcfi, dstfi)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			entries = append(entries, diffEntry{Path: rel, Status: diffDiffers, Reason: reason})
+		}
+	}
+	for rel := range dsttree {
+		if _, ok := srctree[rel]; !ok {
+			entries = append(entries, diffEntry{Path: rel, Status: diffOnlyInDest})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// Print the differences in entries to w, either as text or as a JSON array.
+//
+// Return:
+//   error
+func printDiff(w io.Writer, entries []diffEntry, asJSON bool) error {
+	if asJSON {
+		if entries == nil {
+			entries = []diffEntry{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	for _, e := range entries {
+		var err error
+		if e.Reason != "" {
+			_, err = fmt.Fprintf(w, "%s (%s): %s\n", e.Status, e.Reason, e.Path)
+		} else {
+			_, err = fmt.Fprintf(w, "%s: %s\n", e.Status, e.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+// Direction guards (--download-only and --upload-only).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+)
+
+// Return true if pathname refers to a remote (Google Drive, Azure or HTTP),
+// possibly through the cache. Local paths, archives and unions are kept on
+// the local disk.
+//
+// Return:
+//   bool
+func isRemotePath(pathname string) bool {
+	if isCached, inner := parseCachePath(pathname); isCached {
+		return isRemotePath(inner)
+	}
+	if isAzblob, _ := parseAzblobPath(pathname); isAzblob || isHTTPPath(pathname) {
+		return true
+	}
+	if isUnion, _ := parseUnionPath(pathname); isUnion {
+		return false
+	}
+	if format, _ := parseArchivePath(pathname); format != "" {
+		return false
+	}
+	_, isGdrive, _ := parseRemotePath(pathname)
+	return isGdrive
+}
+
+// Check that syncing srcpaths to dsts goes in the direction declared with
+// --download-only (remote sources, local destinations) or --upload-only
+// (local sources, remote destinations), to catch swapped arguments before
+// anything is written.
+//
+// Return:
+//   error
+func checkDirection(srcpaths []string, dsts []string) error {
+	if opt.downloadOnly && opt.uploadOnly {
+		return fmt.Errorf("--download-only and --upload-only can't be used together")
+	}
+	if !opt.downloadOnly && !opt.uploadOnly {
+		return nil
+	}
+	for _, s := range srcpaths {
+		if opt.downloadOnly && !isRemotePath(s) {
+			return fmt.Errorf("--download-only: source \"%s\" is not remote (arguments swapped?)", s)
+		}
+		if opt.uploadOnly && isRemotePath(s) {
+			return fmt.Errorf("--upload-only: source \"%s\" is not local (arguments swapped?)", s)
+		}
+	}
+	for _, d := range dsts {
+		if opt.downloadOnly && isRemotePath(d) {
+			return fmt.Errorf("--download-only: destination \"%s\" is not local (arguments swapped?)", d)
+		}
+		if opt.uploadOnly && !isRemotePath(d) {
+			return fmt.Errorf("--upload-only: destination \"%s\" is not remote (arguments swapped?)", d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+// Logging of HTTP requests for debugging (--dump-http).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Maximum number of bytes of each body logged with --dump-http-bodies.
+const maxDumpBody = 16 * 1024
+
+// Replacement for credentials in dumped URLs and bodies.
+const redacted = "REDACTED"
+
+// Query string and form parameters holding credentials. Upload session IDs
+// are included, since they grant access to the upload without any token.
+var secretParams = map[string]bool{
+	"access_token":  true,
+	"assertion":     true,
+	"client_secret": true,
+	"code":          true,
+	"code_verifier": true,
+	"id_token":      true,
+	"key":           true,
+	"refresh_token": true,
+	"sig":           true,
+	"upload_id":     true,
+}
+
+// Credentials in JSON bodies (like OAuth token responses). Values may hold
+// escaped quotes, and may be cut short by the end of a truncated body.
+var secretJSON = regexp.MustCompile(`"(access_token|refresh_token|id_token|client_secret|private_key|assertion)"(\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+
+// httpDumper is an http.RoundTripper logging the method, URL, status and
+// latency of every request, and optionally the (textual) request and
+// response bodies. Credentials are removed from everything logged, and
+// headers (including Authorization) are never logged.
+type httpDumper struct {
+	base   http.RoundTripper
+	bodies bool
+	log    *slog.Logger
+}
+
+// Return u with the values of credential parameters redacted.
+func sanitizeURL(u *url.URL) string {
+	q := u.Query()
+	if len(q) == 0 {
+		return u.String()
+	}
+	for k := range q {
+		if secretParams[k] {
+			q.Set(k, redacted)
+		}
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// Return body, of type contentType, with credentials redacted, or a short
+// description of the body if it's not text.
+func sanitizeBody(contentType string, body []byte, size int64) string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/x-www-form-urlencoded":
+		q, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "<invalid form>"
+		}
+		for k := range q {
+			if secretParams[k] {
+				q.Set(k, redacted)
+			}
+		}
+		return q.Encode()
+	case mt == "application/json" || strings.HasPrefix(mt, "text/"):
+		return secretJSON.ReplaceAllString(string(body), `"$1"$2"`+redacted+`"`)
+	}
+	if mt != "" {
+		mt += " "
+	}
+	if size < 0 {
+		return fmt.Sprintf("<%sbody>", mt)
+	}
+	return fmt.Sprintf("<%sbody, %d bytes>", mt, size)
+}
+
+// dumpedBody is a response body partially read by httpDumper: the bytes
+// already read, followed by the rest of the original body.
+type dumpedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// RoundTrip implements http.RoundTripper.
+func (d *httpDumper) RoundTrip(req *http.Request) (*http.Response, error) {
+	attrs := []any{"method", req.Method, "url", sanitizeURL(req.URL)}
+	if n, ok := req.Context().Value(attemptKey{}).(int); ok {
+		attrs = append(attrs, "retry", n)
+	}
+	if d.bodies && req.Body != nil && req.GetBody != nil {
+		// Read a copy, leaving the body to be sent untouched.
+		if body, err := req.GetBody(); err == nil {
+			b, _ := ioutil.ReadAll(io.LimitReader(body, maxDumpBody))
+			body.Close()
+			attrs = append(attrs, "request", sanitizeBody(req.Header.Get("Content-Type"), b, req.ContentLength))
+		}
+	}
+
+	start := time.Now()
+	resp, err := d.base.RoundTrip(req)
+	attrs = append(attrs, "latency", time.Since(start))
+	if err != nil {
+		d.log.Info("http", append(attrs, "error", err)...)
+		return resp, err
+	}
+	attrs = append(attrs, "status", resp.StatusCode)
+	if d.bodies && resp.Body != nil {
+		ct := resp.Header.Get("Content-Type")
+		if mt, _, _ := mime.ParseMediaType(ct); mt == "application/json" || strings.HasPrefix(mt, "text/") {
+			b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxDumpBody))
+			resp.Body = dumpedBody{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+			attrs = append(attrs, "response", sanitizeBody(ct, b, resp.ContentLength))
+		} else {
+			attrs = append(attrs, "response", sanitizeBody(ct, nil, resp.ContentLength))
+		}
+	}
+	d.log.Info("http", attrs...)
+	return resp, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	evScanStart     = "scan-start"
+	evFileQueued    = "file-queued"
+	evEstimate      = "estimate"
+	evTransferStart = "transfer-start"
+	evProgress      = "progress"
+	evTransferDone  = "transfer-done"
+	evError         = "error"
+	evSummary       = "summary"
+)
+
+// Minimum interval between progress events for the same transfer.
+const progressInterval = time.Second
+
+// event is a single entry in the event stream. Durations are in seconds.
+type event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Op       string    `json:"op,omitempty"`
+	Src      string    `json:"src,omitempty"`
+	Dst      string    `json:"dst,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Files    int64     `json:"files,omitempty"`
+	Deletes  int64     `json:"deletes,omitempty"`
+	Percent  float64   `json:"percent,omitempty"`
+	ETA      float64   `json:"eta,omitempty"`
+	Errors   int64     `json:"errors,omitempty"`
+	Skipped  int64     `json:"skipped,omitempty"`
+	Stalled  int64     `json:"stalled,omitempty"`
+	Duration float64   `json:"duration,omitempty"`
+	Error    string    `json:"error,omitempty"`
+
+	// Drive API calls by type, and quota units used (summary only).
+	APICalls map[string]int64 `json:"apiCalls,omitempty"`
+	APIUnits int64            `json:"apiUnits,omitempty"`
+}
+
+// eventLog writes events as newline delimited JSON (one object per line) and
+// keeps the totals reported in the summary event. All methods are safe to
+// call on a nil eventLog, in which case they do nothing, and safe for
+// concurrent use.
+type eventLog struct {
+	mu     gosync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	start  time.Time
+	files  int64
+	bytes  int64
+	errors int64
+	skips  int64
+
+	// Estimated bytes to copy by all destinations (see estimate), when
+	// the estimates started, and bytes copied so far by the transfers in
+	// progress, by source and destination.
+	estBytes int64
+	estStart time.Time
+	inflight map[string]int64
+}
+
+// Event stream (see --events). Nil if not requested.
+var events *eventLog
+
+// Create the event stream in fname. The special name "-" means the standard
+// output.
+//
+// Return:
+//   *eventLog
+//   error
+func openEvents(fname string) (*eventLog, error) {
+	var w io.Writer = os.Stdout
+	el := &eventLog{start: time.Now(), inflight: make(map[string]int64)}
+	if fname != "-" {
+		f, err := os.Create(fname)
+		if err != nil {
+			return nil, err
+		}
+		el.file, w = f, f
+	}
+	el.enc = json.NewEncoder(w)
+	return el, nil
+}
+
+// Write ev to the stream, setting its time. Write errors are ignored, since
+// the event stream must not interfere with the sync.
+func (el *eventLog) emit(ev event) {
+	if el == nil {
+		return
+	}
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	ev.Time = time.Now()
+	el.enc.Encode(ev)
+}
+
+// Record the estimated work of the sync from src to dst: the number of files
+// and bytes to copy, and the number of files to delete. Estimates of all
+// destinations add up to the total used to report the overall progress.
+func (el *eventLog) estimate(src string, dst string, files int64, bytes int64, deletes int64) {
+	if el == nil {
+		return
+	}
+	el.mu.Lock()
+	el.estBytes += bytes
+	if el.estStart.IsZero() {
+		el.estStart = time.Now()
+	}
+	el.mu.Unlock()
+	el.emit(event{Event: evEstimate, Src: src, Dst: dst, Files: files, Bytes: bytes, Deletes: deletes})
+}
+
+// Record that n bytes of op have been copied so far. If the work was
+// estimated, the overall percentage done and the estimated time left are
+// reported along with the progress of op.
+func (el *eventLog) progress(op syncOp, n int64, size int64) {
+	if el == nil {
+		return
+	}
+	ev := event{Event: evProgress, Src: op.Src, Dst: op.Dst, Bytes: n, Size: size}
+	el.mu.Lock()
+	el.inflight[op.Src+"\x00"+op.Dst] = n
+	if el.estBytes > 0 {
+		done := el.bytes
+		for _, b := range el.inflight {
+			done += b
+		}
+		ev.Percent = math.Min(100, 100*float64(done)/float64(el.estBytes))
+		if done > 0 && done < el.estBytes {
+			elapsed := time.Since(el.estStart).Seconds()
+			ev.ETA = elapsed * float64(el.estBytes-done) / float64(done)
+		}
+	}
+	el.mu.Unlock()
+	el.emit(ev)
+}
+
+// Record a completed transfer of n bytes from src to dst.
+func (el *eventLog) transferDone(op syncOp, n int64, d time.Duration) {
+	if el == nil {
+		return
+	}
+	el.mu.Lock()
+	el.files++
+	el.bytes += n
+	delete(el.inflight, op.Src+"\x00"+op.Dst)
+	el.mu.Unlock()
+	el.emit(event{Event: evTransferDone, Op: op.Op, Src: op.Src, Dst: op.Dst, Bytes: n, Duration: d.Seconds()})
+}
+
+// Record an error. Path is the file related to the error, if any.
+func (el *eventLog) error(path string, err error) {
+	if el == nil {
+		return
+	}
+	el.mu.Lock()
+	el.errors++
+	// Failed transfers start over (or are abandoned).
+	for k := range el.inflight {
+		if strings.HasPrefix(k, path+"\x00") {
+			delete(el.inflight, k)
+		}
+	}
+	el.mu.Unlock()
+	el.emit(event{Event: evError, Src: path, Error: err.Error()})
+}
+
+// Record a source file skipped because it can't be downloaded.
+func (el *eventLog) skip() {
+	if el == nil {
+		return
+	}
+	el.mu.Lock()
+	el.skips++
+	el.mu.Unlock()
+}
+
+// Write the summary event and close the stream.
+//
+// Return:
+//   error
+func (el *eventLog) close() error {
+	if el == nil {
+		return nil
+	}
+	el.mu.Lock()
+	ev := event{Event: evSummary, Files: el.files, Bytes: el.bytes, Errors: el.errors, Skipped: el.skips, Stalled: atomic.LoadInt64(&stalledTransfers), Duration: time.Since(el.start).Seconds()}
+	el.mu.Unlock()
+	if ev.APICalls, ev.APIUnits = apiCalls.totals(); ev.APIUnits == 0 {
+		ev.APICalls = nil
+	}
+	el.emit(ev)
+	if el.file == nil {
+		return nil
+	}
+	return el.file.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs/gdrive"
+)
+
+const (
+	// Default export formats configuration file, in the home directory.
+	exportFormatsFile = ".gsync-export-formats.json"
+
+	// Prefix of the mime types of native Google files.
+	googleAppsPrefix = "application/vnd.google-apps."
+)
+
+// Mime types for the most common export extensions. These allow the mime
+// type to be omitted from the export formats configuration.
+var exportMimeTypes = map[string]string{
+	"csv":  "text/csv",
+	"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"html": "text/html",
+	"jpg":  "image/jpeg",
+	"odp":  "application/vnd.oasis.opendocument.presentation",
+	"ods":  "application/x-vnd.oasis.opendocument.spreadsheet",
+	"odt":  "application/vnd.oasis.opendocument.text",
+	"pdf":  "application/pdf",
+	"png":  "image/png",
+	"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"rtf":  "application/rtf",
+	"svg":  "image/svg+xml",
+	"txt":  "text/plain",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Export formats used for types not present in the configuration file.
+var defaultExportFormats = map[string]string{
+	"document":     "docx",
+	"drawing":      "svg",
+	"presentation": "pptx",
+	"spreadsheet":  "xlsx",
+}
+
+// exportFormatEntry is one entry in the export formats configuration file.
+// The value can be either an extension (as in "xlsx") or an object with the
+// mime type and extension of the export format.
+type exportFormatEntry struct {
+	MimeType  string `json:"mimeType"`
+	Extension string `json:"extension"`
+}
+
+// UnmarshalJSON accepts a plain extension string as a shorthand.
+func (e *exportFormatEntry) UnmarshalJSON(data []byte) error {
+	var ext string
+	if json.Unmarshal(data, &ext) == nil {
+		e.Extension = ext
+		return nil
+	}
+	type plain exportFormatEntry
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// Convert an export format entry for the Google mime type (or short type name,
+// as in "spreadsheet") key into a gdrivevfs.ExportFormat.
+//
+// Returns:
+//   string: Google mime type
+//   gdrivevfs.ExportFormat
+//   error
+func exportFormat(key string, entry exportFormatEntry) (string, gdrivevfs.ExportFormat, error) {
+	if !strings.Contains(key, "/") {
+		key = googleAppsPrefix + key
+	}
+	ext := strings.TrimPrefix(entry.Extension, ".")
+	if ext == "" {
+		return "", gdrivevfs.ExportFormat{}, fmt.Errorf("No extension for \"%s\"", key)
+	}
+	mimeType := entry.MimeType
+	if mimeType == "" {
+		var ok bool
+		if mimeType, ok = exportMimeTypes[ext]; !ok {
+			return "", gdrivevfs.ExportFormat{}, fmt.Errorf("Unknown mime type for extension \"%s\" (use mimeType)", ext)
+		}
+	}
+	return key, gdrivevfs.ExportFormat{MimeType: mimeType, Extension: ext}, nil
+}
+
+// Load the export formats for native Google files from fname, on top of the
+// default export formats. An empty fname means the default configuration file
+// in the home directory, which does not need to exist.
+//
+// Returns:
+//   map[string]gdrivevfs.ExportFormat
+//   error
+func loadExportFormats(fname string) (map[string]gdrivevfs.ExportFormat, error) {
+	entries := make(map[string]exportFormatEntry)
+	for k, v := range defaultExportFormats {
+		entries[k] = exportFormatEntry{Extension: v}
+	}
+
+	mustExist := true
+	if fname == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		fname = path.Join(usr.HomeDir, exportFormatsFile)
+		mustExist = false
+	}
+
+	j, err := ioutil.ReadFile(fname)
+	switch {
+	case os.IsNotExist(err) && !mustExist:
+	case err != nil:
+		return nil, fmt.Errorf("Unable to read export formats from \"%s\": %v", fname, err)
+	default:
+		if err = json.Unmarshal(j, &entries); err != nil {
+			return nil, fmt.Errorf("Unable to decode export formats from \"%s\": %v", fname, err)
+		}
+	}
+
+	formats := make(map[string]gdrivevfs.ExportFormat)
+	for k, v := range entries {
+		mimeType, f, err := exportFormat(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid export format in \"%s\": %v", fname, err)
+		}
+		formats[mimeType] = f
+	}
+	return formats, nil
+}
@@ -0,0 +1,869 @@
+//go:build integration
+// +build integration
+
+package main
+
+// A fake Google Drive server implementing the subset of the Drive API (v2,
+// plus the v3 files endpoint) used by the gdrive VFS, for integration tests.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// ID of the root folder in the fake Drive. The "root" alias also works.
+const fakeRootID = "root-folder"
+
+// Mime type of Drive folders.
+const fakeFolderType = "application/vnd.google-apps.folder"
+
+// fakeParent is a parent reference, as returned by the Drive API.
+type fakeParent struct {
+	ID     string `json:"id"`
+	IsRoot bool   `json:"isRoot,omitempty"`
+}
+
+// fakeProperty is a custom file property, as returned by the Drive API.
+type fakeProperty struct {
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	Visibility string `json:"visibility,omitempty"`
+}
+
+// fakeLabels holds the labels of a file. Only "trashed" is supported.
+type fakeLabels struct {
+	Trashed bool `json:"trashed"`
+}
+
+// fakeFile is a file or folder in the fake Drive, in the format of the Drive
+// API v2. The contents of files are kept in data.
+type fakeFile struct {
+	ID             string          `json:"id"`
+	Title          string          `json:"title"`
+	MimeType       string          `json:"mimeType"`
+	FileSize       int64           `json:"fileSize,string,omitempty"`
+	ModifiedDate   string          `json:"modifiedDate"`
+	CreatedDate    string          `json:"createdDate"`
+	Md5Checksum    string          `json:"md5Checksum,omitempty"`
+	HeadRevisionID string          `json:"headRevisionId,omitempty"`
+	DownloadURL    string          `json:"downloadUrl,omitempty"`
+	Parents        []fakeParent    `json:"parents"`
+	Properties     []*fakeProperty `json:"properties,omitempty"`
+	Labels         fakeLabels      `json:"labels"`
+
+	data     []byte
+	revision int
+}
+
+// fakeSession is a resumable upload session.
+type fakeSession struct {
+	id   string // File being replaced, if any.
+	meta map[string]json.RawMessage
+	data []byte
+	size int64 // -1 if unknown.
+
+	setModifiedDate bool
+}
+
+// fakeDrive is an in-memory Google Drive, served by an httptest.Server.
+// Requests sent by the default HTTP transport to Google hosts are redirected
+// to it while it runs (see newFakeDrive). All methods are safe for concurrent
+// use.
+type fakeDrive struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       gosync.Mutex
+	files    map[string]*fakeFile
+	sessions map[string]*fakeSession
+	nextID   int
+
+	// Number of requests served, by kind ("list", "get", "insert",
+	// "update", "download", "copy", "trash", "delete" and "upload").
+	requests map[string]int
+}
+
+// redirectTransport sends requests for Google hosts to the fake server.
+type redirectTransport struct {
+	base http.RoundTripper
+	host string
+}
+
+func (r *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Host, "googleapis.com") || strings.HasSuffix(req.URL.Host, "google.com") {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+		req.URL.Host = r.host
+		req.Host = r.host
+	}
+	return r.base.RoundTrip(req)
+}
+
+// Start a new fake Drive holding only the root folder, and redirect requests
+// to Google made through http.DefaultTransport to it until the test ends.
+func newFakeDrive(t *testing.T) *fakeDrive {
+	fd := &fakeDrive{
+		t:        t,
+		files:    make(map[string]*fakeFile),
+		sessions: make(map[string]*fakeSession),
+		requests: make(map[string]int),
+	}
+	fd.files[fakeRootID] = &fakeFile{
+		ID:           fakeRootID,
+		Title:        "My Drive",
+		MimeType:     fakeFolderType,
+		ModifiedDate: fakeTime(time.Now()),
+		CreatedDate:  fakeTime(time.Now()),
+	}
+	fd.server = httptest.NewServer(http.HandlerFunc(fd.serveHTTP))
+
+	saved := http.DefaultTransport
+	http.DefaultTransport = &redirectTransport{base: fd.server.Client().Transport, host: fd.server.Listener.Addr().String()}
+	t.Cleanup(func() {
+		http.DefaultTransport = saved
+		fd.server.Close()
+	})
+	return fd
+}
+
+// Format t as the Drive API does.
+func fakeTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Return the number of requests of the given kind served so far.
+func (fd *fakeDrive) count(kind string) int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.requests[kind]
+}
+
+// Return the file at pathname (relative to the root, using slashes), or nil
+// if not found. Trashed files are ignored.
+func (fd *fakeDrive) lookup(pathname string) *fakeFile {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	f := fd.files[fakeRootID]
+	for _, name := range strings.Split(pathname, "/") {
+		if name == "" {
+			continue
+		}
+		var next *fakeFile
+		for _, c := range fd.files {
+			if c.Title == name && !c.Labels.Trashed && c.hasParent(f.ID) {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		f = next
+	}
+	return f
+}
+
+// Add a file with data and mtime at pathname, creating its parent folders.
+// Returns the new file.
+func (fd *fakeDrive) put(pathname string, data string, mtime time.Time) *fakeFile {
+	dir := fakeRootID
+	names := strings.Split(strings.Trim(pathname, "/"), "/")
+	for i, name := range names[:len(names)-1] {
+		if f := fd.lookup(strings.Join(names[:i+1], "/")); f != nil {
+			dir = f.ID
+			continue
+		}
+		fd.mu.Lock()
+		f := fd.newFile(name, fakeFolderType, dir)
+		fd.mu.Unlock()
+		dir = f.ID
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f := fd.newFile(names[len(names)-1], "text/plain", dir)
+	f.setData([]byte(data))
+	f.ModifiedDate = fakeTime(mtime)
+	return f
+}
+
+// Create a new empty file or folder named title inside the folder parent.
+// Must be called with fd.mu held.
+func (fd *fakeDrive) newFile(title string, mimeType string, parent string) *fakeFile {
+	fd.nextID++
+	now := fakeTime(time.Now())
+	f := &fakeFile{
+		ID:           fmt.Sprintf("file%04d", fd.nextID),
+		Title:        title,
+		MimeType:     mimeType,
+		ModifiedDate: now,
+		CreatedDate:  now,
+	}
+	if parent != "" {
+		f.Parents = []fakeParent{{ID: parent, IsRoot: parent == fakeRootID}}
+	}
+	if mimeType != fakeFolderType {
+		f.DownloadURL = fd.server.URL + "/download/" + f.ID
+		f.setData(nil)
+	}
+	fd.files[f.ID] = f
+	return f
+}
+
+// Replace the contents of f with data, creating a new revision.
+func (f *fakeFile) setData(data []byte) {
+	sum := md5.Sum(data)
+	f.data = data
+	f.FileSize = int64(len(data))
+	f.Md5Checksum = hex.EncodeToString(sum[:])
+	f.revision++
+	f.HeadRevisionID = strconv.Itoa(f.revision)
+	f.ModifiedDate = fakeTime(time.Now())
+}
+
+// Return true if f is inside the folder with the given ID.
+func (f *fakeFile) hasParent(id string) bool {
+	for _, p := range f.Parents {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the file with the given ID (or the "root" alias). Must be called
+// with fd.mu held.
+func (fd *fakeDrive) file(id string) (*fakeFile, bool) {
+	if id == "root" {
+		id = fakeRootID
+	}
+	f, ok := fd.files[id]
+	return f, ok
+}
+
+// Send v as a JSON response.
+func fakeReply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Send an error response in the format used by the Drive API.
+func fakeError(w http.ResponseWriter, status int, reason string, msg string) {
+	fakeReply(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"errors":  []map[string]string{{"domain": "global", "reason": reason, "message": msg}},
+			"code":    status,
+			"message": msg,
+		},
+	})
+}
+
+// Routes of the fake Drive API.
+var (
+	fakeFileRoute     = regexp.MustCompile(`^/drive/v[23]/files/([^/]+)$`)
+	fakeActionRoute   = regexp.MustCompile(`^/drive/v2/files/([^/]+)/(copy|trash|untrash)$`)
+	fakeUploadRoute   = regexp.MustCompile(`^/upload/drive/v2/files(?:/([^/]+))?$`)
+	fakeSessionRoute  = regexp.MustCompile(`^/upload/session/([^/]+)$`)
+	fakeDownloadRoute = regexp.MustCompile(`^/download/([^/]+)$`)
+)
+
+func (fd *fakeDrive) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p := r.URL.Path
+	switch {
+	case p == "/o/oauth2/token" && r.Method == "POST":
+		fakeReply(w, http.StatusOK, map[string]interface{}{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	case p == "/drive/v2/about" && r.Method == "GET":
+		fakeReply(w, http.StatusOK, map[string]string{"kind": "drive#about", "rootFolderId": fakeRootID})
+	case p == "/drive/v2/files" && r.Method == "GET":
+		fd.list(w, r)
+	case p == "/drive/v2/files" && r.Method == "POST":
+		fd.insert(w, r)
+	case fakeActionRoute.MatchString(p) && r.Method == "POST":
+		m := fakeActionRoute.FindStringSubmatch(p)
+		fd.action(w, r, m[1], m[2])
+	case fakeFileRoute.MatchString(p):
+		id := fakeFileRoute.FindStringSubmatch(p)[1]
+		switch r.Method {
+		case "GET":
+			fd.get(w, r, id)
+		case "PUT", "PATCH":
+			fd.update(w, r, id, nil)
+		case "DELETE":
+			fd.delete(w, id)
+		default:
+			fakeError(w, http.StatusMethodNotAllowed, "methodNotAllowed", r.Method)
+		}
+	case fakeUploadRoute.MatchString(p) && (r.Method == "POST" || r.Method == "PUT"):
+		fd.upload(w, r, fakeUploadRoute.FindStringSubmatch(p)[1])
+	case fakeSessionRoute.MatchString(p) && r.Method == "PUT":
+		fd.resume(w, r, fakeSessionRoute.FindStringSubmatch(p)[1])
+	case fakeDownloadRoute.MatchString(p) && r.Method == "GET":
+		fd.download(w, r, fakeDownloadRoute.FindStringSubmatch(p)[1])
+	default:
+		fd.t.Errorf("fake Drive: unsupported request %s %s", r.Method, r.URL)
+		fakeError(w, http.StatusNotFound, "notFound", "Unsupported request: "+r.Method+" "+p)
+	}
+}
+
+// Clauses supported in the q parameter of files.list.
+var (
+	fakeParentClause  = regexp.MustCompile(`^'((?:[^'\\]|\\.)*)'\s+in\s+parents$`)
+	fakeFieldClause   = regexp.MustCompile(`^(title|mimeType)\s*(=|!=)\s*'((?:[^'\\]|\\.)*)'$`)
+	fakeTrashedClause = regexp.MustCompile(`^trashed\s*=\s*(true|false)$`)
+	fakeAndSeparator  = regexp.MustCompile(`(?i)\s+and\s+`)
+)
+
+// Return a function matching the files selected by the query q, as used by
+// files.list. Only conjunctions of the clauses above are supported.
+func fakeQuery(q string) (func(*fakeFile) bool, error) {
+	unescape := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace
+	var preds []func(*fakeFile) bool
+	trashed := false
+	for _, clause := range fakeAndSeparator.Split(strings.TrimSpace(q), -1) {
+		clause = strings.TrimSpace(clause)
+		switch {
+		case clause == "":
+		case fakeParentClause.MatchString(clause):
+			id := unescape(fakeParentClause.FindStringSubmatch(clause)[1])
+			if id == "root" {
+				id = fakeRootID
+			}
+			preds = append(preds, func(f *fakeFile) bool { return f.hasParent(id) })
+		case fakeFieldClause.MatchString(clause):
+			m := fakeFieldClause.FindStringSubmatch(clause)
+			field, eq, value := m[1], m[2] == "=", unescape(m[3])
+			preds = append(preds, func(f *fakeFile) bool {
+				v := f.Title
+				if field == "mimeType" {
+					v = f.MimeType
+				}
+				return (v == value) == eq
+			})
+		case fakeTrashedClause.MatchString(clause):
+			trashed = fakeTrashedClause.FindStringSubmatch(clause)[1] == "true"
+		default:
+			return nil, fmt.Errorf("unsupported query clause %q", clause)
+		}
+	}
+	return func(f *fakeFile) bool {
+		if f.ID == fakeRootID || f.Labels.Trashed != trashed {
+			return false
+		}
+		for _, pred := range preds {
+			if !pred(f) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// files.list
+func (fd *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	match, err := fakeQuery(r.FormValue("q"))
+	if err != nil {
+		fd.t.Errorf("fake Drive: %v", err)
+		fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	pageSize := 100
+	if n, err := strconv.Atoi(r.FormValue("maxResults")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+	start, _ := strconv.Atoi(r.FormValue("pageToken"))
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["list"]++
+	var items []*fakeFile
+	for _, f := range fd.files {
+		if match(f) {
+			items = append(items, f)
+		}
+	}
+	// Pages must be stable.
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	resp := map[string]interface{}{"kind": "drive#fileList"}
+	if start < len(items) {
+		end := start + pageSize
+		if end < len(items) {
+			resp["nextPageToken"] = strconv.Itoa(end)
+		} else {
+			end = len(items)
+		}
+		resp["items"] = items[start:end]
+	} else {
+		resp["items"] = []*fakeFile{}
+	}
+	fakeReply(w, http.StatusOK, resp)
+}
+
+// files.get, returning the contents with alt=media.
+func (fd *fakeDrive) get(w http.ResponseWriter, r *http.Request, id string) {
+	if r.FormValue("alt") == "media" {
+		fd.download(w, r, id)
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["get"]++
+	f, ok := fd.file(id)
+	if !ok {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	fakeReply(w, http.StatusOK, f)
+}
+
+// Decode the JSON metadata in body into a map of raw fields.
+func fakeMetadata(body io.Reader) (map[string]json.RawMessage, error) {
+	meta := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadAll(body)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// Apply the metadata fields in meta and the query parameters of r to f. Must
+// be called with fd.mu held.
+func (fd *fakeDrive) apply(f *fakeFile, meta map[string]json.RawMessage, r *http.Request) error {
+	for k, v := range meta {
+		var err error
+		switch k {
+		case "title":
+			err = json.Unmarshal(v, &f.Title)
+		case "mimeType":
+			err = json.Unmarshal(v, &f.MimeType)
+		case "parents":
+			var parents []fakeParent
+			if err = json.Unmarshal(v, &parents); err == nil {
+				for i := range parents {
+					if parents[i].ID == "root" {
+						parents[i].ID = fakeRootID
+					}
+					parents[i].IsRoot = parents[i].ID == fakeRootID
+				}
+				f.Parents = parents
+			}
+		case "createdDate", "createdTime":
+			var s string
+			if err = json.Unmarshal(v, &s); err == nil {
+				f.CreatedDate = s
+			}
+		case "properties":
+			var props []*fakeProperty
+			if err = json.Unmarshal(v, &props); err == nil {
+				for _, p := range props {
+					f.setProperty(p)
+				}
+			}
+		case "labels":
+			err = json.Unmarshal(v, &f.Labels)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid field %q: %v", k, err)
+		}
+	}
+
+	// The modification time is only set on request, and defaults to now.
+	if v, ok := meta["modifiedDate"]; ok && r.FormValue("setModifiedDate") == "true" {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("invalid field \"modifiedDate\": %v", err)
+		}
+		f.ModifiedDate = s
+	}
+
+	if add := r.FormValue("addParents"); add != "" {
+		for _, id := range strings.Split(add, ",") {
+			if !f.hasParent(id) {
+				f.Parents = append(f.Parents, fakeParent{ID: id, IsRoot: id == fakeRootID})
+			}
+		}
+	}
+	if remove := r.FormValue("removeParents"); remove != "" {
+		for _, id := range strings.Split(remove, ",") {
+			for i, p := range f.Parents {
+				if p.ID == id {
+					f.Parents = append(f.Parents[:i], f.Parents[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	for _, p := range f.Parents {
+		if _, ok := fd.files[p.ID]; !ok {
+			return fmt.Errorf("parent %q not found", p.ID)
+		}
+	}
+	return nil
+}
+
+// Set the property p of f, replacing any property with the same key. Empty
+// values delete the property.
+func (f *fakeFile) setProperty(p *fakeProperty) {
+	for i, old := range f.Properties {
+		if old.Key == p.Key {
+			f.Properties = append(f.Properties[:i], f.Properties[i+1:]...)
+			break
+		}
+	}
+	if p.Value != "" {
+		f.Properties = append(f.Properties, p)
+	}
+}
+
+// files.insert without media (folders and empty files).
+func (fd *fakeDrive) insert(w http.ResponseWriter, r *http.Request) {
+	meta, err := fakeMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["insert"]++
+	fd.create(w, r, meta, nil)
+}
+
+// Create a new file with the metadata in meta and the given contents, and
+// send it as the response. Must be called with fd.mu held.
+func (fd *fakeDrive) create(w http.ResponseWriter, r *http.Request, meta map[string]json.RawMessage, data []byte) {
+	var mimeType string
+	if v, ok := meta["mimeType"]; ok {
+		json.Unmarshal(v, &mimeType)
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	f := fd.newFile("Untitled", mimeType, fakeRootID)
+	if mimeType != fakeFolderType {
+		f.setData(data)
+	}
+	if err := fd.apply(f, meta, r); err != nil {
+		delete(fd.files, f.ID)
+		fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	fakeReply(w, http.StatusOK, f)
+}
+
+// files.update and files.patch, with optional media.
+func (fd *fakeDrive) update(w http.ResponseWriter, r *http.Request, id string, data []byte) {
+	meta, err := fakeMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["update"]++
+	fd.replace(w, r, id, meta, data)
+}
+
+// Update the file id with the metadata in meta and, if not nil, the contents
+// in data, and send it as the response. Must be called with fd.mu held.
+func (fd *fakeDrive) replace(w http.ResponseWriter, r *http.Request, id string, meta map[string]json.RawMessage, data []byte) {
+	f, ok := fd.file(id)
+	if !ok {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	saved := *f
+	if data != nil {
+		f.setData(data)
+	}
+	if err := fd.apply(f, meta, r); err != nil {
+		*f = saved
+		fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	fakeReply(w, http.StatusOK, f)
+}
+
+// files.copy, files.trash and files.untrash.
+func (fd *fakeDrive) action(w http.ResponseWriter, r *http.Request, id string, action string) {
+	meta, err := fakeMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests[action]++
+	f, ok := fd.file(id)
+	if !ok {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	switch action {
+	case "copy":
+		c := fd.newFile(f.Title, f.MimeType, "")
+		c.Parents = append([]fakeParent(nil), f.Parents...)
+		c.setData(f.data)
+		c.ModifiedDate = f.ModifiedDate
+		for _, p := range f.Properties {
+			cp := *p
+			c.Properties = append(c.Properties, &cp)
+		}
+		if err := fd.apply(c, meta, r); err != nil {
+			delete(fd.files, c.ID)
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		f = c
+	case "trash":
+		f.Labels.Trashed = true
+	case "untrash":
+		f.Labels.Trashed = false
+	}
+	fakeReply(w, http.StatusOK, f)
+}
+
+// files.delete. Folders are deleted along with their contents.
+func (fd *fakeDrive) delete(w http.ResponseWriter, id string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["delete"]++
+	f, ok := fd.file(id)
+	if !ok {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	var remove func(id string)
+	remove = func(id string) {
+		delete(fd.files, id)
+		for _, c := range fd.files {
+			if c.hasParent(id) {
+				remove(c.ID)
+			}
+		}
+	}
+	remove(f.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Uploads to /upload/drive/v2/files, inserting a new file or updating the
+// file id. Media, multipart and resumable uploads are supported.
+func (fd *fakeDrive) upload(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		meta = make(map[string]json.RawMessage)
+		data []byte
+		err  error
+	)
+	switch r.FormValue("uploadType") {
+	case "media":
+		data, err = ioutil.ReadAll(r.Body)
+	case "multipart":
+		meta, data, err = fakeMultipart(r)
+	case "resumable":
+		fd.startSession(w, r, id)
+		return
+	default:
+		err = fmt.Errorf("unsupported upload type %q", r.FormValue("uploadType"))
+	}
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badContent", err.Error())
+		return
+	}
+	if data == nil {
+		data = []byte{}
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.requests["upload"]++
+	if id == "" {
+		fd.create(w, r, meta, data)
+	} else {
+		fd.replace(w, r, id, meta, data)
+	}
+}
+
+// Return the metadata and media of a multipart upload.
+func fakeMultipart(r *http.Request) (map[string]json.RawMessage, []byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := fakeMetadata(part)
+	if err != nil {
+		return nil, nil, err
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadAll(part)
+	return meta, data, err
+}
+
+// Start a resumable upload session, returning its URI in the Location header.
+func (fd *fakeDrive) startSession(w http.ResponseWriter, r *http.Request, id string) {
+	meta, err := fakeMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "parseError", err.Error())
+		return
+	}
+	size := int64(-1)
+	if v := r.Header.Get("X-Upload-Content-Length"); v != "" {
+		if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			fakeError(w, http.StatusBadRequest, "invalid", "Invalid X-Upload-Content-Length")
+			return
+		}
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if id != "" {
+		if _, ok := fd.file(id); !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+			return
+		}
+	}
+	fd.nextID++
+	sid := fmt.Sprintf("session%04d", fd.nextID)
+	fd.sessions[sid] = &fakeSession{
+		id:              id,
+		meta:            meta,
+		size:            size,
+		setModifiedDate: r.FormValue("setModifiedDate") == "true",
+	}
+	w.Header().Set("Location", fd.server.URL+"/upload/session/"+sid)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Parse a Content-Range header of a resumable upload ("bytes 0-99/200",
+// "bytes 0-99/*" or "bytes */200"). Returns the first byte (-1 if no data is
+// sent) and the total size (-1 if unknown).
+func fakeContentRange(s string) (int64, int64, error) {
+	var rng, total string
+	if _, err := fmt.Sscanf(strings.Replace(s, "/", " ", 1), "bytes %s %s", &rng, &total); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	size := int64(-1)
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+		}
+		size = n
+	}
+	if rng == "*" {
+		return -1, size, nil
+	}
+	first, err := strconv.ParseInt(strings.SplitN(rng, "-", 2)[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return first, size, nil
+}
+
+// Receive a chunk of a resumable upload, or report the progress of the
+// session when no data is sent. The file is created or updated when all data
+// has been received.
+func (fd *fakeDrive) resume(w http.ResponseWriter, r *http.Request, sid string) {
+	first, size, err := fakeContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	chunk, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	s, ok := fd.sessions[sid]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "notFound", "Upload session not found")
+		return
+	}
+	if size >= 0 {
+		s.size = size
+	}
+	if first >= 0 {
+		if first != int64(len(s.data)) {
+			fakeError(w, http.StatusBadRequest, "invalid", fmt.Sprintf("expected offset %d, got %d", len(s.data), first))
+			return
+		}
+		s.data = append(s.data, chunk...)
+	}
+	if s.size < 0 || int64(len(s.data)) < s.size {
+		if len(s.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		}
+		w.WriteHeader(308)
+		return
+	}
+
+	delete(fd.sessions, sid)
+	fd.requests["upload"]++
+	q := r.URL.Query()
+	if s.setModifiedDate {
+		q.Set("setModifiedDate", "true")
+	}
+	r.URL.RawQuery = q.Encode()
+	r.Form = nil
+	data := append([]byte{}, s.data...)
+	if s.id == "" {
+		fd.create(w, r, s.meta, data)
+	} else {
+		fd.replace(w, r, s.id, s.meta, data)
+	}
+}
+
+// Send the contents of the file id, honoring Range requests.
+func (fd *fakeDrive) download(w http.ResponseWriter, r *http.Request, id string) {
+	fd.mu.Lock()
+	fd.requests["download"]++
+	f, ok := fd.file(id)
+	var (
+		data  []byte
+		mtime time.Time
+	)
+	if ok {
+		data = f.data
+		mtime, _ = time.Parse(time.RFC3339Nano, f.ModifiedDate)
+	}
+	fd.mu.Unlock()
+	if !ok || f.MimeType == fakeFolderType {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	http.ServeContent(w, r, "", mtime, bytes.NewReader(data))
+}
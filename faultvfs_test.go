@@ -0,0 +1,290 @@
+package main
+
+// A VFS wrapper injecting failures, for tests of the retry and resume code
+// paths of the sync engine.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	localvfs "github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Kinds of faults injected by faultVfs.
+const (
+	faultRateLimit = "rate-limit"
+	faultTimeout   = "timeout"
+	faultPartial   = "partial"
+)
+
+// All kinds of faults.
+var faultKinds = []string{faultRateLimit, faultTimeout, faultPartial}
+
+// errRateLimited is returned by operations failed with faultRateLimit.
+var errRateLimited = errors.New("rate limit exceeded")
+
+// faultVfs wraps a VFS, making a fraction of the operations that read or
+// modify files fail. Faults are chosen by a seeded random number generator, so
+// failing runs can be reproduced. Reads fail after half of the data has been
+// read, and partial writes store half of the data before failing, like
+// interrupted transfers. Operations used to plan the sync (Stat, Walk, etc) and
+// SetMtime never fail. It is safe for concurrent use.
+type faultVfs struct {
+	vfs.VFS
+	mu       gosync.Mutex
+	rng      *rand.Rand
+	rate     float64
+	kinds    []string
+	injected map[string]int
+}
+
+// Return a faultVfs wrapping base, failing operations with probability rate
+// with one of kinds (all kinds, if none given).
+func newFaultVfs(base vfs.VFS, seed int64, rate float64, kinds ...string) *faultVfs {
+	if len(kinds) == 0 {
+		kinds = faultKinds
+	}
+	return &faultVfs{
+		VFS:      base,
+		rng:      rand.New(rand.NewSource(seed)),
+		rate:     rate,
+		kinds:    kinds,
+		injected: make(map[string]int),
+	}
+}
+
+// Return the kind of fault to inject in the next operation, or an empty
+// string if it must succeed.
+func (f *faultVfs) fault() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rng.Float64() >= f.rate {
+		return ""
+	}
+	kind := f.kinds[f.rng.Intn(len(f.kinds))]
+	f.injected[kind]++
+	return kind
+}
+
+// Return the number of faults injected so far.
+func (f *faultVfs) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, v := range f.injected {
+		n += v
+	}
+	return n
+}
+
+// Return the error of operation op on fullpath failed with a fault of kind.
+func faultError(kind string, op string, fullpath string) error {
+	switch kind {
+	case faultTimeout:
+		return fmt.Errorf("%s \"%s\": %w", op, fullpath, context.DeadlineExceeded)
+	case faultPartial:
+		return fmt.Errorf("%s \"%s\": %w", op, fullpath, io.ErrUnexpectedEOF)
+	}
+	return fmt.Errorf("%s \"%s\": %w", op, fullpath, errRateLimited)
+}
+
+// Capabilities returns the capabilities of the underlying VFS.
+func (f *faultVfs) Capabilities() vfs.Capabilities {
+	return vfs.CapabilitiesOf(f.VFS)
+}
+
+// Delete calls Delete in the underlying VFS, unless a fault is injected.
+func (f *faultVfs) Delete(ctx context.Context, fullpath string) error {
+	if kind := f.fault(); kind != "" {
+		return faultError(kind, "Delete", fullpath)
+	}
+	return f.VFS.Delete(ctx, fullpath)
+}
+
+// Mkdir calls Mkdir in the underlying VFS, unless a fault is injected.
+func (f *faultVfs) Mkdir(ctx context.Context, fullpath string) error {
+	if kind := f.fault(); kind != "" {
+		return faultError(kind, "Mkdir", fullpath)
+	}
+	return f.VFS.Mkdir(ctx, fullpath)
+}
+
+// Move calls Move in the underlying VFS, unless a fault is injected.
+func (f *faultVfs) Move(ctx context.Context, srcpath string, dstpath string) error {
+	if kind := f.fault(); kind != "" {
+		return faultError(kind, "Move", dstpath)
+	}
+	return f.VFS.Move(ctx, srcpath, dstpath)
+}
+
+// ReadFromFile calls ReadFromFile in the underlying VFS. If a fault is
+// injected, reading fails after half of the file has been read.
+func (f *faultVfs) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	rc, err := f.VFS.ReadFromFile(ctx, fullpath)
+	kind := f.fault()
+	if err != nil || kind == "" {
+		return rc, err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	r := io.MultiReader(bytes.NewReader(data[:len(data)/2]), &errReader{faultError(kind, "Read", fullpath)})
+	return ioutil.NopCloser(r), nil
+}
+
+// WriteToFile calls WriteToFile in the underlying VFS, unless a fault is
+// injected. Partial writes write half of the data before failing.
+func (f *faultVfs) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	kind := f.fault()
+	switch kind {
+	case "":
+		return f.VFS.WriteToFile(ctx, fullpath, reader)
+	case faultPartial:
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if err = f.VFS.WriteToFile(ctx, fullpath, bytes.NewReader(data[:len(data)/2])); err != nil {
+			return err
+		}
+	}
+	return faultError(kind, "WriteToFile", fullpath)
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// Create a source tree with nfiles files of different sizes under "src", and
+// return their contents by path relative to it.
+func makeFaultTree(t *testing.T, nfiles int) map[string][]byte {
+	files := make(map[string][]byte)
+	tree := make(map[string]string)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < nfiles; i++ {
+		rel := fmt.Sprintf("d%d/e%d/file%d", i%3, i%2, i)
+		data := make([]byte, 1+rng.Intn(64*1024))
+		rng.Read(data)
+		files[filepath.FromSlash(rel)] = data
+		tree[rel] = string(data)
+	}
+	writeTree(t, "src", tree)
+	return files
+}
+
+// Check that every file in files was synced to dstdir.
+func checkFaultTree(t *testing.T, dstdir string, files map[string][]byte) {
+	for rel, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dstdir, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: Expected %d bytes synced, got %d different bytes", rel, len(want), len(got))
+		}
+	}
+}
+
+func TestFaultInjectionRetries(t *testing.T) {
+	defer func(n int, d time.Duration) { opt.fileRetries, fileRetryDelay = n, d }(opt.fileRetries, fileRetryDelay)
+	defer func() { failedFiles = nil }()
+	opt.fileRetries, fileRetryDelay = 20, 0
+
+	chdirTemp(t)
+	files := makeFaultTree(t, 30)
+
+	// Two destinations, synced concurrently from a single faulty source.
+	lfs := localvfs.NewLocalFileSystem()
+	src := newFaultVfs(lfs, 1, 0.2)
+	dst1 := newFaultVfs(lfs, 2, 0.3)
+	dst2 := newFaultVfs(lfs, 3, 0.3)
+	for _, d := range []string{"dst1", "dst2"} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dsts := []syncDest{{path: "dst1", fsys: dst1}, {path: "dst2", fsys: dst2}}
+	if err := syncTo(context.Background(), "src/", src, dsts, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(failedFiles) != 0 {
+		t.Errorf("Expected all files synced, got %d failures", len(failedFiles))
+	}
+	for _, f := range []*faultVfs{src, dst1, dst2} {
+		if f.count() == 0 {
+			t.Errorf("Expected faults to be injected")
+		}
+	}
+	checkFaultTree(t, "dst1", files)
+	checkFaultTree(t, "dst2", files)
+}
+
+func TestFaultInjectionResume(t *testing.T) {
+	// Failures are recorded even without --file-retries.
+	defer func() { failedFiles = nil }()
+	chdirTemp(t)
+	files := makeFaultTree(t, 20)
+	if err := os.Mkdir("dst", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without retries, every fault stops the sync, which is then resumed
+	// from the journal, as after a crash.
+	lfs := localvfs.NewLocalFileSystem()
+	dst := newFaultVfs(lfs, 4, 0.1)
+	runs := 0
+	for ; runs < 100; runs++ {
+		jrnl, err := openJournal("journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sync(context.Background(), "src/", "dst", lfs, dst, jrnl, nil, nil)
+		if err == nil {
+			if err = jrnl.remove(); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		jrnl.file.Close()
+	}
+	if runs == 0 || runs == 100 {
+		t.Fatalf("Expected the sync to fail and be resumed until done, got %d failed runs", runs)
+	}
+	checkFaultTree(t, "dst", files)
+
+	// Nothing is left to do, so any attempt to modify the destination
+	// would fail.
+	dst.rate = 1
+	jrnl, err := openJournal("journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jrnl.remove()
+	if err = sync(context.Background(), "src/", "dst", lfs, dst, jrnl, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFaultTree(t, "dst", files)
+}
@@ -0,0 +1,282 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"context"
+	"path"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Name of the per-directory ignore file
+	ignoreFileName = ".gsyncignore"
+
+	// Git ignore file and repository directory (--exclude-gitignored)
+	gitIgnoreFileName = ".gitignore"
+	gitDirName        = ".git"
+)
+
+// ignoreFiles holds the patterns read from per-directory ignore files, keyed
+// by the directory (relative to the root of the sync) containing the file.
+type ignoreFiles map[string][]string
+
+// Split a slash separated path into its components, removing empty elements.
+func pathComponents(pathname string) []string {
+	var ret []string
+
+	for _, v := range strings.Split(pathname, "/") {
+		if v != "" && v != "." {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Match the pattern components in pat against the path components in name.
+// Each pattern component is a shell glob matched against a single path
+// component, except for "**", which matches zero or more components.
+//
+// Return:
+//   bool
+//   error
+func matchComponents(pat []string, name []string) (bool, error) {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for ix := 0; ix <= len(name); ix++ {
+				match, err := matchComponents(pat[1:], name[ix:])
+				if err != nil || match {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		match, err := path.Match(pat[0], name[0])
+		if err != nil || !match {
+			return false, err
+		}
+		pat = pat[1:]
+		name = name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// Match a single exclusion pattern against relpath, a path relative to the
+// root of the sync. Patterns starting with a slash are anchored to the root
+// of the sync. Other patterns may match at any depth, so "*.o" matches any
+// object file and "cache/*" matches files directly under any "cache"
+// directory. The "**" component matches any number of directories.
+//
+// Return:
+//   bool
+//   error
+func matchPattern(pattern string, relpath string) (bool, error) {
+	pat := pathComponents(pattern)
+	name := pathComponents(relpath)
+
+	if len(pat) == 0 {
+		return false, nil
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return matchComponents(pat, name)
+	}
+	for ix := 0; ix < len(name); ix++ {
+		match, err := matchComponents(pat, name[ix:])
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+// Return true if relpath or any of its parent directories matches one of
+// the patterns in patterns. Excluding a directory excludes everything under it.
+// If dirOnly is set, patterns ending in a slash only match directories: its
+// parents, and relpath itself if isDir is set.
+//
+// Return:
+//   bool
+//   error
+func matchAny(patterns []string, relpath string, dirOnly bool, isDir bool) (bool, error) {
+	name := pathComponents(relpath)
+
+	for _, excpat := range patterns {
+		log.Log(context.Background(), levelTrace, "attempting to match pattern", "path", relpath, "pattern", excpat)
+		last := len(name)
+		if dirOnly && !isDir && strings.HasSuffix(excpat, "/") {
+			last--
+		}
+		for ix := 1; ix <= last; ix++ {
+			match, err := matchPattern(excpat, strings.Join(name[:ix], "/"))
+			if err != nil {
+				return false, err
+			}
+			if match {
+				log.Log(context.Background(), levelTrace, "excluding path", "path", relpath, "pattern", excpat)
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Return true if the passed path (relative to the root of the sync) matches
+// one of the patterns in the exclusion list (opt.exclude).
+//
+// Return:
+//   bool
+//   error
+func excluded(relpath string) (bool, error) {
+	if opt.excludeGitignored {
+		match, err := matchAny([]string{gitDirName}, relpath, false, false)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return matchAny(opt.exclude, relpath, false, false)
+}
+
+// Convert a pattern from a .gitignore file into our own pattern syntax. In
+// gitignore, a pattern containing a slash anywhere but at the end is relative
+// to the directory holding the file, which we express as an anchored pattern.
+// Negated patterns ("!pattern") are not supported and return an empty string,
+// so they are skipped with a warning.
+func gitignorePattern(line string) string {
+	if strings.HasPrefix(line, "!") {
+		return ""
+	}
+	if strings.Contains(strings.TrimSuffix(line, "/"), "/") && !strings.HasPrefix(line, "/") {
+		return "/" + line
+	}
+	return line
+}
+
+// Load the ignore files (if any) inside srcdir in srcvfs. Reldir is the path
+// of srcdir relative to the root of the sync. The .gsyncignore file is always
+// read, and .gitignore is read if --exclude-gitignored is set.
+//
+// Return:
+//   error
+func (ig ignoreFiles) load(ctx context.Context, srcvfs vfs.VFS, srcdir string, reldir string) error {
+	reldir = strings.Join(pathComponents(reldir), "/")
+	if _, ok := ig[reldir]; ok {
+		return nil
+	}
+	ig[reldir] = nil
+
+	err := ig.loadFile(ctx, srcvfs, path.Join(srcdir, ignoreFileName), reldir, nil)
+	if err != nil {
+		return err
+	}
+	if opt.excludeGitignored {
+		return ig.loadFile(ctx, srcvfs, path.Join(srcdir, gitIgnoreFileName), reldir, gitignorePattern)
+	}
+	return nil
+}
+
+// Return the name of the first marker file (--exclude-if-present) found in
+// srcdir in srcvfs, or an empty string if none is found.
+//
+// Return:
+//   string
+//   error
+func excludeMarker(ctx context.Context, srcvfs vfs.VFS, srcdir string) (string, error) {
+	for _, name := range opt.excludeIfPresent {
+		exists, err := srcvfs.FileExists(ctx, path.Join(srcdir, name))
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// Exclude the directory reldir (relative to the root of the sync) and
+// everything under it, as if listed in the ignore file of its parent.
+func (ig ignoreFiles) exclude(reldir string) {
+	name := pathComponents(reldir)
+	if len(name) == 0 {
+		return
+	}
+	// Escape any glob characters in the name.
+	base := name[len(name)-1]
+	for _, c := range []string{"\\", "*", "?", "["} {
+		base = strings.ReplaceAll(base, c, "\\"+c)
+	}
+	parent := strings.Join(name[:len(name)-1], "/")
+	ig[parent] = append(ig[parent], "/"+base)
+}
+
+// Load the patterns in the ignore file fname into the patterns for reldir.
+// The file contains one pattern per line, with the same syntax as --exclude.
+// Patterns are relative to the directory holding the file. Blank lines and
+// lines starting with "#" are ignored. If convert is not nil, it is used to
+// translate each line into a pattern (empty results are skipped with a
+// warning, since they would change what is excluded).
+//
+// Return:
+//   error
+func (ig ignoreFiles) loadFile(ctx context.Context, srcvfs vfs.VFS, fname string, reldir string, convert func(string) string) error {
+	exists, err := srcvfs.FileExists(ctx, fname)
+	if err != nil || !exists {
+		return err
+	}
+	r, err := srcvfs.ReadFromFile(ctx, fname)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if convert != nil {
+			if line = convert(line); line == "" {
+				log.Warn("ignoring unsupported pattern", "file", fname, "pattern", scanner.Text())
+				continue
+			}
+		}
+		ig[reldir] = append(ig[reldir], line)
+	}
+	log.Debug("loaded patterns", "file", fname)
+	return scanner.Err()
+}
+
+// Return true if relpath (relative to the root of the sync) is excluded by
+// the patterns of an ignore file in any of its parent directories. As in
+// gitignore, patterns ending in a slash only match directories, so isDir
+// tells whether relpath is one.
+//
+// Return:
+//   bool
+//   error
+func (ig ignoreFiles) excluded(relpath string, isDir bool) (bool, error) {
+	name := pathComponents(relpath)
+
+	// Check the ignore files from the root of the sync down to the
+	// directory immediately above relpath.
+	for ix := 0; ix < len(name); ix++ {
+		patterns := ig[strings.Join(name[:ix], "/")]
+		if len(patterns) == 0 {
+			continue
+		}
+		match, err := matchAny(patterns, strings.Join(name[ix:], "/"), true, isDir)
+		if err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
@@ -7,25 +7,124 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs/union"
 )
 
 const (
 	// Flag defaults
 	defaultOptVerboseLevel = 0
 	defaultOptDryRun       = false
+	defaultOptBufferSize   = 8 << 20
+	defaultOptHashers      = 4
+	defaultOptBenchFiles   = 20
+	defaultOptBenchSize    = 1 << 20
+
+	// Commands
+	cmdSync           = "sync"
+	cmdAuth           = "auth"
+	cmdBench          = "bench"
+	cmdCopyTo         = "copyto"
+	cmdDiff           = "diff"
+	cmdLsJSON         = "lsjson"
+	cmdRmdirs         = "rmdirs"
+	cmdTouch          = "touch"
+	cmdTree           = "tree"
+	cmdVerifyManifest = "verify-manifest"
+	cmdVersion        = "version"
 )
 
 type multiString []string
 type multiLevelInt int
+type byteSize int64
 
 type cmdLineOpts struct {
-	clientID     string
-	clientSecret string
-	code         string
-	dryrun       bool
-	exclude      multiString
-	inplace      bool
-	verbose      multiLevelInt
+	alsoDest          multiString
+	archiveMode       bool
+	benchFiles        int
+	benchSize         byteSize
+	bufferSize        byteSize
+	bwlimit           byteSize
+	cacheDir          string
+	cacheMaxAge       time.Duration
+	cacheMaxSize      byteSize
+	checkUpdate       bool
+	checksum          bool
+	checksumDB        string
+	clientID          string
+	clientSecret      string
+	code              string
+	conflict          string
+	cpuProfile        string
+	downloadOnly      bool
+	downloadStreams   int
+	dumpHTTP          bool
+	dumpHTTPBodies    bool
+	dryrun            bool
+	events            string
+	exclude           multiString
+	excludeGitignored bool
+	excludeIfPresent  multiString
+	exportFormats     string
+	failedList        string
+	format            string
+	fileRetries       int
+	fuzzy             bool
+	groupMap          string
+	hashers           int
+	ignoreSize        bool
+	ignoreWalkErrors  bool
+	ignoreTimes       bool
+	impersonate       string
+	inplace           bool
+	json              bool
+	logFormat         string
+	logLevel          string
+	journal           string
+	linkDest          string
+	lockFiles         bool
+	maxBufferMemory   byteSize
+	maxDepth          int
+	maxDuration       time.Duration
+	memProfile        string
+	minFreeSpace      byteSize
+	mirror            bool
+	mkpath            bool
+	noEmptyDirs       bool
+	noEstimate        bool
+	oneFileSystem     bool
+	orderBy           string
+	pprofAddr         string
+	proxy             string
+	pruneEmpty        bool
+	retryFrom         string
+	rmdirs            bool
+	quotaWait         bool
+	readOnly          bool
+	recursive         bool
+	remote            string
+	removeSource      bool
+	resetMtime        bool
+	scope             string
+	serviceAccount    string
+	skipReport        string
+	stallTimeout      time.Duration
+	stateDB           string
+	symlinks          string
+	times             bool
+	timeout           time.Duration
+	tokenEncryption   string
+	trace             string
+	unionPrecedence   string
+	uploadConcurrency int
+	uploadOnly        bool
+	uploadSessionDir  string
+	userMap           string
+	verbose           multiLevelInt
+	writeManifest     string
 }
 
 var (
@@ -70,24 +169,68 @@ func (m *multiLevelInt) IsBoolFlag() bool {
 	return true
 }
 
-// Retrieve the sources and destination from the command-line, performing basic sanity checking.
+// Definitions for the custom flag type byteSize
+
+// Return the string representation of the flag.
+func (b *byteSize) String() string {
+	return fmt.Sprint(int64(*b))
+}
+
+// Parse a size in bytes, with an optional K, M or G suffix (powers of 1024).
+func (b *byteSize) Set(value string) error {
+	mult := int64(1)
+	s := strings.TrimSuffix(strings.ToUpper(value), "B")
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid size \"%s\"", value)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// Retrieve the command from the command-line. Commands other than "sync" (the
+// default) are given as the first non-flag argument, as in "gsync diff a b".
+//
+// Returns:
+// 	string: command
+// 	[]string: remaining arguments
+func getCommand() (string, []string) {
+	args := flag.Args()
+	if len(args) > 0 && (args[0] == cmdAuth || args[0] == cmdBench || args[0] == cmdCopyTo || args[0] == cmdDiff || args[0] == cmdLsJSON || args[0] == cmdRmdirs || args[0] == cmdTouch || args[0] == cmdTree || args[0] == cmdVerifyManifest || args[0] == cmdVersion) {
+		return args[0], args[1:]
+	}
+	return cmdSync, args
+}
+
+// Retrieve the sources and destination from args, performing basic sanity checking.
 //
 // Returns:
 // 	[]string: source paths
 // 	string: destination directory
 // 	error
-func getSourceDest() ([]string, string, error) {
+func getSourceDest(args []string) ([]string, string, error) {
 	var srcpaths []string
 
-	if flag.NArg() < 2 {
+	if len(args) < 2 {
 		return nil, "", fmt.Errorf("Must specify source and destination directories")
 	}
 
 	// All arguments but last are considered to be sources
-	for ix := 0; ix < flag.NArg()-1; ix++ {
-		srcpaths = append(srcpaths, flag.Arg(ix))
+	for ix := 0; ix < len(args)-1; ix++ {
+		srcpaths = append(srcpaths, args[ix])
 	}
-	dst := flag.Arg(flag.NArg() - 1)
+	dst := args[len(args)-1]
 
 	return srcpaths, dst, nil
 }
@@ -98,10 +241,91 @@ func parseFlags() {
 	flag.StringVar(&opt.clientID, "id", "", "Client ID")
 	flag.StringVar(&opt.clientSecret, "secret", "", "Client Secret")
 	flag.StringVar(&opt.code, "code", "", "Authorization Code")
+	flag.StringVar(&opt.serviceAccount, "service-account", "", "Service account JSON key file (with --impersonate)")
+	flag.StringVar(&opt.impersonate, "impersonate", "", "Access the Drive of this user through domain-wide delegation")
+	flag.StringVar(&opt.remote, "remote", "", "Name of the remote (account) configured by --id, --secret and --code")
+	flag.StringVar(&opt.scope, "scope", defaultScope, "Google Drive OAuth scope (drive, drive.file or drive.readonly)")
+	flag.StringVar(&opt.tokenEncryption, "token-encryption", "", "Encrypt the cached OAuth tokens with a passphrase (\"passphrase\") or key file (\"file:path\")")
+	flag.BoolVar(&opt.readOnly, "read-only", false, "Fail any attempt to modify Google Drive")
+	flag.StringVar(&opt.exportFormats, "export-formats", "", "Export formats for Google Docs (default ~/"+exportFormatsFile+")")
+	flag.StringVar(&opt.skipReport, "skip-report", "", "List the Google files that can't be downloaded (forms, sites, etc) in this file")
 	flag.BoolVar(&opt.dryrun, "dry-run", defaultOptDryRun, "Dry-run mode")
 	flag.BoolVar(&opt.dryrun, "n", defaultOptDryRun, "Dry-run mode (shorthand)")
+	flag.StringVar(&opt.journal, "journal", "", "Record operations in this file and resume from it after a crash")
 	flag.BoolVar(&opt.inplace, "inplace", false, "Upload files in place (faster, but may leave incomplete files behind if program dies)")
+	flag.BoolVar(&opt.lockFiles, "lock-files", false, "Hold an advisory lock (flock) on local files while writing them")
+	flag.StringVar(&opt.userMap, "usermap", "", "Translate the owners of restored local files using the user map in this file")
+	flag.StringVar(&opt.groupMap, "groupmap", "", "Translate the groups of restored local files using the group map in this file")
+	flag.BoolVar(&opt.ignoreSize, "ignore-size", false, "Only compare modification times to decide if files are up to date")
+	flag.IntVar(&opt.fileRetries, "file-retries", 0, "Try failed file operations this many times, then skip the file and continue (0 stops the sync)")
+	flag.StringVar(&opt.failedList, "failed-list", "", "Write the paths of the files that failed to this file, for --retry-from")
+	flag.StringVar(&opt.retryFrom, "retry-from", "", "Only sync the paths listed in this file (as written by --failed-list)")
+	flag.BoolVar(&opt.ignoreWalkErrors, "ignore-walk-errors", false, "Skip source files and directories that can't be read, instead of failing")
+	flag.BoolVar(&opt.ignoreTimes, "ignore-times", false, "Copy all files, even if they seem to be up to date")
+	flag.BoolVar(&opt.checksum, "checksum", false, "Compare files of the same size by MD5 checksum instead of modification time")
+	flag.BoolVar(&opt.fuzzy, "fuzzy", false, "Copy new files from an identical, similarly named file in the destination directory, instead of transferring them")
+	flag.BoolVar(&opt.times, "times", false, "Only set the modification time of destination files identical to the source (by checksum)")
+	flag.StringVar(&opt.checksumDB, "checksum-db", "", "Cache the checksums of local files in this file (with --checksum)")
+	flag.IntVar(&opt.hashers, "hashers", defaultOptHashers, "Number of local files to hash concurrently, ahead of transfers (with --checksum)")
+	flag.StringVar(&opt.orderBy, "order-by", "", "Sync files in this order: name, mtime or size, optionally followed by ,asc or ,desc (e.g. mtime,desc for newest first)")
+	flag.BoolVar(&opt.pruneEmpty, "prune-empty-dirs", false, "Do not create destination directories that would end up empty")
+	flag.BoolVar(&opt.noEmptyDirs, "no-empty-dirs", false, "Do not create destination directories for source directories without files")
+	flag.BoolVar(&opt.rmdirs, "rmdirs", false, "Remove empty directories from the destination after syncing")
+	flag.StringVar(&opt.unionPrecedence, "union-precedence", unionvfs.PrecedenceFirst, "Which directory of a union provides paths found in several of them (first, last or newest)")
+	flag.BoolVar(&opt.mirror, "mirror", false, "Make the destination an exact copy of the source, removing everything else (verifies all copies)")
+	flag.BoolVar(&opt.downloadOnly, "download-only", false, "Fail unless all sources are remote and all destinations local")
+	flag.BoolVar(&opt.uploadOnly, "upload-only", false, "Fail unless all sources are local and all destinations remote")
+	flag.BoolVar(&opt.mkpath, "mkpath", false, "Create the destination directory and any missing parents")
+	flag.Var(&opt.minFreeSpace, "min-free-space", "Keep at least this much free space in local destinations (e.g. 500M, 10G)")
+	flag.Var(&opt.alsoDest, "also-dest", "Also sync to this destination, sharing the scan of the source (may be repeated)")
+	flag.BoolVar(&opt.removeSource, "remove-source-files", false, "Remove source files after they have been copied and verified")
+	flag.StringVar(&opt.writeManifest, "write-manifest", "", "Write the SHA256 checksums of all transferred files to this file")
+	flag.StringVar(&opt.linkDest, "link-dest", "", "Hard link unchanged files from this previous snapshot instead of copying them (local only)")
+	flag.StringVar(&opt.events, "events", "", "Write progress events as JSON lines to this file (- for stdout)")
+	flag.BoolVar(&opt.noEstimate, "no-estimate", false, "Start transfers before the whole source is scanned, without estimating the work (with --events)")
+	flag.StringVar(&opt.stateDB, "state-db", "", "Keep the state of synced files in this file to speed up future runs")
+	flag.BoolVar(&opt.resetMtime, "reset-mtime-failures", false, "Forget failures to set modification times recorded in the state database")
+	flag.StringVar(&opt.conflict, "conflict", conflictRename, "What to do when both sides changed since the last sync (newer, larger, source, dest, rename, skip or ask)")
+	flag.StringVar(&opt.proxy, "proxy", "", "HTTP/SOCKS5 proxy URL for Google Drive access (e.g. socks5://host:1080)")
+	opt.bufferSize = defaultOptBufferSize
+	flag.Var(&opt.bufferSize, "buffer-size", "Memory buffer per transfer, and chunk size for Google Drive uploads (e.g. 256K, 8M)")
+	flag.Var(&opt.maxBufferMemory, "max-buffer-memory", "Limit the memory used for read-ahead buffers by all transfers together (e.g. 64M)")
+	flag.Var(&opt.bwlimit, "bwlimit", "Limit the bandwidth of all transfers to this many bytes per second (e.g. 512K, 2M)")
+	flag.IntVar(&opt.benchFiles, "bench-files", defaultOptBenchFiles, "Number of files written by the bench command")
+	opt.benchSize = defaultOptBenchSize
+	flag.Var(&opt.benchSize, "bench-size", "Size of each file written by the bench command (e.g. 256K, 10M)")
+	flag.BoolVar(&opt.recursive, "recursive", false, "Set the modification times of everything under the path given to the touch command")
+	flag.IntVar(&opt.maxDepth, "max-depth", 0, "Levels listed by the tree and lsjson commands (0 for all)")
+	flag.StringVar(&opt.format, "format", "", "Go template for each entry listed by the tree and lsjson commands (e.g. \"{{.Size}} {{.Path}}\")")
+	flag.IntVar(&opt.downloadStreams, "download-streams", 1, "Download large files from Google Drive with this many concurrent requests")
+	flag.IntVar(&opt.uploadConcurrency, "upload-concurrency", 1, "Number of chunks of each Google Drive upload to prepare while sending")
+	flag.StringVar(&opt.uploadSessionDir, "upload-session-dir", "", "Directory for resumable upload sessions (default ~/"+uploadSessionDir+")")
+	flag.StringVar(&opt.cacheDir, "cache-dir", "", "Directory for the cache of cache: paths (default ~/"+defaultCacheDir+")")
+	opt.cacheMaxSize = defaultOptCacheMaxSize
+	flag.Var(&opt.cacheMaxSize, "cache-max-size", "Maximum size of the files kept in the cache of each cached remote (e.g. 500M, 2G)")
+	flag.DurationVar(&opt.cacheMaxAge, "cache-max-age", defaultOptCacheMaxAge, "How long cached listings and checksums of cache: paths are used (e.g. 10m, 1h)")
+	flag.BoolVar(&opt.quotaWait, "quota-wait", false, "Wait for the Google Drive daily quota to reset instead of failing")
+	flag.DurationVar(&opt.timeout, "timeout", 0, "Timeout for each filesystem/API operation (e.g. 30s, 5m)")
+	flag.DurationVar(&opt.stallTimeout, "stall-timeout", 0, "Abort and retry transfers that make no progress for this long (e.g. 2m)")
+	flag.DurationVar(&opt.maxDuration, "max-duration", 0, "Maximum duration of the entire run (e.g. 2h)")
+	flag.StringVar(&opt.cpuProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	flag.StringVar(&opt.memProfile, "memprofile", "", "Write a memory (heap) profile to this file at the end of the run")
+	flag.StringVar(&opt.trace, "trace", "", "Write an execution trace to this file")
+	flag.BoolVar(&opt.dumpHTTP, "dump-http", false, "Log every HTTP request (method, URL, status, latency and retries), without credentials")
+	flag.BoolVar(&opt.dumpHTTPBodies, "dump-http-bodies", false, "Like --dump-http, also logging the request and response bodies (except file contents)")
+	flag.StringVar(&opt.pprofAddr, "pprof", "", "Serve live profiles over HTTP on this address (e.g. localhost:6060)")
+	flag.BoolVar(&opt.json, "json", false, "Output the diff and version command reports as JSON")
+	flag.BoolVar(&opt.checkUpdate, "check-update", false, "Check GitHub for a newer release of gsync (with the version command)")
+	flag.StringVar(&opt.symlinks, "symlinks", symlinksFollow, "What to do with symbolic links in local sources (follow or skip)")
+	flag.BoolVar(&opt.archiveMode, "archive", false, "Archive mode: also preserve permissions, ownership, exact mtimes and symbolic links between local trees")
+	flag.BoolVar(&opt.archiveMode, "a", false, "Archive mode (shorthand)")
+	flag.BoolVar(&opt.oneFileSystem, "one-file-system", false, "Do not cross filesystem boundaries when walking local sources")
+	flag.BoolVar(&opt.oneFileSystem, "x", false, "Do not cross filesystem boundaries (shorthand)")
 	flag.Var(&opt.exclude, "exclude", "List of paths to exclude (glob)")
+	flag.BoolVar(&opt.excludeGitignored, "exclude-gitignored", false, "Exclude files matched by .gitignore files and .git directories")
+	flag.Var(&opt.excludeIfPresent, "exclude-if-present", "Exclude directories containing a file with this name (e.g. .nobackup)")
+	flag.StringVar(&opt.logLevel, "log-level", "", "Log level (error, warn, info, debug, trace), optionally per module (e.g. info,gdrive=debug)")
+	flag.StringVar(&opt.logFormat, "log-format", "text", "Log output format (text or json)")
 	flag.Var(&opt.verbose, "verbose", "Verbose mode (use multiple times to increase level)")
 	flag.Var(&opt.verbose, "v", "Verbose mode (use multiple times to increase level)")
 	flag.Parse()
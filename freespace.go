@@ -0,0 +1,48 @@
+package main
+
+// Minimum free space in destinations (--min-free-space).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// errNoFreeSpace is returned (wrapped) when the free space in a destination
+// is below --min-free-space. It stops the sync, even with --file-retries.
+var errNoFreeSpace = errors.New("free space below --min-free-space")
+
+// Check that writing size bytes to dstpath in dstvfs leaves at least
+// --min-free-space available. Files that don't fit are skipped with a warning,
+// since smaller files may still fit. Once the free space is below the minimum,
+// an error wrapping errNoFreeSpace is returned. Destinations that don't report
+// their free space (see vfs.FreeSpacer) are not checked.
+//
+// Return:
+//   bool: true if the file must be skipped.
+//   error
+func checkFreeSpace(ctx context.Context, dstvfs vfs.VFS, dstpath string, size int64) (bool, error) {
+	v, ok := dstvfs.(vfs.FreeSpacer)
+	if opt.minFreeSpace <= 0 || !ok {
+		return false, nil
+	}
+	free, err := v.FreeSpace(ctx, dstpath)
+	if err != nil || free < 0 {
+		return false, err
+	}
+	minFree := int64(opt.minFreeSpace)
+	if free < minFree {
+		return false, fmt.Errorf("Not enough free space for \"%s\" (%d bytes free, %d required): %w", dstpath, free, minFree, errNoFreeSpace)
+	}
+	if size > 0 && free-size < minFree {
+		log.Warn("skipping file: not enough free space", "path", dstpath, "size", size, "free", free)
+		return true, nil
+	}
+	return false, nil
+}
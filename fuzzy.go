@@ -0,0 +1,164 @@
+package main
+
+// Basis files for new destination files (--fuzzy).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Minimum similarity (see nameSimilarity) between the name of a new file and
+// the name of its basis file.
+const minFuzzySimilarity = 0.5
+
+// Return how similar the file names a and b are, from 0 (nothing in common)
+// to 1 (the same name): the length of their common prefix and suffix, relative
+// to the length of the longest name.
+func nameSimilarity(a string, b string) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 1
+	}
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	return float64(pre+suf) / float64(n)
+}
+
+// Return a file in the destination directory of dst with a name similar to
+// dst and the same contents as the source file fi, to be copied to dst within
+// the destination instead of transferring fi (see --fuzzy). This catches
+// files renamed or versioned in the source ("report-v2.pdf" for
+// "report-v1.pdf"). Candidates are compared by checksum, so both sides must
+// provide them. An empty path is returned if there's no such file, or if dst
+// already exists.
+//
+// Return:
+//   string
+//   error
+func (p *planner) fuzzyBasis(fi vfs.FileInfo, dst string) (string, error) {
+	if !opt.fuzzy || fi.Size <= 0 || p.srcvfs == p.dstvfs {
+		return "", nil
+	}
+	// Wrappers (like --timeout) implement DirReader whatever the backend,
+	// so listings must also be a capability.
+	lister, ok := p.dstvfs.(vfs.DirReader)
+	if !ok || !p.dstcaps.ReadDir || !vfs.CapabilitiesOf(p.srcvfs).Checksum || !p.dstcaps.Checksum {
+		return "", nil
+	}
+	exists, err := p.dstvfs.FileExists(p.ctx, dst)
+	if err != nil || exists {
+		return "", err
+	}
+
+	// Directories are listed once, when the first file is copied into them.
+	// New directories have nothing to offer.
+	dir := path.Dir(dst)
+	list, ok := p.dstdirs[dir]
+	if !ok {
+		if exists, err = p.dstvfs.FileExists(p.ctx, dir); err != nil {
+			return "", err
+		}
+		if exists {
+			if list, err = lister.ReadDir(p.ctx, dir); err != nil {
+				return "", err
+			}
+		}
+		p.dstdirs[dir] = list
+	}
+
+	type candidate struct {
+		path  string
+		score float64
+	}
+	var candidates []candidate
+	name := path.Base(dst)
+	for _, c := range list {
+		if !c.IsRegular() || c.Size != fi.Size {
+			continue
+		}
+		if score := nameSimilarity(name, path.Base(c.Path)); score >= minFuzzySimilarity {
+			candidates = append(candidates, candidate{c.Path, score})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	for _, c := range candidates {
+		same, err := checksumsMatch(p.ctx, p.srcvfs, p.dstvfs, fi.Path, c.path)
+		if err != nil {
+			return "", err
+		}
+		if same {
+			log.Debug("identical file in destination; will copy from it", "path", fi.Path, "basis", c.path)
+			return c.path, nil
+		}
+	}
+	return "", nil
+}
+
+// Copy op.From, a file in dstvfs with the same contents as op.Src in srcvfs
+// (see fuzzyBasis), to op.Dst within dstvfs, along with the times and metadata
+// of op.Src. The copy is made on the server side when possible. The basis may
+// have been removed or changed since it was chosen, so the contents of the
+// copy are verified against the source.
+//
+// Return:
+//   bool: false if op.Src must be transferred instead.
+//   error
+func copyBasis(ctx context.Context, op syncOp, srcvfs vfs.VFS, dstvfs vfs.VFS) (bool, error) {
+	exists, err := dstvfs.FileExists(ctx, op.From)
+	if err != nil || !exists {
+		return false, err
+	}
+	fi, err := srcvfs.Stat(ctx, op.Src)
+	if err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+	events.emit(event{Event: evTransferStart, Op: op.Op, Src: op.Src, Dst: op.Dst, Size: fi.Size})
+	caps := vfs.CapabilitiesOf(dstvfs)
+	if v, ok := dstvfs.(vfs.Copier); ok && caps.ServerSideCopy {
+		err = v.Copy(ctx, op.From, op.Dst)
+	} else {
+		var rc io.ReadCloser
+		if rc, err = dstvfs.ReadFromFile(ctx, op.From); err != nil {
+			return false, err
+		}
+		err = dstvfs.WriteToFile(ctx, op.Dst, rc)
+		closeReader(rc, op.From)
+		if err != nil && !caps.AtomicRename {
+			removePartial(ctx, dstvfs, op.Dst)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	same, err := checksumsMatch(ctx, srcvfs, dstvfs, op.Src, op.Dst)
+	if err != nil || !same {
+		log.Debug("basis file changed; will transfer", "path", op.Src, "basis", op.From)
+		return false, err
+	}
+	log.Info("copy", "path", op.Dst, "basis", op.From, "duration", time.Since(start))
+	events.transferDone(op, 0, time.Since(start))
+	return true, copyAttrs(ctx, srcvfs, dstvfs, op, fi.Mtime)
+}
@@ -4,7 +4,78 @@ package main
 // See instructions in the README.md file that accompanies this program.
 // (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
 
-import "testing"
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/archive"
+	"github.com/marcopaganini/gsync/vfs/gdrive"
+	"github.com/marcopaganini/gsync/vfs/local"
+	"github.com/marcopaganini/gsync/vfs/union"
+)
+
+// Change to a temporary directory until the test ends, since destPath always
+// generates relative paths.
+func chdirTemp(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create the files in files (contents by slash separated path, relative to
+// root) and their parent directories. Paths ending in a slash are created as
+// directories.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, data := range files {
+		fname := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(fname, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
 
 func TestDestPath(t *testing.T) {
 	paths := [][]string{
@@ -33,3 +104,4236 @@ func TestDestPath(t *testing.T) {
 		}
 	}
 }
+
+func TestAppDataPath(t *testing.T) {
+	casetab := []struct {
+		pathname string
+		appdata  bool
+		want     string
+	}{
+		{"appdata", true, "/"},
+		{"/appdata/", true, "/"},
+		{"appdata/state.json", true, "/state.json"},
+		{"/appdata/a/b", true, "/a/b"},
+		{"appdatafoo/bar", false, "appdatafoo/bar"},
+		{"foo/appdata", false, "foo/appdata"},
+		{"/", false, "/"},
+	}
+
+	for _, tt := range casetab {
+		appdata, got := appDataPath(tt.pathname)
+		if appdata != tt.appdata || got != tt.want {
+			t.Errorf("appDataPath(%q): Expected (%v, %q) got (%v, %q)\n", tt.pathname, tt.appdata, tt.want, appdata, got)
+		}
+	}
+}
+
+func TestAzblobPath(t *testing.T) {
+	casetab := []struct {
+		pathname string
+		azblob   bool
+		want     string
+	}{
+		{"azblob://", true, "/"},
+		{"azblob://backups", true, "backups"},
+		{"azblob://backups/2024/a.txt", true, "backups/2024/a.txt"},
+		{"azblob:backups", false, "azblob:backups"},
+		{"g:backups", false, "g:backups"},
+		{"/tmp/azblob://x", false, "/tmp/azblob://x"},
+	}
+
+	for _, tt := range casetab {
+		azblob, got := parseAzblobPath(tt.pathname)
+		if azblob != tt.azblob || got != tt.want {
+			t.Errorf("parseAzblobPath(%q): Expected (%v, %q) got (%v, %q)\n", tt.pathname, tt.azblob, tt.want, azblob, got)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	casetab := []struct {
+		pattern string
+		relpath string
+		want    bool
+	}{
+		{"*.o", "foo.o", true},
+		{"*.o", "a/b/foo.o", true},
+		{"*.o", "a/b/foo.c", false},
+		{"cache/*", "cache/foo", true},
+		{"cache/*", "a/cache/foo", true},
+		{"cache/*", "a/cache/foo/bar", false},
+		{"/cache", "cache", true},
+		{"/cache", "a/cache", false},
+		{"/a/*.o", "a/foo.o", true},
+		{"/a/*.o", "b/a/foo.o", false},
+		{"build/**/tmp", "build/tmp", true},
+		{"build/**/tmp", "build/x/y/tmp", true},
+		{"build/**/tmp", "src/build/x/tmp", true},
+		{"/build/**/tmp", "src/build/x/tmp", false},
+		{"**/foo", "a/b/foo", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "b/c", false},
+	}
+
+	for _, tt := range casetab {
+		got, err := matchPattern(tt.pattern, tt.relpath)
+		if err != nil {
+			t.Errorf("pattern=[%s], relpath=[%s]: Unexpected error: %v\n", tt.pattern, tt.relpath, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("pattern=[%s], relpath=[%s], Expected %v got %v\n", tt.pattern, tt.relpath, tt.want, got)
+		}
+	}
+}
+
+func TestIgnoreFilesExcluded(t *testing.T) {
+	ig := ignoreFiles{
+		"":         []string{"*.tmp", "out/"},
+		"proj":     []string{"/build"},
+		"proj/doc": []string{"*.pdf"},
+	}
+
+	casetab := []struct {
+		relpath string
+		isDir   bool
+		want    bool
+	}{
+		{"foo.tmp", false, true},
+		{"proj/x/foo.tmp", false, true},
+		{"proj/build", true, true},
+		{"proj/build/foo.o", false, true},
+		{"proj/src/build", false, false},
+		{"build", false, false},
+		{"proj/doc/manual.pdf", false, true},
+		{"proj/manual.pdf", false, false},
+		// Directory-only patterns.
+		{"proj/out", true, true},
+		{"proj/out/foo", false, true},
+		{"proj/out", false, false},
+	}
+
+	for _, tt := range casetab {
+		got, err := ig.excluded(tt.relpath, tt.isDir)
+		if err != nil {
+			t.Errorf("relpath=[%s]: Unexpected error: %v\n", tt.relpath, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("relpath=[%s], Expected %v got %v\n", tt.relpath, tt.want, got)
+		}
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "journal")
+	root := "src -> dst"
+	ops := []syncOp{
+		{Op: opMkdir, Src: "src/d1", Dst: "dst/d1"},
+		{Op: opCopy, Src: "src/d1/foo", Dst: "dst/d1/foo"},
+		{Op: opSetMtime, Src: "src/d1", Dst: "dst/d1"},
+	}
+
+	j, err := openJournal(fname)
+	if err != nil {
+		t.Fatalf("Unable to open journal: %v", err)
+	}
+	for _, op := range ops {
+		if err = j.recordPlan(root, op); err != nil {
+			t.Fatalf("Unable to record plan: %v", err)
+		}
+	}
+	if err = j.recordPlanned(root); err != nil {
+		t.Fatalf("Unable to record plan: %v", err)
+	}
+	if err = j.recordDone(root, ops[0]); err != nil {
+		t.Fatalf("Unable to record operation: %v", err)
+	}
+	j.file.Close()
+
+	// Reopen, as if resuming after a crash.
+	j, err = openJournal(fname)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal: %v", err)
+	}
+	got, ok := j.resume(root)
+	if !ok || len(got) != len(ops) {
+		t.Fatalf("Expected a plan with %d operations, got %v (found=%v)", len(ops), got, ok)
+	}
+	for ix, op := range ops {
+		want := ix == 0
+		if j.completed(root, op) != want {
+			t.Errorf("Operation %v: expected completed=%v", op, want)
+		}
+	}
+	if _, ok = j.resume("other -> root"); ok {
+		t.Errorf("Unexpected plan found for unknown root")
+	}
+	if err = j.remove(); err != nil {
+		t.Errorf("Unable to remove journal: %v", err)
+	}
+}
+
+func TestSyncLocal(t *testing.T) {
+	// destPath always generates relative paths.
+	chdirTemp(t)
+	srcdir := "src"
+	dstdir := "dst"
+	if err := os.Mkdir(dstdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"d1/foo":     "foo",
+		"d1/d2/bar":  "bar",
+		"d1/d3/none": "",
+		"top":        "top",
+	}
+	writeTree(t, srcdir, files)
+
+	mf, err := openManifest("manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), srcdir+"/", dstdir, lfs, lfs, nil, nil, mf); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := mf.close(); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := ioutil.ReadFile("manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		line := fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte(data)), filepath.Join(dstdir, name))
+		if !strings.Contains(string(sums), line) {
+			t.Errorf("Manifest does not contain %q", line)
+		}
+	}
+
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dstdir, name))
+		if err != nil {
+			t.Errorf("Unable to read destination file: %v", err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("%s: Expected %q got %q", name, data, string(got))
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.mirror, opt.pruneEmpty, opt.exclude = false, false, nil }()
+	opt.mirror, opt.pruneEmpty, opt.exclude = true, true, multiString{"*.o"}
+
+	writeTree(t, ".", map[string]string{
+		"src/foo":      "src/foo",
+		"src/d1/bar":   "src/d1/bar",
+		"src/empty/":   "",
+		"dst/foo":      "dst/foo",
+		"dst/extra":    "dst/extra",
+		"dst/d1/stale": "dst/d1/stale",
+		"dst/d2/d3/x":  "dst/d2/d3/x",
+		"dst/keep/x.o": "dst/keep/x.o",
+	})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes("dst/foo", old, old); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for _, name := range []string{"foo", "d1/bar"} {
+		if got, err := ioutil.ReadFile(filepath.Join("dst", name)); err != nil || string(got) != "src/"+name {
+			t.Errorf("%s: Expected the source file, got %q (err=%v)", name, got, err)
+		}
+	}
+	// Excluded files (and the directories holding them) are kept.
+	if _, err := os.Stat("dst/keep/x.o"); err != nil {
+		t.Errorf("Expected excluded file to be kept, got %v", err)
+	}
+	for _, name := range []string{"extra", "d1/stale", "d2", "empty"} {
+		if _, err := os.Stat(filepath.Join("dst", name)); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected no such file in the mirror, got %v", name, err)
+		}
+	}
+}
+
+func TestMkpath(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.mkpath, opt.dryrun = false, false }()
+	if err := os.MkdirAll("src/d1", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("src/d1/foo", []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+	dst := filepath.Join("a", "b", "c")
+
+	// Missing destinations are an error without --mkpath.
+	if err := sync(ctx, "src/", dst, lfs, lfs, nil, nil, nil); err == nil {
+		t.Fatalf("Expected an error for a missing destination")
+	}
+
+	// Nothing is created in dry-run mode, but the sync goes on.
+	opt.mkpath, opt.dryrun = true, true
+	if err := mkdirAll(ctx, lfs, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(ctx, "src/", dst, lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("dry-run sync failed: %v", err)
+	}
+	if _, err := os.Stat("a"); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be created in dry-run mode, got %v", err)
+	}
+
+	opt.dryrun = false
+	if err := mkdirAll(ctx, lfs, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := sync(ctx, "src/", dst, lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dst, "d1", "foo")); err != nil || string(got) != "foo" {
+		t.Errorf("Expected foo in the new destination, got %q (err=%v)", got, err)
+	}
+	// Existing destinations are left alone, and files are rejected.
+	if err := mkdirAll(ctx, lfs, dst); err != nil {
+		t.Errorf("Expected no error for an existing destination, got %v", err)
+	}
+	if err := mkdirAll(ctx, lfs, filepath.Join(dst, "d1", "foo")); err == nil {
+		t.Errorf("Expected an error for a file as destination")
+	}
+}
+
+func TestSyncMultipleDestinations(t *testing.T) {
+	chdirTemp(t)
+	files := map[string]string{"foo": "foo", "d1/bar": "bar", "d1/d2/baz": "baz"}
+	writeTree(t, "src", files)
+	for _, dir := range []string{"dst1", "dst2"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+
+	dsts := []syncDest{{path: "dst1", fsys: lfs}, {path: "dst2", fsys: lfs}}
+	if err := syncTo(ctx, "src/", lfs, dsts, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for _, dir := range []string{"dst1", "dst2"} {
+		for name, data := range files {
+			if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != data {
+				t.Errorf("%s/%s: Expected %q, got %q (err=%v)", dir, name, data, got, err)
+			}
+		}
+	}
+
+	// A failing destination doesn't stop the others.
+	if err := ioutil.WriteFile("src/new", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dsts = []syncDest{{path: "missing", fsys: lfs}, {path: "dst1", fsys: lfs}}
+	err := syncTo(ctx, "src/", lfs, dsts, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected an error naming the missing destination, got %v", err)
+	}
+	if got, err := ioutil.ReadFile("dst1/new"); err != nil || string(got) != "new" {
+		t.Errorf("Expected dst1/new to be copied, got %q (err=%v)", got, err)
+	}
+}
+
+func TestSyncArchive(t *testing.T) {
+	dir := t.TempDir()
+	srcdir := filepath.Join(dir, "src")
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"d1/foo":    "foo",
+		"d1/d2/bar": "bar",
+		"top":       "top",
+	}
+	writeTree(t, srcdir, files)
+	for name := range files {
+		fname := filepath.Join(srcdir, name)
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fname := filepath.Join(dir, "out.tar.gz")
+	archive, err := initArchiveVfs(archivevfs.FormatTar, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err = sync(context.Background(), srcdir+"/", "/", lfs, archive, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if _, err = os.Stat(fname); err == nil {
+		t.Errorf("Archive exists before Close")
+	}
+	if err = archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	dirs := map[string]bool{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs[hdr.Name] = true
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+		if !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: Expected mtime %v got %v", hdr.Name, mtime, hdr.ModTime)
+		}
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("Expected files %v got %v", files, got)
+	}
+	for _, d := range []string{"d1/", "d1/d2/"} {
+		if !dirs[d] {
+			t.Errorf("Directory %q missing from archive", d)
+		}
+	}
+}
+
+func TestSyncFromArchive(t *testing.T) {
+	// destPath always generates relative paths.
+	chdirTemp(t)
+	fname := "in.tar.gz"
+	dstdir := "dst"
+	if err := os.Mkdir(dstdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Files before their directories, an implicit directory and a link.
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	hdrs := []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{tar.Header{Typeflag: tar.TypeReg, Name: "d1/d2/bar", Mode: 0600}, "bar"},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "./d1/foo", Mode: 0644}, "foo"},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "d1/", Mode: 0755}, ""},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "d1/foo"}, ""},
+	}
+	for _, h := range hdrs {
+		h.hdr.Size = int64(len(h.data))
+		h.hdr.ModTime = mtime
+		if err := tw.WriteHeader(&h.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(h.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := initArchiveSourceVfs(archivevfs.FormatTar, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	// Links are only restored with --archive.
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetSymlinks(true)
+	if err = sync(context.Background(), "/", dstdir, archive, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for name, data := range map[string]string{"d1/foo": "foo", "d1/d2/bar": "bar", "link": "foo"} {
+		fullpath := filepath.Join(dstdir, name)
+		got, err := ioutil.ReadFile(fullpath)
+		if err != nil {
+			t.Errorf("Unable to read destination file: %v", err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("%s: Expected %q got %q", name, data, string(got))
+		}
+		fi, err := os.Stat(fullpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: Expected mtime %v got %v", name, mtime, fi.ModTime())
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(filepath.Join(dstdir, "d1/d2/bar")); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected mode 0600 for d1/d2/bar, got %v (%v)", fi.Mode().Perm(), err)
+		}
+		if target, err := os.Readlink(filepath.Join(dstdir, "link")); err != nil || target != "d1/foo" {
+			t.Errorf("Expected link to \"d1/foo\", got %q (%v)", target, err)
+		}
+	}
+}
+
+func TestSyncFromHTTP(t *testing.T) {
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	pages := map[string]string{
+		"/pub/": `<a href="../">Parent</a> <a href="?C=M;O=A">Sort</a>
+			<a href="a.txt">a.txt</a> <a href="/pub/sub/">sub/</a>
+			<a href="http://example.com/pub/x.txt">x.txt</a>`,
+		"/pub/sub/":      `<a href="b.txt">b.txt</a> <a href="#top">Top</a>`,
+		"/pub/a.txt":     "aaa",
+		"/pub/sub/b.txt": "bbbb",
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+		io.WriteString(w, data)
+	}))
+	defer ts.Close()
+
+	// destPath always generates relative paths.
+	chdirTemp(t)
+	dstdir := "dst"
+	if err := os.Mkdir(dstdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	hfs, err := initHTTPVfs(ts.URL + "/pub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err = sync(context.Background(), "/", dstdir, hfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for name, data := range map[string]string{"a.txt": "aaa", "sub/b.txt": "bbbb"} {
+		fullpath := filepath.Join(dstdir, name)
+		got, err := ioutil.ReadFile(fullpath)
+		if err != nil {
+			t.Errorf("Unable to read destination file: %v", err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("%s: Expected %q got %q", name, data, string(got))
+		}
+		fi, err := os.Stat(fullpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: Expected mtime %v got %v", name, mtime, fi.ModTime())
+		}
+	}
+	for _, name := range []string{"x.txt", "sub/top"} {
+		if _, err := os.Stat(filepath.Join(dstdir, name)); err == nil {
+			t.Errorf("%s: should not have been copied", name)
+		}
+	}
+}
+
+func TestReadURLManifest(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "urls.txt")
+	data := "# Datasets\n\nhttps://example.com/data/a.csv\nhttps://example.com/b.csv?v=2 csv/b.csv\n"
+	if err := ioutil.WriteFile(manifest, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readURLManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"/a.csv":     "https://example.com/data/a.csv",
+		"/csv/b.csv": "https://example.com/b.csv?v=2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+
+	data += "https://example.com/other/a.csv\n"
+	if err := ioutil.WriteFile(manifest, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readURLManifest(manifest); err == nil {
+		t.Errorf("Expected an error for duplicate names")
+	}
+}
+
+func TestSyncConflict(t *testing.T) {
+	chdirTemp(t)
+	for _, dir := range []string{"src", "dst"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(fname string, data string, mtime time.Time) {
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write("src/foo", "orig", t0)
+
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Change both sides and sync again.
+	write("src/foo", "source", t0.Add(time.Minute))
+	write("dst/foo", "dest", t0.Add(2*time.Minute))
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if got, _ := ioutil.ReadFile("dst/foo"); string(got) != "dest" {
+		t.Errorf("Destination file overwritten: got %q", string(got))
+	}
+	aside, err := filepath.Glob("dst/foo" + conflictSuffix + "*")
+	if err != nil || len(aside) != 1 {
+		t.Fatalf("Expected one conflicting copy, got %v (err=%v)", aside, err)
+	}
+	if got, _ := ioutil.ReadFile(aside[0]); string(got) != "source" {
+		t.Errorf("Conflicting copy: expected %q, got %q", "source", string(got))
+	}
+
+	// The conflict is only reported once.
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if aside, _ = filepath.Glob("dst/foo" + conflictSuffix + "*"); len(aside) != 1 {
+		t.Errorf("Expected one conflicting copy, got %v", aside)
+	}
+}
+
+func TestStateIndex(t *testing.T) {
+	t0 := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	state := &stateDB{Roots: map[string]map[string]*stateEntry{
+		"r": {
+			"a": {Size: 1, Mtime: t0},
+			"b": {Size: 1, Mtime: t0},
+			"c": {Size: 2, Mtime: t0},
+			"d": {Size: 1, Mtime: t0.Add(time.Nanosecond)},
+		},
+		"other": {"e": {Size: 1, Mtime: t0}},
+	}}
+	key := func(size int64, mtime time.Time) string {
+		return sizeMtimeKey(vfs.FileInfo{Size: size, Mtime: mtime})
+	}
+
+	for _, tt := range []struct {
+		seen map[string]bool
+		want map[string][]string
+	}{
+		{nil, map[string][]string{key(1, t0): {"a", "b"}, key(2, t0): {"c"}, key(1, t0.Add(time.Nanosecond)): {"d"}}},
+		{map[string]bool{"a": true, "c": true}, map[string][]string{key(1, t0): {"b"}, key(1, t0.Add(time.Nanosecond)): {"d"}}},
+	} {
+		got := state.index("r", tt.seen)
+		for _, rels := range got {
+			sort.Strings(rels)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("seen=%v: Expected %v, got %v", tt.seen, tt.want, got)
+		}
+	}
+	if got := (*stateDB)(nil).index("r", nil); len(got) != 0 {
+		t.Errorf("Expected an empty index, got %v", got)
+	}
+}
+
+func TestDetectMoves(t *testing.T) {
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	sum := func(data string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	}
+
+	// The new source file "new" holds "data", modified at t0. Recorded
+	// entries have its size and mtime unless given.
+	for _, tt := range []struct {
+		name     string
+		entries  map[string]*stateEntry
+		dst      map[string]string
+		seen     []string
+		checksum bool
+		want     string
+	}{
+		{
+			name:    "Same size and mtime",
+			entries: map[string]*stateEntry{"old": {}},
+			dst:     map[string]string{"old": "data"},
+			want:    "dst/old",
+		},
+		{
+			name:    "Different size",
+			entries: map[string]*stateEntry{"old": {Size: 5}},
+			dst:     map[string]string{"old": "data"},
+		},
+		{
+			name:    "Different mtime",
+			entries: map[string]*stateEntry{"old": {Mtime: t0.Add(time.Second)}},
+			dst:     map[string]string{"old": "data"},
+		},
+		{
+			name:    "Still in source",
+			entries: map[string]*stateEntry{"old": {}},
+			dst:     map[string]string{"old": "data"},
+			seen:    []string{"old"},
+		},
+		{
+			name:    "Gone from destination",
+			entries: map[string]*stateEntry{"old": {}},
+		},
+		{
+			name:     "Checksums match",
+			entries:  map[string]*stateEntry{"old": {MD5: sum("data")}},
+			dst:      map[string]string{"old": "data"},
+			checksum: true,
+			want:     "dst/old",
+		},
+		{
+			name:     "Source checksum differs",
+			entries:  map[string]*stateEntry{"old": {MD5: sum("diff")}},
+			dst:      map[string]string{"old": "diff"},
+			checksum: true,
+		},
+		{
+			name:     "Destination checksum differs",
+			entries:  map[string]*stateEntry{"old": {MD5: sum("data")}},
+			dst:      map[string]string{"old": "diff"},
+			checksum: true,
+		},
+		{
+			name:    "Several candidates",
+			entries: map[string]*stateEntry{"old1": {}, "old2": {}},
+			dst:     map[string]string{"old1": "data", "old2": "data"},
+		},
+		{
+			name:    "One candidate left in destination",
+			entries: map[string]*stateEntry{"old1": {}, "old2": {}},
+			dst:     map[string]string{"old2": "data"},
+			want:    "dst/old2",
+		},
+		{
+			name:     "One candidate with the same checksum",
+			entries:  map[string]*stateEntry{"old1": {MD5: sum("data")}, "old2": {MD5: sum("diff")}},
+			dst:      map[string]string{"old1": "data", "old2": "diff"},
+			checksum: true,
+			want:     "dst/old1",
+		},
+	} {
+		chdirTemp(t)
+		for _, dir := range []string{"src", "dst"} {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := ioutil.WriteFile("src/new", []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes("src/new", t0, t0); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range tt.dst {
+			if err := ioutil.WriteFile(filepath.Join("dst", name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		state := &stateDB{Roots: map[string]map[string]*stateEntry{"r": {}}}
+		for rel, entry := range tt.entries {
+			if entry.Size == 0 {
+				entry.Size = 4
+			}
+			if entry.Mtime.IsZero() {
+				entry.Mtime = t0
+			}
+			state.Roots["r"][rel] = entry
+		}
+		seen := map[string]bool{"new": true}
+		for _, rel := range tt.seen {
+			seen[rel] = true
+		}
+
+		lfs := localvfs.NewLocalFileSystem()
+		lfs.SetChecksum(tt.checksum)
+		ops := []syncOp{{Op: opCopy, Src: "src/new", Dst: "dst/new", Rel: "new"}}
+		ops, err := detectMoves(context.Background(), "r", "dst", lfs, lfs, ops, seen, state)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		wantOp := opCopy
+		if tt.want != "" {
+			wantOp = opMove
+		}
+		if len(ops) != 1 || ops[0].Op != wantOp || ops[0].From != tt.want {
+			t.Errorf("%s: Expected %s from %q, got %+v", tt.name, wantOp, tt.want, ops)
+			continue
+		}
+		// Files moved are no longer candidates.
+		if moved := strings.TrimPrefix(tt.want, "dst/"); moved != "" && state.lookup("r", moved) != nil {
+			t.Errorf("%s: Expected %s to be forgotten", tt.name, moved)
+		}
+	}
+}
+
+func TestLocalMove(t *testing.T) {
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"a/x.txt": "xxx", "b/": ""})
+	orig, err := os.Stat("a/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+
+	// Renames and moves keep the same file.
+	for _, mv := range [][2]string{{"a/x.txt", "a/y.txt"}, {"a/y.txt", "b/z.txt"}} {
+		if err = lfs.Move(ctx, mv[0], mv[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(mv[0]); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected it to be gone after the move, got %v", mv[0], err)
+		}
+		if fi, err := os.Stat(mv[1]); err != nil || !os.SameFile(fi, orig) {
+			t.Errorf("%s: Expected the moved file, got %v (err=%v)", mv[1], fi, err)
+		}
+	}
+	if err = lfs.Move(ctx, "b/z.txt", "c/z.txt"); err == nil {
+		t.Errorf("Expected an error moving into a missing directory")
+	}
+
+	// Files renamed or moved in the source are moved in the destination.
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTree(t, ".", map[string]string{"src/a.txt": "aaa", "src/d1/b.txt": "bbbb", "dst/": ""})
+	for _, name := range []string{"src/a.txt", "src/d1/b.txt"} {
+		if err = os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(ctx, "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	synced := map[string]os.FileInfo{}
+	for _, name := range []string{"a.txt", "d1/b.txt"} {
+		if synced[name], err = os.Stat(filepath.Join("dst", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, mv := range [][2]string{{"src/a.txt", "src/renamed.txt"}, {"src/d1/b.txt", "src/d2/b.txt"}} {
+		if err = os.MkdirAll(filepath.Dir(mv[1]), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(mv[0], mv[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sync(ctx, "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	for old, name := range map[string]string{"a.txt": "renamed.txt", "d1/b.txt": "d2/b.txt"} {
+		if fi, err := os.Stat(filepath.Join("dst", name)); err != nil || !os.SameFile(fi, synced[old]) {
+			t.Errorf("%s: Expected dst/%s to be moved, got %v (err=%v)", name, old, fi, err)
+		}
+		if _, err := os.Stat(filepath.Join("dst", old)); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected it to be gone after the move, got %v", old, err)
+		}
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	defer func(policy string) { opt.conflict = policy }(opt.conflict)
+
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	lfs := localvfs.NewLocalFileSystem()
+
+	// The destination is newer and smaller than the source.
+	cases := []struct {
+		policy string
+		want   string
+		aside  bool
+	}{
+		{conflictNewer, "dest", false},
+		{conflictLarger, "source", false},
+		{conflictSource, "source", false},
+		{conflictDest, "dest", false},
+		{conflictSkip, "dest", false},
+		{conflictRename, "dest", true},
+	}
+	// Write data to name, modified at mtime.
+	write := func(name string, data string, mtime time.Time) {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range cases {
+		chdirTemp(t)
+		for _, d := range []string{"src", "dst"} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write("src/foo", "orig", t0)
+
+		state, err := openStateDB("state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt.conflict = tt.policy
+		if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+			t.Fatalf("%s: sync failed: %v", tt.policy, err)
+		}
+		write("src/foo", "source", t0.Add(time.Minute))
+		write("dst/foo", "dest", t0.Add(2*time.Minute))
+		if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+			t.Fatalf("%s: sync failed: %v", tt.policy, err)
+		}
+
+		got, err := ioutil.ReadFile("dst/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: expected destination %q, got %q", tt.policy, tt.want, string(got))
+		}
+		aside, err := filepath.Glob("dst/foo" + conflictSuffix + "*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(aside) > 0) != tt.aside {
+			t.Errorf("%s: unexpected conflicting copies: %v", tt.policy, aside)
+		}
+	}
+	if checkConflictPolicy("bogus") == nil {
+		t.Errorf("Expected an error for an invalid conflict policy")
+	}
+}
+
+func TestConflictPrompt(t *testing.T) {
+	lfs := localvfs.NewLocalFileSystem()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	src := vfs.FileInfo{Path: "src/foo", Size: 10, Mtime: mtime, Type: vfs.TypeRegular}
+	dst := vfs.FileInfo{Path: "dst/foo", Size: 20, Mtime: mtime, Type: vfs.TypeRegular}
+
+	// Capital letters apply to the rest of the conflicts.
+	var out bytes.Buffer
+	c := newConflictPrompter(strings.NewReader("x\nd\nR\n"), &out)
+	for _, want := range []string{conflictDest, conflictRename, conflictRename} {
+		if got := c.ask(context.Background(), "foo", lfs, src, lfs, dst); got != want {
+			t.Errorf("Expected policy %q, got %q", want, got)
+		}
+	}
+	for _, s := range []string{"\"foo\"", "10 bytes, modified 2020-01-02 03:04:05", "20 bytes", "Invalid answer \"x\""} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in the prompt, got %q", s, out.String())
+		}
+	}
+
+	// Conflicts are skipped without answers.
+	c = newConflictPrompter(strings.NewReader(""), ioutil.Discard)
+	if got := c.ask(context.Background(), "foo", lfs, src, lfs, dst); got != conflictSkip {
+		t.Errorf("Expected policy %q without input, got %q", conflictSkip, got)
+	}
+}
+
+func TestLinkDest(t *testing.T) {
+	defer func() { opt.linkDest = "" }()
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"src/same": "same", "src/changed": "changed", "snap1/": "", "snap2/": ""})
+
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "snap1", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes("src/changed", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	opt.linkDest = "snap1"
+	if err := sync(context.Background(), "src/", "snap2", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for name, linked := range map[string]bool{"same": true, "changed": false} {
+		fi1, err := os.Stat(filepath.Join("snap1", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi2, err := os.Stat(filepath.Join("snap2", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(fi1, fi2) != linked {
+			t.Errorf("%s: expected linked=%v", name, linked)
+		}
+	}
+}
+
+// badMD5Vfs is a local VFS reporting the wrong MD5 checksum for all files.
+type badMD5Vfs struct {
+	*localvfs.LocalFileSystem
+}
+
+func (badMD5Vfs) MD5(context.Context, string) (string, error) {
+	return "d41d8cd98f00b204e9800998ecf8427e", nil
+}
+
+func TestCopyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	op := syncOp{Op: opCopy, Src: src, Dst: dst}
+	_, err := runOp(context.Background(), op, badMD5Vfs{lfs}, lfs, nil)
+	if _, ok := err.(*checksumError); !ok {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+	if got, _ := ioutil.ReadFile(dst); string(got) != "old" {
+		t.Errorf("Destination replaced by corrupted copy: got %q", string(got))
+	}
+
+	// Data matching the checksum is copied normally.
+	r, err := verifyingReader(context.Background(), strings.NewReader(""), badMD5Vfs{lfs}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(r); err != nil {
+		t.Errorf("Unexpected error reading verified data: %v", err)
+	}
+}
+
+func TestNeedToCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	lfs := localvfs.NewLocalFileSystem()
+	defer func() { opt.ignoreSize = false }()
+
+	mtime := time.Now().Truncate(time.Second)
+	for _, f := range []struct {
+		name  string
+		data  string
+		mtime time.Time
+	}{{src, "source", mtime}, {dst, "trunc", mtime.Add(time.Minute)}} {
+		if err := ioutil.WriteFile(f.name, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.name, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcfi, err := lfs.Stat(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Up to date files are copied anyway with --ignore-times.
+	opt.ignoreTimes = true
+	got, err := needToCopy(context.Background(), lfs, lfs, srcfi, src, true)
+	opt.ignoreTimes = false
+	if err != nil || !got {
+		t.Errorf("ignoreTimes: expected needToCopy=true, got %v (err=%v)", got, err)
+	}
+
+	// Newer destination, but with a different size.
+	for _, ignore := range []bool{false, true} {
+		opt.ignoreSize = ignore
+		got, err := needToCopy(context.Background(), lfs, lfs, srcfi, dst, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != !ignore {
+			t.Errorf("ignoreSize=%v: expected needToCopy=%v, got %v", ignore, !ignore, got)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	fname := filepath.Join(dir, "sums.json")
+	defer func() { opt.checksum = false }()
+
+	mtime := time.Now().Truncate(time.Second)
+	for _, f := range []struct {
+		name  string
+		mtime time.Time
+	}{{src, mtime}, {dst, mtime.Add(-time.Minute)}} {
+		if err := ioutil.WriteFile(f.name, []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.name, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sums, err := openChecksumDB(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+	lfs.SetHashCache(sums)
+	srcfi, err := lfs.Stat(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A newer source with the same contents is only copied without --checksum.
+	for _, checksum := range []bool{false, true} {
+		opt.checksum = checksum
+		got, err := needToCopy(ctx, lfs, lfs, srcfi, dst, true)
+		if err != nil || got == checksum {
+			t.Errorf("checksum=%v: expected needToCopy=%v, got %v (err=%v)", checksum, !checksum, got, err)
+		}
+	}
+	if err = ioutil.WriteFile(dst, []byte("diff"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := needToCopy(ctx, lfs, lfs, srcfi, dst, true); err != nil || !got {
+		t.Errorf("Expected needToCopy=true for different contents, got %v (err=%v)", got, err)
+	}
+
+	// Checksums are reused from the database while files are unchanged.
+	if err = sums.save(); err != nil {
+		t.Fatal(err)
+	}
+	if sums, err = openChecksumDB(fname); err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs(src)
+	entry, ok := sums.Files[abs]
+	if !ok || entry.MD5 != "51037a4a37730f52c8732586d3aaa316" {
+		t.Fatalf("Expected checksum of %q in the database, got %+v", abs, entry)
+	}
+	entry.MD5 = "cached"
+	lfs.SetHashCache(sums)
+	if got, err := lfs.MD5(ctx, src); err != nil || got != "cached" {
+		t.Errorf("Expected cached checksum, got %q (err=%v)", got, err)
+	}
+	if err = os.Chtimes(src, mtime, mtime.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lfs.MD5(ctx, src); err != nil || got != "51037a4a37730f52c8732586d3aaa316" {
+		t.Errorf("Expected new checksum after change, got %q (err=%v)", got, err)
+	}
+}
+
+func TestHashAhead(t *testing.T) {
+	// destPath always generates relative paths.
+	chdirTemp(t)
+	defer func() { opt.checksum, opt.hashers = false, defaultOptHashers }()
+
+	// Files with the same size on both sides are hashed, others are not.
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("f%02d", i))
+	}
+	for _, name := range names {
+		dstdata := "same"
+		if name == "f07" {
+			dstdata = "longer"
+		}
+		for dir, data := range map[string]string{"src": "same", "dst": dstdata} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sums, err := openChecksumDB("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+	lfs.SetHashCache(sums)
+	ctx := context.Background()
+	done := make(chan struct{})
+	defer close(done)
+
+	list := func() <-chan vfs.FileInfo {
+		c := make(chan vfs.FileInfo, len(names))
+		for _, name := range names {
+			fi, err := lfs.Stat(ctx, filepath.Join("src", name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c <- fi
+		}
+		close(c)
+		return c
+	}
+
+	// Nothing to do without --checksum.
+	opt.hashers = 3
+	if paths := list(); hashAhead(ctx, "src/", "dst", lfs, lfs, paths, done) != paths {
+		t.Errorf("Expected the listing to be returned unchanged without --checksum")
+	}
+
+	// Files come out in the order they were listed.
+	opt.checksum = true
+	var got []string
+	for fi := range hashAhead(ctx, "src/", "dst", lfs, lfs, list(), done) {
+		got = append(got, filepath.Base(fi.Path))
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("Expected files in order %v, got %v", names, got)
+	}
+	for _, name := range names {
+		for _, dir := range []string{"src", "dst"} {
+			abs, _ := filepath.Abs(filepath.Join(dir, name))
+			_, ok := sums.Files[abs]
+			if want := name != "f07"; ok != want {
+				t.Errorf("%s: expected hashed=%v, got %v", abs, want, ok)
+			}
+		}
+	}
+}
+
+// capsVfs is a local VFS reporting the given capabilities. SetMtime fails
+// unless supported.
+type capsVfs struct {
+	*localvfs.LocalFileSystem
+	caps vfs.Capabilities
+}
+
+func (c capsVfs) Capabilities() vfs.Capabilities {
+	return c.caps
+}
+
+func (c capsVfs) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	if !c.caps.SetMtime {
+		return fmt.Errorf("SetMtime not supported")
+	}
+	return c.LocalFileSystem.SetMtime(ctx, fullpath, mtime)
+}
+
+// stallingVfs is a local VFS whose first writes hang until canceled.
+type stallingVfs struct {
+	*localvfs.LocalFileSystem
+	stalls int
+}
+
+func (s *stallingVfs) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	if s.stalls > 0 {
+		s.stalls--
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.LocalFileSystem.WriteToFile(ctx, fullpath, reader)
+}
+
+func TestStallTimeout(t *testing.T) {
+	defer func(d time.Duration) { opt.stallTimeout = d }(opt.stallTimeout)
+	opt.stallTimeout = 50 * time.Millisecond
+	stalledTransfers = 0
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+
+	// Stalled transfers are retried.
+	op := syncOp{Op: opCopy, Src: src, Dst: dst}
+	if _, err := runOp(context.Background(), op, lfs, &stallingVfs{lfs, 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(dst); err != nil || string(data) != "data" || stalledTransfers != 1 {
+		t.Errorf("Expected a copy after 1 stall, got %q (err=%v) after %d stalls", data, err, stalledTransfers)
+	}
+
+	// A limited number of times.
+	os.Remove(dst)
+	_, err := runOp(context.Background(), op, lfs, &stallingVfs{lfs, maxCopyAttempts}, nil)
+	var serr *stallError
+	if !errors.As(err, &serr) {
+		t.Errorf("Expected a stall error, got %v", err)
+	}
+
+	// Transfers ignoring cancellation are abandoned and not retried.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	err = watchStall(context.Background(), dst, pr, func(_ context.Context, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if !errors.As(err, &serr) || serr.retry {
+		t.Errorf("Expected a stall error without retry, got %v", err)
+	}
+
+	// Data sent by the backend (like a large upload chunk) counts as
+	// progress, even if nothing is read meanwhile.
+	err = watchStall(context.Background(), dst, strings.NewReader("data"), func(ctx context.Context, r io.Reader) error {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		for ix := 0; ix < 5; ix++ {
+			time.Sleep(opt.stallTimeout / 2)
+			vfs.Progress(ctx, 1)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Errorf("Expected sends to count as progress, got %v", err)
+	}
+}
+
+// failingVfs is a local VFS failing writes to files with the given names, the
+// given number of times (-1 for always).
+type failingVfs struct {
+	*localvfs.LocalFileSystem
+	mu    gosync.Mutex
+	fails map[string]int
+}
+
+func (f *failingVfs) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	f.mu.Lock()
+	n := f.fails[filepath.Base(fullpath)]
+	if n != 0 {
+		f.fails[filepath.Base(fullpath)] = n - 1
+	}
+	f.mu.Unlock()
+	if n != 0 {
+		return fmt.Errorf("Write to \"%s\" failed", fullpath)
+	}
+	return f.LocalFileSystem.WriteToFile(ctx, fullpath, reader)
+}
+
+func TestFileRetries(t *testing.T) {
+	defer func(n int, d time.Duration) { opt.fileRetries, fileRetryDelay = n, d }(opt.fileRetries, fileRetryDelay)
+	defer func() { failedFiles = nil }()
+	fileRetryDelay = 0
+
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"src/a": "src/a", "src/b": "src/b", "src/c": "src/c", "dst/": ""})
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+
+	// Without retries, the first failure stops the sync.
+	opt.fileRetries = 0
+	fsys := &failingVfs{LocalFileSystem: lfs, fails: map[string]int{"a": 1}}
+	if err := sync(ctx, "src/", "dst", lfs, fsys, nil, nil, nil); err == nil {
+		t.Errorf("Expected the sync to fail")
+	}
+
+	// With retries, transient failures are retried and permanent ones
+	// skipped.
+	failedFiles = nil
+	opt.fileRetries = 2
+	fsys = &failingVfs{LocalFileSystem: lfs, fails: map[string]int{"a": 1, "b": -1}}
+	if err := sync(ctx, "src/", "dst", lfs, fsys, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"dst/a": true, "dst/b": false, "dst/c": true} {
+		if _, err := os.Stat(name); (err == nil) != want {
+			t.Errorf("%s: Expected copied=%v, got err=%v", name, want, err)
+		}
+	}
+	if len(failedFiles) != 1 || failedFiles[0].path != "src/b" {
+		t.Errorf("Expected only src/b to fail, got %v", failedFiles)
+	}
+}
+
+func TestRemoveSource(t *testing.T) {
+	defer func(l *slog.Logger) { log = l }(log)
+	defer func(n int, d time.Duration) { opt.fileRetries, fileRetryDelay = n, d }(opt.fileRetries, fileRetryDelay)
+	defer func() { opt.removeSource, opt.dryrun, failedFiles = false, false, nil }()
+	opt.removeSource = true
+	fileRetryDelay = 0
+
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"src/a": "src/a", "src/b": "src/b", "src/c": "src/c", "dst/": ""})
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+	ctx := context.Background()
+
+	// Nothing is removed in dry-run mode, but removals are logged.
+	var buf bytes.Buffer
+	log = slog.New(slog.NewTextHandler(&buf, nil))
+	opt.dryrun = true
+	if err := sync(ctx, "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "msg=\"remove source\""); n != 3 {
+		t.Errorf("Expected 3 sources to be removed, got %d:\n%s", n, buf.String())
+	}
+	log = vfs.DiscardLogger()
+	opt.dryrun = false
+
+	// Sources failing to copy, or skipped, are kept.
+	opt.fileRetries = 1
+	src := &unreadableVfs{LocalFileSystem: lfs, path: "src/b"}
+	dst := &failingVfs{LocalFileSystem: lfs, fails: map[string]int{"c": -1}}
+	if err := sync(ctx, "src/", "dst", src, dst, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"src/a": false, "src/b": true, "src/c": true, "dst/a": true, "dst/b": false, "dst/c": false} {
+		if _, err := os.Stat(name); (err == nil) != want {
+			t.Errorf("%s: Expected exists=%v, got err=%v", name, want, err)
+		}
+	}
+
+	// Copies of the same size, but different contents, are not verified.
+	if err := ioutil.WriteFile("dst/b", []byte("dst/x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	op := syncOp{Op: opDelete, Src: "src/b", Dst: "dst/b"}
+	if _, err := runOp(ctx, op, lfs, lfs, nil); err == nil || !strings.Contains(err.Error(), "checksums differ") {
+		t.Errorf("Expected a checksum verification error, got %v", err)
+	}
+	if _, err := os.Stat("src/b"); err != nil {
+		t.Errorf("Expected src/b to be kept, got %v", err)
+	}
+}
+
+func TestNoEmptyDirs(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.noEmptyDirs, opt.exclude = false, nil }()
+	opt.noEmptyDirs, opt.exclude = true, multiString{"*.o"}
+
+	writeTree(t, ".", map[string]string{"src/a/b/file": "src/a/b/file", "src/excl/x.o": "src/excl/x.o", "src/empty/": "", "dst/": ""})
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"dst/a/b/file": true, "dst/excl": false, "dst/empty": false} {
+		if _, err := os.Stat(name); (err == nil) != want {
+			t.Errorf("%s: Expected exists=%v, got err=%v", name, want, err)
+		}
+	}
+}
+
+func TestRetryFrom(t *testing.T) {
+	defer func() { failedFiles, retryPaths = nil, nil }()
+	chdirTemp(t)
+	files := map[string]string{"dst/": ""}
+	for _, name := range []string{"src/a", "src/d1/b", "src/d1/c", "src/d2/e/f", "src/d2/g"} {
+		files[name] = name
+	}
+	writeTree(t, ".", files)
+
+	// Failed files are written relative to the destination root.
+	failedFiles = []failedFile{{rel: "d1/b"}, {rel: "/d2/e/"}, {rel: "d1/b"}}
+	if err := writeFailedList("failed"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile("failed"); err != nil || string(data) != "d1/b\n/d2/e/\n" {
+		t.Errorf("Unexpected list of failed files %q (err=%v)", data, err)
+	}
+
+	// And only those (and everything below them) are synced.
+	var err error
+	if retryPaths, err = loadRetryList("failed"); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"dst/a": false, "dst/d1/b": true, "dst/d1/c": false, "dst/d2/e/f": true, "dst/d2/g": false} {
+		if _, err := os.Stat(name); (err == nil) != want {
+			t.Errorf("%s: Expected copied=%v, got err=%v", name, want, err)
+		}
+	}
+}
+
+func TestOrderListing(t *testing.T) {
+	defer func() { order = listOrder{} }()
+	if _, err := parseOrder("bogus"); err == nil {
+		t.Errorf("Expected an error for an invalid field")
+	}
+	if _, err := parseOrder("mtime,down"); err == nil {
+		t.Errorf("Expected an error for an invalid direction")
+	}
+
+	now := time.Now()
+	listing := []vfs.FileInfo{
+		{Path: "d", Type: vfs.TypeDir},
+		{Path: "d/old", Type: vfs.TypeRegular, Size: 3, Mtime: now.Add(-time.Hour)},
+		{Path: "d/e", Type: vfs.TypeDir},
+		{Path: "d/e/new", Type: vfs.TypeRegular, Size: 1, Mtime: now},
+		{Path: "d/mid", Type: vfs.TypeRegular, Size: 2, Mtime: now.Add(-time.Minute)},
+	}
+	casetab := []struct {
+		spec string
+		want []string
+	}{
+		{"", []string{"d", "d/old", "d/e", "d/e/new", "d/mid"}},
+		{"mtime,desc", []string{"d", "d/e", "d/e/new", "d/mid", "d/old"}},
+		{"size", []string{"d", "d/e", "d/e/new", "d/mid", "d/old"}},
+		{"name,desc", []string{"d", "d/e", "d/old", "d/mid", "d/e/new"}},
+	}
+	for _, tt := range casetab {
+		var err error
+		if order, err = parseOrder(tt.spec); err != nil {
+			t.Fatal(err)
+		}
+		paths := make(chan vfs.FileInfo, len(listing))
+		for _, fi := range listing {
+			paths <- fi
+		}
+		close(paths)
+		var got []string
+		for fi := range orderListing(paths, nil) {
+			got = append(got, fi.Path)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Expected %v, got %v", tt.spec, tt.want, got)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := ioutil.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	nomtime := capsVfs{lfs, vfs.Capabilities{ServerSideMove: true}}
+
+	// Mtimes are not set in destinations that don't support them.
+	op := syncOp{Op: opCopy, Src: src, Dst: dst}
+	if _, err := runOp(ctx, op, lfs, nomtime, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// And are not used to compare files, only sizes (no checksums here).
+	srcfi, err := lfs.Stat(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := needToCopy(ctx, lfs, nomtime, srcfi, dst, true)
+	if err != nil || got {
+		t.Errorf("Expected needToCopy=false for equal sizes, got %v (err=%v)", got, err)
+	}
+	if err = ioutil.WriteFile(dst, []byte("old data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err = needToCopy(ctx, lfs, nomtime, srcfi, dst, true)
+	if err != nil || !got {
+		t.Errorf("Expected needToCopy=true for different sizes, got %v (err=%v)", got, err)
+	}
+
+	// Failed writes to destinations without atomic renames leave nothing behind.
+	inplace := localvfs.NewLocalFileSystem()
+	inplace.SetWriteInPlace(true)
+	if vfs.CapabilitiesOf(inplace).AtomicRename {
+		t.Fatalf("Expected no atomic renames when writing in place")
+	}
+	if _, err = runOp(ctx, op, badMD5Vfs{lfs}, inplace, nil); err == nil {
+		t.Fatalf("Expected a checksum error")
+	}
+	if _, err = os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("Expected partial destination file to be removed, got %v", err)
+	}
+}
+
+// noMtimeVfs is a local VFS failing to set modification times.
+type noMtimeVfs struct {
+	*localvfs.LocalFileSystem
+}
+
+func (noMtimeVfs) SetMtime(context.Context, string, time.Time) error {
+	return fmt.Errorf("operation not permitted")
+}
+
+func TestMtimeFailure(t *testing.T) {
+	chdirTemp(t)
+	files := map[string]string{"dst/": ""}
+	for ix := 0; ix < mtimeFailureLimit; ix++ {
+		files[fmt.Sprintf("src/foo%d", ix)] = "foo"
+	}
+	writeTree(t, ".", files)
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Repeated failures to set mtimes don't abort the sync, and are
+	// remembered.
+	lfs := localvfs.NewLocalFileSystem()
+	dstvfs := noMtimeVfs{lfs}
+	if err = sync(context.Background(), "src/", "dst", lfs, dstvfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if _, err = os.Stat("dst/foo0"); err != nil {
+		t.Errorf("File not copied: %v", err)
+	}
+	if state, err = openStateDB("state"); err != nil {
+		t.Fatal(err)
+	}
+	if !state.mtimeUnreliable("src/ -> dst") {
+		t.Fatalf("Expected mtime failure to be recorded in the state database")
+	}
+
+	// A newer source with the same size is not copied, since destination
+	// mtimes are not trusted anymore.
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes("src/foo0", future, future); err != nil {
+		t.Fatal(err)
+	}
+	srcfi, err := lfs.Stat(context.Background(), "src/foo0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := needToCopy(context.Background(), lfs, dstvfs, srcfi, "dst/foo0", false)
+	if err != nil || got {
+		t.Errorf("Expected needToCopy=false, got %v (err=%v)", got, err)
+	}
+
+	// Setting an mtime successfully clears the failures.
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if state.mtimeUnreliable("src/ -> dst") {
+		t.Errorf("Expected mtime failures to be cleared by a successful sync")
+	}
+}
+
+func TestMtimeFailureCount(t *testing.T) {
+	state := &stateDB{}
+	root := "src/ -> dst"
+
+	// Isolated failures don't make mtimes unreliable.
+	for ix := 1; ix < mtimeFailureLimit; ix++ {
+		state.recordMtimeFailure(root)
+	}
+	state.recordMtimeSuccess(root)
+	for ix := 1; ix < mtimeFailureLimit; ix++ {
+		state.recordMtimeFailure(root)
+	}
+	if state.mtimeUnreliable(root) {
+		t.Fatalf("Expected mtimes to be reliable after %d failures", mtimeFailureLimit-1)
+	}
+	state.recordMtimeFailure(root)
+	if !state.mtimeUnreliable(root) {
+		t.Fatalf("Expected mtimes to be unreliable after %d failures", mtimeFailureLimit)
+	}
+
+	// Failures can also be forgotten by hand.
+	state.resetMtimeFailures()
+	if state.mtimeUnreliable(root) {
+		t.Errorf("Expected mtime failures to be forgotten")
+	}
+}
+
+// badDirVfs is a local VFS failing to read the contents of directories named
+// "bad".
+type badDirVfs struct {
+	*localvfs.LocalFileSystem
+}
+
+func (b badDirVfs) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	return b.LocalFileSystem.Walk(ctx, fullpath, func(fi vfs.FileInfo, err error) error {
+		if dir := filepath.Dir(fi.Path); err == nil && filepath.Base(dir) == "bad" {
+			return walkFn(vfs.FileInfo{Path: dir}, fmt.Errorf("permission denied"))
+		}
+		return walkFn(fi, err)
+	})
+}
+
+func TestWalkErrors(t *testing.T) {
+	defer func() {
+		opt.ignoreWalkErrors = false
+		walkErrors = 0
+	}()
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"src/bad/foo": "data", "src/good": "data", "dst/": ""})
+	srcvfs := badDirVfs{localvfs.NewLocalFileSystem()}
+	dstvfs := localvfs.NewLocalFileSystem()
+
+	// Unreadable paths make the sync fail by default...
+	err := sync(context.Background(), "src/", "dst", srcvfs, dstvfs, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Expected a walk error, got %v", err)
+	}
+
+	// ...or are skipped with --ignore-walk-errors.
+	opt.ignoreWalkErrors = true
+	walkErrors = 0
+	if err = sync(context.Background(), "src/", "dst", srcvfs, dstvfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if walkErrors != 1 {
+		t.Errorf("Expected 1 walk error, got %d", walkErrors)
+	}
+	if _, err = os.Stat("dst/good"); err != nil {
+		t.Errorf("Readable file not copied: %v", err)
+	}
+
+	// Mirrors don't remove anything when the source was not read
+	// completely, as the unreadable files would look extraneous.
+	opt.mirror = true
+	defer func() { opt.mirror = false }()
+	for _, f := range []string{"dst/bad/foo", "dst/extra"} {
+		if err = ioutil.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sync(context.Background(), "src/", "dst", srcvfs, dstvfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for _, f := range []string{"dst/bad/foo", "dst/extra"} {
+		if _, err = os.Stat(f); err != nil {
+			t.Errorf("Destination file removed despite walk errors: %v", err)
+		}
+	}
+
+	// Errors listing other sources don't matter.
+	if err = sync(context.Background(), "src/", "dst", dstvfs, dstvfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if _, err = os.Stat("dst/extra"); !os.IsNotExist(err) {
+		t.Errorf("Expected extraneous file to be removed, got %v", err)
+	}
+}
+
+// statCountVfs is a local VFS counting calls to Stat on regular files.
+type statCountVfs struct {
+	*localvfs.LocalFileSystem
+	n *int
+}
+
+func (s statCountVfs) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	fi, err := s.LocalFileSystem.Stat(ctx, fullpath)
+	if fi.IsRegular() {
+		*s.n++
+	}
+	return fi, err
+}
+
+func TestNoSourceStats(t *testing.T) {
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"src/a": "data", "src/b": "data", "src/dir/c": "data", "dst/": ""})
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Files in an up to date source are never examined with Stat, since
+	// everything needed comes from the walk.
+	n := 0
+	srcvfs := statCountVfs{lfs, &n}
+	if err := sync(context.Background(), "src/", "dst", srcvfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if n > 0 {
+		t.Errorf("Expected no Stat calls on source files, got %d", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	chdirTemp(t)
+	os.Mkdir("src", 0755)
+	os.Mkdir("dst", 0755)
+	if err := ioutil.WriteFile("src/foo", []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	if events, err = openEvents("events"); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil)
+	events.close()
+	events = nil
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	data, err := ioutil.ReadFile("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	var last event
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if err = json.Unmarshal([]byte(line), &last); err != nil {
+			t.Fatalf("Invalid event %q: %v", line, err)
+		}
+		got = append(got, last.Event)
+	}
+	want := []string{evScanStart, evFileQueued, evEstimate, evTransferStart, evTransferDone, evSummary}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+	if last.Files != 1 || last.Bytes != 3 {
+		t.Errorf("Expected 1 file and 3 bytes in summary, got %+v", last)
+	}
+}
+
+func TestSkipReport(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "skipped")
+	var err error
+	if skipped, err = openSkipReport(fname); err != nil {
+		t.Fatal(err)
+	}
+	if events, err = openEvents(filepath.Join(dir, "events")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		skipped, events = nil, nil
+		atomic.StoreInt64(&unexportableFiles, 0)
+	}()
+
+	unexportableSkipped("a/Survey", "application/vnd.google-apps.form")
+	unexportableSkipped("b/App", "application/vnd.google-apps.drive-sdk.12345")
+	if err = skipped.close(); err != nil {
+		t.Fatal(err)
+	}
+	events.close()
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a/Survey\tform\tapplication/vnd.google-apps.form\n" +
+		"b/App\tthird-party shortcut\tapplication/vnd.google-apps.drive-sdk.12345\n"
+	if string(data) != want {
+		t.Errorf("Expected report %q, got %q", want, data)
+	}
+	if n := atomic.LoadInt64(&unexportableFiles); n != 2 {
+		t.Errorf("Expected 2 skipped files, got %d", n)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "events"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev event
+	if err = json.Unmarshal(data, &ev); err != nil || ev.Event != evSummary || ev.Skipped != 2 {
+		t.Errorf("Expected a summary with 2 skipped files, got %s (err=%v)", data, err)
+	}
+
+	// Documents can be exported.
+	if kind := gdrivevfs.UnexportableKind("application/vnd.google-apps.document"); kind != "" {
+		t.Errorf("Expected documents to be exportable, got %q", kind)
+	}
+}
+
+func TestLoadExportFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "formats.json")
+	j := `{"document": "odt", "drawing": {"mimeType": "image/png", "extension": ".png"}}`
+	if err = ioutil.WriteFile(fname, []byte(j), 0600); err != nil {
+		t.Fatal(err)
+	}
+	formats, err := loadExportFormats(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	casetab := []struct {
+		mimeType string
+		want     string
+	}{
+		{"application/vnd.google-apps.document", "odt"},
+		{"application/vnd.google-apps.drawing", "png"},
+		{"application/vnd.google-apps.spreadsheet", "xlsx"},
+	}
+	for _, tt := range casetab {
+		if got := formats[tt.mimeType].Extension; got != tt.want {
+			t.Errorf("%s: Expected extension %q got %q\n", tt.mimeType, tt.want, got)
+		}
+	}
+	if got := formats["application/vnd.google-apps.document"].MimeType; got != exportMimeTypes["odt"] {
+		t.Errorf("Expected document mime type %q got %q\n", exportMimeTypes["odt"], got)
+	}
+
+	if err = ioutil.WriteFile(fname, []byte(`{"form": "xyz"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadExportFormats(fname); err == nil {
+		t.Errorf("Expected error for unknown extension")
+	}
+}
+
+func TestLoadIDMap(t *testing.T) {
+	dir := t.TempDir()
+	lookup := func(name string) (string, error) {
+		if name == "backup" {
+			return "2000", nil
+		}
+		return "", fmt.Errorf("unknown user %s", name)
+	}
+	write := func(data string) string {
+		fname := filepath.Join(dir, "map")
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+
+	if m, err := loadIDMap("", lookup); m != nil || err != nil {
+		t.Errorf("Expected no map without a file, got %v (err=%v)", m, err)
+	}
+	m, err := loadIDMap(write("# comment\nalice 1500\n\n1001\tbackup\n* 65534\n"), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := localvfs.IDMap{"alice": 1500, "1001": 2000, "*": 65534}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Expected %v, got %v", want, m)
+	}
+
+	for _, data := range []string{"alice\n", "alice 1 2\n", "alice nobody\n", "alice -1\n"} {
+		if _, err = loadIDMap(write(data), lookup); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	srcdir := filepath.Join(dir, "src")
+	dstdir := filepath.Join(dir, "dst")
+
+	mtime := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(name string, data string) {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(srcdir, "same"), "same")
+	write(filepath.Join(dstdir, "same"), "same")
+	write(filepath.Join(srcdir, "d1/size"), "foo")
+	write(filepath.Join(dstdir, "d1/size"), "foobar")
+	write(filepath.Join(srcdir, "srconly"), "x")
+	write(filepath.Join(dstdir, "d2/dstonly"), "x")
+	write(filepath.Join(srcdir, "mtime"), "x")
+	write(filepath.Join(dstdir, "mtime"), "x")
+	if err := os.Chtimes(filepath.Join(dstdir, "mtime"), mtime, mtime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	got, err := diffTrees(context.Background(), srcdir, dstdir, lfs, lfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diffEntry{
+		{"d1/size", diffDiffers, "size"},
+		{"d2", diffOnlyInDest, ""},
+		{"d2/dstonly", diffOnlyInDest, ""},
+		{"mtime", diffDiffers, "mtime"},
+		{"srconly", diffOnlyInSource, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v got %v", want, got)
+	}
+}
+
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+	lfs := localvfs.NewLocalFileSystem()
+	results, err := runBench(context.Background(), lfs, dir, 3, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		test  string
+		bytes int64
+	}{{benchUpload, 3000}, {benchList, 0}, {benchStat, 0}, {benchDownload, 3000}, {benchDelete, 0}}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), results)
+	}
+	for i, w := range want {
+		if r := results[i]; r.Test != w.test || r.Ops != 3 || r.Bytes != w.bytes {
+			t.Errorf("Expected %s with 3 ops and %d bytes, got %+v", w.test, w.bytes, r)
+		}
+	}
+	// Nothing is left behind.
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty directory after the benchmark, got %v (err=%v)", entries, err)
+	}
+
+	var buf bytes.Buffer
+	if err = printBench(&buf, results, false); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], "TEST") {
+		t.Errorf("Unexpected table:\n%s", buf.String())
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	dir := t.TempDir()
+	opt.cpuProfile = filepath.Join(dir, "cpu.prof")
+	opt.memProfile = filepath.Join(dir, "mem.prof")
+	opt.trace = filepath.Join(dir, "trace.out")
+	opt.pprofAddr = "localhost:0"
+	defer func() {
+		opt.cpuProfile, opt.memProfile, opt.trace, opt.pprofAddr = "", "", "", ""
+		stopProfiling = func() {}
+	}()
+
+	if err := startProfiling(); err != nil {
+		t.Fatal(err)
+	}
+	stopProfiling()
+	// Stopping again is harmless.
+	stopProfiling()
+
+	for _, fname := range []string{opt.cpuProfile, opt.memProfile, opt.trace} {
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Errorf("Profile not written: %v", err)
+			continue
+		}
+		if fi.Size() == 0 {
+			t.Errorf("Expected %s to have data", fname)
+		}
+	}
+
+	// Unwritable profiles fail early, stopping the ones already started.
+	opt.trace = filepath.Join(dir, "nodir", "trace.out")
+	opt.memProfile, opt.pprofAddr = "", ""
+	if err := startProfiling(); err == nil {
+		t.Errorf("Expected an error for an unwritable trace")
+	}
+	opt.trace = ""
+	if err := startProfiling(); err != nil {
+		t.Errorf("Expected the CPU profile to be stopped after a failure, got %v", err)
+	}
+	stopProfiling()
+}
+
+func TestParseLogLevels(t *testing.T) {
+	casetab := []struct {
+		spec    string
+		want    map[string]slog.Level
+		wantErr bool
+	}{
+		{"", map[string]slog.Level{moduleAzblob: slog.LevelWarn, moduleEngine: slog.LevelWarn, moduleGdrive: slog.LevelWarn, moduleHTTP: slog.LevelWarn, moduleLocal: slog.LevelWarn}, false},
+		{"debug", map[string]slog.Level{moduleAzblob: slog.LevelDebug, moduleEngine: slog.LevelDebug, moduleGdrive: slog.LevelDebug, moduleHTTP: slog.LevelDebug, moduleLocal: slog.LevelDebug}, false},
+		{"gdrive=trace,info", map[string]slog.Level{moduleAzblob: slog.LevelInfo, moduleEngine: slog.LevelInfo, moduleGdrive: levelTrace, moduleHTTP: slog.LevelInfo, moduleLocal: slog.LevelInfo}, false},
+		{"local=ERROR", map[string]slog.Level{moduleAzblob: slog.LevelWarn, moduleEngine: slog.LevelWarn, moduleGdrive: slog.LevelWarn, moduleHTTP: slog.LevelWarn, moduleLocal: slog.LevelError}, false},
+		{"loud", nil, true},
+		{"foo=info", nil, true},
+	}
+
+	for _, tt := range casetab {
+		got, err := parseLogLevels(tt.spec, slog.LevelWarn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevels(%q): unexpected error status: %v", tt.spec, err)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLogLevels(%q): Expected %v got %v", tt.spec, tt.want, got)
+		}
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tag_name": "v1.2.0", "html_url": "https://example.com/v1.2.0"}`)
+	}))
+	defer ts.Close()
+
+	casetab := []struct {
+		version string
+		want    string
+	}{
+		{"v1.2.0", "gsync v1.2.0 is up to date\n"},
+		{"1.2.0", "gsync 1.2.0 is up to date\n"},
+		{"v1.1.0", "gsync v1.2.0 is available (running v1.1.0): https://example.com/v1.2.0\n"},
+	}
+	for _, tt := range casetab {
+		var buf bytes.Buffer
+		if err := checkUpdate(&buf, buildInfo{Version: tt.version}, ts.URL); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("version %s: Expected %q got %q", tt.version, tt.want, buf.String())
+		}
+	}
+}
+
+func TestAuthPrompts(t *testing.T) {
+	credfile := filepath.Join(t.TempDir(), "credentials.json")
+	if _, err := handleCredentials(credfile, "saved-id", "saved-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty answers keep the saved credentials.
+	var out bytes.Buffer
+	in := bufio.NewReader(strings.NewReader("\nnew-secret\n"))
+	cred, err := promptCredentials(in, &out, credfile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.ClientID != "saved-id" || cred.ClientSecret != "new-secret" {
+		t.Errorf("Expected saved-id/new-secret, got %+v", cred)
+	}
+	if want := "Client ID [saved-id]: Client secret (optional) [********cret]: "; out.String() != want {
+		t.Errorf("Expected prompts %q, got %q", want, out.String())
+	}
+
+	// Credentials given on the command line are not asked for.
+	cred, err = promptCredentials(bufio.NewReader(strings.NewReader("")), io.Discard, credfile, "id", "secret")
+	if err != nil || cred.ClientID != "id" || cred.ClientSecret != "secret" {
+		t.Errorf("Expected id/secret, got %+v (err=%v)", cred, err)
+	}
+	if _, err = promptCredentials(bufio.NewReader(strings.NewReader("\n\n")), io.Discard, "missing.json", "", ""); err == nil {
+		t.Errorf("Expected an error without credentials")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fields") != "user" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"user": {"displayName": "Foo", "emailAddress": "foo@example.com"}}`)
+	}))
+	defer ts.Close()
+	if email, err := testAuthorization(ts.Client(), ts.URL+"?fields=user"); err != nil || email != "foo@example.com" {
+		t.Errorf("Expected foo@example.com, got %q (err=%v)", email, err)
+	}
+	if _, err = testAuthorization(ts.Client(), ts.URL); err == nil {
+		t.Errorf("Expected an error for a failed test call")
+	}
+}
+
+func TestExchangeCode(t *testing.T) {
+	verifier, challenge, err := pkcePair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if want := base64.RawURLEncoding.EncodeToString(sum[:]); challenge != want || len(verifier) < 43 {
+		t.Errorf("Invalid PKCE pair %q/%q", verifier, challenge)
+	}
+
+	var form url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		if form.Get("code") != "good" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Bad code"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "at", "refresh_token": "rt", "expires_in": 3600}`)
+	}))
+	defer ts.Close()
+
+	config := oauthConfig(&GdriveCredentials{ClientID: "id"}, "scope")
+	config.TokenURL = ts.URL
+	token, err := exchangeCode(ts.Client(), config, "good", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "at" || token.RefreshToken != "rt" || time.Until(token.Expiry) < 59*time.Minute {
+		t.Errorf("Unexpected token %+v", token)
+	}
+	// No secret is sent without one.
+	if form.Get("code_verifier") != verifier || form.Get("client_id") != "id" || form["client_secret"] != nil {
+		t.Errorf("Unexpected token request %v", form)
+	}
+	if _, err = exchangeCode(ts.Client(), config, "bad", verifier); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Expected invalid_grant error, got %v", err)
+	}
+}
+
+func TestTokenVault(t *testing.T) {
+	// RFC 7914, section 11.
+	dk := pbkdf2Key([]byte("passwd"), []byte("salt"), 1, 64)
+	if got := fmt.Sprintf("%x", dk[:16]); got != "55ac046e56e3089fec1691c22544b605" {
+		t.Errorf("Unexpected PBKDF2 output %s", got)
+	}
+
+	defer func(n int) { tokenKDFIterations = n }(tokenKDFIterations)
+	tokenKDFIterations = 10
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "key")
+	cachefile := filepath.Join(dir, "token-cache.json")
+	if err := ioutil.WriteFile(keyfile, []byte("secret key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := newTokenVault("bogus", nil, nil); err == nil || v != nil {
+		t.Errorf("Expected an error for an invalid spec")
+	}
+
+	// New caches are encrypted at the end.
+	v, err := newTokenVault("file:"+keyfile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := v.open(cachefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := `{"AccessToken":"at","RefreshToken":"rt"}`
+	if err = ioutil.WriteFile(tmp, []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(cachefile)
+	if err != nil || bytes.Contains(data, []byte("RefreshToken")) {
+		t.Errorf("Expected an encrypted token cache, got %q (err=%v)", data, err)
+	}
+	if _, err = os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected the decrypted copy to be removed, got %v", err)
+	}
+
+	// And decrypted when used again, with the right key only.
+	if tmp, err = v.open(cachefile); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tmp); err != nil || string(got) != token {
+		t.Errorf("Expected %q, got %q (err=%v)", token, got, err)
+	}
+	v.close()
+	t.Setenv(tokenPassphraseEnv, "wrong")
+	v, _ = newTokenVault(tokenPassphrase, nil, nil)
+	if _, err = v.open(cachefile); err == nil {
+		t.Errorf("Expected an error decrypting with the wrong passphrase")
+	}
+}
+
+func TestAuthReceiver(t *testing.T) {
+	recv, err := newAuthReceiver("xyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.close()
+	if !strings.HasPrefix(recv.redirectURL(), "http://127.0.0.1:") {
+		t.Errorf("Unexpected redirect URL %q", recv.redirectURL())
+	}
+
+	// Requests for other authorizations are rejected.
+	resp, err := http.Get(recv.redirectURL() + "?state=other&code=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %d for the wrong state, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = http.Get(recv.redirectURL() + "?state=xyz&code=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Nothing typed: the code comes from the browser.
+	ctx := context.Background()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	code, err := readAuthCode(ctx, bufio.NewReader(pr), io.Discard, recv, "xyz")
+	if err != nil || code != "abc" {
+		t.Errorf("Expected code abc, got %q (err=%v)", code, err)
+	}
+
+	// Addresses pasted by the user.
+	casetab := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"plaincode", "plaincode", false},
+		{"http://127.0.0.1:1234/?state=xyz&code=def", "def", false},
+		{"http://127.0.0.1:1234/?state=other&code=def", "", true},
+		{"http://127.0.0.1:1234/?state=xyz&error=access_denied", "", true},
+	}
+	for _, tt := range casetab {
+		code, err = readAuthCode(ctx, bufio.NewReader(strings.NewReader(tt.line+"\n")), io.Discard, recv, "xyz")
+		if code != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("%s: Expected %q (error %v), got %q (err=%v)", tt.line, tt.want, tt.wantErr, code, err)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var calls int
+	reason := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"error": {"errors": [{"reason": %q}]}}`, reason)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var waits []time.Duration
+	rt := newRetryTransport(http.DefaultTransport, false)
+	rt.sleep = func(_ context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	client := &http.Client{Transport: rt}
+
+	// Rate limiting: retry after the time in Retry-After.
+	reason = "userRateLimitExceeded"
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("Expected success after 2 calls, got status %d after %d calls", resp.StatusCode, calls)
+	}
+	if len(waits) != 1 || waits[0] != 7*time.Second {
+		t.Errorf("Expected a single 7s wait, got %v", waits)
+	}
+
+	// Retries don't modify the request of the caller.
+	calls = 0
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+	if resp, err = rt.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls != 2 || req.Body != body || resp.Request == req {
+		t.Errorf("Expected a retry with a clone of the request, got %d calls", calls)
+	}
+
+	// Quota exhaustion: fail without retrying.
+	calls = 0
+	reason = "dailyLimitExceeded"
+	_, err = client.Get(ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Errorf("Expected quota error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+
+	// Other errors are returned to the caller untouched.
+	calls = 0
+	reason = "insufficientPermissions"
+	resp, err = client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", resp.StatusCode)
+	}
+}
+
+// fakeTransport is an http.RoundTripper returning canned responses.
+type fakeTransport func(*http.Request) (*http.Response, error)
+
+func (f fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAPIStats(t *testing.T) {
+	casetab := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{"GET", "https://www.googleapis.com/drive/v2/files?q=x", apiList},
+		{"GET", "https://www.googleapis.com/drive/v2/files/abc/children", apiList},
+		{"GET", "https://www.googleapis.com/drive/v2/files/abc", apiGet},
+		{"GET", "https://www.googleapis.com/drive/v3/about?fields=user", apiGet},
+		{"POST", "https://www.googleapis.com/upload/drive/v2/files?uploadType=multipart", apiInsert},
+		{"POST", "https://www.googleapis.com/drive/v2/files/abc/copy", apiInsert},
+		{"PATCH", "https://www.googleapis.com/drive/v3/files/abc", apiUpdate},
+		{"PUT", "https://www.googleapis.com/upload/drive/v2/files/abc?upload_id=x", apiUpload},
+		{"POST", "https://www.googleapis.com/drive/v2/files/abc/trash", apiDelete},
+		{"POST", "https://accounts.google.com/o/oauth2/token", ""},
+		{"GET", "https://example.com/drive/v2/files", ""},
+	}
+	for _, tt := range casetab {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		if got := apiCallType(req); got != tt.want {
+			t.Errorf("%s %s: Expected %q, got %q", tt.method, tt.url, tt.want, got)
+		}
+	}
+
+	// Retries count as quota units, but not as calls.
+	var sent int
+	base := fakeTransport(func(req *http.Request) (*http.Response, error) {
+		sent++
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("{}"))}
+		if sent == 1 {
+			resp.StatusCode = http.StatusTooManyRequests
+		}
+		return resp, nil
+	})
+	stats := newAPIStats()
+	rt := newRetryTransport(&apiCounter{base: base, stats: stats, units: true}, false)
+	rt.sleep = func(context.Context, time.Duration) error { return nil }
+	client := &http.Client{Transport: &apiCounter{base: rt, stats: stats}}
+	for _, u := range []string{"https://www.googleapis.com/drive/v2/files/abc", "https://accounts.google.com/o/oauth2/token"} {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	calls, units := stats.totals()
+	if len(calls) != 1 || calls[apiGet] != 1 || units != 2 || sent != 3 {
+		t.Errorf("Expected 1 get call and 2 units (3 requests), got %v and %d units (%d requests)", calls, units, sent)
+	}
+}
+
+func TestDumpHTTP(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token": "secret1", "expires_in": 3600}`)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "text", "dump", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := newRetryTransport(&httpDumper{base: http.DefaultTransport, bodies: true, log: l}, false)
+	rt.sleep = func(context.Context, time.Duration) error { return nil }
+	client := &http.Client{Transport: rt}
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"secret2"}, "client_id": {"id"}}
+	resp, err := client.PostForm(ts.URL+"/token?key=secret3", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(body), "secret1") {
+		t.Errorf("Expected the whole response body, got %q (err=%v)", body, err)
+	}
+
+	dump := buf.String()
+	if strings.Contains(dump, "secret") {
+		t.Errorf("Expected credentials to be redacted, got %s", dump)
+	}
+	for _, want := range []string{"status=429", "status=200", "retry=1", "client_id=id", "expires_in", "REDACTED"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Expected %q in the dump, got %s", want, dump)
+		}
+	}
+}
+
+func TestSanitizeJSONBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"access_token": "secret", "n": 1}`, `{"access_token": "REDACTED", "n": 1}`},
+		{`{"private_key": "se\"cr\net", "n": 1}`, `{"private_key": "REDACTED", "n": 1}`},
+		// Bodies truncated in the middle of a value.
+		{`{"n": 1, "refresh_token": "secr`, `{"n": 1, "refresh_token": "REDACTED"`},
+		{`{"n": 1, "private_key": "secret\`, `{"n": 1, "private_key": "REDACTED"`},
+	}
+	for _, tt := range tests {
+		if got := sanitizeBody("application/json", []byte(tt.body), -1); got != tt.want {
+			t.Errorf("sanitizeBody(%q): expected %q, got %q", tt.body, tt.want, got)
+		}
+	}
+}
+
+func TestStreamPipe(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*pipeChunkSize/16+5)
+
+	p := newStreamPipe(iotest.HalfReader(bytes.NewReader(data)), 0)
+	got, err := ioutil.ReadAll(p)
+	p.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected %d bytes through the pipe, got %d (err=%v)", len(data), len(got), err)
+	}
+
+	// Errors reading the source are returned after the data read before them.
+	p = newStreamPipe(io.MultiReader(bytes.NewReader(data[:100]), iotest.ErrReader(io.ErrClosedPipe)), 0)
+	got, err = ioutil.ReadAll(p)
+	p.Close()
+	if err != io.ErrClosedPipe || len(got) != 100 {
+		t.Errorf("Expected 100 bytes and %v, got %d bytes and %v", io.ErrClosedPipe, len(got), err)
+	}
+
+	// Closing the pipe early stops reading from the source.
+	p = newStreamPipe(bytes.NewReader(data), 0)
+	if _, err = p.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+}
+
+func TestBufferPool(t *testing.T) {
+	p := &vfs.BufferPool{}
+	p.SetMax(3000)
+
+	// Sizes are rounded up to a power of two.
+	a := p.Get(1000)
+	if len(a) != 1000 || p.InUse() != 1024 {
+		t.Errorf("Expected 1000 bytes and 1024 in use, got %d and %d", len(a), p.InUse())
+	}
+	b := p.TryGet(1024)
+	if b == nil {
+		t.Fatalf("Expected a read-ahead buffer below the limit")
+	}
+	if c := p.TryGet(1024); c != nil {
+		t.Errorf("Expected no read-ahead buffer above the limit, got %d bytes", len(c))
+	}
+	// Required buffers are granted above the limit.
+	c := p.Get(2000)
+	if len(c) != 2000 || p.InUse() != 4096 {
+		t.Errorf("Expected 2000 bytes and 4096 in use, got %d and %d", len(c), p.InUse())
+	}
+	p.Put(a)
+	p.Put(b)
+	p.Put(c)
+	p.Put(nil)
+	if p.InUse() != 0 {
+		t.Errorf("Expected nothing in use, got %d", p.InUse())
+	}
+
+	// Pipes work with a single buffer, and return their buffers when closed.
+	// Buffers are returned in the background, so wait for other tests.
+	waitBuffers := func() {
+		for deadline := time.Now().Add(5 * time.Second); vfs.Buffers.InUse() != 0; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected all buffers back in the pool, %d bytes in use", vfs.Buffers.InUse())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitBuffers()
+	vfs.Buffers.SetMax(1)
+	defer vfs.Buffers.SetMax(0)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*pipeChunkSize/16+5)
+	pipe := newStreamPipe(bytes.NewReader(data), 4*pipeChunkSize)
+	if n := vfs.Buffers.InUse(); n != pipeChunkSize {
+		t.Errorf("Expected a single pipe buffer (%d bytes), got %d bytes", pipeChunkSize, n)
+	}
+	got, err := ioutil.ReadAll(pipe)
+	pipe.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected %d bytes through the pipe, got %d (err=%v)", len(data), len(got), err)
+	}
+	waitBuffers()
+}
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 2 << 20
+	lim := newRateLimiter(rate)
+	r := &limitedReader{ctx: context.Background(), r: bytes.NewReader(make([]byte, rate/4)), lim: lim}
+	start := time.Now()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected a transfer of %d bytes at %d bytes/s to take about 250ms, took %v", rate/4, rate, d)
+	}
+
+	// Waits are interrupted when the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := lim.wait(ctx, rate); err != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	casetab := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"256K", 256 << 10, false},
+		{"8m", 8 << 20, false},
+		{"1GB", 1 << 30, false},
+		{"0", 0, true},
+		{"foo", 0, true},
+		{"-1M", 0, true},
+	}
+	for _, tt := range casetab {
+		var b byteSize
+		err := b.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q): unexpected error status: %v", tt.value, err)
+			continue
+		}
+		if !tt.wantErr && int64(b) != tt.want {
+			t.Errorf("Set(%q): Expected %d got %d", tt.value, tt.want, int64(b))
+		}
+	}
+}
+
+func TestLocalStat(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fname, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+
+	fi, err := lfs.Stat(ctx, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := vfs.FileInfo{Path: fname, Size: 4, Mtime: mtime, Type: vfs.TypeRegular}
+	if fi.Path != want.Path || fi.Size != want.Size || !fi.Mtime.Equal(want.Mtime) || fi.Type != want.Type {
+		t.Errorf("Stat(file): Expected %+v got %+v", want, fi)
+	}
+	if fi, err = lfs.Stat(ctx, dir); err != nil || !fi.IsDir() || fi.IsRegular() {
+		t.Errorf("Stat(dir): Expected a directory, got %+v (error %v)", fi, err)
+	}
+	if _, err = lfs.Stat(ctx, filepath.Join(dir, "missing")); !errors.Is(err, vfs.ErrNotExist) {
+		t.Errorf("Stat(missing): Expected ErrNotExist, got %v", err)
+	}
+
+	// Symbolic links are reported as such, with the type of their targets.
+	for _, tt := range []struct {
+		target string
+		want   vfs.FileType
+	}{{fname, vfs.TypeRegular}, {dir, vfs.TypeDir}, {"missing", vfs.TypeSymlink}} {
+		link := filepath.Join(dir, "link")
+		os.Remove(link)
+		if err = os.Symlink(tt.target, link); err != nil {
+			t.Skipf("Unable to create symbolic links: %v", err)
+		}
+		fi, err = lfs.Stat(ctx, link)
+		if err != nil || fi.Type != vfs.TypeSymlink || fi.Target != tt.want {
+			t.Errorf("Stat(link to %q): Expected target type %v, got %+v (error %v)", tt.target, tt.want, fi, err)
+		}
+	}
+}
+
+func TestLocalLocking(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	for _, inplace := range []bool{false, true} {
+		lfs := localvfs.NewLocalFileSystem()
+		lfs.SetLocking(true)
+		lfs.SetWriteInPlace(inplace)
+		fname := filepath.Join(dir, fmt.Sprintf("file-%v", inplace))
+		for _, data := range []string{"first", "second version"} {
+			if err := lfs.WriteToFile(ctx, fname, strings.NewReader(data)); err != nil {
+				t.Fatalf("inplace=%v: %v", inplace, err)
+			}
+			got, err := ioutil.ReadFile(fname)
+			if err != nil || string(got) != data {
+				t.Errorf("inplace=%v: expected %q, got %q (err=%v)", inplace, data, got, err)
+			}
+		}
+	}
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("Expected 2 files in %s, got %d (err=%v)", dir, len(entries), err)
+	}
+}
+
+func TestLocalFileExists(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(fname, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{{fname, true}, {dir, true}, {filepath.Join(dir, "missing"), false}} {
+		got, err := lfs.FileExists(ctx, tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("FileExists(%q): Expected %v, got %v (error %v)", tt.path, tt.want, got, err)
+		}
+	}
+
+	// Errors other than missing files are returned.
+	if runtime.GOOS != "windows" {
+		if _, err := lfs.FileExists(ctx, filepath.Join(fname, "child")); err == nil {
+			t.Errorf("FileExists(file/child): Expected an error")
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	defer func() { opt.symlinks = symlinksFollow }()
+	chdirTemp(t)
+	for _, d := range []string{"src", "src/dir", "dst", "dst2"} {
+		os.Mkdir(d, 0755)
+	}
+	if err := ioutil.WriteFile("src/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for target, link := range map[string]string{"file": "src/filelink", "dir": "src/dirlink", "missing": "src/dangling"} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("Unable to create symbolic links: %v", err)
+		}
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	for _, tt := range []struct {
+		policy string
+		dst    string
+		want   []string
+	}{
+		{symlinksFollow, "dst", []string{"dir", "file", "filelink"}},
+		{symlinksSkip, "dst2", []string{"dir", "file"}},
+	} {
+		opt.symlinks = tt.policy
+		if err := sync(context.Background(), "src/", tt.dst, lfs, lfs, nil, nil, nil); err != nil {
+			t.Fatalf("%s: sync failed: %v", tt.policy, err)
+		}
+		var got []string
+		entries, _ := ioutil.ReadDir(tt.dst)
+		for _, e := range entries {
+			if !e.Mode().IsRegular() && !e.IsDir() {
+				t.Errorf("%s: %s is not a regular file or directory", tt.policy, e.Name())
+			}
+			got = append(got, e.Name())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Expected %v, got %v", tt.policy, tt.want, got)
+		}
+	}
+}
+
+func TestArchiveMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Permission bits are not supported on Windows")
+	}
+	defer func() { opt.archiveMode = false }()
+	chdirTemp(t)
+	for _, d := range []string{"src", "dst", "dst2"} {
+		os.Mkdir(d, 0755)
+	}
+	if err := ioutil.WriteFile("src/file", []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod("src/file", 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", "src/link"); err != nil {
+		t.Skipf("Unable to create symbolic links: %v", err)
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	for _, tt := range []struct {
+		archive bool
+		dst     string
+	}{
+		{false, "dst"},
+		{true, "dst2"},
+	} {
+		opt.archiveMode = tt.archive
+		lfs.SetSymlinks(tt.archive)
+		if err := sync(context.Background(), "src/", tt.dst, lfs, lfs, nil, nil, nil); err != nil {
+			t.Fatalf("archive=%v: sync failed: %v", tt.archive, err)
+		}
+		fi, err := os.Stat(filepath.Join(tt.dst, "file"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); (perm == 0640) != tt.archive {
+			t.Errorf("archive=%v: Unexpected mode %o", tt.archive, perm)
+		}
+		lfi, err := os.Lstat(filepath.Join(tt.dst, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if islink := lfi.Mode()&os.ModeSymlink != 0; islink != tt.archive {
+			t.Errorf("archive=%v: Expected a symbolic link: %v, got %v", tt.archive, tt.archive, islink)
+		}
+	}
+}
+
+func TestLocalMetadata(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	for _, f := range []string{src, dst} {
+		if err := ioutil.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(src, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1420070400, 123456789)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	meta, err := lfs.Metadata(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta[localvfs.MetaMode] != "600" {
+		t.Errorf("Expected mode 600, got %q", meta[localvfs.MetaMode])
+	}
+	if err = lfs.SetMetadata(context.Background(), dst, meta); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected restored mode 0600, got %v", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected restored mtime %v, got %v", mtime, fi.ModTime())
+	}
+
+	// Symbolic links are only restored as links when asked for.
+	link := filepath.Join(dir, "link")
+	if err = ioutil.WriteFile(link, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = lfs.SetMetadata(context.Background(), link, map[string]string{localvfs.MetaSymlink: "dst"}); err != nil {
+		t.Fatal(err)
+	}
+	if lfi, err := os.Lstat(link); err != nil || lfi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("Expected %s to be kept as a regular file (%v)", link, err)
+	}
+	lfs.SetSymlinks(true)
+	if err = lfs.SetMetadata(context.Background(), link, map[string]string{localvfs.MetaSymlink: "dst"}); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(link); err != nil || target != "dst" {
+		t.Errorf("Expected link to \"dst\", got %q (%v)", target, err)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.times = false }()
+	opt.times = true
+
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []struct {
+		name    string
+		src     string
+		dst     string
+		dstTime time.Time
+		want    time.Time
+	}{
+		// Identical, destination newer or older: mtime fixed, no copy.
+		{"newer", "same", "same", old.Add(time.Hour), old},
+		{"older", "same", "same", old.Add(-time.Hour), old},
+		// Same size, different content: left alone (destination newer).
+		{"differ", "aaaa", "bbbb", old.Add(time.Hour), old.Add(time.Hour)},
+	}
+	for _, dir := range []string{"src", "dst"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inodes := make(map[string]os.FileInfo)
+	for _, f := range files {
+		src, dst := filepath.Join("src", f.name), filepath.Join("dst", f.name)
+		if err := ioutil.WriteFile(src, []byte(f.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dst, []byte(f.dst), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dst, f.dstTime, f.dstTime); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if inodes[f.name], err = os.Stat(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		fi, err := os.Stat(filepath.Join("dst", f.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(f.want) {
+			t.Errorf("%s: Expected mtime %v, got %v", f.name, f.want, fi.ModTime())
+		}
+		if !os.SameFile(fi, inodes[f.name]) {
+			t.Errorf("%s: Expected the destination not to be copied", f.name)
+		}
+	}
+}
+
+type unreadableVfs struct {
+	*localvfs.LocalFileSystem
+	path string
+}
+
+func (u *unreadableVfs) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	if fullpath == u.path {
+		return nil, fmt.Errorf("Unable to read \"%s\"", fullpath)
+	}
+	return u.LocalFileSystem.ReadFromFile(ctx, fullpath)
+}
+
+func TestFuzzy(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want float64
+	}{
+		{"report-v1.pdf", "report-v2.pdf", 12.0 / 13},
+		{"abc", "abc", 1},
+		{"abc", "xyz", 0},
+		{"aa", "aaaa", 0.5},
+	} {
+		if got := nameSimilarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("nameSimilarity(%q, %q): Expected %v, got %v", tt.a, tt.b, tt.want, got)
+		}
+	}
+
+	chdirTemp(t)
+	defer func() { opt.fuzzy = false }()
+	opt.fuzzy = true
+
+	writeTree(t, ".", map[string]string{
+		"src/report-v2.pdf": "report",
+		"src/notes.txt":     "new notes",
+		"dst/report-v1.pdf": "report",
+		"dst/notes-old.txt": "old notes",
+	})
+	// Files copied from a basis are never read from the source.
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+	src := &unreadableVfs{LocalFileSystem: lfs, path: "src/report-v2.pdf"}
+	if err := sync(context.Background(), "src/", "dst", src, lfs, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"dst/report-v2.pdf": "report", "dst/notes.txt": "new notes", "dst/report-v1.pdf": "report"} {
+		if data, err := ioutil.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("%s: Expected %q, got %q (err=%v)", name, want, data, err)
+		}
+	}
+
+	// Destinations that can't list directories have no basis files, even
+	// behind wrappers that always implement ReadDir.
+	if err := ioutil.WriteFile("src/report-v3.pdf", []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := newTimeoutVfs(unlistableVfs{lfs}, time.Minute)
+	if err := sync(context.Background(), "src/", "dst", lfs, dst, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile("dst/report-v3.pdf"); err != nil || string(data) != "report" {
+		t.Errorf("dst/report-v3.pdf: Expected %q, got %q (err=%v)", "report", data, err)
+	}
+}
+
+// unlistableVfs is a checksumming VFS that can't list single directories.
+type unlistableVfs struct {
+	vfs.VFS
+}
+
+func (u unlistableVfs) MD5(ctx context.Context, fullpath string) (string, error) {
+	return u.VFS.(vfs.MD5er).MD5(ctx, fullpath)
+}
+
+// hiddenVfs is a local VFS whose directories named "hidden" hold objects
+// not listed by Walk.
+type hiddenVfs struct {
+	*localvfs.LocalFileSystem
+}
+
+func (hiddenVfs) IsEmptyDir(ctx context.Context, fullpath string) (bool, error) {
+	return filepath.Base(fullpath) != "hidden", nil
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	defer func() { opt.exclude = nil }()
+	opt.exclude = multiString{"keep"}
+
+	root := t.TempDir()
+	files := make(map[string]string)
+	for _, name := range []string{"a/b/", "a/c/file", "d/e/f/", "keep/g/", "h/keep/", "i/j/hidden/", "l/"} {
+		files[name] = ""
+	}
+	writeTree(t, root, files)
+
+	// Links to directories are not empty directories.
+	if err := os.Symlink(filepath.Join(root, "d/e"), filepath.Join(root, "l/link")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := removeEmptyDirs(context.Background(), hiddenVfs{localvfs.NewLocalFileSystem()}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 directories removed, got %d", n)
+	}
+	for name, want := range map[string]bool{
+		"":           true,
+		"a":          true,
+		"a/b":        false,
+		"a/c/file":   true,
+		"d":          false,
+		"keep/g":     true,
+		"h/keep":     true,
+		"i/j/hidden": true,
+		"l":          true,
+	} {
+		if _, err = os.Stat(filepath.Join(root, name)); (err == nil) != want {
+			t.Errorf("%s: Expected exists=%v, got err=%v", name, want, err)
+		}
+	}
+}
+
+func TestUnion(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.unionPrecedence = unionvfs.PrecedenceFirst }()
+
+	old := time.Now().Add(-time.Hour)
+	writeTree(t, ".", map[string]string{
+		"a/both":      "a",
+		"a/dir/onlya": "a",
+		"a/dirfile/x": "a",
+		"b/both":      "b",
+		"b/dir/onlyb": "b",
+		"b/dirfile":   "b",
+	})
+	if err := os.Chtimes("a/both", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	lfs := localvfs.NewLocalFileSystem()
+	for _, tt := range []struct {
+		precedence string
+		want       map[string]string
+	}{
+		{unionvfs.PrecedenceFirst, map[string]string{"both": "a", "dir/onlya": "a", "dir/onlyb": "b", "dirfile/x": "a"}},
+		{unionvfs.PrecedenceLast, map[string]string{"both": "b", "dir/onlya": "a", "dir/onlyb": "b", "dirfile": "b"}},
+		{unionvfs.PrecedenceNewest, map[string]string{"both": "b", "dir/onlya": "a", "dir/onlyb": "b", "dirfile/x": "a"}},
+	} {
+		opt.unionPrecedence = tt.precedence
+		isUnion, roots := parseUnionPath("union:a,b")
+		if !isUnion || len(roots) != 2 {
+			t.Fatalf("Expected a union of two directories, got %v", roots)
+		}
+		u, err := initUnionVfs(roots, lfs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst := "dst-" + tt.precedence
+		if err = os.Mkdir(dst, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = sync(context.Background(), "/", dst, u, lfs, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		filepath.Walk(dst, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				got = append(got, p)
+			}
+			return err
+		})
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: Expected %d files, got %v", tt.precedence, len(tt.want), got)
+		}
+		for name, want := range tt.want {
+			if data, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || string(data) != want {
+				t.Errorf("%s: %s: Expected %q, got %q (err=%v)", tt.precedence, name, want, data, err)
+			}
+		}
+	}
+
+	if _, err := initUnionVfs([]string{"a", "g:remote"}, lfs); err == nil {
+		t.Errorf("Expected an error for a remote union member")
+	}
+	if _, err := initUnionVfs([]string{"a/both"}, lfs); err == nil {
+		t.Errorf("Expected an error for a union member that is not a directory")
+	}
+}
+
+// readCountVfs is a local VFS counting walks and files read.
+type readCountVfs struct {
+	*localvfs.LocalFileSystem
+	walks *int
+	reads *int
+}
+
+func (r readCountVfs) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	*r.walks++
+	return r.LocalFileSystem.Walk(ctx, fullpath, walkFn)
+}
+
+func (r readCountVfs) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	*r.reads++
+	return r.LocalFileSystem.ReadFromFile(ctx, fullpath)
+}
+
+func TestCacheVfs(t *testing.T) {
+	src := t.TempDir()
+	cachedir := t.TempDir()
+	writeTree(t, src, map[string]string{"a": "0123456789", "b": "0123456789", "dir/c": "0123456789"})
+	var walks, reads int
+	base := readCountVfs{localvfs.NewLocalFileSystem(), &walks, &reads}
+	ctx := context.Background()
+
+	// Each run uses a new cacheVfs, sharing the cache directory.
+	walk := func(c *cacheVfs) []string {
+		var ret []string
+		err := c.Walk(ctx, src, func(fi vfs.FileInfo, err error) error {
+			ret = append(ret, fi.Path)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	read := func(c *cacheVfs, name string) {
+		rc, err := c.ReadFromFile(ctx, filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		if data, err := ioutil.ReadAll(rc); err != nil || string(data) != "0123456789" {
+			t.Errorf("%s: Expected the file contents, got %q (err=%v)", name, data, err)
+		}
+	}
+	run := func(maxSize int64, maxAge time.Duration) *cacheVfs {
+		c, err := newCacheVfs(base, cachedir, "local", maxSize, maxAge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := run(25, time.Hour)
+	first := walk(c)
+	read(c, "a")
+	read(c, "b")
+
+	// Walks and files are read from the cache by the next run.
+	c = run(25, time.Hour)
+	if got := walk(c); !reflect.DeepEqual(got, first) || walks != 1 {
+		t.Errorf("Expected the cached walk %v, got %v after %d walks", first, got, walks)
+	}
+	if exists, err := c.FileExists(ctx, filepath.Join(src, "nothere")); exists || err != nil {
+		t.Errorf("Expected a missing file in the cached walk, got %v (err=%v)", exists, err)
+	}
+	read(c, "a")
+	read(c, "b")
+	if reads != 2 {
+		t.Errorf("Expected cached files to be reused, got %d reads", reads)
+	}
+
+	// The least recently used file (b is newer, since it was read last) is
+	// evicted.
+	read(c, "dir/c")
+	read(c, "b")
+	read(c, "a")
+	if reads != 4 {
+		t.Errorf("Expected a to be evicted, got %d reads", reads)
+	}
+
+	// Writes discard cached walks.
+	if err := c.WriteToFile(ctx, filepath.Join(src, "new"), strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := walk(c); len(got) != len(first)+1 || walks != 2 {
+		t.Errorf("Expected a new walk after a write, got %v after %d walks", got, walks)
+	}
+
+	// Expired walks are not used.
+	walk(run(25, 0))
+	if walks != 3 {
+		t.Errorf("Expected an expired walk to be ignored, got %d walks", walks)
+	}
+}
+
+func TestCheckDirection(t *testing.T) {
+	defer func() { opt.downloadOnly, opt.uploadOnly = false, false }()
+	tests := []struct {
+		download bool
+		upload   bool
+		srcs     []string
+		dsts     []string
+		ok       bool
+	}{
+		{false, false, []string{"/local"}, []string{"/other"}, true},
+		{true, false, []string{"g:docs", "cache:azblob://bucket/x"}, []string{"/local", "tar:x.tar"}, true},
+		{true, false, []string{"g:docs"}, []string{"g:backup"}, false},
+		{true, false, []string{"/local"}, []string{"/other"}, false},
+		{true, false, []string{"https://example.com/x"}, []string{"/local"}, true},
+		{false, true, []string{"/local", "union:/a,/b"}, []string{"g:backup", "azblob://bucket"}, true},
+		{false, true, []string{"g:docs"}, []string{"/local"}, false},
+		{false, true, []string{"/local"}, []string{"g:backup", "/other"}, false},
+		{true, true, []string{"g:docs"}, []string{"/local"}, false},
+	}
+	for _, tt := range tests {
+		opt.downloadOnly, opt.uploadOnly = tt.download, tt.upload
+		if err := checkDirection(tt.srcs, tt.dsts); (err == nil) != tt.ok {
+			t.Errorf("%v -> %v (download=%v, upload=%v): Expected ok=%v, got %v", tt.srcs, tt.dsts, tt.download, tt.upload, tt.ok, err)
+		}
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.mirror, opt.pruneEmpty, opt.exclude = false, false, nil }()
+
+	writeTree(t, ".", map[string]string{"src/a": "src/a", "src/b": "src/b", "src/c": "src/c", "dst/": ""})
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	root := "src/ -> dst"
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Deleted source files get a tombstone. Excluded files still exist.
+	opt.exclude = multiString{"b"}
+	if err = os.Remove("src/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if ts := state.tombstone(root, "a"); ts == nil || ts.Side != sideSource || ts.Size != 5 || state.lookup(root, "a") != nil {
+		t.Errorf("Expected a source tombstone for a, got %+v", ts)
+	}
+	if ts := state.tombstone(root, "b"); ts != nil || state.lookup(root, "b") == nil {
+		t.Errorf("Expected no tombstone for an excluded file, got %+v", ts)
+	}
+
+	// Mirrors copy files deleted from the destination again, even when the
+	// source is unchanged.
+	opt.mirror, opt.pruneEmpty, opt.exclude = true, true, nil
+	if err = os.Remove("dst/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if got, err := ioutil.ReadFile("dst/c"); err != nil || string(got) != "src/c" {
+		t.Errorf("Expected c to be copied again, got %q (err=%v)", got, err)
+	}
+	if _, err = os.Stat("dst/a"); !os.IsNotExist(err) {
+		t.Errorf("Expected a to be removed from the mirror, got %v", err)
+	}
+	if ts := state.tombstone(root, "c"); ts != nil || state.lookup(root, "c") == nil {
+		t.Errorf("Expected c synced again, got tombstone %+v", ts)
+	}
+
+	// Tombstones are saved, and expire.
+	if state, err = openStateDB("state"); err != nil {
+		t.Fatal(err)
+	}
+	ts := state.tombstone(root, "a")
+	if ts == nil || ts.Side != sideSource {
+		t.Fatalf("Expected the tombstone for a to be saved, got %+v", ts)
+	}
+	ts.Deleted = time.Now().Add(-tombstoneMaxAge - time.Hour)
+	if err = state.save(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = openStateDB("state"); err != nil {
+		t.Fatal(err)
+	}
+	if ts = state.tombstone(root, "a"); ts != nil {
+		t.Errorf("Expected the tombstone for a to expire, got %+v", ts)
+	}
+}
+
+func TestStateDB(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "state")
+
+	// Missing files are empty databases, and corrupt ones errors.
+	state, err := openStateDB(fname)
+	if err != nil || len(state.Roots) != 0 {
+		t.Fatalf("Expected an empty database, got %+v (err=%v)", state, err)
+	}
+	if err = ioutil.WriteFile(fname, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openStateDB(fname); err == nil {
+		t.Errorf("Expected an error opening a corrupt database")
+	}
+
+	// Everything saved is loaded back. Expired tombstones are dropped, along
+	// with roots left without tombstones.
+	t0 := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	recent := time.Now().Add(-time.Hour).UTC().Round(0)
+	expired := time.Now().Add(-tombstoneMaxAge - time.Hour).UTC().Round(0)
+	state.Roots = map[string]map[string]*stateEntry{
+		"r": {"a": {SrcID: "s1", DstID: "d1", SrcRev: "1", DstRev: "2", Size: 5, Mtime: t0, MD5: "abc"}},
+	}
+	state.Tombstones = map[string]map[string]*tombstone{
+		"r":   {"b": {stateEntry{Size: 1, Mtime: t0}, sideSource, recent}, "c": {stateEntry{Size: 2, Mtime: t0}, sideDest, expired}},
+		"old": {"d": {stateEntry{Size: 3, Mtime: t0}, sideDest, expired}},
+	}
+	state.NoMtime = map[string]bool{"r": true}
+	state.MtimeFailures = map[string]int{"r": mtimeFailureLimit}
+	if err = state.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := openStateDB(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTombs := map[string]map[string]*tombstone{
+		"r": {"b": {stateEntry{Size: 1, Mtime: t0}, sideSource, recent}},
+	}
+	if !reflect.DeepEqual(loaded.Roots, state.Roots) || !reflect.DeepEqual(loaded.Tombstones, wantTombs) ||
+		!reflect.DeepEqual(loaded.NoMtime, state.NoMtime) || !reflect.DeepEqual(loaded.MtimeFailures, state.MtimeFailures) {
+		t.Errorf("Expected %+v, got %+v", state, loaded)
+	}
+
+	// Saves replace the database atomically, leaving no temporary files, and
+	// failed saves leave it untouched.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected only the database in %s, got %v (err=%v)", dir, entries, err)
+	}
+	saved, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "subdir", "x"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded.fname = filepath.Join(dir, "subdir")
+	if err = loaded.save(); err == nil {
+		t.Errorf("Expected an error replacing a directory")
+	}
+	if entries, err = ioutil.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("Expected no temporary files in %s, got %v (err=%v)", dir, entries, err)
+	}
+	if data, err := ioutil.ReadFile(fname); err != nil || !bytes.Equal(data, saved) {
+		t.Errorf("Expected the database to be untouched, got %q (err=%v)", data, err)
+	}
+
+	// A nil database remembers nothing.
+	var none *stateDB
+	none.bury("r", "a", sideSource)
+	if none.save() != nil || none.lookup("r", "a") != nil || none.tombstone("r", "a") != nil || none.mtimeUnreliable("r") {
+		t.Errorf("Expected a nil database to do nothing")
+	}
+}
+
+func TestStateUnchanged(t *testing.T) {
+	t0 := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	lfs := localvfs.NewLocalFileSystem()
+	state := &stateDB{Roots: map[string]map[string]*stateEntry{
+		"r": {
+			"plain": {Size: 5, Mtime: t0},
+			"rev":   {Size: 5, Mtime: t0, SrcRev: "1"},
+		},
+	}}
+
+	for _, tt := range []struct {
+		name  string
+		rel   string
+		rev   string
+		size  int64
+		mtime time.Time
+		want  bool
+	}{
+		// Without revisions, size and mtime must match.
+		{"Same size and mtime", "plain", "", 5, t0, true},
+		{"Different size", "plain", "", 6, t0, false},
+		{"Different mtime", "plain", "", 5, t0.Add(time.Nanosecond), false},
+		{"Revision not recorded", "plain", "1", 5, t0, true},
+		// With revisions, only the revision matters.
+		{"Same revision", "rev", "1", 6, t0.Add(time.Hour), true},
+		{"New revision", "rev", "2", 5, t0, false},
+		// Sources that lost their revision fall back to size and mtime.
+		{"No revision", "rev", "", 5, t0, true},
+		{"No revision, changed", "rev", "", 5, t0.Add(time.Second), false},
+		{"Not synced", "new", "1", 5, t0, false},
+	} {
+		src := &revVfs{lfs, map[string]string{"src/" + tt.rel: tt.rev}}
+		fi := vfs.FileInfo{Path: "src/" + tt.rel, Size: tt.size, Mtime: tt.mtime}
+		got, err := state.unchanged(context.Background(), "r", tt.rel, src, fi)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Expected %v, got %v (err=%v)", tt.name, tt.want, got, err)
+		}
+	}
+}
+
+// statErrVfs is a local VFS failing to stat files named "b".
+type statErrVfs struct {
+	*localvfs.LocalFileSystem
+}
+
+func (s statErrVfs) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	if filepath.Base(fullpath) == "b" {
+		return vfs.FileInfo{}, fmt.Errorf("permission denied")
+	}
+	return s.LocalFileSystem.Stat(ctx, fullpath)
+}
+
+func TestTombstoneConflicts(t *testing.T) {
+	chdirTemp(t)
+	defer func(policy string) { opt.conflict, opt.exclude = policy, nil }(opt.conflict)
+	opt.conflict = conflictRename
+
+	writeTree(t, ".", map[string]string{"src/a": "src/a", "src/b": "src/b", "dst/": ""})
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	root := "src/ -> dst"
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Files that can't be checked are not buried, and don't fail the sync.
+	opt.exclude = multiString{"b"}
+	if err = os.Remove("src/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(context.Background(), "src/", "dst", statErrVfs{lfs}, lfs, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if state.tombstone(root, "a") == nil || state.tombstone(root, "b") != nil || state.lookup(root, "b") == nil {
+		t.Fatalf("Expected a tombstone for a only, got %+v and %+v", state.tombstone(root, "a"), state.tombstone(root, "b"))
+	}
+
+	// Files created again in the source don't clobber destination
+	// changes made since they were deleted.
+	for name, data := range map[string]string{"src/a": "new source", "dst/a": "new dest"} {
+		if err = ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ix := 0; ix < 2; ix++ {
+		if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, state, nil); err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+	}
+	if got, err := ioutil.ReadFile("dst/a"); err != nil || string(got) != "new dest" {
+		t.Errorf("Expected the destination to be kept, got %q (err=%v)", got, err)
+	}
+	// Only once: the conflict is resolved.
+	aside, err := filepath.Glob("dst/a" + conflictSuffix + "*")
+	if err != nil || len(aside) != 1 {
+		t.Errorf("Expected one conflicting copy, got %v (err=%v)", aside, err)
+	}
+	if state.tombstone(root, "a") != nil || state.lookup(root, "a") == nil {
+		t.Errorf("Expected the entry for a to be restored")
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.mirror, opt.pruneEmpty, opt.noEstimate, events = false, false, false, nil }()
+	opt.mirror, opt.pruneEmpty = true, true
+
+	writeTree(t, ".", map[string]string{"src/a": "abc", "src/d/b": "defgh", "dst/extra": "x"})
+
+	// Return the events written by a sync.
+	run := func() []event {
+		var err error
+		if events, err = openEvents("events"); err != nil {
+			t.Fatal(err)
+		}
+		lfs := localvfs.NewLocalFileSystem()
+		err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil)
+		events.close()
+		events = nil
+		if err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+		data, err := ioutil.ReadFile("events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []event
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var ev event
+			if err = json.Unmarshal([]byte(line), &ev); err != nil {
+				t.Fatalf("Invalid event %q: %v", line, err)
+			}
+			ret = append(ret, ev)
+		}
+		return ret
+	}
+
+	// The estimate comes before any transfer.
+	var est *event
+	for _, ev := range run() {
+		if ev.Event == evEstimate {
+			est = &ev
+			break
+		}
+		if ev.Event == evTransferStart {
+			t.Fatalf("Expected the estimate before transfers")
+		}
+	}
+	if est == nil || est.Files != 2 || est.Bytes != 8 || est.Deletes != 1 || est.Src != "src/" || est.Dst != "dst" {
+		t.Errorf("Expected 2 files, 8 bytes and 1 delete from src/ to dst, got %+v", est)
+	}
+
+	// Overall progress: finished transfers and the progress of those
+	// still running count.
+	var buf bytes.Buffer
+	el := &eventLog{inflight: make(map[string]int64), enc: json.NewEncoder(&buf)}
+	el.estimate("src", "dst", 2, 100, 0)
+	el.transferDone(syncOp{Op: opCopy, Src: "c", Dst: "d"}, 50, time.Second)
+	buf.Reset()
+	el.progress(syncOp{Op: opCopy, Src: "a", Dst: "b"}, 25, 50)
+	var ev event
+	if err := json.Unmarshal(buf.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Percent != 75 || ev.ETA <= 0 {
+		t.Errorf("Expected 75%% done and some time left, got %+v", ev)
+	}
+	el.error("a", errors.New("failed"))
+	if len(el.inflight) != 0 {
+		t.Errorf("Expected failed transfers to be forgotten, got %v", el.inflight)
+	}
+
+	opt.noEstimate = true
+	for _, ev := range run() {
+		if ev.Event == evEstimate {
+			t.Errorf("Expected no estimate with --no-estimate, got %+v", ev)
+		}
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	chdirTemp(t)
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"ok", "changed", "corrupted", "missing", "dir"} {
+		fname := filepath.Join("src", name)
+		if err := os.MkdirAll("src", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte("data of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fname, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir("dst", 0755); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := openManifest("manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	if err = sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, mf); err != nil {
+		t.Fatal(err)
+	}
+	if err = mf.close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest("manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 || entries[0].MD5 == "" || entries[0].SHA256 == "" {
+		t.Fatalf("Expected 5 entries with both checksums, got %+v", entries)
+	}
+
+	// Corrupted files keep their modification time.
+	written := time.Now()
+	if err = ioutil.WriteFile("dst/changed", []byte("new data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	future := written.Add(time.Minute)
+	if err = os.Chtimes("dst/changed", future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile("dst/corrupted", []byte("data of c0rrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes("dst/corrupted", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove("dst/missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove("dst/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir("dst/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []diffEntry{
+		{Path: "dst/changed", Status: verifyChanged, Reason: "sha256"},
+		{Path: "dst/corrupted", Status: verifyCorrupted, Reason: "sha256"},
+		{Path: "dst/dir", Status: verifyChanged, Reason: "type"},
+		{Path: "dst/missing", Status: verifyMissing},
+	}
+	var walks, reads int
+	fsys := readCountVfs{lfs, &walks, &reads}
+	got, err := verifyManifest(context.Background(), fsys, entries, written, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if reads != 3 {
+		t.Errorf("Expected 3 files read, got %d", reads)
+	}
+
+	// With MD5 checksums available, no files are read.
+	lfs.SetChecksum(true)
+	reads = 0
+	for ix := range want[:2] {
+		want[ix].Reason = "md5"
+	}
+	if got, err = verifyManifest(context.Background(), fsys, entries, written, true); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if reads != 0 {
+		t.Errorf("Expected no files read, got %d", reads)
+	}
+
+	// Paths may hold spaces.
+	if err = ioutil.WriteFile("sums", []byte("ABCD  a b\n0123 *c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sums := make(map[string]string)
+	if err = readChecksumFile("sums", sums); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sums, map[string]string{"a b": "abcd", "c": "0123"}) {
+		t.Errorf("Unexpected checksums: %v", sums)
+	}
+	if err = ioutil.WriteFile("sums", []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = readChecksumFile("sums", sums); err == nil {
+		t.Errorf("Expected error reading invalid checksums")
+	}
+}
+
+// revVfs is a local VFS with revisions set by the test.
+type revVfs struct {
+	*localvfs.LocalFileSystem
+	revs map[string]string
+}
+
+func (r *revVfs) Revision(ctx context.Context, fullpath string) (string, error) {
+	return r.revs[fullpath], nil
+}
+
+func TestRevisions(t *testing.T) {
+	chdirTemp(t)
+	for _, d := range []string{"src", "dst"} {
+		os.Mkdir(d, 0755)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, f := range []string{"src/a", "src/b"} {
+		if err := ioutil.WriteFile(f, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	src := &revVfs{lfs, map[string]string{"src/a": "1", "src/b": "1"}}
+	dst := &revVfs{lfs, map[string]string{}}
+	root := "src/ -> dst"
+	if err = sync(context.Background(), "src/", "dst", src, dst, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if entry := state.lookup(root, "a"); entry == nil || entry.SrcRev != "1" || entry.DstRev != "" {
+		t.Fatalf("Expected source revision recorded, got %+v", entry)
+	}
+
+	// Files with the same revision are unchanged whatever their mtime, and
+	// files with a new revision are compared with the destination again,
+	// even with the same mtime.
+	now := time.Now()
+	if err = os.Chtimes("src/a", now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile("src/b", []byte("src/bb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes("src/b", old, old); err != nil {
+		t.Fatal(err)
+	}
+	src.revs["src/b"] = "2"
+	if err = sync(context.Background(), "src/", "dst", src, dst, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if fi, err := os.Stat("dst/a"); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("Expected dst/a not to be copied again")
+	}
+	if data, err := ioutil.ReadFile("dst/b"); err != nil || string(data) != "src/bb" {
+		t.Errorf("Expected dst/b to be copied, got %q (%v)", data, err)
+	}
+
+	// Destination revisions tell if the destination changed.
+	entry := &stateEntry{Size: 3, Mtime: old, DstRev: "7"}
+	for rev, want := range map[string]bool{"7": false, "8": true} {
+		dst.revs["dst/a"] = rev
+		changed, err := dstChanged(context.Background(), entry, dst, "dst/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Errorf("Revision %s: expected changed=%v, got %v", rev, want, changed)
+		}
+	}
+}
+
+func TestExcludeIfPresent(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.excludeIfPresent, opt.mirror = nil, false }()
+	opt.excludeIfPresent = multiString{".nobackup", "CACHEDIR.TAG"}
+
+	files := make(map[string]string)
+	for _, f := range []string{"src/a", "src/d/b", "src/skip/c", "src/skip/.nobackup", "src/d/[x]/CACHEDIR.TAG", "src/d/[x]/e/f", "src/d/x/g", "dst/skip/old"} {
+		files[f] = f
+	}
+	writeTree(t, ".", files)
+	// Excluded directories are left alone in the destination.
+	opt.mirror = true
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for f, want := range map[string]bool{"a": true, "d/b": true, "d/x/g": true, "skip": true, "skip/old": true, "skip/c": false, "d/[x]": false} {
+		if _, err := os.Stat(filepath.Join("dst", f)); (err == nil) != want {
+			t.Errorf("%s: Expected exists=%v, got %v", f, want, err)
+		}
+	}
+}
+
+func TestExcludeGitignored(t *testing.T) {
+	chdirTemp(t)
+	defer func(l *slog.Logger) { log = l }(log)
+	defer func() { opt.excludeGitignored = false }()
+	opt.excludeGitignored = true
+
+	files := map[string]string{
+		"src/.gitignore":      "# Comment\n*.log\n!keep.log\nbuild/\nsub/tmp\n",
+		"src/a.log":           "",
+		"src/keep.log":        "",
+		"src/b.txt":           "",
+		"src/build/x":         "",
+		"src/sub/tmp":         "",
+		"src/sub/.gitignore":  "*.bak\n",
+		"src/sub/c.bak":       "",
+		"src/sub/d":           "",
+		"src/c.bak":           "",
+		"src/other/sub/tmp":   "",
+		"src/other/build":     "",
+		"src/.git/HEAD":       "",
+		"src/mod/.git":        "gitdir: ../.git/modules/mod",
+		"src/mod/e":           "",
+		"src/.gitattributes":  "",
+		"src/.github/ci.yaml": "",
+		"dst/":                "",
+	}
+	writeTree(t, ".", files)
+
+	var buf bytes.Buffer
+	log = slog.New(slog.NewTextHandler(&buf, nil))
+	lfs := localvfs.NewLocalFileSystem()
+	if err := sync(context.Background(), "src/", "dst", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for name, want := range map[string]bool{
+		".gitignore":      true,
+		"a.log":           false,
+		"keep.log":        false,
+		"b.txt":           true,
+		"build":           false,
+		"sub/tmp":         false,
+		"sub/c.bak":       false,
+		"sub/d":           true,
+		"c.bak":           true,
+		"other/sub/tmp":   true,
+		"other/build":     true,
+		".git":            false,
+		"mod/.git":        false,
+		"mod/e":           true,
+		".gitattributes":  true,
+		".github/ci.yaml": true,
+	} {
+		if _, err := os.Stat(filepath.Join("dst", name)); (err == nil) != want {
+			t.Errorf("%s: Expected exists=%v, got %v", name, want, err)
+		}
+	}
+	// Negated patterns are not supported, and say so.
+	if !strings.Contains(buf.String(), "level=WARN msg=\"ignoring unsupported pattern\"") || !strings.Contains(buf.String(), "pattern=!keep.log") {
+		t.Errorf("Expected a warning about the negated pattern, got:\n%s", buf.String())
+	}
+}
+
+// freeVfs is a local VFS reporting a fixed amount of free space.
+type freeVfs struct {
+	*localvfs.LocalFileSystem
+	free int64
+}
+
+func (f *freeVfs) FreeSpace(ctx context.Context, fullpath string) (int64, error) {
+	return f.free, nil
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	chdirTemp(t)
+	defer func() { opt.minFreeSpace = 0 }()
+	opt.minFreeSpace = 1000
+
+	writeTree(t, ".", map[string]string{"src/small": strings.Repeat("x", 10), "src/large": strings.Repeat("x", 600), "dst/": ""})
+
+	// Files that would leave less than the minimum are skipped.
+	lfs := localvfs.NewLocalFileSystem()
+	dst := &freeVfs{lfs, 1500}
+	if err := sync(context.Background(), "src/", "dst", lfs, dst, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if _, err := os.Stat("dst/small"); err != nil {
+		t.Errorf("Expected small file copied: %v", err)
+	}
+	if _, err := os.Stat("dst/large"); err == nil {
+		t.Errorf("Expected large file skipped")
+	}
+
+	// Nothing is written once the free space is below the minimum.
+	os.Remove("dst/small")
+	dst.free = 999
+	err := sync(context.Background(), "src/", "dst", lfs, dst, nil, nil, nil)
+	if !errors.Is(err, errNoFreeSpace) {
+		t.Errorf("Expected errNoFreeSpace, got %v", err)
+	}
+	if _, err = os.Stat("dst/small"); err == nil {
+		t.Errorf("Expected nothing copied")
+	}
+
+	// The real free space is known locally.
+	free, err := lfs.FreeSpace(context.Background(), "dst/missing/file")
+	if err != nil || free == 0 {
+		t.Errorf("Expected the free space of dst, got %d (%v)", free, err)
+	}
+}
+
+func TestTree(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"b/c/d": strings.Repeat("x", 2048), "b/e": strings.Repeat("x", 10), "a": "x", "x.tmp": strings.Repeat("x", 5)})
+	defer func() { opt.exclude = nil }()
+	opt.exclude = multiString{"*.tmp"}
+
+	tree, err := buildTree(context.Background(), localvfs.NewLocalFileSystem(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.name = "top"
+	for _, tt := range []struct {
+		depth int
+		want  string
+	}{
+		{0, "[  2.0K]  top/\n├── [     1]  a\n└── [  2.0K]  b/\n    ├── [  2.0K]  c/\n    │   └── [  2.0K]  d\n    └── [    10]  e\n\n2 directories, 3 files, 2.0K\n"},
+		{1, "[  2.0K]  top/\n├── [     1]  a\n└── [  2.0K]  b/\n\n2 directories, 3 files, 2.0K\n"},
+	} {
+		var buf bytes.Buffer
+		if err = printTree(&buf, tree, tt.depth, treeLabel); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("depth=%d: Expected:\n%s\ngot:\n%s", tt.depth, tt.want, buf.String())
+		}
+	}
+
+	for size, want := range map[int64]string{-1: "?", 0: "0", 1023: "1023", 1536: "1.5K", 3 << 30: "3.0G"} {
+		if got := humanSize(size); got != want {
+			t.Errorf("humanSize(%d): Expected %q, got %q", size, want, got)
+		}
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "a", "d/b.html": "a", "d/e/c": "a"})
+	lfs := localvfs.NewLocalFileSystem()
+	lfs.SetChecksum(true)
+
+	var buf bytes.Buffer
+	n, err := listJSON(context.Background(), &buf, lfs, dir, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []lsEntry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e lsEntry
+		if err = dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		e.Mtime = time.Time{}
+		got = append(got, e)
+	}
+	want := []lsEntry{
+		{Path: "a.txt", Size: 1, MimeType: mime.TypeByExtension(".txt"), MD5: "0cc175b9c0f1b6a831c399e269772661"},
+		{Path: "d", Size: got[1].Size, MimeType: dirMimeType, IsDir: true},
+		{Path: "d/b.html", Size: 1, MimeType: mime.TypeByExtension(".html"), MD5: "0cc175b9c0f1b6a831c399e269772661"},
+		{Path: "d/e", Size: got[3].Size, MimeType: dirMimeType, IsDir: true},
+	}
+	if n != len(want) || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %d entries %+v, got %d %+v", len(want), want, n, got)
+	}
+
+	// Files are listed by name.
+	buf.Reset()
+	if _, err = listJSON(context.Background(), &buf, lfs, filepath.Join(dir, "a.txt"), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), `{"path":"a.txt","size":1,`) {
+		t.Errorf("Unexpected listing of a file: %s", buf.String())
+	}
+}
+
+func TestListFormat(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": strings.Repeat("x", 2048), "d/b": strings.Repeat("x", 10)})
+	lfs := localvfs.NewLocalFileSystem()
+	// Local directories have sizes of their own, but directories in trees
+	// show the total size of their files.
+	format, err := parseListFormat("{{if .IsDir}}-{{else}}{{size .Size}}{{end}}\t{{.Path}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err = listJSON(context.Background(), &buf, lfs, dir, 0, format); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2.0K\ta\n-\td\n10\td/b\n"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+
+	tree, err := buildTree(context.Background(), lfs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.name = "top"
+	buf.Reset()
+	if format, err = parseListFormat("{{size .Size}} {{.Name}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err = printTree(&buf, tree, 0, treeFormat(context.Background(), lfs, format)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2.0K top\n├── 2.0K a\n└── 10 d\n    └── 10 b\n\n1 directory, 2 files, 2.0K\n"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+
+	if _, err = parseListFormat("{{.Size"); err == nil {
+		t.Errorf("Expected error parsing invalid format")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "", "d/b": "", "d/skip": ""})
+	defer func() { opt.exclude = nil }()
+	opt.exclude = multiString{"skip"}
+	lfs := localvfs.NewLocalFileSystem()
+	mtime, err := parseTouchTime("2001-02-03 04:05:06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2001, 2, 3, 4, 5, 6, 0, time.Local); !mtime.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, mtime)
+	}
+	if _, err = parseTouchTime("yesterday"); err == nil {
+		t.Errorf("Expected error parsing invalid time")
+	}
+
+	check := func(want map[string]bool) {
+		for name, touched := range want {
+			fi, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.ModTime().Equal(mtime) != touched {
+				t.Errorf("%s: Expected touched=%v, got mtime %v", name, touched, fi.ModTime())
+			}
+		}
+	}
+	n, err := touchTree(context.Background(), lfs, filepath.Join(dir, "a"), mtime, false)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 path touched, got %d (%v)", n, err)
+	}
+	check(map[string]bool{"a": true, "d": false, "d/b": false})
+
+	// Directories are set after their contents.
+	n, err = touchTree(context.Background(), lfs, dir, mtime, true)
+	if err != nil || n != 4 {
+		t.Fatalf("Expected 4 paths touched, got %d (%v)", n, err)
+	}
+	check(map[string]bool{".": true, "d": true, "d/b": true, "d/skip": false})
+}
+
+func TestCopyTo(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.pdf")
+	if err := ioutil.WriteFile(src, []byte("Q1 report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "reports"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+
+	dst := filepath.Join(dir, "reports", "2024-q1.pdf")
+	if err := copyTo(ctx, src, lfs, dst, lfs, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil || string(data) != "Q1 report" {
+		t.Fatalf("Expected the file copied to %s, got %q (%v)", dst, data, err)
+	}
+
+	// Copies with the same size and modification time are left alone.
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dst, []byte("Q1 REPORT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyTo(ctx, src, lfs, dst, lfs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = ioutil.ReadFile(dst); string(data) != "Q1 REPORT" {
+		t.Errorf("Expected %s not to be copied again, got %q", dst, data)
+	}
+
+	for _, bad := range []string{filepath.Join(dir, "reports"), filepath.Join(dir, "missing", "2024-q1.pdf")} {
+		if err = copyTo(ctx, src, lfs, bad, lfs, nil); err == nil {
+			t.Errorf("Expected error copying to %s", bad)
+		}
+	}
+	if err = copyTo(ctx, filepath.Join(dir, "reports"), lfs, filepath.Join(dir, "copy"), lfs, nil); err == nil {
+		t.Errorf("Expected error copying a directory")
+	}
+}
+
+func TestSyncFileToFile(t *testing.T) {
+	chdirTemp(t)
+	writeTree(t, ".", map[string]string{"notes.txt": "new notes", "remote.txt": "old", "dir/keep": "keep"})
+	lfs := localvfs.NewLocalFileSystem()
+	ctx := context.Background()
+
+	if err := sync(ctx, "notes.txt", "remote.txt", lfs, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if got, err := ioutil.ReadFile("remote.txt"); err != nil || string(got) != "new notes" {
+		t.Errorf("Expected remote.txt to be updated, got %q (err=%v)", got, err)
+	}
+	if _, err := os.Stat("remote.txt/notes.txt"); err == nil {
+		t.Errorf("Expected no file created under remote.txt")
+	}
+
+	// Directories can't be synced to files.
+	if err := sync(ctx, "dir", "remote.txt", lfs, lfs, nil, nil, nil); err == nil {
+		t.Errorf("Expected error syncing a directory to a file")
+	}
+}
+
+// slowVfs delays Stat calls by a fixed time.
+type slowVfs struct {
+	vfs.VFS
+	delay time.Duration
+}
+
+func (s slowVfs) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	time.Sleep(s.delay)
+	return s.VFS.Stat(ctx, fullpath)
+}
+
+func TestTimeoutVfs(t *testing.T) {
+	dir := t.TempDir()
+	lfs := localvfs.NewLocalFileSystem()
+	tv := newTimeoutVfs(slowVfs{VFS: lfs, delay: 50 * time.Millisecond}, 5*time.Millisecond)
+	if _, err := tv.Stat(context.Background(), dir); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Expected Stat to time out, got %v", err)
+	}
+	tv.timeout = time.Second
+	if fi, err := tv.Stat(context.Background(), dir); err != nil || !fi.IsDir() {
+		t.Errorf("Expected Stat of a directory, got %+v (%v)", fi, err)
+	}
+
+	// Timeouts too short for a tenth of them to be a valid ticker interval.
+	tv = newTimeoutVfs(lfs, time.Nanosecond)
+	tv.WriteToFile(context.Background(), filepath.Join(dir, "foo"), strings.NewReader("foo"))
+}
+
+// metaVfs returns fixed metadata for every file.
+type metaVfs struct {
+	vfs.VFS
+	meta map[string]string
+}
+
+func (m metaVfs) Metadata(context.Context, string) (map[string]string, error) {
+	return m.meta, nil
+}
+
+func TestStaleMetadataMtime(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := ioutil.WriteFile(dst, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs := localvfs.NewLocalFileSystem()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range []struct {
+		meta time.Time
+		want time.Time
+	}{
+		// Exact times of the same second are restored.
+		{mtime.Add(123456789), mtime.Add(123456789)},
+		// Times recorded before the source was modified are stale.
+		{mtime.Add(-time.Hour), mtime},
+	} {
+		if err := os.Chtimes(dst, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		src := metaVfs{VFS: lfs, meta: map[string]string{localvfs.MetaMtime: strconv.FormatInt(tt.meta.UnixNano(), 10)}}
+		if err := copyMetadata(context.Background(), src, lfs, "src", dst, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if fi, err := os.Stat(dst); err != nil || !fi.ModTime().Equal(tt.want) {
+			t.Errorf("Expected mtime %v, got %v (%v)", tt.want, fi.ModTime(), err)
+		}
+	}
+}
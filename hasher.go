@@ -0,0 +1,120 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// hashJob is a file listed in the source, waiting for its checksums to be
+// computed. Ready is closed when done.
+type hashJob struct {
+	fi    vfs.FileInfo
+	ready chan struct{}
+}
+
+// Compute the checksums of local files listed in paths ahead of the planner,
+// with up to --hashers concurrent workers, so hashing the next files overlaps
+// with transferring the current ones. Checksums are stored in the hash cache
+// of the local backend, where the planner finds them. Files are passed on to
+// the returned channel in their original order, each once its checksums are
+// ready. Files are only hashed when the planner would compare checksums
+// (see needToCopy), so paths is returned unchanged without --checksum, or if
+// neither side is local.
+//
+// Return:
+//   <-chan vfs.FileInfo
+func hashAhead(ctx context.Context, srcpath string, dstdir string, srcvfs vfs.VFS, dstvfs vfs.VFS, paths <-chan vfs.FileInfo, done <-chan struct{}) <-chan vfs.FileInfo {
+	n := opt.hashers
+	if n < 1 || !opt.checksum || opt.ignoreTimes || !vfs.CapabilitiesOf(srcvfs).Checksum || !vfs.CapabilitiesOf(dstvfs).Checksum {
+		return paths
+	}
+	if !isLocalVfs(srcvfs) && !isLocalVfs(dstvfs) {
+		return paths
+	}
+
+	out := make(chan vfs.FileInfo, pipelineBuffer)
+	// Jobs in the order they were listed. The size of the queue limits how
+	// far ahead of the planner files are hashed.
+	queue := make(chan hashJob, n)
+	jobs := make(chan hashJob)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range jobs {
+				hashFile(ctx, srcvfs, dstvfs, j.fi, destPath(srcpath, dstdir, j.fi.Path))
+				close(j.ready)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		for fi := range paths {
+			j := hashJob{fi: fi, ready: make(chan struct{})}
+			select {
+			case queue <- j:
+			case <-done:
+				return
+			}
+			// Excluded files are filtered by the planner, but there's no
+			// point in hashing them.
+			exc, err := excluded(destPath(srcpath, "", fi.Path))
+			if !fi.IsRegular() || exc || err != nil {
+				close(j.ready)
+				continue
+			}
+			select {
+			case jobs <- j:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		for j := range queue {
+			select {
+			case <-j.ready:
+			case <-done:
+				return
+			}
+			select {
+			case out <- j.fi:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Compute the checksums of the source file described by fi and its
+// destination dst, on the sides where that means reading the file (local
+// backends), and only if the destination exists with the same size. Errors
+// are ignored, since the planner reads the checksums again and reports them.
+func hashFile(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, fi vfs.FileInfo, dst string) {
+	dstfi, err := dstvfs.Stat(ctx, dst)
+	if err != nil || !dstfi.IsRegular() {
+		return
+	}
+	if !opt.ignoreSize && fi.Size >= 0 && dstfi.Size >= 0 && fi.Size != dstfi.Size {
+		return
+	}
+	for _, f := range []struct {
+		fsys vfs.VFS
+		path string
+	}{{srcvfs, fi.Path}, {dstvfs, dst}} {
+		if v, ok := f.fsys.(vfs.MD5er); ok && isLocalVfs(f.fsys) {
+			if _, err = v.MD5(ctx, f.path); err != nil {
+				log.Debug("unable to hash ahead", "path", f.path, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs/archive"
+)
+
+// Prefixes of archive paths (as in "tar:/backups/home.tar.gz"), and the
+// corresponding archive formats.
+var archivePrefixes = map[string]string{
+	"tar:": archivevfs.FormatTar,
+	"zip:": archivevfs.FormatZip,
+}
+
+// Check if pathname names an archive, starting with one of archivePrefixes.
+// If so, return the archive format and the name of the archive file.
+// Otherwise, return an empty format and the path itself.
+//
+// Returns:
+//   format
+//   string
+func parseArchivePath(pathname string) (string, string) {
+	for prefix, format := range archivePrefixes {
+		if strings.HasPrefix(pathname, prefix) {
+			return format, strings.TrimPrefix(pathname, prefix)
+		}
+	}
+	return "", pathname
+}
+
+// Initializes a new ArchiveVFS writing a new archive in format to fname. The
+// archive is only complete after Close is called.
+//
+// Returns:
+//   *archivevfs.ArchiveFileSystem
+//   error
+func initArchiveVfs(format string, fname string) (*archivevfs.ArchiveFileSystem, error) {
+	a, err := archivevfs.NewArchiveFileSystem(fname, format)
+	if err != nil {
+		return nil, err
+	}
+	a.SetLogger(localLog)
+	return a, nil
+}
+
+// Initializes a new ArchiveSourceVFS reading the archive in format named
+// fname.
+//
+// Returns:
+//   *archivevfs.ArchiveSourceFileSystem
+//   error
+func initArchiveSourceVfs(format string, fname string) (*archivevfs.ArchiveSourceFileSystem, error) {
+	a, err := archivevfs.NewArchiveSourceFileSystem(fname, format)
+	if err != nil {
+		return nil, err
+	}
+	a.SetLogger(localLog)
+	return a, nil
+}
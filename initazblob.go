@@ -0,0 +1,63 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"os"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/azblob"
+)
+
+// Prefix of Azure Blob Storage paths, as in "azblob://container/path".
+const azblobPrefix = "azblob://"
+
+// Check if pathname is an Azure Blob Storage path. If so, return true and the
+// path without the prefix (starting with the container name). Otherwise,
+// return false and the path itself.
+//
+// Returns:
+//   bool
+//   string
+func parseAzblobPath(pathname string) (bool, string) {
+	if !strings.HasPrefix(pathname, azblobPrefix) {
+		return false, pathname
+	}
+	p := strings.TrimPrefix(pathname, azblobPrefix)
+	if p == "" {
+		return true, "/"
+	}
+	return true, p
+}
+
+// Initializes a new AzblobVFS instance. The storage account and credentials
+// come from the same environment variables used by the Azure CLI:
+// AZURE_STORAGE_ACCOUNT, and either AZURE_STORAGE_KEY or
+// AZURE_STORAGE_SAS_TOKEN. AZURE_STORAGE_BLOB_ENDPOINT overrides the default
+// endpoint of the account (useful with emulators like Azurite).
+//
+// Returns:
+//   vfs.VFS
+//   error
+func initAzblobVfs() (vfs.VFS, error) {
+	if err := setupProxy(opt.proxy); err != nil {
+		return nil, err
+	}
+	a, err := azblobvfs.NewAzblobFileSystem(
+		os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		os.Getenv("AZURE_STORAGE_KEY"),
+		os.Getenv("AZURE_STORAGE_SAS_TOKEN"),
+		os.Getenv("AZURE_STORAGE_BLOB_ENDPOINT"))
+	if err != nil {
+		return nil, err
+	}
+	a.SetLogger(azblobLog)
+	a.SetBufferSize(int(opt.bufferSize))
+	if opt.readOnly {
+		a.SetReadOnly(true)
+	}
+	return a, nil
+}
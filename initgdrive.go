@@ -8,17 +8,109 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
 	"os/user"
 	"path"
+	"strings"
 
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/marcopaganini/gsync/vfs"
 	"github.com/marcopaganini/gsync/vfs/gdrive"
 )
 
 const (
 	authCacheFile   = ".gsync-token-cache.json"
 	credentialsFile = ".gsync-credentials.json"
+
+	// Default directory for resumable upload sessions (--upload-session-dir)
+	uploadSessionDir = ".gsync-upload-sessions"
+
+	// Default OAuth scope (--scope)
+	defaultScope = "drive"
+
+	// Scope used to access the application data folder. This is not
+	// selectable with --scope, but implied by paths under appDataPrefix.
+	appDataScope = "drive.appdata"
+
+	// Paths under this top level folder refer to the hidden application data
+	// folder (appDataFolder), as in "gdrive:appdata/state".
+	appDataPrefix = "appdata"
 )
 
+// Supported OAuth scopes (--scope)
+var driveScopes = map[string]string{
+	"drive":          drive.DriveScope,
+	"drive.file":     drive.DriveFileScope,
+	"drive.readonly": drive.DriveReadonlyScope,
+}
+
+// Check if pathname (without the remote prefix) points inside the application
+// data folder. If so, return true and the path relative to the folder.
+//
+// Returns:
+//   bool
+//   string
+func appDataPath(pathname string) (bool, string) {
+	p := strings.TrimLeft(pathname, "/")
+	if p == appDataPrefix {
+		return true, "/"
+	}
+	if strings.HasPrefix(p, appDataPrefix+"/") {
+		return true, p[len(appDataPrefix):]
+	}
+	return false, pathname
+}
+
+// Add suffix to the base name of fname, before the extension.
+func addSuffix(fname string, suffix string) string {
+	ext := path.Ext(fname)
+	return strings.TrimSuffix(fname, ext) + "-" + suffix + ext
+}
+
+// Return the credentials file for the given remote. The default remote
+// ("g:" or "gdrive:") is represented by an empty string.
+func credentialsFileFor(homedir string, remote string) string {
+	if remote == "" {
+		return path.Join(homedir, credentialsFile)
+	}
+	return path.Join(homedir, addSuffix(credentialsFile, remote))
+}
+
+// Return the token cache file for the given remote and scope. Tokens are only
+// valid for the account and scope they were issued for, so each combination
+// gets its own cache.
+func tokenCacheFile(homedir string, remote string, scope string) string {
+	fname := authCacheFile
+	if remote != "" {
+		fname = addSuffix(fname, remote)
+	}
+	if scope != defaultScope {
+		fname = addSuffix(fname, scope)
+	}
+	return path.Join(homedir, fname)
+}
+
+// Return true if remote names a configured remote (one with a credentials
+// file) or the remote being configured with --remote.
+func isRemote(remote string) bool {
+	if remote == "" || strings.ContainsAny(remote, "/\\") {
+		return false
+	}
+	if remote == opt.remote {
+		return true
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(credentialsFileFor(usr.HomeDir, remote))
+	return err == nil
+}
+
 // GdriveCredentials contain the ClientID & secret credentials for Google Drive.
 type GdriveCredentials struct {
 	ClientID     string
@@ -39,13 +131,8 @@ func handleCredentials(credFile string, clientID string, clientSecret string) (*
 	// If client, secret and code specified, save config
 	if clientID != "" && clientSecret != "" {
 		cred = &GdriveCredentials{ClientID: clientID, ClientSecret: clientSecret}
-		j, err := json.Marshal(*cred)
-		if err != nil {
-			return nil, fmt.Errorf("Unable to convert configuration to JSON: %v", err)
-		}
-
-		if ioutil.WriteFile(credFile, j, 0600) != nil {
-			return nil, fmt.Errorf("Unable to write configuration file \"%s\": %v", credFile, err)
+		if err := saveCredentials(credFile, cred); err != nil {
+			return nil, err
 		}
 	} else {
 		j, err := ioutil.ReadFile(credFile)
@@ -60,31 +147,205 @@ func handleCredentials(credFile string, clientID string, clientSecret string) (*
 	return cred, nil
 }
 
-// Initializes a new GdriveVFS instance. This is a helper wrapper to gdrivefs.NewGdriveFileSystem.
-// This function calls handleCredentials to load/save the token and act on the Oauth code, if needed.
+// Save cred to credFile, readable only by the user.
 //
 // Returns:
-//   gsyncVfs
 //   error
-func initGdriveVfs(clientID string, clientSecret string, code string) (gsyncVfs, error) {
+func saveCredentials(credFile string, cred *GdriveCredentials) error {
+	j, err := json.Marshal(*cred)
+	if err != nil {
+		return fmt.Errorf("Unable to convert configuration to JSON: %v", err)
+	}
+	if err = ioutil.WriteFile(credFile, j, 0600); err != nil {
+		return fmt.Errorf("Unable to write configuration file \"%s\": %v", credFile, err)
+	}
+	return nil
+}
+
+// The standard HTTP transport, before any wrapping (see setupTransport).
+var baseTransport, _ = http.DefaultTransport.(*http.Transport)
+
+// Install the retryTransport on top of the default HTTP transport, so all
+// requests to Google Drive handle rate limiting and quota errors, with the
+// apiCounters accounting for Drive API calls around it. Every request sent is
+// logged with --dump-http. This must be called once, before any Google Drive
+// filesystem is initialized.
+func setupTransport() {
+	var base http.RoundTripper = http.DefaultTransport
+	if opt.dumpHTTP || opt.dumpHTTPBodies {
+		// The format was validated by setupLogging.
+		l, _ := newLogger(os.Stderr, opt.logFormat, "dump", slog.LevelInfo)
+		base = &httpDumper{base: base, bodies: opt.dumpHTTPBodies, log: l}
+	}
+	units := &apiCounter{base: base, stats: apiCalls, units: true}
+	http.DefaultTransport = &apiCounter{base: newRetryTransport(units, opt.quotaWait), stats: apiCalls}
+}
+
+// Configure the proxy used by all HTTP clients, including the OAuth and Drive
+// clients used by the gdrive VFS. If proxy is empty, the standard HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables are honored, falling back to
+// ALL_PROXY if none of them are set. HTTP, HTTPS and SOCKS5 proxies are
+// supported (e.g. socks5://localhost:1080).
+//
+// Returns:
+//   error
+func setupProxy(proxy string) error {
+	transport := baseTransport
+	if transport == nil {
+		return fmt.Errorf("Unable to configure proxy: unsupported default HTTP transport")
+	}
+
+	if proxy == "" {
+		for _, v := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+			if os.Getenv(v) != "" {
+				// Handled by http.ProxyFromEnvironment.
+				return nil
+			}
+		}
+		if proxy = os.Getenv("ALL_PROXY"); proxy == "" {
+			proxy = os.Getenv("all_proxy")
+		}
+		if proxy == "" {
+			return nil
+		}
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("Invalid proxy \"%s\": %v", proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("Invalid proxy \"%s\": scheme must be http, https or socks5", proxy)
+	}
+	transport.Proxy = http.ProxyURL(u)
+	gdriveLog.Debug("using proxy", "host", u.Host)
+	return nil
+}
+
+// Load the credentials for the given remote and OAuth scope, and return them
+// along with the name of the token cache file to use.
+//
+// Returns:
+//   *GdriveCredentials
+//   cachefile
+//   error
+func loadGdriveCredentials(remote string, clientID string, clientSecret string, scopeName string, scope string) (*GdriveCredentials, string, error) {
 	// Credentials and cache file
 	usr, err := user.Current()
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	credfile := credentialsFileFor(usr.HomeDir, remote)
+	cachefile := tokenCacheFile(usr.HomeDir, remote, scopeName)
+
+	err = setupProxy(opt.proxy)
+	if err != nil {
+		return nil, "", err
 	}
-	credfile := path.Join(usr.HomeDir, credentialsFile)
-	cachefile := path.Join(usr.HomeDir, authCacheFile)
 
-	// Load/save credentials
-	cred, err := handleCredentials(credfile, clientID, clientSecret)
+	// Load/save credentials. When impersonating a user through a service
+	// account, a fresh access token is placed in a separate token cache.
+	var cred *GdriveCredentials
+	if opt.impersonate != "" {
+		if opt.serviceAccount == "" {
+			return nil, "", fmt.Errorf("--impersonate requires --service-account")
+		}
+		key, token, err := impersonationToken(opt.serviceAccount, opt.impersonate, scope)
+		if err != nil {
+			return nil, "", err
+		}
+		cachefile, err = tokens.open(addSuffix(cachefile, opt.impersonate))
+		if err != nil {
+			return nil, "", err
+		}
+		if err = oauth.CacheFile(cachefile).PutToken(token); err != nil {
+			return nil, "", err
+		}
+		cred = &GdriveCredentials{ClientID: key.ClientID}
+	} else {
+		cred, err = handleCredentials(credfile, clientID, clientSecret)
+		if err != nil {
+			return nil, "", err
+		}
+		if cachefile, err = tokens.open(cachefile); err != nil {
+			return nil, "", err
+		}
+	}
+	return cred, cachefile, nil
+}
+
+// Initializes a new GdriveVFS instance for the given remote ("" for the default
+// remote). This is a helper wrapper to gdrivefs.NewGdriveFileSystem. This
+// function calls handleCredentials to load/save the token and act on the Oauth
+// code, if needed.
+//
+// Returns:
+//   vfs.VFS
+//   error
+func initGdriveVfs(remote string, clientID string, clientSecret string, code string) (vfs.VFS, error) {
+	scope, ok := driveScopes[opt.scope]
+	if !ok {
+		return nil, fmt.Errorf("Invalid scope \"%s\"", opt.scope)
+	}
+	cred, cachefile, err := loadGdriveCredentials(remote, clientID, clientSecret, opt.scope, scope)
 	if err != nil {
 		return nil, err
 	}
 
 	// Initialize virtual filesystems
-	g, err := gdrivevfs.NewGdriveFileSystem(cred.ClientID, cred.ClientSecret, opt.code, cachefile)
+	g, err := gdrivevfs.NewGdriveFileSystem(cred.ClientID, cred.ClientSecret, code, scope, cachefile)
+	if err != nil {
+		return nil, err
+	}
+	formats, err := loadExportFormats(opt.exportFormats)
 	if err != nil {
 		return nil, err
 	}
+	g.SetExportFormats(formats)
+	g.SetSkipFunc(unexportableSkipped)
+	g.SetLogger(gdriveLog)
+
+	sessionDir := opt.uploadSessionDir
+	if sessionDir == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		sessionDir = path.Join(usr.HomeDir, uploadSessionDir)
+	}
+	g.SetUploadSessionDir(sessionDir)
+	g.SetBufferSize(int(opt.bufferSize))
+	g.SetDownloadStreams(opt.downloadStreams)
+	g.SetUploadConcurrency(opt.uploadConcurrency)
+
+	// Writes would fail anyway with a read-only scope, but fail early.
+	if opt.readOnly || scope == drive.DriveReadonlyScope {
+		g.SetReadOnly(true)
+	}
 	return g, nil
 }
+
+// Initializes a VFS for the hidden application data folder of the given
+// remote. Access to this folder uses a separate scope (drive.appdata) and
+// therefore a separate authorization and token cache.
+//
+// Returns:
+//   vfs.VFS
+//   error
+func initAppDataVfs(remote string, clientID string, clientSecret string, code string) (vfs.VFS, error) {
+	cred, cachefile, err := loadGdriveCredentials(remote, clientID, clientSecret, appDataScope, drive.DriveAppdataScope)
+	if err != nil {
+		return nil, err
+	}
+	a, err := gdrivevfs.NewAppDataFileSystem(cred.ClientID, cred.ClientSecret, code, cachefile)
+	if err != nil {
+		return nil, err
+	}
+	a.SetLogger(gdriveLog)
+	if opt.readOnly {
+		a.SetReadOnly(true)
+	}
+	return a, nil
+}
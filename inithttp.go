@@ -0,0 +1,99 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs/http"
+)
+
+// Prefix of URL manifests, as in "urls:/data/files.txt". The manifest is a
+// local file or a URL listing the URLs to read.
+const urlsPrefix = "urls:"
+
+// Check if pathname is an HTTP source: an http or https URL, or a manifest of
+// URLs. If so, return true. Otherwise, return false.
+//
+// Returns:
+//   bool
+func isHTTPPath(pathname string) bool {
+	for _, prefix := range []string{"http://", "https://", urlsPrefix} {
+		if strings.HasPrefix(pathname, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Initializes a new HTTPVFS instance for pathname, which must be a URL (a
+// single file, or a directory listing if it ends in a slash) or a manifest of
+// URLs (see httpvfs.ReadManifest).
+//
+// Returns:
+//   *httpvfs.HTTPFileSystem
+//   error
+func initHTTPVfs(pathname string) (*httpvfs.HTTPFileSystem, error) {
+	if err := setupProxy(opt.proxy); err != nil {
+		return nil, err
+	}
+
+	var (
+		h   *httpvfs.HTTPFileSystem
+		err error
+	)
+	if !strings.HasPrefix(pathname, urlsPrefix) {
+		h, err = httpvfs.NewHTTPFileSystem(pathname)
+	} else {
+		var files map[string]string
+		files, err = readURLManifest(strings.TrimPrefix(pathname, urlsPrefix))
+		if err == nil {
+			h, err = httpvfs.NewHTTPListFileSystem(files)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.SetLogger(httpLog)
+	return h, nil
+}
+
+// Read the manifest of URLs in name, which is a local file or an http or
+// https URL.
+//
+// Returns:
+//   map[string]string: URLs by name
+//   error
+func readURLManifest(name string) (map[string]string, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		resp, err := http.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Unable to read manifest \"%s\": %s", name, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	files, err := httpvfs.ReadManifest(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest \"%s\": %v", name, err)
+	}
+	return files, nil
+}
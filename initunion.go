@@ -0,0 +1,70 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/union"
+)
+
+// Prefix of union sources, as in "union:/data,/home/me/docs".
+const unionPrefix = "union:"
+
+// Check if pathname is a union source. If so, return true and the
+// directories in the union, in order. Otherwise, return false and nil.
+//
+// Returns:
+//   bool
+//   []string
+func parseUnionPath(pathname string) (bool, []string) {
+	if !strings.HasPrefix(pathname, unionPrefix) {
+		return false, nil
+	}
+	var roots []string
+	for _, r := range strings.Split(strings.TrimPrefix(pathname, unionPrefix), ",") {
+		if r != "" {
+			roots = append(roots, r)
+		}
+	}
+	return true, roots
+}
+
+// Initializes a new UnionVFS overlaying the local directories roots in lfs,
+// with collisions resolved as set by --union-precedence.
+//
+// Returns:
+//   *unionvfs.UnionFileSystem
+//   error
+func initUnionVfs(roots []string, lfs vfs.VFS) (*unionvfs.UnionFileSystem, error) {
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("Unions need at least one directory, as in \"%s/data,/home/me/docs\"", unionPrefix)
+	}
+	var members []unionvfs.Member
+	for _, r := range roots {
+		isAzblob, _ := parseAzblobPath(r)
+		_, isGdrive, _ := parseRemotePath(r)
+		if format, _ := parseArchivePath(r); format != "" || isHTTPPath(r) || isAzblob || isGdrive {
+			return nil, fmt.Errorf("Union members must be local directories: \"%s\"", r)
+		}
+		fi, err := lfs.Stat(context.Background(), r)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, fmt.Errorf("Union member \"%s\" is not a directory", r)
+		}
+		members = append(members, unionvfs.Member{FS: lfs, Root: r})
+	}
+	u, err := unionvfs.NewUnionFileSystem(members, opt.unionPrecedence)
+	if err != nil {
+		return nil, err
+	}
+	u.SetLogger(localLog)
+	return u, nil
+}
@@ -0,0 +1,344 @@
+//go:build integration
+// +build integration
+
+package main
+
+// Integration tests running full syncs against the fake Google Drive server
+// in fakedrive_test.go. Run with "go test -tags integration".
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+	"code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/marcopaganini/gsync/vfs/gdrive"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Size of upload chunks used in these tests, so files larger than this are
+// uploaded with resumable sessions and downloaded with parallel streams.
+const testChunkSize = 256 << 10
+
+// Return a GdriveFileSystem talking to the fake Drive fd, authenticated with
+// a cached token.
+func newFakeGdrive(t *testing.T, fd *fakeDrive) *gdrivevfs.GdriveFileSystem {
+	cachefile := filepath.Join(t.TempDir(), "token-cache")
+	token := &oauth.Token{
+		AccessToken:  "fake-access-token",
+		RefreshToken: "fake-refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	}
+	if err := oauth.CacheFile(cachefile).PutToken(token); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gdrivevfs.NewGdriveFileSystem("fake-id", "fake-secret", "", drive.DriveScope, cachefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.SetUploadSessionDir(t.TempDir())
+	g.SetBufferSize(testChunkSize)
+	return g
+}
+
+// Return data large enough to need several upload chunks.
+func largeData() []byte {
+	return bytes.Repeat([]byte("0123456789abcdef"), (2*testChunkSize+1000)/16)
+}
+
+func TestDriveIntegrationUpload(t *testing.T) {
+	fd := newFakeDrive(t)
+	g := newFakeGdrive(t, fd)
+	lfs := localvfs.NewLocalFileSystem()
+	chdirTemp(t)
+	ctx := context.Background()
+
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string][]byte{
+		"a.txt":      []byte("aaa"),
+		"d1/b.txt":   []byte("bbbb"),
+		"d1/big.bin": largeData(),
+	}
+	tree := make(map[string]string)
+	for name, data := range files {
+		tree[name] = string(data)
+	}
+	writeTree(t, "src", tree)
+	for name := range files {
+		fname := filepath.Join("src", name)
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Mkdir(ctx, "backup"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sync(ctx, "src/", "backup", lfs, g, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for name, data := range files {
+		f := fd.lookup("backup/" + name)
+		if f == nil {
+			t.Errorf("%s: not uploaded", name)
+			continue
+		}
+		if !bytes.Equal(f.data, data) {
+			t.Errorf("%s: Expected %d bytes, got %d", name, len(data), len(f.data))
+		}
+		if got, err := time.Parse(time.RFC3339Nano, f.ModifiedDate); err != nil || !got.Equal(mtime) {
+			t.Errorf("%s: Expected mtime %v, got %q", name, mtime, f.ModifiedDate)
+		}
+	}
+	if n := fd.count("upload"); n != len(files) {
+		t.Errorf("Expected %d uploads, got %d", len(files), n)
+	}
+
+	// Up to date files are not uploaded again.
+	if err := sync(ctx, "src/", "backup", lfs, g, nil, nil, nil); err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	if n := fd.count("upload"); n != len(files) {
+		t.Errorf("Expected no new uploads, got %d", n-len(files))
+	}
+
+	// Changed files replace the existing copy.
+	newer := mtime.Add(time.Hour)
+	if err := ioutil.WriteFile("src/a.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("src/a.txt", newer, newer); err != nil {
+		t.Fatal(err)
+	}
+	old := fd.lookup("backup/a.txt")
+	if err := sync(ctx, "src/", "backup", lfs, g, nil, nil, nil); err != nil {
+		t.Fatalf("third sync failed: %v", err)
+	}
+	f := fd.lookup("backup/a.txt")
+	if f == nil || string(f.data) != "changed" || f.ID != old.ID {
+		t.Errorf("Expected a.txt to be updated in place, got %+v", f)
+	}
+	if n := fd.count("upload"); n != len(files)+1 {
+		t.Errorf("Expected one new upload, got %d", n-len(files))
+	}
+}
+
+func TestDriveIntegrationDownload(t *testing.T) {
+	fd := newFakeDrive(t)
+	g := newFakeGdrive(t, fd)
+	g.SetDownloadStreams(2)
+	lfs := localvfs.NewLocalFileSystem()
+	chdirTemp(t)
+	ctx := context.Background()
+
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	files := map[string]string{
+		"a.txt":      "aaa",
+		"d1/d2/b":    "bbbb",
+		"d1/big.bin": string(largeData()),
+	}
+	for name, data := range files {
+		fd.put("data/"+name, data, mtime)
+	}
+	if err := os.Mkdir("dst", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sync(ctx, "data/", "dst", g, lfs, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for name, data := range files {
+		fname := filepath.Join("dst", name)
+		got, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Errorf("Unable to read destination file: %v", err)
+			continue
+		}
+		if string(got) != data {
+			t.Errorf("%s: Expected %d bytes, got %d", name, len(data), len(got))
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: Expected mtime %v got %v", name, mtime, fi.ModTime())
+		}
+	}
+	// The large file is fetched in parts, by several streams.
+	if n := fd.count("download"); n <= len(files) {
+		t.Errorf("Expected more than %d download requests, got %d", len(files), n)
+	}
+
+	// The downloaded tree is identical to the source.
+	entries, err := diffTrees(ctx, "data", "dst", g, lfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no differences, got %+v", entries)
+	}
+}
+
+func TestDriveIntegrationServerSide(t *testing.T) {
+	fd := newFakeDrive(t)
+	g := newFakeGdrive(t, fd)
+	ctx := context.Background()
+
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fd.put("src/a.txt", "aaa", mtime)
+	fd.put("src/d1/b.txt", "bbbb", mtime)
+	if err := g.Mkdir(ctx, "dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sync(ctx, "src/", "dst", g, g, nil, nil, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for name, data := range map[string]string{"a.txt": "aaa", "d1/b.txt": "bbbb"} {
+		f := fd.lookup("dst/" + name)
+		if f == nil || string(f.data) != data {
+			t.Errorf("%s: Expected %q, got %+v", name, data, f)
+		}
+	}
+	// Files are copied without transferring any data.
+	if n := fd.count("copy"); n != 2 {
+		t.Errorf("Expected 2 server-side copies, got %d", n)
+	}
+	if n := fd.count("download") + fd.count("upload"); n != 0 {
+		t.Errorf("Expected no data transfers, got %d", n)
+	}
+
+	// Moves change the parent and title of the existing file.
+	f := fd.lookup("dst/a.txt")
+	if err := g.Move(ctx, "dst/a.txt", "dst/d1/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fd.lookup("dst/d1/c.txt"); got == nil || got.ID != f.ID {
+		t.Errorf("Expected dst/a.txt to be moved to dst/d1/c.txt, got %+v", got)
+	}
+	if fd.lookup("dst/a.txt") != nil {
+		t.Errorf("dst/a.txt still exists after move")
+	}
+
+	// Deleted files go to the trash.
+	if err := g.Delete(ctx, "dst/d1/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if fd.lookup("dst/d1/c.txt") != nil || !f.Labels.Trashed {
+		t.Errorf("Expected dst/d1/c.txt to be trashed")
+	}
+}
+
+func TestDriveIntegrationMove(t *testing.T) {
+	fd := newFakeDrive(t)
+	g := newFakeGdrive(t, fd)
+	ctx := context.Background()
+
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := fd.put("a/x.txt", "xxx", mtime)
+	if err := g.Mkdir(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	dirA, dirB := fd.lookup("a"), fd.lookup("b")
+
+	// Renames within a folder only change the title.
+	if err := g.Move(ctx, "a/x.txt", "a/y.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fd.lookup("a/y.txt"); got != f || got.Title != "y.txt" || len(got.Parents) != 1 || got.Parents[0].ID != dirA.ID {
+		t.Errorf("Expected a/x.txt to be renamed to a/y.txt, got %+v", got)
+	}
+	if fd.lookup("a/x.txt") != nil {
+		t.Errorf("a/x.txt still exists after rename")
+	}
+
+	// Moves across folders replace the parent.
+	if err := g.Move(ctx, "a/y.txt", "b/z.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fd.lookup("b/z.txt"); got != f || len(got.Parents) != 1 || got.Parents[0].ID != dirB.ID {
+		t.Errorf("Expected a/y.txt to be moved to b/z.txt, got %+v", got)
+	}
+	if fd.lookup("a/y.txt") != nil {
+		t.Errorf("a/y.txt still exists after move")
+	}
+	if string(f.data) != "xxx" {
+		t.Errorf("Expected the contents to be kept, got %q", f.data)
+	}
+	if n := fd.count("upload") + fd.count("download") + fd.count("copy"); n != 0 {
+		t.Errorf("Expected no data transfers, got %d", n)
+	}
+
+	// Missing files and folders can't be moved into.
+	if err := g.Move(ctx, "b/nothing", "b/other"); err == nil {
+		t.Errorf("Expected an error moving a missing file")
+	}
+	if err := g.Move(ctx, "b/z.txt", "c/z.txt"); err == nil {
+		t.Errorf("Expected an error moving into a missing folder")
+	}
+}
+
+// Files renamed or moved in the source are moved in Drive, not uploaded again.
+func TestDriveIntegrationSyncMove(t *testing.T) {
+	fd := newFakeDrive(t)
+	g := newFakeGdrive(t, fd)
+	lfs := localvfs.NewLocalFileSystem()
+	chdirTemp(t)
+	ctx := context.Background()
+
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeTree(t, "src", map[string]string{"a.txt": "aaa", "d1/b.txt": "bbbb"})
+	for _, name := range []string{"src/a.txt", "src/d1/b.txt"} {
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Mkdir(ctx, "backup"); err != nil {
+		t.Fatal(err)
+	}
+	state, err := openStateDB("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(ctx, "src/", "backup", lfs, g, nil, state, nil); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	a, b := fd.lookup("backup/a.txt"), fd.lookup("backup/d1/b.txt")
+	uploads := fd.count("upload")
+
+	if err = os.Rename("src/a.txt", "src/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir("src/d2", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename("src/d1/b.txt", "src/d2/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = sync(ctx, "src/", "backup", lfs, g, nil, state, nil); err != nil {
+		t.Fatalf("second sync failed: %v", err)
+	}
+	for name, want := range map[string]*fakeFile{"renamed.txt": a, "d2/b.txt": b} {
+		if got := fd.lookup("backup/" + name); got == nil || got != want {
+			t.Errorf("%s: Expected file %s to be moved, got %+v", name, want.ID, got)
+		}
+	}
+	for _, name := range []string{"a.txt", "d1/b.txt"} {
+		if fd.lookup("backup/"+name) != nil {
+			t.Errorf("%s: still exists after move", name)
+		}
+	}
+	if n := fd.count("upload"); n != uploads {
+		t.Errorf("Expected no new uploads, got %d", n-uploads)
+	}
+}
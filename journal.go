@@ -0,0 +1,199 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	gosync "sync"
+)
+
+// Journal events
+const (
+	journalPlan    = "plan"
+	journalPlanned = "planned"
+	journalDone    = "done"
+)
+
+// journalEntry represents a single line in the journal file. Each sync root
+// (source and destination pair) first records all of its planned operations,
+// followed by a "planned" event once the plan is complete. A "done" event is
+// recorded after each operation succeeds.
+type journalEntry struct {
+	Event string  `json:"event"`
+	Root  string  `json:"root"`
+	Op    *syncOp `json:"op,omitempty"`
+}
+
+// journal keeps a persistent record of the operations planned and completed
+// by the sync engine, allowing an interrupted run to be resumed. Entries may be
+// recorded concurrently (one sync per destination). All methods are safe to
+// call on a nil journal, in which case they do nothing.
+type journal struct {
+	fname string
+	mu    gosync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+
+	// Complete plans and finished operations from a previous run.
+	plans map[string][]syncOp
+	done  map[string]bool
+}
+
+// Return a key uniquely identifying an operation under a sync root.
+func journalKey(root string, op syncOp) string {
+	return root + "\x00" + op.Op + "\x00" + op.Src + "\x00" + op.Dst
+}
+
+// Open the journal file fname, loading the state of a previous run if the file
+// exists. New entries are appended to the file.
+//
+// Return:
+//   *journal
+//   error
+func openJournal(fname string) (*journal, error) {
+	j := &journal{
+		fname: fname,
+		plans: make(map[string][]syncOp),
+		done:  make(map[string]bool),
+	}
+
+	f, err := os.Open(fname)
+	if err == nil {
+		err = j.load(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	j.file, err = os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.enc = json.NewEncoder(j.file)
+	return j, nil
+}
+
+// Load the entries from a previous run. Plans without a final "planned" event
+// are discarded, as the scan was interrupted before the plan was complete.
+//
+// Return:
+//   error
+func (j *journal) load(r io.Reader) error {
+	partial := make(map[string][]syncOp)
+
+	dec := json.NewDecoder(r)
+	for {
+		var e journalEntry
+
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A crash may leave a truncated last line behind.
+			log.Warn("ignoring remainder of journal", "file", j.fname, "error", err)
+			break
+		}
+		switch e.Event {
+		case journalPlan:
+			if e.Op != nil {
+				partial[e.Root] = append(partial[e.Root], *e.Op)
+			}
+		case journalPlanned:
+			j.plans[e.Root] = partial[e.Root]
+		case journalDone:
+			if e.Op != nil {
+				j.done[journalKey(e.Root, *e.Op)] = true
+			}
+		default:
+			return fmt.Errorf("Unknown event \"%s\" in journal \"%s\"", e.Event, j.fname)
+		}
+	}
+	return nil
+}
+
+// Write a single entry to the journal, syncing the file to stable storage.
+func (j *journal) write(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.enc.Encode(e)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Return the complete plan recorded for root by a previous run, if any.
+//
+// Return:
+//   []syncOp
+//   bool: true if a complete plan was found.
+func (j *journal) resume(root string) ([]syncOp, bool) {
+	if j == nil {
+		return nil, false
+	}
+	ops, ok := j.plans[root]
+	return ops, ok
+}
+
+// Record a planned operation for root.
+//
+// Return:
+//   error
+func (j *journal) recordPlan(root string, op syncOp) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalEntry{Event: journalPlan, Root: root, Op: &op})
+}
+
+// Record that all operations for root have been planned.
+//
+// Return:
+//   error
+func (j *journal) recordPlanned(root string) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalEntry{Event: journalPlanned, Root: root})
+}
+
+// Record that op has been successfully executed.
+//
+// Return:
+//   error
+func (j *journal) recordDone(root string, op syncOp) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalEntry{Event: journalDone, Root: root, Op: &op})
+}
+
+// Return true if op was completed by a previous run.
+func (j *journal) completed(root string, op syncOp) bool {
+	if j == nil {
+		return false
+	}
+	return j.done[journalKey(root, op)]
+}
+
+// Close and remove the journal. This should only be called after all sync
+// operations have completed successfully.
+//
+// Return:
+//   error
+func (j *journal) remove() error {
+	if j == nil {
+		return nil
+	}
+	j.file.Close()
+	return os.Remove(j.fname)
+}
@@ -0,0 +1,61 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Return the path of the copy of dst in the previous snapshot (--link-dest).
+// The previous snapshot has the same layout as the destination directory.
+//
+// Return:
+//   string
+//   error
+func (p *planner) linkDestPath(dst string) (string, error) {
+	rel, err := filepath.Rel(p.dstdir, dst)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(opt.linkDest, rel), nil
+}
+
+// Return a link operation for dst if the previous snapshot (--link-dest)
+// holds a regular file with the same size and mtime as the source file
+// described by srcfi. Hard linking that file is much cheaper than copying the
+// source again.
+//
+// Return:
+//   syncOp
+//   bool
+//   error
+func (p *planner) linkOp(srcfi vfs.FileInfo, dst string, relpath string) (syncOp, bool, error) {
+	if opt.linkDest == "" {
+		return syncOp{}, false, nil
+	}
+	prev, err := p.linkDestPath(dst)
+	if err != nil {
+		return syncOp{}, false, err
+	}
+	prevfi, err := p.dstvfs.Stat(p.ctx, prev)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return syncOp{}, false, nil
+	}
+	if err != nil || !prevfi.IsRegular() {
+		return syncOp{}, false, err
+	}
+
+	if srcfi.Size < 0 || srcfi.Size != prevfi.Size {
+		return syncOp{}, false, nil
+	}
+	if !srcfi.Mtime.Truncate(time.Second).Equal(prevfi.Mtime.Truncate(time.Second)) {
+		return syncOp{}, false, nil
+	}
+	return syncOp{Op: opLink, Src: srcfi.Path, Dst: dst, Rel: relpath, From: prev}, true, nil
+}
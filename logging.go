@@ -0,0 +1,184 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Logging modules. Each module has its own logger and verbosity level.
+const (
+	moduleAzblob = "azblob"
+	moduleEngine = "engine"
+	moduleGdrive = "gdrive"
+	moduleHTTP   = "http"
+	moduleLocal  = "local"
+)
+
+// levelTrace is more verbose than slog.LevelDebug and is used for messages
+// that are only useful when debugging a specific problem (like pattern
+// matching.)
+const levelTrace = slog.LevelDebug - 4
+
+var (
+	// Logger for the sync engine. Messages from the Google Drive, Azure, HTTP
+	// and local filesystem code go to gdriveLog, azblobLog, httpLog and
+	// localLog. All loggers discard everything until setupLogging is called.
+	log       = vfs.DiscardLogger()
+	azblobLog = vfs.DiscardLogger()
+	gdriveLog = vfs.DiscardLogger()
+	httpLog   = vfs.DiscardLogger()
+	localLog  = vfs.DiscardLogger()
+)
+
+// Names of the log levels accepted by --log-level.
+var logLevels = map[string]slog.Level{
+	"error": slog.LevelError,
+	"warn":  slog.LevelWarn,
+	"info":  slog.LevelInfo,
+	"debug": slog.LevelDebug,
+	"trace": levelTrace,
+}
+
+// Return the log level corresponding to the --verbose count. Without
+// --verbose only warnings and errors are logged. Each --verbose adds a level,
+// up to "trace".
+func verboseLevel(verbose int) slog.Level {
+	switch {
+	case verbose <= 0:
+		return slog.LevelWarn
+	case verbose == 1:
+		return slog.LevelInfo
+	case verbose == 2:
+		return slog.LevelDebug
+	}
+	return levelTrace
+}
+
+// Parse a --log-level specification. The specification is a comma separated
+// list of levels, optionally prefixed by a module name, as in
+// "info,gdrive=debug". A level without a module applies to all modules.
+//
+// Return:
+//   map[string]slog.Level: Level per module
+//   error
+func parseLogLevels(spec string, def slog.Level) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{
+		moduleAzblob: def,
+		moduleEngine: def,
+		moduleGdrive: def,
+		moduleHTTP:   def,
+		moduleLocal:  def,
+	}
+	if spec == "" {
+		return levels, nil
+	}
+
+	// Global levels first, so module levels can override them regardless
+	// of their position in the list.
+	var modspecs []string
+	for _, s := range strings.Split(spec, ",") {
+		if strings.Contains(s, "=") {
+			modspecs = append(modspecs, s)
+			continue
+		}
+		level, ok := logLevels[strings.ToLower(s)]
+		if !ok {
+			return nil, fmt.Errorf("Invalid log level \"%s\"", s)
+		}
+		for m := range levels {
+			levels[m] = level
+		}
+	}
+	for _, s := range modspecs {
+		kv := strings.SplitN(s, "=", 2)
+		if _, ok := levels[kv[0]]; !ok {
+			return nil, fmt.Errorf("Invalid log module \"%s\"", kv[0])
+		}
+		level, ok := logLevels[strings.ToLower(kv[1])]
+		if !ok {
+			return nil, fmt.Errorf("Invalid log level \"%s\"", kv[1])
+		}
+		levels[kv[0]] = level
+	}
+	return levels, nil
+}
+
+// Show levelTrace as "TRACE" instead of "DEBUG-4".
+func replaceLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey {
+		if level, ok := a.Value.Any().(slog.Level); ok && level == levelTrace {
+			a.Value = slog.StringValue("TRACE")
+		}
+	}
+	return a
+}
+
+// Create a logger writing to w in the given format ("text" or "json").
+//
+// Return:
+//   *slog.Logger
+//   error
+func newLogger(w io.Writer, format string, module string, level slog.Level) (*slog.Logger, error) {
+	var handler slog.Handler
+
+	hopts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(w, hopts)
+	case "json":
+		handler = slog.NewJSONHandler(w, hopts)
+	default:
+		return nil, fmt.Errorf("Invalid log format \"%s\" (must be text or json)", format)
+	}
+	return slog.New(handler).With("module", module), nil
+}
+
+// Set up all loggers according to --verbose, --log-level and --log-format.
+// Logs go to stderr.
+//
+// Return:
+//   error
+func setupLogging() error {
+	levels, err := parseLogLevels(opt.logLevel, verboseLevel(int(opt.verbose)))
+	if err != nil {
+		return err
+	}
+	loggers := map[string]**slog.Logger{
+		moduleAzblob: &azblobLog,
+		moduleEngine: &log,
+		moduleGdrive: &gdriveLog,
+		moduleHTTP:   &httpLog,
+		moduleLocal:  &localLog,
+	}
+	for module, l := range loggers {
+		*l, err = newLogger(os.Stderr, opt.logFormat, module, levels[module])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Log err and exit the program with a non-zero status.
+func fatal(err error) {
+	log.Error(err.Error())
+	apiCalls.report()
+	if ferr := writeFailedList(opt.failedList); ferr != nil {
+		log.Error(ferr.Error())
+	}
+	events.error("", err)
+	events.close()
+	skipped.close()
+	closeTokens()
+	stopProfiling()
+	os.Exit(1)
+}
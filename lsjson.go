@@ -0,0 +1,138 @@
+package main
+
+// JSON listings (lsjson command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// MIME type of directories, for backends that don't keep MIME types.
+const dirMimeType = "inode/directory"
+
+// lsEntry describes a file or directory in a JSON listing. Path is relative
+// to the path listed. Fields not known to the backend are omitted.
+type lsEntry struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mtime    time.Time `json:"mtime"`
+	MimeType string    `json:"mimeType,omitempty"`
+	ID       string    `json:"id,omitempty"`
+	IsDir    bool      `json:"isDir"`
+	MD5      string    `json:"md5,omitempty"`
+}
+
+// Name returns the last element of the path of e, for --format templates.
+func (e lsEntry) Name() string {
+	return path.Base(e.Path)
+}
+
+// ModTime returns the modification time of e, for --format templates.
+func (e lsEntry) ModTime() time.Time {
+	return e.Mtime
+}
+
+// Parse the listing format given with --format. Templates use the fields and
+// methods of lsEntry, and the "size" function to format sizes like the tree
+// command (see humanSize). A newline is added after each entry. Returns nil if
+// no format was given.
+//
+// Return:
+//   *template.Template
+//   error
+func parseListFormat(format string) (*template.Template, error) {
+	if format == "" {
+		return nil, nil
+	}
+	return template.New("format").Funcs(template.FuncMap{"size": humanSize}).Parse(format + "\n")
+}
+
+// Return the listing entry for fi in fsys, under the relative path rel. MIME
+// types are taken from the backend when it keeps them, and guessed from the
+// file extension otherwise.
+//
+// Return:
+//   lsEntry
+//   error
+func newLsEntry(ctx context.Context, fsys vfs.VFS, fi vfs.FileInfo, rel string) (lsEntry, error) {
+	var err error
+	e := lsEntry{Path: rel, Size: fi.Size, Mtime: fi.Mtime, IsDir: fi.IsDir()}
+
+	if v, ok := fsys.(vfs.MimeTyper); ok {
+		if e.MimeType, err = v.MimeType(ctx, fi.Path); err != nil {
+			return e, err
+		}
+	}
+	if e.MimeType == "" {
+		if e.IsDir {
+			e.MimeType = dirMimeType
+		} else {
+			e.MimeType = mime.TypeByExtension(path.Ext(rel))
+		}
+	}
+	if v, ok := fsys.(vfs.FileIDer); ok {
+		if e.ID, err = v.FileID(ctx, fi.Path); err != nil {
+			return e, err
+		}
+	}
+	if v, ok := fsys.(vfs.MD5er); ok && !e.IsDir {
+		if e.MD5, err = v.MD5(ctx, fi.Path); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// Write a JSON object describing every file and directory under root in fsys
+// to w, one per line, down to maxDepth levels below root (all levels if
+// maxDepth is 0). With a format (see parseListFormat), each entry is written
+// with it instead. If root is a file, only the file is listed. Excluded paths
+// are skipped.
+//
+// Return:
+//   int: number of entries written
+//   error
+func listJSON(ctx context.Context, w io.Writer, fsys vfs.VFS, root string, maxDepth int, format *template.Template) (int, error) {
+	n := 0
+	enc := json.NewEncoder(w)
+	err := fsys.Walk(ctx, root, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(root, fi.Path)
+		if rel == "" {
+			if fi.IsDir() {
+				return nil
+			}
+			rel = path.Base(fi.Path)
+		}
+		if maxDepth > 0 && len(pathComponents(rel)) > maxDepth {
+			return nil
+		}
+		skip, err := excluded(rel)
+		if err != nil || skip {
+			return err
+		}
+		e, err := newLsEntry(ctx, fsys, fi, rel)
+		if err != nil {
+			return err
+		}
+		n++
+		if format != nil {
+			return format.Execute(w, e)
+		}
+		return enc.Encode(e)
+	})
+	return n, err
+}
@@ -7,55 +7,46 @@ package main
 // (C) 2014 by Marco Paganini <paganini AT paganini DOT net>
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"time"
-
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/archive"
 	"github.com/marcopaganini/gsync/vfs/local"
-	"github.com/marcopaganini/logger"
 )
 
-var (
-	// Generic logging object
-	log *logger.Logger
-)
-
-// VFS interface
-type gsyncVfs interface {
-	FileTree(string) ([]string, error)
-	FileExists(string) (bool, error)
-	IsDir(string) (bool, error)
-	IsRegular(string) (bool, error)
-	Mkdir(string) error
-	Mtime(string) (time.Time, error)
-	ReadFromFile(string) (io.Reader, error)
-	SetMtime(string, time.Time) error
-	SetWriteInPlace(bool)
-	Size(string) (int64, error)
-	WriteToFile(string, io.Reader) error
-}
-
-// Check if fullpath looks like a gdrive path (starting with g: or gdrive:). If
-// so, return true and the path without the prefix. Otherwise, return false and
-// the path itself.
+// Check if fullpath looks like a gdrive path, starting with g: or gdrive: (the
+// default remote) or the name of a configured remote followed by a colon (as
+// in "work:projects"). If so, return the remote name ("" for the default
+// remote), true and the path without the prefix. Otherwise, return an empty
+// remote, false and the path itself.
 //
 // Returns
+//   remote
 //   bool
 //   realpath
-func isGdrivePath(fullpath string) (bool, string) {
-	if strings.HasPrefix(fullpath, "g:") || strings.HasPrefix(fullpath, "gdrive:") {
-		idx := strings.Index(fullpath, ":")
-		// Return a single slash if a bare g: or gdrive: is specified
-		if idx == (len(fullpath) - 1) {
-			return true, "/"
-		}
-		return true, fullpath[idx+1:]
+func parseRemotePath(fullpath string) (string, bool, string) {
+	idx := strings.Index(fullpath, ":")
+	if idx < 0 {
+		return "", false, fullpath
+	}
+	remote := fullpath[:idx]
+	switch {
+	case remote == "g" || remote == "gdrive":
+		remote = ""
+	case !isRemote(remote):
+		return "", false, fullpath
+	}
+	// Return a single slash if a bare remote is specified
+	if idx == (len(fullpath) - 1) {
+		return remote, true, "/"
 	}
-	return false, fullpath
+	return remote, true, fullpath[idx+1:]
 }
 
 // Prints error message and program usage to stderr, exit the program.
@@ -63,64 +54,694 @@ func usage(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
 	}
-	fmt.Fprintf(os.Stderr, "Usage%s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] source... destination\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] copyto source destination\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] diff source destination\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] bench path\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] rmdirs path\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] touch path [time]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] tree path\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] lsjson path\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] verify-manifest manifest [remote:]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] auth [remote]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [--json] [--check-update] version\n\n", os.Args[0])
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 func main() {
 	var (
-		srcvfs   gsyncVfs
-		dstvfs   gsyncVfs
-		gfs      gsyncVfs
-		lfs      gsyncVfs
+		archive  *archivevfs.ArchiveFileSystem
+		dstvfs   vfs.VFS
+		dstPath  string
+		lfs      vfs.VFS
 		srcdir   string
 		dstdir   string
 		srcpaths []string
+		jrnl     *journal
+		state    *stateDB
+		sums     *checksumDB
+		mf       *manifest
 	)
 
 	parseFlags()
 
-	// Set verbose level
-	log = logger.New("")
-	if opt.verbose > 0 {
-		log.SetVerboseLevel(int(opt.verbose))
+	// Set up logging (see --verbose and --log-level)
+	if err := setupLogging(); err != nil {
+		usage(err)
+	}
+
+	if err := checkConflictPolicy(opt.conflict); err != nil {
+		usage(err)
+	}
+	if opt.conflict == conflictAsk {
+		conflictPrompt = newConflictPrompter(os.Stdin, os.Stderr)
+	}
+	if err := checkSymlinkPolicy(opt.symlinks); err != nil {
+		usage(err)
+	}
+	var err error
+	if order, err = parseOrder(opt.orderBy); err != nil {
+		usage(err)
 	}
 
-	srcpaths, dstdir, err := getSourceDest()
+	// Mirrors never get empty directories the source doesn't have.
+	if opt.mirror {
+		if opt.removeSource {
+			usage(fmt.Errorf("--mirror can't be used with --remove-source-files"))
+		}
+		// Everything not listed would be removed.
+		if opt.retryFrom != "" {
+			usage(fmt.Errorf("--mirror can't be used with --retry-from"))
+		}
+		opt.pruneEmpty = true
+	}
+
+	if err := startProfiling(); err != nil {
+		fatal(err)
+	}
+	defer stopProfiling()
+
+	command, args := getCommand()
+	if command == cmdVersion {
+		bi := getBuildInfo()
+		if err := printVersion(os.Stdout, bi, opt.json); err != nil {
+			fatal(err)
+		}
+		if opt.checkUpdate {
+			if err := checkUpdate(os.Stdout, bi, latestReleaseURL); err != nil {
+				fatal(err)
+			}
+		}
+		return
+	}
+
+	// Bench only takes the path where its test files are written, rmdirs
+	// the path to clean up, and tree and lsjson the path to list.
+	if command == cmdBench || command == cmdRmdirs || command == cmdTree || command == cmdLsJSON {
+		if len(args) != 1 {
+			usage(fmt.Errorf("The %s command requires exactly one path", command))
+		}
+		dstdir = args[0]
+		isUnion, _ := parseUnionPath(dstdir)
+		if format, _ := parseArchivePath(dstdir); command == cmdRmdirs && (format != "" || isHTTPPath(dstdir) || isUnion) {
+			usage(fmt.Errorf("The rmdirs command can't be used with archives, HTTP sources or unions"))
+		}
+	} else if command == cmdTouch {
+		if len(args) < 1 || len(args) > 2 {
+			usage(fmt.Errorf("The touch command requires a path and at most one time"))
+		}
+		dstdir = args[0]
+		isUnion, _ := parseUnionPath(dstdir)
+		if format, _ := parseArchivePath(dstdir); format != "" || isHTTPPath(dstdir) || isUnion {
+			usage(fmt.Errorf("The touch command can't be used with archives, HTTP sources or unions"))
+		}
+	} else if command == cmdAuth {
+		if len(args) > 1 {
+			usage(fmt.Errorf("The auth command takes at most one remote name"))
+		}
+	} else if command == cmdVerifyManifest {
+		// The files in the manifest are looked up in the remote, if given,
+		// or locally (relative to the current directory).
+		if len(args) < 1 || len(args) > 2 {
+			usage(fmt.Errorf("The verify-manifest command requires a manifest and at most one remote"))
+		}
+		dstdir = "."
+		if len(args) == 2 {
+			if !isRemotePath(args[1]) {
+				usage(fmt.Errorf("Not a remote: \"%s\"", args[1]))
+			}
+			dstdir = args[1]
+		}
+	} else if srcpaths, dstdir, err = getSourceDest(args); err != nil {
+		usage(err)
+	}
+	if opt.format != "" && command != cmdTree && command != cmdLsJSON {
+		usage(fmt.Errorf("--format can only be used with the tree and lsjson commands"))
+	}
+	format, err := parseListFormat(opt.format)
 	if err != nil {
+		usage(fmt.Errorf("Invalid --format: %v", err))
+	}
+	if command == cmdDiff && len(srcpaths) != 1 {
+		usage(fmt.Errorf("The diff command requires exactly one source and one destination"))
+	}
+	if command == cmdCopyTo {
+		isUnion, _ := parseUnionPath(srcpaths[0])
+		switch {
+		case len(srcpaths) != 1:
+			usage(fmt.Errorf("The copyto command requires exactly one source and one destination"))
+		case isUnion:
+			usage(fmt.Errorf("The copyto command can't be used with unions"))
+		case opt.removeSource:
+			usage(fmt.Errorf("--remove-source-files can't be used with the copyto command"))
+		case opt.rmdirs:
+			usage(fmt.Errorf("--rmdirs can't be used with the copyto command"))
+		}
+		if format, _ := parseArchivePath(dstdir); format != "" {
+			usage(fmt.Errorf("The copyto command can't write to archives"))
+		}
+	}
+	if len(opt.alsoDest) > 0 {
+		switch {
+		case command != cmdSync:
+			usage(fmt.Errorf("--also-dest can only be used to sync"))
+		case opt.removeSource:
+			usage(fmt.Errorf("--also-dest can't be used with --remove-source-files"))
+		case opt.linkDest != "":
+			usage(fmt.Errorf("--also-dest can't be used with --link-dest"))
+		}
+	}
+
+	// Refuse to sync in the wrong direction.
+	if command == cmdSync {
+		if err = checkDirection(srcpaths, append([]string{dstdir}, opt.alsoDest...)); err != nil {
+			usage(err)
+		}
+	} else if opt.downloadOnly || opt.uploadOnly {
+		usage(fmt.Errorf("--download-only and --upload-only can only be used to sync"))
+	}
+
+	// Only sync the files that failed in a previous run.
+	if opt.retryFrom != "" {
+		if retryPaths, err = loadRetryList(opt.retryFrom); err != nil {
+			usage(err)
+		}
+	}
+
+	// Token caches are encrypted back when the run ends.
+	if tokens, err = newTokenVault(opt.tokenEncryption, os.Stdin, os.Stderr); err != nil {
 		usage(err)
 	}
+	defer closeTokens()
+
+	setupTransport()
+	if opt.bwlimit > 0 {
+		bwlimit = newRateLimiter(int64(opt.bwlimit))
+	}
+	vfs.Buffers.SetMax(int64(opt.maxBufferMemory))
 
-	// Initialize virtual filesystems
-	gfs, err = initGdriveVfs(opt.clientID, opt.clientSecret, opt.code)
+	// Authorize a remote ("g" and "gdrive" name the default remote).
+	if command == cmdAuth {
+		remote := opt.remote
+		if len(args) == 1 {
+			remote = strings.TrimSuffix(args[0], ":")
+		}
+		if remote == "g" || remote == "gdrive" {
+			remote = ""
+		}
+		if err = runAuth(os.Stdin, os.Stdout, remote); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	// Checksums of local files, cached across runs with --checksum-db.
+	if sums, err = openChecksumDB(opt.checksumDB); err != nil {
+		fatal(err)
+	}
+
+	// Initialize virtual filesystems. Google Drive and Azure filesystems are
+	// only initialized when a path in the corresponding remote is used.
+	l := localvfs.NewLocalFileSystem()
+	l.SetLogger(localLog)
+	l.SetBufferSize(int(opt.bufferSize))
+	l.SetOneFileSystem(opt.oneFileSystem)
+	l.SetLocking(opt.lockFiles)
+	l.SetSymlinks(opt.archiveMode)
+	users, err := loadIDMap(opt.userMap, lookupUser)
+	if err != nil {
+		fatal(err)
+	}
+	groups, err := loadIDMap(opt.groupMap, lookupGroup)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	l.SetIDMaps(users, groups)
+	// --times and --fuzzy compare files by checksum.
+	l.SetChecksum(opt.checksum || opt.times || opt.fuzzy)
+	l.SetHashCache(sums)
+	lfs = l
+	if opt.timeout > 0 {
+		lfs = newTimeoutVfs(lfs, opt.timeout)
+	}
+	gfses := make(map[string]vfs.VFS)
+	var sourceArchives []*archivevfs.ArchiveSourceFileSystem
+
+	// Return the VFS and real path for pathname.
+	var selectVfs func(pathname string) (vfs.VFS, string, error)
+	selectVfs = func(pathname string) (vfs.VFS, string, error) {
+		if isCached, inner := parseCachePath(pathname); isCached {
+			fsys, realpath, err := selectVfs(inner)
+			if err != nil {
+				return nil, "", err
+			}
+			isUnion, _ := parseUnionPath(inner)
+			if format, _ := parseArchivePath(inner); fsys == lfs || format != "" || isUnion {
+				return nil, "", fmt.Errorf("Only remote paths can be cached: \"%s\"", pathname)
+			}
+			// Paths in the same remote share the cache.
+			key := cachePrefix + strings.TrimSuffix(inner, realpath)
+			if cfs, ok := gfses[key]; ok {
+				return cfs, realpath, nil
+			}
+			cfs, err := initCacheVfs(fsys, key)
+			if err != nil {
+				return nil, "", err
+			}
+			gfses[key] = cfs
+			return cfs, realpath, nil
+		}
+		if isUnion, roots := parseUnionPath(pathname); isUnion {
+			if opt.removeSource {
+				return nil, "", fmt.Errorf("--remove-source-files can't be used with unions")
+			}
+			u, err := initUnionVfs(roots, lfs)
+			if err != nil {
+				return nil, "", err
+			}
+			return u, "/", nil
+		}
+		if format, fname := parseArchivePath(pathname); format != "" {
+			if opt.removeSource {
+				return nil, "", fmt.Errorf("--remove-source-files can't be used with archives")
+			}
+			a, err := initArchiveSourceVfs(format, fname)
+			if err != nil {
+				return nil, "", err
+			}
+			sourceArchives = append(sourceArchives, a)
+			var fsys vfs.VFS = a
+			if opt.timeout > 0 {
+				fsys = newTimeoutVfs(fsys, opt.timeout)
+			}
+			return fsys, "/", nil
+		}
+		if isHTTPPath(pathname) {
+			if opt.removeSource {
+				return nil, "", fmt.Errorf("--remove-source-files can't be used with HTTP sources")
+			}
+			h, err := initHTTPVfs(pathname)
+			if err != nil {
+				return nil, "", err
+			}
+			var fsys vfs.VFS = h
+			if opt.timeout > 0 {
+				fsys = newTimeoutVfs(fsys, opt.timeout)
+			}
+			return fsys, "/", nil
+		}
+		if isAzblob, realpath := parseAzblobPath(pathname); isAzblob {
+			if afs, ok := gfses[azblobPrefix]; ok {
+				return afs, realpath, nil
+			}
+			afs, err := initAzblobVfs()
+			if err != nil {
+				return nil, "", err
+			}
+			if opt.timeout > 0 {
+				afs = newTimeoutVfs(afs, opt.timeout)
+			}
+			gfses[azblobPrefix] = afs
+			return afs, realpath, nil
+		}
+		remote, isGdrive, realpath := parseRemotePath(pathname)
+		if !isGdrive {
+			return lfs, realpath, nil
+		}
+		// The application data folder is a separate VFS in each remote.
+		key := remote
+		appdata, apppath := appDataPath(realpath)
+		if appdata {
+			key, realpath = remote+":"+appDataPrefix, apppath
+		}
+		if gfs, ok := gfses[key]; ok {
+			return gfs, realpath, nil
+		}
+		// Credentials and code only apply to the remote being configured.
+		var id, secret, code string
+		if remote == opt.remote {
+			id, secret, code = opt.clientID, opt.clientSecret, opt.code
+		}
+		var gfs vfs.VFS
+		var err error
+		if appdata {
+			gfs, err = initAppDataVfs(remote, id, secret, code)
+		} else {
+			gfs, err = initGdriveVfs(remote, id, secret, code)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if opt.timeout > 0 {
+			gfs = newTimeoutVfs(gfs, opt.timeout)
+		}
+		gfses[key] = gfs
+		return gfs, realpath, nil
 	}
-	lfs = localvfs.NewLocalFileSystem()
-	dstvfs = lfs
-	isDstGdrive, dstPath := isGdrivePath(dstdir)
-	if isDstGdrive {
-		dstvfs = gfs
+
+	if command == cmdBench {
+		fsys, benchdir, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		results, err := runBench(context.Background(), fsys, benchdir, opt.benchFiles, int64(opt.benchSize))
+		if perr := printBench(os.Stdout, results, opt.json); perr != nil && err == nil {
+			err = perr
+		}
+		if err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		return
+	}
+
+	if command == cmdRmdirs {
+		fsys, root, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err = removeEmptyDirs(context.Background(), fsys, root); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		return
+	}
+
+	if command == cmdVerifyManifest {
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		entries, err := readManifest(args[0])
+		if err != nil {
+			fatal(err)
+		}
+		fsys, _, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		useMD5 := dstdir != "." && !strings.HasPrefix(dstdir, cachePrefix)
+		problems, err := verifyManifest(context.Background(), fsys, entries, fi.ModTime(), useMD5)
+		if err != nil {
+			fatal(err)
+		}
+		if err = printDiff(os.Stdout, problems, opt.json); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		if len(problems) > 0 {
+			closeTokens()
+			stopProfiling()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == cmdTouch {
+		mtime := time.Now()
+		if len(args) == 2 {
+			if mtime, err = parseTouchTime(args[1]); err != nil {
+				usage(err)
+			}
+		}
+		fsys, root, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err = touchTree(context.Background(), fsys, root, mtime, opt.recursive); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		return
+	}
+
+	if command == cmdTree {
+		fsys, root, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		tree, err := buildTree(context.Background(), fsys, root)
+		if err != nil {
+			fatal(err)
+		}
+		tree.name = dstdir
+		label := treeLabel
+		if format != nil {
+			label = treeFormat(context.Background(), fsys, format)
+		}
+		if err = printTree(os.Stdout, tree, opt.maxDepth, label); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		return
+	}
+
+	if command == cmdLsJSON {
+		fsys, root, err := selectVfs(dstdir)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err = listJSON(context.Background(), os.Stdout, fsys, root, opt.maxDepth, format); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		return
+	}
+
+	if isHTTPPath(dstdir) && command != cmdDiff {
+		usage(fmt.Errorf("HTTP sources can't be used as a destination"))
+	}
+	if isUnion, _ := parseUnionPath(dstdir); isUnion && command != cmdDiff {
+		usage(fmt.Errorf("Unions can't be used as a destination"))
+	}
+	// Archive destinations are created from scratch, but diff reads them
+	// like any other tree.
+	if format, fname := parseArchivePath(dstdir); format != "" && command != cmdDiff {
+		if opt.removeSource {
+			usage(fmt.Errorf("--remove-source-files can't be used with archive destinations"))
+		}
+		if opt.rmdirs {
+			usage(fmt.Errorf("--rmdirs can't be used with archive destinations"))
+		}
+		if archive, err = initArchiveVfs(format, fname); err != nil {
+			fatal(err)
+		}
+		dstvfs, dstPath = archive, "/"
+		if opt.timeout > 0 {
+			dstvfs = newTimeoutVfs(dstvfs, opt.timeout)
+		}
+	} else if dstvfs, dstPath, err = selectVfs(dstdir); err != nil {
+		fatal(err)
+	}
+
+	// Diff is read-only and does not use any of the sync machinery.
+	if command == cmdDiff {
+		srcvfs, srcPath, err := selectVfs(srcpaths[0])
+		if err != nil {
+			fatal(err)
+		}
+		entries, err := diffTrees(context.Background(), srcPath, dstPath, srcvfs, dstvfs)
+		if err != nil {
+			fatal(err)
+		}
+		if err = printDiff(os.Stdout, entries, opt.json); err != nil {
+			fatal(err)
+		}
+		if err = sums.save(); err != nil {
+			fatal(err)
+		}
+		apiCalls.report()
+		if len(entries) > 0 {
+			closeTokens()
+			stopProfiling()
+			os.Exit(1)
+		}
+		return
 	}
 	if opt.inplace {
 		dstvfs.SetWriteInPlace(true)
 	}
+	if opt.linkDest != "" {
+		if _, remote, _ := parseRemotePath(opt.linkDest); remote || dstvfs != lfs {
+			usage(fmt.Errorf("--link-dest requires a local destination and snapshot directory"))
+		}
+	}
+
+	// Other destinations fed by the same scan of the source.
+	dsts := []syncDest{{path: dstPath, fsys: dstvfs}}
+	for _, d := range opt.alsoDest {
+		isUnion, _ := parseUnionPath(d)
+		if format, _ := parseArchivePath(d); format != "" || isHTTPPath(d) || isUnion {
+			usage(fmt.Errorf("Archives, HTTP sources and unions can't be used with --also-dest: \"%s\"", d))
+		}
+		fsys, p, err := selectVfs(d)
+		if err != nil {
+			fatal(err)
+		}
+		if opt.inplace {
+			fsys.SetWriteInPlace(true)
+		}
+		dsts = append(dsts, syncDest{path: p, fsys: fsys})
+	}
+
+	// Operation journal (not used in dry-run mode)
+	if opt.journal != "" && !opt.dryrun {
+		jrnl, err = openJournal(opt.journal)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// State database
+	if opt.stateDB != "" {
+		state, err = openStateDB(opt.stateDB)
+		if err != nil {
+			fatal(err)
+		}
+		if opt.resetMtime {
+			state.resetMtimeFailures()
+		}
+	}
+
+	// Manifest of transferred files (nothing is transferred in dry-run mode)
+	if opt.writeManifest != "" && !opt.dryrun {
+		mf, err = openManifest(opt.writeManifest)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// Event stream for other programs
+	if opt.events != "" {
+		events, err = openEvents(opt.events)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// Report of Google files that can't be downloaded
+	if opt.skipReport != "" {
+		skipped, err = openSkipReport(opt.skipReport)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	// Limit the total run time, if requested.
+	ctx := context.Background()
+	if opt.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.maxDuration)
+		defer cancel()
+	}
+
+	// Create the destinations (the directory holding the copy, for copyto),
+	// if requested.
+	if opt.mkpath {
+		for _, d := range dsts {
+			dir := d.path
+			if command == cmdCopyTo {
+				dir = parentDir(d.fsys, d.path)
+			}
+			if err = mkdirAll(ctx, d.fsys, dir); err != nil {
+				fatal(err)
+			}
+		}
+	}
 
 	// Treat each path separately
 	for _, srcdir = range srcpaths {
-		isSrcGdrive, srcPath := isGdrivePath(srcdir)
-
 		// Select VFSes according to path type
-		srcvfs = lfs
-		if isSrcGdrive {
-			srcvfs = gfs
+		srcvfs, srcPath, err := selectVfs(srcdir)
+		if err != nil {
+			fatal(err)
 		}
 
 		// Sync
-		err = sync(srcPath, dstPath, srcvfs, dstvfs)
+		if command == cmdCopyTo {
+			err = copyTo(ctx, srcPath, srcvfs, dstPath, dstvfs, mf)
+		} else {
+			err = syncTo(ctx, srcPath, srcvfs, dsts, jrnl, state, mf)
+		}
 		if err != nil {
-			log.Fatal(err)
+			// Checksums computed so far are still valid.
+			mf.close()
+			sums.save()
+			fatal(err)
 		}
 	}
+
+	// Remove the directories left empty by the sync (and any others).
+	if opt.rmdirs {
+		for _, d := range dsts {
+			if _, err = removeEmptyDirs(ctx, d.fsys, d.path); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	// Nothing is written to archives in dry-run mode.
+	if archive != nil && !opt.dryrun {
+		if err = archive.Close(); err != nil {
+			fatal(err)
+		}
+	}
+	for _, a := range sourceArchives {
+		a.Close()
+	}
+	if err = sums.save(); err != nil {
+		fatal(err)
+	}
+
+	err = mf.close()
+	if err != nil {
+		fatal(err)
+	}
+	apiCalls.report()
+	if err = events.close(); err != nil {
+		events = nil
+		fatal(err)
+	}
+	if err = skipped.close(); err != nil {
+		skipped = nil
+		fatal(err)
+	}
+	if n := atomic.LoadInt64(&closeErrors); n > 0 {
+		log.Warn("errors closing source files", "count", n)
+	}
+	if n := atomic.LoadInt64(&walkErrors); n > 0 {
+		log.Warn("source paths could not be read", "count", n)
+	}
+	if n := atomic.LoadInt64(&stalledTransfers); n > 0 {
+		log.Warn("transfers stalled and were retried", "count", n)
+	}
+	if n := atomic.LoadInt64(&mtimeErrors); n > 0 {
+		log.Warn("modification times could not be set", "count", n)
+	}
+	if n := atomic.LoadInt64(&unexportableFiles); n > 0 {
+		log.Warn("Google files skipped because they can't be downloaded", "count", n)
+	}
+
+	// Files given up on with --file-retries fail the run, and are retried
+	// when resuming from the journal (or with --retry-from).
+	if err = writeFailedList(opt.failedList); err != nil {
+		opt.failedList = ""
+		fatal(err)
+	}
+	if len(failedFiles) > 0 {
+		for _, f := range failedFiles {
+			log.Error("file not synced", "path", f.path, "error", f.err)
+		}
+		log.Error("some files could not be synced", "count", len(failedFiles))
+		closeTokens()
+		stopProfiling()
+		os.Exit(1)
+	}
+
+	// All done. The journal is no longer needed.
+	err = jrnl.remove()
+	if err != nil {
+		fatal(err)
+	}
 }
@@ -0,0 +1,127 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	gosync "sync"
+)
+
+// Suffix of the companion file holding the MD5 checksums of the files in a
+// manifest.
+const manifestMD5Suffix = ".md5"
+
+// manifest records the SHA256 checksum of every file transferred during the
+// run, in the format used by sha256sum (and SHA256SUMS files). The MD5
+// checksums of the same files go to a companion file in the format used by
+// md5sum, named after the manifest (see manifestMD5Suffix), so remotes that
+// keep MD5 checksums can be verified without downloading every file (see
+// verifyManifest). Files may be added concurrently. All methods are safe to
+// call on a nil manifest, in which case they do nothing.
+type manifest struct {
+	fname   string
+	mu      gosync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	md5file *os.File
+	md5w    *bufio.Writer
+}
+
+// manifestHash computes the SHA256 and MD5 checksums of the data written to
+// it at once. Sum returns the SHA256 checksum.
+type manifestHash struct {
+	hash.Hash
+	md5 hash.Hash
+}
+
+// Write adds p to both checksums.
+func (h *manifestHash) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	return h.Hash.Write(p)
+}
+
+// Create the manifest file fname and its companion MD5 file, truncating them
+// if they already exist.
+//
+// Return:
+//   *manifest
+//   error
+func openManifest(fname string) (*manifest, error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create manifest \"%s\": %v", fname, err)
+	}
+	mf, err := os.Create(fname + manifestMD5Suffix)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to create manifest \"%s\": %v", fname+manifestMD5Suffix, err)
+	}
+	return &manifest{fname: fname, file: f, w: bufio.NewWriter(f), md5file: mf, md5w: bufio.NewWriter(mf)}, nil
+}
+
+// Return a new hash to compute the checksums of a file, or nil if no manifest
+// is being written.
+func (m *manifest) hasher() hash.Hash {
+	if m == nil {
+		return nil
+	}
+	return &manifestHash{Hash: sha256.New(), md5: md5.New()}
+}
+
+// Add the checksums in h (as returned by hasher) for the file named path to
+// the manifest.
+//
+// Return:
+//   error
+func (m *manifest) add(h hash.Hash, path string) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.w, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), path)
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest \"%s\": %v", m.fname, err)
+	}
+	if mh, ok := h.(*manifestHash); ok {
+		if _, err = fmt.Fprintf(m.md5w, "%s  %s\n", hex.EncodeToString(mh.md5.Sum(nil)), path); err != nil {
+			return fmt.Errorf("Unable to write manifest \"%s\": %v", m.fname+manifestMD5Suffix, err)
+		}
+	}
+	return nil
+}
+
+// Flush all pending entries and close the manifest file.
+//
+// Return:
+//   error
+func (m *manifest) close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.w.Flush()
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest \"%s\": %v", m.fname, err)
+	}
+	err = m.md5w.Flush()
+	if cerr := m.md5file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest \"%s\": %v", m.fname+manifestMD5Suffix, err)
+	}
+	return nil
+}
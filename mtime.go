@@ -0,0 +1,43 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// mtimeError is returned when the modification time of a destination file or
+// directory could not be set. Everything else about the operation succeeded,
+// so these errors do not stop the sync.
+type mtimeError struct {
+	path string
+	err  error
+}
+
+func (e *mtimeError) Error() string {
+	return fmt.Sprintf("Unable to set the modification time of \"%s\": %v", e.path, e.err)
+}
+
+func (e *mtimeError) Unwrap() error {
+	return e.err
+}
+
+// Number of modification times that could not be set.
+var mtimeErrors int64
+
+// Handle a failure to set a modification time in the sync of root. Only the
+// first failure is reported as a warning. The failure is recorded in the state
+// database and, if it keeps happening, destination files under root are
+// compared by checksum or size in future syncs, as their modification times
+// can't be trusted.
+func mtimeFailed(root string, merr *mtimeError, state *stateDB) {
+	if atomic.AddInt64(&mtimeErrors, 1) == 1 {
+		log.Warn("unable to set modification times; continuing", "path", merr.path, "error", merr.err)
+	} else {
+		log.Debug("unable to set modification time", "path", merr.path, "error", merr.err)
+	}
+	state.recordMtimeFailure(root)
+}
@@ -0,0 +1,112 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Fields accepted by --order-by.
+const (
+	orderName  = "name"
+	orderMtime = "mtime"
+	orderSize  = "size"
+)
+
+// Directions accepted by --order-by.
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// listOrder is the order in which source files are synced (see --order-by).
+type listOrder struct {
+	field string
+	desc  bool
+}
+
+// Order in which source files are synced. The zero value keeps the order of
+// the listing.
+var order listOrder
+
+// Parse an --order-by specification, as in "mtime,desc". The direction is
+// optional, and defaults to ascending.
+//
+// Return:
+//   listOrder
+//   error
+func parseOrder(spec string) (listOrder, error) {
+	if spec == "" {
+		return listOrder{}, nil
+	}
+	parts := strings.Split(spec, ",")
+	o := listOrder{field: parts[0]}
+	switch o.field {
+	case orderName, orderMtime, orderSize:
+	default:
+		return listOrder{}, fmt.Errorf("Invalid --order-by \"%s\" (must be %s, %s or %s, optionally followed by \",%s\" or \",%s\")", spec, orderName, orderMtime, orderSize, orderAsc, orderDesc)
+	}
+	if len(parts) > 2 || len(parts) == 2 && parts[1] != orderAsc && parts[1] != orderDesc {
+		return listOrder{}, fmt.Errorf("Invalid --order-by direction in \"%s\" (must be %s or %s)", spec, orderAsc, orderDesc)
+	}
+	o.desc = len(parts) == 2 && parts[1] == orderDesc
+	return o, nil
+}
+
+// Return true if the file described by a goes before b.
+func (o listOrder) less(a vfs.FileInfo, b vfs.FileInfo) bool {
+	if o.desc {
+		a, b = b, a
+	}
+	switch o.field {
+	case orderMtime:
+		return a.Mtime.Before(b.Mtime)
+	case orderSize:
+		return a.Size < b.Size
+	}
+	return a.Path < b.Path
+}
+
+// Return the source listing in paths sorted as requested by --order-by, or
+// paths itself if the listing order is kept. The whole listing is read before
+// the first file is passed on. Directories are passed on first, in their
+// original order (so parents still come before their contents), followed by
+// all files in the requested order. Files with the same sort key keep their
+// relative order.
+//
+// Return:
+//   <-chan vfs.FileInfo
+func orderListing(paths <-chan vfs.FileInfo, done <-chan struct{}) <-chan vfs.FileInfo {
+	if order.field == "" || order.field == orderName && !order.desc {
+		return paths
+	}
+	out := make(chan vfs.FileInfo, pipelineBuffer)
+	go func() {
+		defer close(out)
+		var dirs, files []vfs.FileInfo
+		for fi := range paths {
+			if fi.IsDir() {
+				dirs = append(dirs, fi)
+			} else {
+				files = append(files, fi)
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return order.less(files[i], files[j])
+		})
+		for _, fi := range append(dirs, files...) {
+			select {
+			case out <- fi:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,228 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"io"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/archive"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Size of each chunk held by a streamPipe.
+const pipeChunkSize = 256 << 10
+
+// Limit for the bandwidth used by all transfers (see --bwlimit), or nil for
+// no limit.
+var bwlimit *rateLimiter
+
+// rateLimiter limits the rate of data transfers to a number of bytes per
+// second, shared by all transfers. Up to one second worth of unused bandwidth
+// can be used in bursts. All methods are safe to call on a nil rateLimiter, in
+// which case they do nothing, and safe for concurrent use.
+type rateLimiter struct {
+	mu     gosync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Return a new rateLimiter allowing rate bytes per second.
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), last: time.Now()}
+}
+
+// Wait until n more bytes can be transferred, or ctx is done.
+//
+// Return:
+//
+//	error
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	// Take the bytes now, and wait until the debt is paid.
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader limits the rate of reads from r with a rateLimiter.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rateLimiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.lim.wait(l.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// streamPipe reads ahead from a source reader into a bounded set of buffers,
+// so downloads from one remote backend continue while the data is being
+// uploaded to another (and vice versa), without staging files on disk.
+type streamPipe struct {
+	full   chan []byte
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+	once   gosync.Once
+
+	// Chunk being consumed, and the unread part of it.
+	buf []byte
+	cur []byte
+
+	// Error reading the source. Valid after full is closed.
+	err error
+}
+
+// Return a new streamPipe reading from r, holding up to size bytes in
+// memory (at least two chunks). Chunks come from the shared buffer pool, and
+// only the first one is guaranteed, so the pipe reads ahead less when the pool
+// is at its limit (see --max-buffer-memory). The pipe must be closed after
+// use, to stop reading from r and release its buffers.
+func newStreamPipe(r io.Reader, size int) *streamPipe {
+	n := size / pipeChunkSize
+	if n < 2 {
+		n = 2
+	}
+	p := &streamPipe{
+		full:   make(chan []byte, n),
+		free:   make(chan []byte, n),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	p.free <- vfs.Buffers.Get(pipeChunkSize)
+	for i := 1; i < n; i++ {
+		buf := vfs.Buffers.TryGet(pipeChunkSize)
+		if buf == nil {
+			break
+		}
+		p.free <- buf
+	}
+	go p.fill(r)
+	return p
+}
+
+// Read chunks from r until EOF, an error, or the pipe is closed.
+func (p *streamPipe) fill(r io.Reader) {
+	defer close(p.exited)
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+		n, err := r.Read(buf[:cap(buf)])
+		if n > 0 {
+			select {
+			case p.full <- buf[:n]:
+			case <-p.done:
+				vfs.Buffers.Put(buf)
+				return
+			}
+		} else {
+			p.free <- buf
+		}
+		if err != nil {
+			p.err = err
+			close(p.full)
+			return
+		}
+	}
+}
+
+func (p *streamPipe) Read(b []byte) (int, error) {
+	if len(p.cur) == 0 {
+		if p.buf != nil {
+			p.free <- p.buf
+			p.buf = nil
+		}
+		buf, ok := <-p.full
+		if !ok {
+			return 0, p.err
+		}
+		p.buf, p.cur = buf, buf
+	}
+	n := copy(b, p.cur)
+	p.cur = p.cur[n:]
+	return n, nil
+}
+
+// Close stops reading from the source. Data not read yet is discarded, and
+// the buffers go back to the pool once the source read in progress (if any)
+// returns.
+func (p *streamPipe) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		go func() {
+			<-p.exited
+			vfs.Buffers.Put(p.buf)
+			putBuffers(p.full)
+			putBuffers(p.free)
+		}()
+	})
+	return nil
+}
+
+// Return the buffers queued in ch to the pool.
+func putBuffers(ch chan []byte) {
+	for {
+		select {
+		case buf, ok := <-ch:
+			if !ok {
+				return
+			}
+			vfs.Buffers.Put(buf)
+		default:
+			return
+		}
+	}
+}
+
+// Return true if fsys keeps its data on a local disk.
+func isLocalVfs(fsys vfs.VFS) bool {
+	if t, ok := fsys.(*timeoutVfs); ok {
+		fsys = t.VFS
+	}
+	switch fsys.(type) {
+	case *localvfs.LocalFileSystem, *archivevfs.ArchiveFileSystem, *archivevfs.ArchiveSourceFileSystem:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof" // Registers the /debug/pprof handlers.
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	gosync "sync"
+)
+
+// Stop all profiles started by startProfiling and write their results. Safe
+// to call more than once, and before profiling starts.
+var stopProfiling = func() {}
+
+// Start the profiles requested with --cpuprofile, --memprofile and --trace,
+// and the pprof HTTP server requested with --pprof. The results are written
+// when stopProfiling is called, which must happen before the program exits.
+//
+// Return:
+//   error
+func startProfiling() (err error) {
+	var stops []func() error
+	// Don't leave profiles running if a later one fails to start.
+	defer func() {
+		if err != nil {
+			for _, stop := range stops {
+				stop()
+			}
+		}
+	}()
+
+	if opt.cpuProfile != "" {
+		f, err := os.Create(opt.cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return fmt.Errorf("Unable to start CPU profile: %v", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+
+	if opt.trace != "" {
+		f, err := os.Create(opt.trace)
+		if err != nil {
+			return err
+		}
+		if err = trace.Start(f); err != nil {
+			f.Close()
+			return fmt.Errorf("Unable to start execution trace: %v", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+
+	if opt.pprofAddr != "" {
+		l, err := net.Listen("tcp", opt.pprofAddr)
+		if err != nil {
+			return fmt.Errorf("Unable to start pprof server: %v", err)
+		}
+		log.Info("pprof server listening", "url", "http://"+l.Addr().String()+"/debug/pprof/")
+		go http.Serve(l, nil)
+		stops = append(stops, l.Close)
+	}
+
+	// The heap profile is taken at the end of the run.
+	if opt.memProfile != "" {
+		fname := opt.memProfile
+		stops = append(stops, func() error {
+			f, err := os.Create(fname)
+			if err != nil {
+				return err
+			}
+			runtime.GC()
+			if err = pprof.WriteHeapProfile(f); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	}
+
+	var once gosync.Once
+	stopProfiling = func() {
+		once.Do(func() {
+			for _, stop := range stops {
+				if err := stop(); err != nil {
+					log.Error("unable to write profile", "error", err)
+				}
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Maximum number of retries for rate limited requests.
+	maxRateLimitRetries = 8
+
+	// Initial and maximum backoff between retries, when the server does not
+	// send a Retry-After header.
+	initialBackoff = time.Second
+	maxBackoff     = 64 * time.Second
+
+	// Maximum size of error bodies inspected for the error reason.
+	maxErrorBody = 64 * 1024
+)
+
+// Drive API error reasons. Rate limit errors are transient and can be
+// retried after a short wait. Quota errors last until the daily quota resets.
+var (
+	rateLimitReasons = map[string]bool{
+		"rateLimitExceeded":     true,
+		"userRateLimitExceeded": true,
+	}
+	quotaReasons = map[string]bool{
+		"dailyLimitExceeded": true,
+		"quotaExceeded":      true,
+	}
+)
+
+// Drive API quotas reset at midnight, Pacific time.
+var quotaResetLocation = func() *time.Location {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		return time.FixedZone("PST", -8*3600)
+	}
+	return loc
+}()
+
+// retryTransport is an http.RoundTripper that retries requests rejected by
+// the Drive API due to rate limiting, honoring the Retry-After header, and
+// handles the exhaustion of the daily quota by either waiting for the quota
+// to reset (see --quota-wait) or failing with a clear error.
+type retryTransport struct {
+	base      http.RoundTripper
+	quotaWait bool
+
+	// Overridable for tests.
+	sleep func(context.Context, time.Duration) error
+	now   func() time.Time
+}
+
+// attemptKey is the context key holding the number of the current retry of
+// a request, in requests retried by retryTransport.
+type attemptKey struct{}
+
+// Return a new retryTransport on top of base.
+func newRetryTransport(base http.RoundTripper, quotaWait bool) *retryTransport {
+	return &retryTransport{
+		base:      base,
+		quotaWait: quotaWait,
+		sleep:     sleepContext,
+		now:       time.Now,
+	}
+}
+
+// Sleep for d or until ctx is done, whichever happens first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Return the reason of a Drive API error, from the error body in b.
+func errorReason(b []byte) string {
+	var e struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &e) != nil || len(e.Error.Errors) == 0 {
+		return ""
+	}
+	return e.Error.Errors[0].Reason
+}
+
+// Return the wait requested by the Retry-After header in resp (in seconds or
+// as an HTTP date), and true if the header is present and valid.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// Return the exponential backoff for the given attempt (starting at zero),
+// with random jitter.
+func backoff(attempt int) time.Duration {
+	d := initialBackoff << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(time.Second)))
+}
+
+// Return the time of the next daily quota reset after now.
+func nextQuotaReset(now time.Time) time.Time {
+	t := now.In(quotaResetLocation)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, quotaResetLocation)
+}
+
+// RoundTrip implements http.RoundTripper. Retries send a clone of req, which
+// is never modified.
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 {
+			r = req.Clone(context.WithValue(req.Context(), attemptKey{}, attempt))
+			// Requests can only be retried if the body can be recreated.
+			if req.Body != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r.Body = body
+			}
+		}
+
+		resp, err := rt.base.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		// Inspect the error reason and restore the body for the caller.
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		reason := errorReason(b)
+		retriable := req.Body == nil || req.GetBody != nil
+
+		switch {
+		case quotaReasons[reason]:
+			reset := nextQuotaReset(rt.now())
+			if !rt.quotaWait || !retriable {
+				return nil, fmt.Errorf("Google Drive daily quota exhausted (%s); quota resets at %v (use --quota-wait to wait for it)", reason, reset.Local())
+			}
+			gdriveLog.Warn("daily quota exhausted; waiting for reset", "reason", reason, "until", reset.Local())
+			if err = rt.sleep(req.Context(), reset.Sub(rt.now())); err != nil {
+				return nil, err
+			}
+
+		case rateLimitReasons[reason] || resp.StatusCode == http.StatusTooManyRequests:
+			if attempt >= maxRateLimitRetries || !retriable {
+				return resp, nil
+			}
+			wait, ok := retryAfter(resp, rt.now())
+			if !ok {
+				wait = backoff(attempt)
+			}
+			gdriveLog.Info("rate limited; retrying", "url", req.URL.Path, "reason", reason, "wait", wait, "attempt", attempt+1)
+			if err = rt.sleep(req.Context(), wait); err != nil {
+				return nil, err
+			}
+
+		default:
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+// Lists of failed files (--failed-list and --retry-from).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// retryList holds the paths to sync with --retry-from, relative to the sync
+// root as seen in the destination (like exclusion patterns). Listed paths
+// map to true, and their parent directories to false.
+type retryList map[string]bool
+
+// Paths to sync (see --retry-from). Nil to sync everything.
+var retryPaths retryList
+
+// Return the path rel in the canonical form used in the lists.
+func listPath(rel string) string {
+	return strings.Trim(path.Clean("/"+rel), "/")
+}
+
+// Read the list of paths to sync from fname, with one path per line. Empty
+// lines are ignored.
+//
+// Return:
+//   retryList
+//   error
+func loadRetryList(fname string) (retryList, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := make(retryList)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p := listPath(scanner.Text())
+		if p == "" {
+			continue
+		}
+		r[p] = true
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			if _, ok := r[d]; !ok {
+				r[d] = false
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read \"%s\": %v", fname, err)
+	}
+	return r, nil
+}
+
+// Return true if rel must be skipped: it's not in the list, inside a listed
+// directory, or a parent directory of a listed path. Nothing is skipped with
+// a nil retryList.
+func (r retryList) skip(rel string) bool {
+	if r == nil {
+		return false
+	}
+	rel = listPath(rel)
+	if _, ok := r[rel]; ok {
+		return false
+	}
+	for d := path.Dir(rel); d != "."; d = path.Dir(d) {
+		if r[d] {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the paths of the files that failed in this run (see fileFailed) to
+// fname, one per line, in a format accepted by --retry-from. The file is
+// written even if nothing failed.
+//
+// Return:
+//   error
+func writeFailedList(fname string) error {
+	if fname == "" {
+		return nil
+	}
+	failedMu.Lock()
+	defer failedMu.Unlock()
+
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, f := range failedFiles {
+		if f.rel != "" && !seen[f.rel] {
+			seen[f.rel] = true
+			b.WriteString(f.rel + "\n")
+		}
+	}
+	if err := ioutil.WriteFile(fname, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("Unable to write the list of failed files \"%s\": %v", fname, err)
+	}
+	return nil
+}
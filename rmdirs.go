@@ -0,0 +1,106 @@
+package main
+
+// Removal of empty directories (rmdirs command and --rmdirs).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"path"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Remove all empty directories under root in fsys, including those left empty
+// by the removal of their empty subdirectories. Root itself is never removed.
+// Excluded directories (see --exclude) are left alone, along with the
+// directories above them. Symbolic links to directories are not directories
+// here, so they are never removed, and keep the directories holding them. On
+// backends whose listings may omit objects (see vfs.EmptyDirChecker),
+// directories are only removed if the backend confirms they are empty. In
+// dry-run mode, directories are only logged.
+//
+// Return:
+//   int: number of directories removed
+//   error
+func removeEmptyDirs(ctx context.Context, fsys vfs.VFS, root string) (int, error) {
+	var dirs []vfs.FileInfo
+	// Relative paths of directories holding files or excluded paths, and
+	// of excluded directories.
+	keep := make(map[string]bool)
+	skip := make(map[string]bool)
+
+	err := fsys.Walk(ctx, root, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(root, fi.Path)
+		if rel == "" {
+			return nil
+		}
+		isDir := fi.Type == vfs.TypeDir
+		if skip[path.Dir(rel)] {
+			if isDir {
+				skip[rel] = true
+			}
+			return nil
+		}
+		exc, err := excluded(rel)
+		if err != nil {
+			return err
+		}
+		if isDir && !exc {
+			dirs = append(dirs, fi)
+			return nil
+		}
+		if isDir {
+			skip[rel] = true
+		}
+		keepParents(keep, rel)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Walks list directories before their contents.
+	checker, _ := fsys.(vfs.EmptyDirChecker)
+	removed := 0
+	for ix := len(dirs) - 1; ix >= 0; ix-- {
+		rel := relPath(root, dirs[ix].Path)
+		if keep[rel] {
+			continue
+		}
+		if checker != nil {
+			empty, err := checker.IsEmptyDir(ctx, dirs[ix].Path)
+			if err != nil {
+				return removed, err
+			}
+			if !empty {
+				log.Info("not removing directory holding unlisted objects", "path", dirs[ix].Path)
+				keepParents(keep, rel)
+				continue
+			}
+		}
+		log.Info("rmdir", "path", dirs[ix].Path)
+		if !opt.dryrun {
+			if err = fsys.Delete(ctx, dirs[ix].Path); err != nil {
+				return removed, err
+			}
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Info("removed empty directories", "path", root, "count", removed)
+	}
+	return removed, nil
+}
+
+// Mark all directories above the relative path rel as kept.
+func keepParents(keep map[string]bool, rel string) {
+	for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+		keep[d] = true
+	}
+}
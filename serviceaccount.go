@@ -0,0 +1,158 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/goauth2/oauth"
+)
+
+const (
+	// Default token endpoint for service accounts.
+	defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+	// Lifetime of the requested access tokens (maximum allowed by Google).
+	serviceTokenLifetime = time.Hour
+)
+
+// serviceAccountKey holds the relevant fields of a service account JSON key
+// file, as downloaded from the Google Developers Console.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	ClientID    string `json:"client_id"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// Load a service account key from keyfile.
+//
+// Returns:
+//   *serviceAccountKey
+//   error
+func loadServiceAccountKey(keyfile string) (*serviceAccountKey, error) {
+	j, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read service account key \"%s\": %v", keyfile, err)
+	}
+	key := &serviceAccountKey{}
+	if err = json.Unmarshal(j, key); err != nil {
+		return nil, fmt.Errorf("Unable to decode service account key \"%s\": %v", keyfile, err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("Service account key \"%s\" is missing client_email or private_key", keyfile)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = defaultTokenURI
+	}
+	return key, nil
+}
+
+// Return a signed JWT assertion for the service account, requesting scope
+// on behalf of subject (domain-wide delegation).
+//
+// Returns:
+//   string
+//   error
+func (key *serviceAccountKey) assertion(subject string, scope string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("Invalid private key in service account key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse service account private key: %v", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("Service account private key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"sub":   subject,
+		"scope": scope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(serviceTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// Obtain an access token for subject using the service account key in
+// keyfile, which must have domain-wide delegation enabled for scope. Service
+// account tokens cannot be refreshed and are valid for one hour.
+//
+// Returns:
+//   *serviceAccountKey
+//   *oauth.Token
+//   error
+func impersonationToken(keyfile string, subject string, scope string) (*serviceAccountKey, *oauth.Token, error) {
+	key, err := loadServiceAccountKey(keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	assertion, err := key.assertion(subject, scope, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := http.PostForm(key.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Unable to impersonate \"%s\": %s: %s", subject, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &t); err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode token response: %v", err)
+	}
+	// No expiry is set, since the token cannot be refreshed anyway.
+	gdriveLog.Debug("obtained access token", "subject", subject, "expires", time.Duration(t.ExpiresIn)*time.Second)
+	return key, &oauth.Token{AccessToken: t.AccessToken}, nil
+}
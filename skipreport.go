@@ -0,0 +1,81 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	gosync "sync"
+	"sync/atomic"
+
+	"github.com/marcopaganini/gsync/vfs/gdrive"
+)
+
+// Number of native Google files (forms, sites, etc) skipped because they
+// can't be downloaded or exported.
+var unexportableFiles int64
+
+// skipReport lists the native Google files skipped because they can't be
+// downloaded (see --skip-report), one per line, with the kind and mime type
+// of the file. All methods are safe to call on a nil skipReport, in which
+// case they do nothing, and safe for concurrent use.
+type skipReport struct {
+	mu   gosync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+// List of skipped files (see --skip-report). Nil if not requested.
+var skipped *skipReport
+
+// Create the report of skipped files in fname.
+//
+// Return:
+//   *skipReport
+//   error
+func openSkipReport(fname string) (*skipReport, error) {
+	f, err := os.Create(fname)
+	if err != nil {
+		return nil, err
+	}
+	return &skipReport{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Record the native Google file at fullpath, of the given mime type, as
+// skipped. Write errors are reported when closing the report.
+func (r *skipReport) add(fullpath string, mimeType string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.w, "%s\t%s\t%s\n", fullpath, gdrivevfs.UnexportableKind(mimeType), mimeType)
+}
+
+// Flush and close the report.
+//
+// Return:
+//   error
+func (r *skipReport) close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.w.Flush()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Count and report a native Google file skipped by Walk because it can't be
+// downloaded.
+func unexportableSkipped(fullpath string, mimeType string) {
+	atomic.AddInt64(&unexportableFiles, 1)
+	events.skip()
+	skipped.add(fullpath, mimeType)
+}
@@ -0,0 +1,82 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Number of transfers retried after stalling (see --stall-timeout).
+var stalledTransfers int64
+
+// stallError is returned when a transfer makes no progress for longer than
+// --stall-timeout. Retry is false if the transfer could not be stopped, in
+// which case retrying it could race with the stalled one.
+type stallError struct {
+	path    string
+	timeout time.Duration
+	retry   bool
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("Transfer of \"%s\" stalled: no data transferred for %v", e.path, e.timeout)
+}
+
+// Run the transfer fn to fullpath with a reader wrapping reader. If no data
+// is read or acknowledged by the destination (as reported by backends, see
+// vfs.WithProgress) for longer than --stall-timeout, the context passed to fn
+// is canceled and a stallError is returned. Transfers that don't stop within the
+// timeout after being canceled are abandoned, and keep running in the
+// background.
+//
+// Return:
+//   error
+func watchStall(ctx context.Context, fullpath string, reader io.Reader, fn func(context.Context, io.Reader) error) error {
+	timeout := opt.stallTimeout
+	if timeout <= 0 {
+		return fn(ctx, reader)
+	}
+	ar := &activityReader{r: reader, last: time.Now().UnixNano()}
+	wctx, cancel := context.WithCancel(vfs.WithProgress(ctx, func(int) { ar.touch() }))
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn(wctx, ar)
+	}()
+
+	interval := timeout / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if ar.idle() <= timeout {
+				continue
+			}
+			cancel()
+			serr := &stallError{path: fullpath, timeout: timeout}
+			select {
+			case <-errc:
+				serr.retry = true
+			case <-time.After(timeout):
+			}
+			return serr
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// stateEntry holds what we know about a file after it has been synced.
+type stateEntry struct {
+	SrcID  string    `json:"src_id,omitempty"`
+	DstID  string    `json:"dst_id,omitempty"`
+	SrcRev string    `json:"src_rev,omitempty"`
+	DstRev string    `json:"dst_rev,omitempty"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	MD5    string    `json:"md5,omitempty"`
+}
+
+// Sides of a sync where a deletion was observed (see tombstone).
+const (
+	sideSource = "source"
+	sideDest   = "dest"
+)
+
+// Number of consecutive failures to set modification times in a destination
+// before its modification times are considered unreliable.
+const mtimeFailureLimit = 3
+
+// How long tombstones are kept.
+const tombstoneMaxAge = 90 * 24 * time.Hour
+
+// tombstone records a synced file deleted from one side of the sync, along
+// with its last known state. This tells "deleted since the last sync" apart
+// from "never synced".
+type tombstone struct {
+	stateEntry
+	Side    string    `json:"side"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// stateDB is a persistent database holding the state of all files at the end
+// of the last sync. Entries are grouped by sync root (source and destination
+// pair) and keyed by the path relative to the root of the sync. Files deleted
+// since they were synced are moved to Tombstones, grouped the same way.
+// Consecutive failures to set modification times in the destination of each
+// root are counted in MtimeFailures, and roots reaching mtimeFailureLimit are
+// recorded in NoMtime until a modification time is set successfully.
+// All methods are safe to call on a nil stateDB, in which case they do
+// nothing, and safe for concurrent use.
+type stateDB struct {
+	mu         gosync.Mutex
+	fname      string
+	Roots      map[string]map[string]*stateEntry `json:"roots"`
+	Tombstones map[string]map[string]*tombstone  `json:"tombstones,omitempty"`
+	NoMtime    map[string]bool                   `json:"no_mtime,omitempty"`
+
+	MtimeFailures map[string]int `json:"mtime_failures,omitempty"`
+}
+
+// Load the state database from fname. A missing file results in an empty
+// database.
+//
+// Return:
+//   *stateDB
+//   error
+func openStateDB(fname string) (*stateDB, error) {
+	db := &stateDB{
+		fname: fname,
+		Roots: make(map[string]map[string]*stateEntry),
+	}
+
+	j, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(j, db)
+	return db, err
+}
+
+// Save the state database atomically to disk. Expired tombstones are
+// dropped.
+//
+// Return:
+//   error
+func (db *stateDB) save() error {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	for root, tombs := range db.Tombstones {
+		for rel, t := range tombs {
+			if time.Since(t.Deleted) > tombstoneMaxAge {
+				delete(tombs, rel)
+			}
+		}
+		if len(tombs) == 0 {
+			delete(db.Tombstones, root)
+		}
+	}
+	j, err := json.Marshal(db)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(db.fname), filepath.Base(db.fname))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(j)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.fname)
+}
+
+// Return the entry for relpath under root, or nil if not found.
+func (db *stateDB) lookup(root string, relpath string) *stateEntry {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.Roots[root][relpath]
+}
+
+// Remove the entry for relpath under root.
+func (db *stateDB) forget(root string, relpath string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.Roots[root], relpath)
+}
+
+// Replace the entry for relpath under root with a tombstone recording its
+// deletion from side (sideSource or sideDest). Does nothing if there's no
+// entry.
+func (db *stateDB) bury(root string, relpath string, side string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry := db.Roots[root][relpath]
+	if entry == nil {
+		return
+	}
+	delete(db.Roots[root], relpath)
+	if db.Tombstones == nil {
+		db.Tombstones = make(map[string]map[string]*tombstone)
+	}
+	if db.Tombstones[root] == nil {
+		db.Tombstones[root] = make(map[string]*tombstone)
+	}
+	db.Tombstones[root][relpath] = &tombstone{stateEntry: *entry, Side: side, Deleted: time.Now()}
+}
+
+// Return the tombstone for relpath under root, or nil if the file was not
+// deleted since it was last synced.
+func (db *stateDB) tombstone(root string, relpath string) *tombstone {
+	if db == nil {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.Tombstones[root][relpath]
+}
+
+// Return true if setting modification times failed repeatedly in the
+// destination of root.
+func (db *stateDB) mtimeUnreliable(root string) bool {
+	if db == nil {
+		return false
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.NoMtime[root]
+}
+
+// Record a failure to set a modification time in the sync of root. After
+// mtimeFailureLimit consecutive failures, modification times in the
+// destination of root are considered unreliable.
+func (db *stateDB) recordMtimeFailure(root string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.MtimeFailures == nil {
+		db.MtimeFailures = make(map[string]int)
+	}
+	db.MtimeFailures[root]++
+	if db.MtimeFailures[root] < mtimeFailureLimit {
+		return
+	}
+	if db.NoMtime == nil {
+		db.NoMtime = make(map[string]bool)
+	}
+	db.NoMtime[root] = true
+}
+
+// Record that a modification time was set in the sync of root, so earlier
+// failures were not caused by the destination itself.
+func (db *stateDB) recordMtimeSuccess(root string) {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.MtimeFailures, root)
+	delete(db.NoMtime, root)
+}
+
+// Forget all failures to set modification times, in all roots.
+func (db *stateDB) resetMtimeFailures() {
+	if db == nil {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.MtimeFailures = nil
+	db.NoMtime = nil
+}
+
+// Return the relative paths of all entries under root indexed by their size
+// and mtime (in the same format as sizeMtimeKey). If seen is not nil, paths
+// present in seen are skipped.
+func (db *stateDB) index(root string, seen map[string]bool) map[string][]string {
+	idx := make(map[string][]string)
+	if db == nil {
+		return idx
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for rel, entry := range db.Roots[root] {
+		if !seen[rel] {
+			key := fmt.Sprintf("%d/%d", entry.Size, entry.Mtime.UnixNano())
+			idx[key] = append(idx[key], rel)
+		}
+	}
+	return idx
+}
+
+// Return true if the source file described by srcfi in srcvfs is unchanged
+// since the last sync, according to the entry for relpath under root. When
+// revisions are known (see vfs.Revisioner), the file is unchanged if its
+// revision is the same, whatever its mtime, so mtimes changed by other
+// programs don't cause copies. Otherwise, it must have the same size and
+// mtime.
+//
+// Return:
+//   bool
+//   error
+func (db *stateDB) unchanged(ctx context.Context, root string, relpath string, srcvfs vfs.VFS, srcfi vfs.FileInfo) (bool, error) {
+	entry := db.lookup(root, relpath)
+	if entry == nil {
+		return false, nil
+	}
+	if v, ok := srcvfs.(vfs.Revisioner); ok && entry.SrcRev != "" {
+		rev, err := v.Revision(ctx, srcfi.Path)
+		if err != nil {
+			return false, err
+		}
+		if rev != "" {
+			return rev == entry.SrcRev, nil
+		}
+	}
+	return srcfi.Size == entry.Size && srcfi.Mtime.Equal(entry.Mtime), nil
+}
+
+// Return the revision of fullpath in fsys, or an empty string if fsys does
+// not support revisions.
+//
+// Return:
+//   string
+//   error
+func revision(ctx context.Context, fsys vfs.VFS, fullpath string) (string, error) {
+	if v, ok := fsys.(vfs.Revisioner); ok {
+		return v.Revision(ctx, fullpath)
+	}
+	return "", nil
+}
+
+// Update the entry for relpath under root with the current state of srcpath
+// in srcvfs and dstpath in dstvfs. Object IDs, revisions and MD5 checksums are
+// recorded for the VFSes that support them.
+//
+// Return:
+//   error
+func (db *stateDB) update(ctx context.Context, root string, relpath string, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) error {
+	if db == nil {
+		return nil
+	}
+	srcfi, err := srcvfs.Stat(ctx, srcpath)
+	if err != nil {
+		return err
+	}
+	return db.record(ctx, root, relpath, srcvfs, dstvfs, srcfi, dstpath)
+}
+
+// Like update, for a source file already described by srcfi.
+//
+// Return:
+//   error
+func (db *stateDB) record(ctx context.Context, root string, relpath string, srcvfs vfs.VFS, dstvfs vfs.VFS, srcfi vfs.FileInfo, dstpath string) error {
+	if db == nil {
+		return nil
+	}
+	var err error
+	srcpath := srcfi.Path
+	entry := &stateEntry{Size: srcfi.Size, Mtime: srcfi.Mtime}
+	if v, ok := srcvfs.(vfs.FileIDer); ok {
+		if entry.SrcID, err = v.FileID(ctx, srcpath); err != nil {
+			return err
+		}
+	}
+	if v, ok := dstvfs.(vfs.FileIDer); ok {
+		if entry.DstID, err = v.FileID(ctx, dstpath); err != nil {
+			return err
+		}
+	}
+	if entry.SrcRev, err = revision(ctx, srcvfs, srcpath); err != nil {
+		return err
+	}
+	if entry.DstRev, err = revision(ctx, dstvfs, dstpath); err != nil {
+		return err
+	}
+	// Prefer the checksum from the source, if available.
+	for _, pair := range []struct {
+		fsys     vfs.VFS
+		pathname string
+	}{{srcvfs, srcpath}, {dstvfs, dstpath}} {
+		if v, ok := pair.fsys.(vfs.MD5er); ok {
+			if entry.MD5, err = v.MD5(ctx, pair.pathname); err != nil {
+				return err
+			}
+			if entry.MD5 != "" {
+				break
+			}
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Roots[root] == nil {
+		db.Roots[root] = make(map[string]*stateEntry)
+	}
+	db.Roots[root][relpath] = entry
+	delete(db.Tombstones[root], relpath)
+	return nil
+}
+
+// Update the source size, mtime and revision of the existing entry for
+// relpath under root with the current state of srcpath in srcvfs, keeping the
+// recorded state of the destination. Entries of files deleted since the last
+// sync are restored from their tombstones. Does nothing if there's no entry.
+//
+// Return:
+//   error
+func (db *stateDB) updateSource(ctx context.Context, root string, relpath string, srcvfs vfs.VFS, srcpath string) error {
+	entry := db.lookup(root, relpath)
+	restore := false
+	if entry == nil {
+		ts := db.tombstone(root, relpath)
+		if ts == nil {
+			return nil
+		}
+		e := ts.stateEntry
+		entry, restore = &e, true
+	}
+	fi, err := srcvfs.Stat(ctx, srcpath)
+	if err != nil {
+		return err
+	}
+	rev, err := revision(ctx, srcvfs, srcpath)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entry.Size, entry.Mtime, entry.SrcRev = fi.Size, fi.Mtime, rev
+	if restore {
+		if db.Roots[root] == nil {
+			db.Roots[root] = make(map[string]*stateEntry)
+		}
+		db.Roots[root][relpath] = entry
+		delete(db.Tombstones[root], relpath)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Symbolic link policies (--symlinks).
+	symlinksFollow = "follow"
+	symlinksSkip   = "skip"
+)
+
+var symlinkPolicies = []string{symlinksFollow, symlinksSkip}
+
+// Make sure policy is a valid symbolic link policy.
+//
+// Return:
+//   error
+func checkSymlinkPolicy(policy string) error {
+	for _, p := range symlinkPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid symlink policy \"%s\" (must be one of %v)", policy, symlinkPolicies)
+}
+
+// Return true if the source path src, described by fi, is a symbolic link that
+// must be skipped. With the "follow" policy, links to files are copied as
+// regular files, but links to directories are skipped, since the source walk
+// does not descend into them. Dangling links are always skipped. The root of
+// the sync is always followed.
+func (p *planner) skipSymlink(src string, fi vfs.FileInfo) bool {
+	if !fi.IsSymlink() || src == p.srcpath {
+		return false
+	}
+	switch {
+	case opt.symlinks == symlinksSkip:
+		log.Debug("skipping symbolic link", "path", src)
+	case fi.Target == vfs.TypeSymlink:
+		log.Warn("skipping dangling symbolic link", "path", src)
+	case fi.IsDir():
+		log.Warn("skipping symbolic link to directory", "path", src)
+	default:
+		return false
+	}
+	return true
+}
@@ -5,20 +5,60 @@ package main
 // (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"path"
 	"path/filepath"
-	"sort"
+	"strconv"
 	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Sync operation types
+const (
+	opMkdir    = "mkdir"
+	opCopy     = "copy"
+	opMove     = "move"
+	opDelete   = "delete"
+	opSetMtime = "set-mtime"
+	opLink     = "link"
+	opRemove   = "remove"
 )
 
-// Directory pairs for sync post-processing of directories
-type dirpair struct {
-	src string
-	dst string
+// syncOp describes a single operation performed by the sync engine. Src is a
+// path in the source VFS and Dst a path in the destination VFS. Delete
+// operations remove Src from the source (--remove-source-files), and remove
+// operations remove Dst from the destination (--mirror). Move
+// operations move From to Dst, both in the destination VFS. Rel is the path
+// relative to the root of the sync. Conflict is set for copies of files that
+// changed on both sides, set aside next to the destination file.
+type syncOp struct {
+	Op       string `json:"op"`
+	Src      string `json:"src,omitempty"`
+	Dst      string `json:"dst,omitempty"`
+	Rel      string `json:"rel,omitempty"`
+	From     string `json:"from,omitempty"`
+	Conflict bool   `json:"conflict,omitempty"`
+
+	// Size of the source file, when known (copies only).
+	Size int64 `json:"size,omitempty"`
 }
 
+const (
+	// Number of entries buffered between the stages of the sync pipeline.
+	pipelineBuffer = 1024
+)
+
+// errWalkStopped is used to stop a source walk when the sync is aborted.
+var errWalkStopped = errors.New("walk stopped")
+
 // Generate a destination path based on the source directory and
 // path under that directory.
 func destPath(srcdir string, dstdir string, srcfile string) string {
@@ -73,219 +113,1717 @@ func destPath(srcdir string, dstdir string, srcfile string) string {
 	return strings.Join(dst, "/")
 }
 
-// Determine if we need to copy the file pointed by srcpath in srcvfs to
-// the file dstpath in dstvfs.
+// Determine if we need to copy the file described by srcfi in srcvfs to
+// the file dstpath in dstvfs. Files of different sizes are always copied
+// (unless --ignore-size is set). Otherwise, the source is copied if it is
+// newer than the destination. With --ignore-times, all files are copied.
+//
+// Destinations that can't set modification times are compared by checksum
+// instead, when both sides provide them. The same happens when trustMtime is
+// false, as when setting modification times failed in a previous sync, and
+// with --checksum.
 //
 // Return:
 // 	 bool
 // 	 error
-func needToCopy(srcvfs gsyncVfs, dstvfs gsyncVfs, srcpath string, dstpath string) (bool, error) {
+func needToCopy(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcfi vfs.FileInfo, dstpath string, trustMtime bool) (bool, error) {
+	srcpath := srcfi.Path
+
 	// If destination doesn't exist we need to copy
-	exists, err := dstvfs.FileExists(dstpath)
+	dstInfo, err := dstvfs.Stat(ctx, dstpath)
+	if errors.Is(err, vfs.ErrNotExist) {
+		log.Debug("destination does not exist; will copy", "path", srcpath)
+		return true, nil
+	}
 	if err != nil {
 		return false, err
 	}
-	if !exists {
-		log.Verbosef(2, "needToCopy: destination file %q does not exist; will copy.", srcpath)
+	if opt.ignoreTimes {
+		log.Debug("ignoring times; will copy", "path", srcpath)
 		return true, nil
 	}
 
-	// If destination exists, we check mtimes truncated to the nearest second
-	srcMtime, err := srcvfs.Mtime(srcpath)
-	if err != nil {
-		return false, err
+	// Sizes are only compared when known on both sides.
+	if !opt.ignoreSize && srcfi.Size >= 0 && dstInfo.Size >= 0 && srcfi.Size != dstInfo.Size {
+		log.Debug("source and destination sizes differ; will copy", "path", srcpath, "srcSize", srcfi.Size, "dstSize", dstInfo.Size)
+		return true, nil
 	}
-	dstMtime, err := dstvfs.Mtime(dstpath)
-	if err != nil {
-		return false, err
+
+	// With --checksum, modification times are only used when checksums are
+	// not available on both sides.
+	if opt.checksum && vfs.CapabilitiesOf(srcvfs).Checksum && vfs.CapabilitiesOf(dstvfs).Checksum {
+		trustMtime = false
+	}
+
+	// The mtime of these files is the time they were copied.
+	if !trustMtime || !vfs.CapabilitiesOf(dstvfs).SetMtime {
+		differ, err := checksumsDiffer(ctx, srcvfs, dstvfs, srcpath, dstpath)
+		if differ {
+			log.Debug("source and destination checksums differ; will copy", "path", srcpath)
+		}
+		return differ, err
 	}
 
-	srcMtime = srcMtime.Truncate(time.Second)
-	dstMtime = dstMtime.Truncate(time.Second)
+	// If destination exists, we check mtimes truncated to the nearest second
+	srcMtime := srcfi.Mtime.Truncate(time.Second)
+	dstMtime := dstInfo.Mtime.Truncate(time.Second)
 
 	if srcMtime.After(dstMtime) {
-		log.Verbosef(2, "needToCopy: %q: source is newer destination (%v > %v); will copy.", srcpath, srcMtime, dstMtime)
+		log.Debug("source is newer than destination; will copy", "path", srcpath, "srcMtime", srcMtime, "dstMtime", dstMtime)
 		return true, nil
 	}
 
-	log.Verbosef(2, "needToCopy: %q: source is older than destination (%v <= %v); will not copy.", srcpath, srcMtime, dstMtime)
+	log.Debug("source is older than destination; will not copy", "path", srcpath, "srcMtime", srcMtime, "dstMtime", dstMtime)
 	return false, nil
 }
 
-// Return true if the passed path matches one of the patterns in the exclusion
-// list (opt.exclude).
+// Determine if srcpath in srcvfs and dstpath in dstvfs have different MD5
+// checksums. Files are considered equal unless both checksums are known.
 //
 // Return:
 //   bool
 //   error
-
-func excluded(pathname string) (bool, error) {
-	fname := path.Base(pathname)
-	for _, excpat := range opt.exclude {
-		log.Verbosef(3, "attempting to match %q to pattern %q", pathname, excpat)
-		match, err := filepath.Match(excpat, fname)
-		if err != nil {
-			return false, err
-		}
-		if match {
-			log.Verbosef(3, "excluding %q: matched %q", pathname, excpat)
-			return match, err
-		}
+func checksumsDiffer(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) (bool, error) {
+	src, ok1 := srcvfs.(vfs.MD5er)
+	dst, ok2 := dstvfs.(vfs.MD5er)
+	if !ok1 || !ok2 || !vfs.CapabilitiesOf(srcvfs).Checksum || !vfs.CapabilitiesOf(dstvfs).Checksum {
+		return false, nil
 	}
-	return false, nil
+	srcSum, err := src.MD5(ctx, srcpath)
+	if err != nil {
+		return false, err
+	}
+	dstSum, err := dst.MD5(ctx, dstpath)
+	if err != nil {
+		return false, err
+	}
+	return srcSum != "" && dstSum != "" && srcSum != dstSum, nil
 }
 
-// Copy the content of all files/directories pointed by srcpath into dstdir.
-// If srcpath is a file, the file will be copied. If it is a directory, the
-// entire subtree will be copied.  Dstdir must be a directory.
+// Determine if srcpath in srcvfs and dstpath in dstvfs have the same MD5
+// checksum. Unlike checksumsDiffer, files are considered different unless
+// both checksums are known.
 //
-// Like rsync, a source path ending in slash means "copy the contents of this
-// directory into the destination" whereas a path not ending in a slash means
-// "copy this directory and its contents into the destination."
+// Return:
+//   bool
+//   error
+func checksumsMatch(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) (bool, error) {
+	src, ok1 := srcvfs.(vfs.MD5er)
+	dst, ok2 := dstvfs.(vfs.MD5er)
+	if !ok1 || !ok2 || !vfs.CapabilitiesOf(srcvfs).Checksum || !vfs.CapabilitiesOf(dstvfs).Checksum {
+		return false, nil
+	}
+	srcSum, err := src.MD5(ctx, srcpath)
+	if err != nil || srcSum == "" {
+		return false, err
+	}
+	dstSum, err := dst.MD5(ctx, dstpath)
+	if err != nil {
+		return false, err
+	}
+	return srcSum == dstSum, nil
+}
+
+// Verify that the copy of srcpath in srcvfs to dstpath in dstvfs completed
+// successfully by comparing the sizes of both files. Sources of unknown size
+// (negative, as with exported Google Docs) are not verified.
 //
-// Files/directories are only copied if needed (based on the modification date
-// of the file on both filesystems.) This function uses the srcvfs and dstvfs
-// VFS objects to perform operations on the respective filesystems.
+// Return:
+//   error
+func verifyCopy(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) error {
+	srcInfo, err := srcvfs.Stat(ctx, srcpath)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Size < 0 {
+		return nil
+	}
+	dstInfo, err := dstvfs.Stat(ctx, dstpath)
+	if err != nil {
+		return err
+	}
+	if srcInfo.Size != dstInfo.Size {
+		return fmt.Errorf("Verification failed for \"%s\": source size %d, destination size %d", dstpath, srcInfo.Size, dstInfo.Size)
+	}
+	return nil
+}
+
+// Verify the copy of srcpath to dstpath like verifyCopy, also comparing the
+// MD5 checksums of both files when available (see --mirror).
 //
 // Return:
-// 	 error
-func sync(srcpath string, dstdir string, srcvfs gsyncVfs, dstvfs gsyncVfs) error {
+//   error
+func verifyChecksums(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) error {
+	if err := verifyCopy(ctx, srcvfs, dstvfs, srcpath, dstpath); err != nil {
+		return err
+	}
+	differ, err := checksumsDiffer(ctx, srcvfs, dstvfs, srcpath, dstpath)
+	if err != nil {
+		return err
+	}
+	if differ {
+		return fmt.Errorf("Verification failed for \"%s\": checksums differ", dstpath)
+	}
+	return nil
+}
+
+// Return the operations needed to create the directory dir and all its
+// parents that are still marked as pending creation in the pending map (see
+// --prune-empty-dirs). Directories are returned top-down and removed from the
+// map.
+func mkdirPending(dir string, pending map[string]bool) []syncOp {
 	var (
-		srctree  []string
-		dirpairs []dirpair
+		dirs []string
+		ops  []syncOp
 	)
 
-	// Destination must exist and be a directory
-	exists, err := dstvfs.FileExists(dstdir)
-	if err != nil {
-		return err
+	for d := dir; pending[d]; d = path.Dir(d) {
+		dirs = append(dirs, d)
 	}
-	if !exists {
-		return fmt.Errorf("Destination \"%s\" does not exist", dstdir)
+	for ix := len(dirs) - 1; ix >= 0; ix-- {
+		ops = append(ops, syncOp{Op: opMkdir, Dst: dirs[ix]})
+		delete(pending, dirs[ix])
+	}
+	return ops
+}
+
+// planner holds the state needed to plan the operations of a single sync.
+type planner struct {
+	ctx     context.Context
+	root    string
+	srcpath string
+	dstdir  string
+	srcvfs  vfs.VFS
+	dstvfs  vfs.VFS
+	state   *stateDB
+
+	// Destination of a single file source synced to a file, instead of a
+	// file of the same name in dstdir (see newSyncBranch).
+	dstfile string
+
+	// Capabilities of the destination.
+	dstcaps vfs.Capabilities
+
+	// Destination directories whose creation has been deferred until
+	// we find a file to be copied into them (--prune-empty-dirs).
+	pending map[string]bool
+
+	// Patterns from per-directory ignore files.
+	ignores ignoreFiles
+
+	// Relative paths of all files seen in the source.
+	seen map[string]bool
+
+	// Source paths of the files considered up to date by the state database,
+	// by relative path.
+	unchanged map[string]string
+
+	// Relative paths of all directories seen in the source, and whether
+	// the source itself is a directory (see --mirror).
+	dirs     map[string]bool
+	srcIsDir bool
+
+	// State database entries indexed by size and mtime (see detectMoves)
+	sizeIndex map[string][]string
+
+	// Listings of destination directories searched for basis files
+	// (see --fuzzy).
+	dstdirs map[string][]vfs.FileInfo
+
+	// Directory mtime operations, executed after everything else.
+	dirops []syncOp
+
+	// Operations held until the entire source has been seen.
+	held []syncOp
+
+	// Number of source paths the listing could not read (see listSource).
+	walkErrors *int64
+}
+
+// Create a new planner for a sync from srcpath in srcvfs to dstdir in dstvfs.
+//
+// Return:
+//   *planner
+//   error
+func newPlanner(ctx context.Context, root string, srcpath string, dstdir string, srcvfs vfs.VFS, dstvfs vfs.VFS, state *stateDB) (*planner, error) {
+	p := &planner{
+		ctx:       ctx,
+		root:      root,
+		srcpath:   srcpath,
+		dstdir:    dstdir,
+		srcvfs:    srcvfs,
+		dstvfs:    dstvfs,
+		state:     state,
+		dstcaps:   vfs.CapabilitiesOf(dstvfs),
+		pending:   make(map[string]bool),
+		ignores:   make(ignoreFiles),
+		seen:      make(map[string]bool),
+		unchanged: make(map[string]string),
+		dirs:      make(map[string]bool),
+		dstdirs:   make(map[string][]vfs.FileInfo),
+		sizeIndex: state.index(root, nil),
 	}
 
-	isdir, err := dstvfs.IsDir(dstdir)
+	// Ignore file at the root of the sync.
+	fi, err := srcvfs.Stat(ctx, srcpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !isdir {
-		return fmt.Errorf("Destination \"%s\" is not a directory/folder", dstdir)
+	if fi.IsDir() {
+		p.srcIsDir = true
+		err = p.ignores.load(ctx, srcvfs, srcpath, destPath(srcpath, "", srcpath))
+		if err != nil {
+			return nil, err
+		}
 	}
+	return p, nil
+}
 
-	// Special case: If the source path is not a directory, we short circuit
-	// the FileTree method here and set srctree to that single file.
-	isdir, err = srcvfs.IsDir(srcpath)
+// Return the operations needed to sync the source path described by fi, as
+// returned by the source walk. Directories must be planned before the files
+// inside them.
+//
+// If a state database is in use, files with the same size and mtime recorded
+// in the database are considered up to date without checking the destination.
+// Copies of files that could be the result of a move are held until the end
+// of the sync (see detectMoves.)
+//
+// Return:
+// 	 []syncOp
+// 	 error
+func (p *planner) plan(fi vfs.FileInfo) ([]syncOp, error) {
+	var ops []syncOp
+	src := fi.Path
+
+	// Check for exclusions (--exclude and ignore files). Patterns are
+	// matched against the path relative to the sync root, as seen in
+	// the destination.
+	relpath := destPath(p.srcpath, "", src)
+	exc, err := excluded(relpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if isdir {
-		srctree, err = srcvfs.FileTree(srcpath)
+	if !exc {
+		exc, err = p.ignores.excluded(relpath, fi.IsDir())
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
-		srctree = []string{srcpath}
+	}
+	if exc {
+		log.Debug("excluded from copy", "path", src)
+		return nil, nil
+	}
+	if retryPaths.skip(relpath) {
+		log.Debug("not in the retry list; will not copy", "path", src)
+		return nil, nil
+	}
+
+	dst := destPath(p.srcpath, p.dstdir, src)
+	if p.dstfile != "" {
+		dst = p.dstfile
 	}
 
-	// Guarantee that we'll process a directory before files inside it
-	sort.Strings(srctree)
+	if p.skipSymlink(src, fi) {
+		return nil, nil
+	}
 
-	for _, src := range srctree {
-		// Check for exclusions (--exclude)
-		exc, err := excluded(src)
+	if fi.IsDir() {
+		// Directories holding a marker file (--exclude-if-present) are
+		// skipped with everything under them. The root is always synced.
+		if relpath != "" {
+			marker, err := excludeMarker(p.ctx, p.srcvfs, src)
+			if err != nil {
+				return nil, err
+			}
+			if marker != "" {
+				log.Debug("excluded from copy by marker file", "path", src, "marker", marker)
+				p.ignores.exclude(relpath)
+				return nil, nil
+			}
+		}
+		p.dirs[relpath] = true
+		// Create destination dir if needed
+		exists, err := p.dstvfs.FileExists(p.ctx, dst)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if exc {
-			log.Verboseln(2, src, "excluded from copy")
-			continue
+		if !exists {
+			if opt.pruneEmpty || opt.noEmptyDirs {
+				p.pending[dst] = true
+			} else {
+				ops = append(ops, syncOp{Op: opMkdir, Src: src, Dst: dst})
+			}
+		}
+		// Patterns in this directory's ignore file apply to everything below it.
+		err = p.ignores.load(p.ctx, p.srcvfs, src, relpath)
+		if err != nil {
+			return nil, err
+		}
+		// Save directory for post processing
+		if p.dstcaps.SetMtime {
+			p.dirops = append(p.dirops, syncOp{Op: opSetMtime, Src: src, Dst: dst})
 		}
+		return ops, nil
+	}
+
+	if !fi.IsRegular() {
+		log.Warn("skipping: not a regular file or directory", "path", src)
+		return nil, nil
+	}
 
-		dst := destPath(srcpath, dstdir, src)
+	p.seen[relpath] = true
+	// With --no-empty-dirs, directories are created once they're known to
+	// hold a file, whether or not it's copied.
+	if opt.noEmptyDirs {
+		ops = mkdirPending(path.Dir(dst), p.pending)
+	}
+	unchanged, err := p.state.unchanged(p.ctx, p.root, relpath, p.srcvfs, fi)
+	if err != nil {
+		return nil, err
+	}
+	if unchanged && !opt.ignoreTimes {
+		log.Debug("unchanged since last sync; will not copy", "path", src)
+		p.unchanged[relpath] = src
+		return ops, nil
+	}
 
-		isdir, err := srcvfs.IsDir(src)
+	// Don't blindly clobber destination files that also changed since the
+	// last sync (see --conflict).
+	conflict, err := p.conflict(relpath, dst)
+	if err != nil {
+		return nil, err
+	}
+	if conflict {
+		cops, overwrite, err := p.resolveConflict(relpath, fi, dst)
+		if err != nil || !overwrite {
+			return append(ops, cops...), err
+		}
+	} else {
+		// With --times, identical files only get their mtime fixed.
+		fixup, err := p.mtimeFixup(fi, dst)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		isregular, err := srcvfs.IsRegular(src)
+		if fixup {
+			return append(ops, syncOp{Op: opSetMtime, Src: src, Dst: dst, Rel: relpath}), nil
+		}
+		copyNeeded, err := needToCopy(p.ctx, p.srcvfs, p.dstvfs, fi, dst, !p.state.mtimeUnreliable(p.root))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if !copyNeeded {
+			// Record files already in sync in the state database.
+			return ops, p.state.record(p.ctx, p.root, relpath, p.srcvfs, p.dstvfs, fi, dst)
+		}
+	}
+
+	// Create any deferred parent directories first.
+	ops = append(ops, mkdirPending(path.Dir(dst), p.pending)...)
+
+	// Unchanged files are hard linked from the previous snapshot.
+	lop, link, err := p.linkOp(fi, dst, relpath)
+	if err != nil {
+		return nil, err
+	}
+	if link {
+		ops = append(ops, lop)
+		if opt.removeSource {
+			ops = append(ops, syncOp{Op: opDelete, Src: src, Dst: dst})
 		}
+		return ops, nil
+	}
+
+	copyop := syncOp{Op: opCopy, Src: src, Dst: dst, Rel: relpath, Size: fi.Size}
+	if copyop.From, err = p.fuzzyBasis(fi, dst); err != nil {
+		return nil, err
+	}
+	copyops := []syncOp{copyop}
+	if opt.removeSource {
+		copyops = append(copyops, syncOp{Op: opDelete, Src: src, Dst: dst})
+	}
 
-		// Start sync operation
+	// Hold copies that may turn out to be moves.
+	if len(p.sizeIndex) > 0 {
+		if len(p.sizeIndex[sizeMtimeKey(fi)]) > 0 {
+			p.held = append(p.held, copyops...)
+			return ops, nil
+		}
+	}
+	return append(ops, copyops...), nil
+}
 
-		if isdir {
-			// Create destination dir if needed
-			exists, err := dstvfs.FileExists(dst)
-			if err != nil {
-				return err
+// Determine if the destination dst of the regular file fi only needs its
+// modification time set from the source (see --times): both files have the
+// same size and checksum, but different modification times.
+//
+// Return:
+//   bool
+//   error
+func (p *planner) mtimeFixup(fi vfs.FileInfo, dst string) (bool, error) {
+	if !opt.times || opt.ignoreTimes || !p.dstcaps.SetMtime || fi.Size < 0 {
+		return false, nil
+	}
+	dstInfo, err := p.dstvfs.Stat(p.ctx, dst)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !dstInfo.IsRegular() || dstInfo.Size != fi.Size || fi.Mtime.Truncate(time.Second).Equal(dstInfo.Mtime.Truncate(time.Second)) {
+		return false, nil
+	}
+	same, err := checksumsMatch(p.ctx, p.srcvfs, p.dstvfs, fi.Path, dst)
+	if same {
+		log.Debug("source and destination are identical; will set mtime", "path", fi.Path, "srcMtime", fi.Mtime, "dstMtime", dstInfo.Mtime)
+	}
+	return same, err
+}
+
+// Return the operations to be executed after all source paths have been
+// planned: held copies (possibly converted into moves) and directory mtimes.
+//
+// Return:
+// 	 []syncOp
+// 	 error
+func (p *planner) finish() ([]syncOp, error) {
+	// Replace copies of files that were just moved around with server-side moves.
+	ops, err := detectMoves(p.ctx, p.root, p.dstdir, p.srcvfs, p.dstvfs, p.held, p.seen, p.state)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.buryDeleted(); err != nil {
+		return nil, err
+	}
+
+	// Remove everything else from the destination. This changes the mtimes
+	// of the directories, so it must also happen before setting them.
+	if opt.mirror && p.srcIsDir {
+		rops, err := p.extraneous()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, rops...)
+	}
+
+	// Set the mtimes of all destination directories to the original mtimes.
+	// We have to do it last (and bottom first!) because in certain filesystems,
+	// updating files inside directories will also change the directory mtime.
+	// Directories never created (--prune-empty-dirs) are skipped.
+	for ix := len(p.dirops) - 1; ix >= 0; ix-- {
+		if !p.pending[p.dirops[ix].Dst] {
+			ops = append(ops, p.dirops[ix])
+		}
+	}
+	return ops, nil
+}
+
+// Record the files deleted from the source since the last sync as tombstones
+// in the state database: files in the database not seen in the source (and
+// not moved, see detectMoves), that no longer exist. Files skipped for other
+// reasons (exclusions, unreadable directories, etc) still exist. Errors
+// checking files are only logged.
+//
+// Return:
+//   error
+func (p *planner) buryDeleted() error {
+	// Retries only look at a few files.
+	if retryPaths != nil {
+		return nil
+	}
+	for _, rels := range p.state.index(p.root, p.seen) {
+		for _, rel := range rels {
+			src := rel
+			if strings.HasSuffix(p.srcpath, "/") {
+				src = p.srcpath + rel
+			} else if dir := path.Dir(p.srcpath); dir != "." {
+				src = path.Join(dir, rel)
 			}
-			if !exists {
-				log.Verboseln(1, dst)
-				if !opt.dryrun {
-					err := dstvfs.Mkdir(dst)
-					if err != nil {
-						return err
-					}
-				}
+			_, err := p.srcvfs.Stat(p.ctx, src)
+			if errors.Is(err, vfs.ErrNotExist) {
+				log.Debug("deleted from source since last sync", "path", src)
+				p.state.bury(p.root, rel, sideSource)
+				continue
 			}
-			// Save directory for post processing
-			d := dirpair{src, dst}
-			dirpairs = append(dirpairs, d)
-		} else if isregular {
-			copyNeeded, err := needToCopy(srcvfs, dstvfs, src, dst)
+			// Files that can't be checked are left alone until the next sync.
 			if err != nil {
-				return err
+				if p.ctx.Err() != nil {
+					return p.ctx.Err()
+				}
+				log.Warn("unable to check if file was deleted from source", "path", src, "error", err)
 			}
+		}
+	}
+	return nil
+}
 
-			if copyNeeded {
-				if !opt.dryrun {
-					r, err := srcvfs.ReadFromFile(src)
-					if err != nil {
-						log.Printf("Warning: Skipping \"%s\": %v\n", src, err)
-						continue
-					}
-					err = dstvfs.WriteToFile(dst, r)
-					if err != nil {
-						return err
-					}
-					// Set destination mtime == source mtime
-					mtime, err := srcvfs.Mtime(src)
-					if err != nil {
-						return err
-					}
-					err = dstvfs.SetMtime(dst, mtime)
-					if err != nil {
-						return err
-					}
-				}
-				log.Verboseln(1, dst)
+// Return the operations removing the destination files and directories not
+// found in the source (--mirror), files before the directories holding them.
+// Excluded paths are left alone, along with the directories above them.
+// Nothing is removed if parts of the source could not be read
+// (--ignore-walk-errors), since their files would look extraneous.
+// Files considered up to date by the state database but deleted from the
+// destination are recorded as tombstones, and copied again.
+//
+// Return:
+// 	 []syncOp
+// 	 error
+func (p *planner) extraneous() ([]syncOp, error) {
+	var (
+		extra []syncOp
+		keep  = make(map[string]bool)
+		found = make(map[string]bool)
+	)
+
+	dstroot := destPath("/", p.dstdir, "")
+	root := destPath(p.srcpath, p.dstdir, p.srcpath)
+	err := p.dstvfs.Walk(p.ctx, root, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(dstroot, fi.Path)
+		found[rel] = true
+		if rel == "" || p.seen[rel] || p.dirs[rel] {
+			return nil
+		}
+		exc, err := excluded(rel)
+		if err == nil && !exc {
+			exc, err = p.ignores.excluded(rel, fi.IsDir())
+		}
+		if err != nil {
+			return err
+		}
+		if exc {
+			for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+				keep[d] = true
 			}
-		} else {
-			log.Printf("Warning: Skipping \"%s\": not a regular file or directory.\n", src)
+			return nil
+		}
+		extra = append(extra, syncOp{Op: opRemove, Dst: fi.Path, Rel: rel})
+		return nil
+	})
+	// Nothing to remove from destinations not created yet (--mkpath).
+	if errors.Is(err, vfs.ErrNotExist) && opt.dryrun {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []syncOp
+	if len(extra) > 0 && p.walkErrors != nil && atomic.LoadInt64(p.walkErrors) > 0 {
+		log.Warn("not removing extraneous destination paths, since the source could not be read completely", "path", root, "count", len(extra))
+		extra = nil
+	}
+
+	// Walks list directories before their contents.
+	for ix := len(extra) - 1; ix >= 0; ix-- {
+		if keep[extra[ix].Rel] {
 			continue
 		}
+		ops = append(ops, extra[ix])
+		p.state.forget(p.root, extra[ix].Rel)
 	}
 
-	// Set the mtimes of all destination directories to the original mtimes.
-	// We have to do it here (and bottom first!) because in certain filesystems,
-	// updating files inside directories will also change the directory mtime.
+	for rel, src := range p.unchanged {
+		if found[rel] {
+			continue
+		}
+		dst := destPath(p.srcpath, p.dstdir, src)
+		log.Debug("deleted from destination since last sync; will copy", "path", dst)
+		op := syncOp{Op: opCopy, Src: src, Dst: dst, Rel: rel}
+		if entry := p.state.lookup(p.root, rel); entry != nil {
+			op.Size = entry.Size
+		}
+		p.state.bury(p.root, rel, sideDest)
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
 
-	if !opt.dryrun {
-		for ix := len(dirpairs) - 1; ix >= 0; ix-- {
-			src := dirpairs[ix].src
-			dst := dirpairs[ix].dst
+// List all files and directories under srcpath in srcvfs and send their
+// information to the returned channel as they're found. Directories are always sent before the
+// files inside them. The channel is closed at the end of the listing, after
+// which the error channel receives the result. Listing stops early if done is
+// closed. Paths that can't be read are counted in werrs (see walkFailed).
+//
+// Return:
+//   <-chan vfs.FileInfo
+//   <-chan error
+func listSource(ctx context.Context, srcpath string, srcvfs vfs.VFS, done <-chan struct{}, werrs *int64) (<-chan vfs.FileInfo, <-chan error) {
+	paths := make(chan vfs.FileInfo, pipelineBuffer)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(paths)
 
-			mtime, err := srcvfs.Mtime(src)
+		send := func(fi vfs.FileInfo, err error) error {
 			if err != nil {
-				return err
+				return walkFailed(fi.Path, err, werrs)
 			}
-			err = dstvfs.SetMtime(dst, mtime)
-			if err != nil {
-				return err
+			select {
+			case paths <- fi:
+				return nil
+			case <-done:
+				return errWalkStopped
 			}
 		}
-	}
 
+		// Special case: If the source path is not a directory, we short
+		// circuit the Walk method here and send that single file.
+		fi, err := srcvfs.Stat(ctx, srcpath)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if fi.IsDir() {
+			err = srcvfs.Walk(ctx, srcpath, send)
+		} else {
+			err = send(fi, nil)
+		}
+		if err == errWalkStopped {
+			err = nil
+		}
+		errc <- err
+	}()
+	return paths, errc
+}
+
+// Number of source paths that could not be read while listing all sources.
+var walkErrors int64
+
+// Handle an error reading src while listing the source, counting it in werrs
+// (the errors of the current listing) and walkErrors. With
+// --ignore-walk-errors, the error is reported and the listing continues.
+// Otherwise, the sync fails.
+//
+// Return:
+//   error
+func walkFailed(src string, err error, werrs *int64) error {
+	atomic.AddInt64(&walkErrors, 1)
+	atomic.AddInt64(werrs, 1)
+	events.error(src, err)
+	if !opt.ignoreWalkErrors {
+		return fmt.Errorf("Unable to read \"%s\": %w", src, err)
+	}
+	log.Warn("skipping unreadable source path", "path", src, "error", err)
+	return nil
+}
+
+// Plan the operations for all paths received from the paths channel and send
+// them to the returned channel, in the order they must be executed. The
+// channel is closed after all operations have been sent (or on error), after
+// which the error channel receives the result of listing and planning.
+//
+// Return:
+//   <-chan syncOp
+//   <-chan error
+func planSync(p *planner, paths <-chan vfs.FileInfo, listerrc <-chan error, done <-chan struct{}) (<-chan syncOp, <-chan error) {
+	opc := make(chan syncOp, pipelineBuffer)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(opc)
+
+		send := func(ops []syncOp) bool {
+			for _, op := range ops {
+				if op.Op == opCopy || op.Op == opMove || op.Op == opLink {
+					events.emit(event{Event: evFileQueued, Op: op.Op, Src: op.Src, Dst: op.Dst})
+				}
+				select {
+				case opc <- op:
+				case <-done:
+					return false
+				}
+			}
+			return true
+		}
+
+		for fi := range paths {
+			ops, err := p.plan(fi)
+			if err != nil {
+				// Reported like errors executing operations.
+				events.error(fi.Path, err)
+				errc <- fmt.Errorf("Unable to sync \"%s\": %w", fi.Path, err)
+				return
+			}
+			if !send(ops) {
+				errc <- nil
+				return
+			}
+		}
+		if err := <-listerrc; err != nil {
+			errc <- err
+			return
+		}
+		// Listings stopped early (see done) end without errors.
+		select {
+		case <-done:
+			errc <- nil
+			return
+		default:
+		}
+		ops, err := p.finish()
+		if err != nil {
+			errc <- err
+			return
+		}
+		send(ops)
+		errc <- nil
+	}()
+	return opc, errc
+}
+
+// Return a key combining the size and mtime of the file described by fi.
+func sizeMtimeKey(fi vfs.FileInfo) string {
+	return fmt.Sprintf("%d/%d", fi.Size, fi.Mtime.UnixNano())
+}
+
+// Return the MD5 checksum of fullpath in fsys, or an empty string if fsys
+// does not provide checksums.
+//
+// Return:
+//   string
+//   error
+func fileMD5(ctx context.Context, fsys vfs.VFS, fullpath string) (string, error) {
+	if v, ok := fsys.(vfs.MD5er); ok {
+		return v.MD5(ctx, fullpath)
+	}
+	return "", nil
+}
+
+// Detect files that have been renamed or moved in the source since the last
+// sync, using the state database. A copy is replaced by a move in the
+// destination when exactly one file with the same size and mtime was recorded
+// in a path that no longer exists in the source, the old destination file
+// still exists and, if an MD5 checksum was recorded, both the source and the
+// old destination file still have it. Copies matching several recorded files
+// are kept. Seen holds the relative paths of all files in the source.
+//
+// Return:
+// 	 []syncOp
+// 	 error
+func detectMoves(ctx context.Context, root string, dstdir string, srcvfs vfs.VFS, dstvfs vfs.VFS, ops []syncOp, seen map[string]bool, state *stateDB) ([]syncOp, error) {
+	// Moves that transfer data are no better than copies.
+	if !vfs.CapabilitiesOf(dstvfs).ServerSideMove {
+		return ops, nil
+	}
+
+	// Index entries of files that disappeared from the source.
+	gone := state.index(root, seen)
+	if len(gone) == 0 {
+		return ops, nil
+	}
+
+	for ix, op := range ops {
+		if op.Op != opCopy {
+			continue
+		}
+		fi, err := srcvfs.Stat(ctx, op.Src)
+		if err != nil {
+			return nil, err
+		}
+		key := sizeMtimeKey(fi)
+		candidates := gone[key]
+		if len(candidates) == 0 {
+			continue
+		}
+		// Only new files can be the result of a move.
+		exists, err := dstvfs.FileExists(ctx, op.Dst)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		var (
+			matches []int
+			srcsum  string
+			summed  bool
+		)
+		for cx, oldrel := range candidates {
+			entry := state.lookup(root, oldrel)
+			olddst := destPath("/", dstdir, oldrel)
+			exists, err := dstvfs.FileExists(ctx, olddst)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			if entry.MD5 != "" {
+				if !summed {
+					if srcsum, err = fileMD5(ctx, srcvfs, op.Src); err != nil {
+						return nil, err
+					}
+					summed = true
+				}
+				dstsum, err := fileMD5(ctx, dstvfs, olddst)
+				if err != nil {
+					return nil, err
+				}
+				if srcsum != "" && srcsum != entry.MD5 || dstsum != "" && dstsum != entry.MD5 {
+					continue
+				}
+			}
+			matches = append(matches, cx)
+		}
+		if len(matches) > 1 {
+			log.Debug("several files may have moved in source; will copy", "path", op.Src)
+		}
+		if len(matches) != 1 {
+			continue
+		}
+		cx := matches[0]
+		oldrel := candidates[cx]
+		log.Debug("moved in source; will move destination", "path", op.Src, "from", oldrel)
+		ops[ix] = syncOp{Op: opMove, Src: op.Src, Dst: op.Dst, Rel: op.Rel, From: destPath("/", dstdir, oldrel)}
+		gone[key] = append(candidates[:cx], candidates[cx+1:]...)
+		state.forget(root, oldrel)
+	}
+	return ops, nil
+}
+
+// Copy the creation time of srcpath to dstpath, if both VFSes support
+// creation times. Creation times are preserved on a best effort basis, so
+// errors are only logged.
+func copyBtime(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string) {
+	src, ok1 := srcvfs.(vfs.Btimer)
+	dst, ok2 := dstvfs.(vfs.Btimer)
+	if !ok1 || !ok2 {
+		return
+	}
+	btime, err := src.Btime(ctx, srcpath)
+	if err == nil && !btime.IsZero() {
+		err = dst.SetBtime(ctx, dstpath, btime)
+	}
+	if err != nil {
+		log.Warn("unable to preserve creation time", "path", dstpath, "error", err)
+	}
+}
+
+// Copy the metadata of srcpath (modified at mtime) to dstpath, if srcvfs
+// provides metadata and dstvfs can store it. Metadata is only copied between different filesystems
+// (local files uploaded to Drive and restored from it), or between local trees
+// in archive mode (-a).
+//
+// Return:
+//   error
+func copyMetadata(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, srcpath string, dstpath string, mtime time.Time) error {
+	if srcvfs == dstvfs && !(opt.archiveMode && isLocalVfs(dstvfs)) {
+		return nil
+	}
+	src, ok1 := srcvfs.(vfs.MetadataGetter)
+	dst, ok2 := dstvfs.(vfs.MetadataSetter)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	meta, err := src.Metadata(ctx, srcpath)
+	if err != nil || len(meta) == 0 {
+		return err
+	}
+	// The exact modification time is stale if the source was modified after
+	// it was recorded (as when a Drive file is edited elsewhere), and would
+	// make the copies differ forever.
+	if v, ok := meta[localvfs.MetaMtime]; ok {
+		ns, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && mtime.Truncate(time.Second).After(time.Unix(0, ns).Truncate(time.Second)) {
+			log.Debug("ignoring stale modification time in metadata", "path", srcpath, "mtime", mtime)
+			fresh := make(map[string]string, len(meta))
+			for k, v := range meta {
+				fresh[k] = v
+			}
+			delete(fresh, localvfs.MetaMtime)
+			meta = fresh
+		}
+	}
+	return dst.SetMetadata(ctx, dstpath, meta)
+}
+
+// Return the directory holding fullpath in fsys. Local paths use the
+// separators of the operating system.
+func parentDir(fsys vfs.VFS, fullpath string) string {
+	if isLocalVfs(fsys) {
+		return filepath.Dir(filepath.Clean(fullpath))
+	}
+	return path.Dir(strings.TrimSuffix(fullpath, "/"))
+}
+
+// Create the directory dir in fsys, along with any missing parent directories
+// (see --mkpath). Nothing is created in dry-run mode.
+//
+// Return:
+//   error
+func mkdirAll(ctx context.Context, fsys vfs.VFS, dir string) error {
+	fi, err := fsys.Stat(ctx, dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("Destination \"%s\" is not a directory/folder", dir)
+		}
+		return nil
+	}
+	if !errors.Is(err, vfs.ErrNotExist) {
+		return err
+	}
+
+	parent := parentDir(fsys, dir)
+	if parent != dir && parent != "." && parent != "/" {
+		if err = mkdirAll(ctx, fsys, parent); err != nil {
+			return err
+		}
+	}
+	log.Info("mkdir", "path", dir)
+	if opt.dryrun {
+		return nil
+	}
+	return fsys.Mkdir(ctx, dir)
+}
+
+// Number of errors closing source files. Reads are complete by the time the
+// file is closed, so these errors are reported but do not stop the sync.
+var closeErrors int64
+
+// Close the reader for srcpath, logging and counting errors.
+func closeReader(rc io.Closer, srcpath string) {
+	if err := rc.Close(); err != nil {
+		atomic.AddInt64(&closeErrors, 1)
+		log.Warn("error closing source file", "path", srcpath, "error", err)
+	}
+}
+
+// countingReader counts the bytes read through it, and reports the progress
+// of the transfer of op to the event stream (see --events).
+type countingReader struct {
+	r    io.Reader
+	n    int64
+	op   syncOp
+	size int64
+	last time.Time
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if events != nil && time.Since(c.last) >= progressInterval {
+		c.last = time.Now()
+		events.progress(c.op, c.n, c.size)
+	}
+	return n, err
+}
+
+// Copy op.Src in srcvfs to op.Dst in dstvfs, along with its times and
+// metadata. When the source VFS provides MD5 checksums, the data is verified
+// as it is transferred and a checksumError is returned on mismatch, before the
+// destination file is replaced (unless writing in place). Partial files left
+// behind by failed writes to destinations without atomic renames are removed.
+//
+// Copies within a VFS supporting server-side copies don't transfer any data,
+// unless the data is needed for the manifest. The same goes for copies from a
+// basis file in the destination (op.From, see --fuzzy). An mtimeError is returned if
+// the file was copied but its modification time could not be set.
+//
+// Return:
+// 	 bool: true if the source file could not be read and was skipped.
+// 	 error
+func copyFile(ctx context.Context, op syncOp, srcvfs vfs.VFS, dstvfs vfs.VFS, mf *manifest) (bool, error) {
+	caps := vfs.CapabilitiesOf(dstvfs)
+	if srcvfs == dstvfs && caps.ServerSideCopy && mf == nil {
+		return false, copyServerSide(ctx, op, dstvfs)
+	}
+	// New files may be copied from a similar destination file (--fuzzy).
+	if op.From != "" && mf == nil {
+		done, err := copyBasis(ctx, op, srcvfs, dstvfs)
+		if done || err != nil {
+			return false, err
+		}
+	}
+
+	start := time.Now()
+	rc, err := srcvfs.ReadFromFile(ctx, op.Src)
+	if err != nil {
+		log.Warn("skipping unreadable file", "path", op.Src, "error", err)
+		events.error(op.Src, err)
+		return true, nil
+	}
+	defer closeReader(rc, op.Src)
+
+	var r io.Reader = rc
+	if r, err = verifyingReader(ctx, r, srcvfs, op.Src); err != nil {
+		return false, err
+	}
+	h := mf.hasher()
+	if h != nil {
+		r = io.TeeReader(r, h)
+	}
+	fi, err := srcvfs.Stat(ctx, op.Src)
+	if err != nil {
+		return false, err
+	}
+	// Data between two remote backends goes through a bounded read-ahead
+	// buffer, so downloads and uploads overlap.
+	if !isLocalVfs(srcvfs) && !isLocalVfs(dstvfs) {
+		p := newStreamPipe(r, int(opt.bufferSize))
+		defer p.Close()
+		r = p
+	}
+	if bwlimit != nil {
+		r = &limitedReader{ctx: ctx, r: r, lim: bwlimit}
+	}
+	cr := &countingReader{r: r, op: op, size: fi.Size, last: start}
+	events.emit(event{Event: evTransferStart, Op: op.Op, Src: op.Src, Dst: op.Dst, Size: fi.Size})
+	err = watchStall(ctx, op.Dst, cr, func(ctx context.Context, r io.Reader) error {
+		// Large uploads can be resumed if interrupted.
+		if v, ok := dstvfs.(vfs.ResumableWriter); ok && fi.Size >= 0 {
+			return v.WriteToFileResumable(ctx, op.Dst, r, fi.Size, fi.Mtime)
+		}
+		return dstvfs.WriteToFile(ctx, op.Dst, r)
+	})
+	if err != nil {
+		if !caps.AtomicRename {
+			removePartial(ctx, dstvfs, op.Dst)
+		}
+		return false, err
+	}
+	log.Info("copy", "path", op.Dst, "bytes", cr.n, "duration", time.Since(start))
+	events.transferDone(op, cr.n, time.Since(start))
+	if err = mf.add(h, op.Dst); err != nil {
+		return false, err
+	}
+	return false, copyAttrs(ctx, srcvfs, dstvfs, op, fi.Mtime)
+}
+
+// Copy the times and metadata of op.Src in srcvfs, with modification time
+// mtime, to op.Dst in dstvfs, after its contents have been copied. An
+// mtimeError is returned if only the modification time could not be set.
+//
+// Return:
+//   error
+func copyAttrs(ctx context.Context, srcvfs vfs.VFS, dstvfs vfs.VFS, op syncOp, mtime time.Time) error {
+	copyBtime(ctx, srcvfs, dstvfs, op.Src, op.Dst)
+
+	// Set destination mtime == source mtime
+	var merr error
+	if vfs.CapabilitiesOf(dstvfs).SetMtime {
+		if err := dstvfs.SetMtime(ctx, op.Dst, mtime); err != nil {
+			merr = &mtimeError{path: op.Dst, err: err}
+		}
+	}
+
+	// Metadata goes last, since it may hold a more precise mtime.
+	if err := copyMetadata(ctx, srcvfs, dstvfs, op.Src, op.Dst, mtime); err != nil {
+		return err
+	}
+	return merr
+}
+
+// Copy op.Src to op.Dst on the server side of fsys, along with its times.
+//
+// Return:
+//   error
+func copyServerSide(ctx context.Context, op syncOp, fsys vfs.VFS) error {
+	start := time.Now()
+	fi, err := fsys.Stat(ctx, op.Src)
+	if err != nil {
+		return err
+	}
+	events.emit(event{Event: evTransferStart, Op: op.Op, Src: op.Src, Dst: op.Dst, Size: fi.Size})
+	if err = fsys.(vfs.Copier).Copy(ctx, op.Src, op.Dst); err != nil {
+		return err
+	}
+	log.Info("copy", "path", op.Dst, "server-side", true, "duration", time.Since(start))
+	events.transferDone(op, 0, time.Since(start))
+	copyBtime(ctx, fsys, fsys, op.Src, op.Dst)
+	if !vfs.CapabilitiesOf(fsys).SetMtime {
+		return nil
+	}
+	if err = fsys.SetMtime(ctx, op.Dst, fi.Mtime); err != nil {
+		return &mtimeError{path: op.Dst, err: err}
+	}
+	return nil
+}
+
+// Remove the partial file left behind by a failed write to fullpath in fsys,
+// so it isn't mistaken for an up to date copy later. Errors are only logged.
+func removePartial(ctx context.Context, fsys vfs.VFS, fullpath string) {
+	exists, err := fsys.FileExists(ctx, fullpath)
+	if err == nil && exists {
+		err = fsys.Delete(ctx, fullpath)
+	}
+	if err != nil {
+		log.Warn("unable to remove partial file", "path", fullpath, "error", err)
+	}
+}
+
+// Delay before the first retry of a failed operation (see --file-retries).
+// Each further retry waits longer.
+var fileRetryDelay = time.Second
+
+// failedFile is a file whose operation failed after all its attempts. Rel is
+// its path relative to the sync root, as seen in the destination.
+type failedFile struct {
+	path string
+	rel  string
+	err  error
+}
+
+var (
+	// Failed files, reported at the end of the run (see --failed-list).
+	failedMu    gosync.Mutex
+	failedFiles []failedFile
+)
+
+// Record that op, syncing rel, failed with err after all its attempts.
+//
+// Return:
+//   string: the path of the file (the source, if any)
+func fileFailed(op syncOp, rel string, err error) string {
+	path := op.Src
+	if path == "" {
+		path = op.Dst
+	}
+	failedMu.Lock()
+	defer failedMu.Unlock()
+	failedFiles = append(failedFiles, failedFile{path: path, rel: rel, err: err})
+	return path
+}
+
+// Run op (see runOp), making up to --file-retries attempts if it fails.
+// Modification time errors are not retried, since they don't fail the sync.
+//
+// Return:
+// 	 bool: true if the source file could not be read and was skipped.
+// 	 error
+func runOpRetries(ctx context.Context, op syncOp, srcvfs vfs.VFS, dstvfs vfs.VFS, mf *manifest) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		skip, err := runOp(ctx, op, srcvfs, dstvfs, mf)
+		var merr *mtimeError
+		if err == nil || errors.As(err, &merr) || errors.Is(err, errNoFreeSpace) || attempt >= opt.fileRetries || ctx.Err() != nil {
+			return skip, err
+		}
+		log.Warn("operation failed; retrying", "op", op.Op, "path", op.Dst, "attempt", attempt, "error", err)
+		if err = sleepContext(ctx, time.Duration(attempt)*fileRetryDelay); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Execute a single sync operation. Operations are idempotent, so they can be
+// safely repeated when resuming from a journal. In dry-run mode, operations are
+// only logged. The checksum of every file copied is added to mf.
+//
+// Return:
+// 	 bool: true if the source file could not be read and was skipped.
+// 	 error
+func runOp(ctx context.Context, op syncOp, srcvfs vfs.VFS, dstvfs vfs.VFS, mf *manifest) (bool, error) {
+	switch op.Op {
+	case opMkdir:
+		log.Info("mkdir", "path", op.Dst)
+		if opt.dryrun {
+			return false, nil
+		}
+		// The directory may already exist if we're resuming a previous run.
+		exists, err := dstvfs.FileExists(ctx, op.Dst)
+		if err != nil || exists {
+			return false, err
+		}
+		return false, dstvfs.Mkdir(ctx, op.Dst)
+
+	case opCopy:
+		if opt.dryrun {
+			log.Info("copy", "path", op.Dst)
+			return false, nil
+		}
+		if skip, err := checkFreeSpace(ctx, dstvfs, op.Dst, op.Size); skip || err != nil {
+			return skip, err
+		}
+		// Transfers corrupted on the way, or stalled, are retried.
+		for attempt := 1; ; attempt++ {
+			skip, err := copyFile(ctx, op, srcvfs, dstvfs, mf)
+			if err == nil && !skip && opt.mirror {
+				err = verifyChecksums(ctx, srcvfs, dstvfs, op.Src, op.Dst)
+			}
+			var cerr *checksumError
+			if errors.As(err, &cerr) && attempt < maxCopyAttempts {
+				log.Warn("checksum mismatch; retrying", "path", op.Src, "attempt", attempt, "error", err)
+				continue
+			}
+			var serr *stallError
+			if errors.As(err, &serr) && serr.retry && attempt < maxCopyAttempts {
+				atomic.AddInt64(&stalledTransfers, 1)
+				log.Warn("transfer stalled; retrying", "path", op.Src, "attempt", attempt, "error", err)
+				continue
+			}
+			return skip, err
+		}
+
+	case opMove:
+		log.Info("move", "path", op.Dst, "from", op.From)
+		if opt.dryrun {
+			return false, nil
+		}
+		// The move may have completed already if we're resuming a previous run.
+		exists, err := dstvfs.FileExists(ctx, op.From)
+		if err != nil || !exists {
+			return false, err
+		}
+		return false, dstvfs.Move(ctx, op.From, op.Dst)
+
+	case opLink:
+		log.Info("link", "path", op.Dst, "from", op.From)
+		if opt.dryrun {
+			return false, nil
+		}
+		v, ok := dstvfs.(vfs.Linker)
+		if !ok {
+			return false, fmt.Errorf("Unable to link \"%s\": destination does not support hard links", op.Dst)
+		}
+		return false, v.Link(ctx, op.From, op.Dst)
+
+	case opDelete:
+		log.Info("remove source", "path", op.Src)
+		if opt.dryrun {
+			return false, nil
+		}
+		// The source may already be gone if we're resuming a previous run.
+		exists, err := srcvfs.FileExists(ctx, op.Src)
+		if err != nil || !exists {
+			return false, err
+		}
+		// Only remove the source after the copy has been verified, by
+		// checksum if both sides have them.
+		verify := verifyCopy
+		if vfs.CapabilitiesOf(srcvfs).Checksum && vfs.CapabilitiesOf(dstvfs).Checksum {
+			verify = verifyChecksums
+		}
+		if err = verify(ctx, srcvfs, dstvfs, op.Src, op.Dst); err != nil {
+			return false, err
+		}
+		return false, srcvfs.Delete(ctx, op.Src)
+
+	case opRemove:
+		log.Info("remove", "path", op.Dst)
+		if opt.dryrun {
+			return false, nil
+		}
+		// The file may be gone already if we're resuming a previous run, or
+		// if it was moved.
+		exists, err := dstvfs.FileExists(ctx, op.Dst)
+		if err != nil || !exists {
+			return false, err
+		}
+		return false, dstvfs.Delete(ctx, op.Dst)
+
+	case opSetMtime:
+		if opt.dryrun {
+			return false, nil
+		}
+		fi, err := srcvfs.Stat(ctx, op.Src)
+		if err != nil {
+			return false, err
+		}
+		if err = dstvfs.SetMtime(ctx, op.Dst, fi.Mtime); err != nil {
+			return false, &mtimeError{path: op.Dst, err: err}
+		}
+
+	default:
+		return false, fmt.Errorf("Unknown sync operation \"%s\"", op.Op)
+	}
+	return false, nil
+}
+
+// Copy the content of all files/directories pointed by srcpath into dstdir.
+// If srcpath is a file, the file will be copied. If it is a directory, the
+// entire subtree will be copied.  Dstdir must be a directory, or an existing
+// file when srcpath is a file (which then replaces it).
+//
+// Like rsync, a source path ending in slash means "copy the contents of this
+// directory into the destination" whereas a path not ending in a slash means
+// "copy this directory and its contents into the destination."
+//
+// Files/directories are only copied if needed (based on the modification date
+// of the file on both filesystems.) This function uses the srcvfs and dstvfs
+// VFS objects to perform operations on the respective filesystems.
+//
+// If state is not nil, the state database is updated with every file copied
+// and saved at the end of the sync.
+//
+// If mf is not nil, the checksum of every file copied is added to it.
+//
+// If jrnl is not nil, all planned and completed operations are recorded in the
+// journal. If the journal holds a complete plan for this source and
+// destination from a previous (interrupted) run, the source is not scanned
+// again and only the operations not yet completed are executed.
+//
+// The sync stops with an error when ctx is done (see --max-duration).
+//
+// Return:
+// 	 error
+func sync(ctx context.Context, srcpath string, dstdir string, srcvfs vfs.VFS, dstvfs vfs.VFS, jrnl *journal, state *stateDB, mf *manifest) error {
+	return syncTo(ctx, srcpath, srcvfs, []syncDest{{path: dstdir, fsys: dstvfs}}, jrnl, state, mf)
+}
+
+// syncDest is one of the destinations of a sync: a directory and the VFS
+// holding it.
+type syncDest struct {
+	path string
+	fsys vfs.VFS
+}
+
+// syncBranch holds the state of the sync to one destination. Each branch
+// plans and executes its operations independently of the others.
+type syncBranch struct {
+	root    string
+	srcpath string
+	dstdir  string
+	dstvfs  vfs.VFS
+	p       *planner
+
+	// Operations to execute, and the result of listing and planning them.
+	// Resumed branches execute the plan found in the journal.
+	opc     <-chan syncOp
+	errc    <-chan error
+	resumed bool
+
+	// Closed when the branch stops, so it is no longer fed listed files.
+	done chan struct{}
+
+	// Number of operations executed, by type.
+	count map[string]int
+}
+
+// Sync srcpath to every destination in dsts, as described in sync. The source
+// is listed only once, and every file listed is passed to the planner of each
+// destination, so all destinations are compared and updated concurrently. An
+// error in one destination stops its sync, but not the sync of the others.
+//
+// Return:
+// 	 error: the error of the only destination, or an error naming all
+// 	 destinations that failed.
+func syncTo(ctx context.Context, srcpath string, srcvfs vfs.VFS, dsts []syncDest, jrnl *journal, state *stateDB, mf *manifest) error {
+	// Closing done stops the listing goroutines.
+	done := make(chan struct{})
+
+	errs := make([]error, len(dsts))
+	branches := make([]*syncBranch, len(dsts))
+	var listed []*syncBranch
+	for i, d := range dsts {
+		b, err := newSyncBranch(ctx, srcpath, srcvfs, d, jrnl, state)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		branches[i] = b
+		if !b.resumed {
+			listed = append(listed, b)
+		}
+	}
+
+	// Listing, planning and execution run concurrently, so transfers start
+	// as soon as the first files are listed.
+	if len(listed) > 0 {
+		// Destinations sharing the listing share its errors.
+		var listErrors int64
+		for _, b := range listed {
+			b.p.walkErrors = &listErrors
+		}
+		paths, listerrc := listSource(ctx, srcpath, srcvfs, done, &listErrors)
+		paths = orderListing(paths, done)
+		if len(listed) == 1 {
+			listed[0].plan(ctx, srcpath, srcvfs, paths, listerrc)
+		} else {
+			teeListing(ctx, srcpath, srcvfs, listed, paths, listerrc, done)
+		}
+	}
+
+	var wg gosync.WaitGroup
+	for i, b := range branches {
+		if b == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, b *syncBranch) {
+			defer wg.Done()
+			defer close(b.done)
+			errs[i] = b.execute(ctx, srcvfs, jrnl, state, mf)
+		}(i, b)
+	}
+	wg.Wait()
+
+	// Branches stop early on errors. Wait for their planners to exit, so
+	// nothing is left running when the sync returns.
+	close(done)
+	for _, b := range branches {
+		if b != nil {
+			for range b.opc {
+			}
+		}
+	}
+
+	if len(dsts) == 1 && errs[0] != nil {
+		return errs[0]
+	}
+	// Results for each destination.
+	var failed []string
+	for i, d := range dsts {
+		if len(dsts) == 1 {
+			break
+		}
+		if errs[i] != nil {
+			log.Error("destination failed", "dst", d.path, "error", errs[i])
+			failed = append(failed, d.path)
+			continue
+		}
+		b := branches[i]
+		log.Info("destination synced", "dst", d.path, "copied", b.count[opCopy], "moved", b.count[opMove], "linked", b.count[opLink], "deleted", b.count[opDelete], "removed", b.count[opRemove])
+	}
+
+	// State is saved even if some destinations failed, so the others
+	// don't copy everything again next time.
+	var err error
+	if !opt.dryrun {
+		err = state.save()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Unable to sync \"%s\" to %d of %d destinations: \"%s\"", srcpath, len(failed), len(dsts), strings.Join(failed, "\", \""))
+	}
+	return err
+}
+
+// Create the branch syncing srcpath to d. The plan recorded in the journal by
+// a previous run is resumed, if found. Otherwise, the destination is checked
+// and the planner is created (see plan).
+//
+// Return:
+//   *syncBranch
+//   error
+func newSyncBranch(ctx context.Context, srcpath string, srcvfs vfs.VFS, d syncDest, jrnl *journal, state *stateDB) (*syncBranch, error) {
+	b := &syncBranch{
+		root:    srcpath + " -> " + d.path,
+		srcpath: srcpath,
+		dstdir:  d.path,
+		dstvfs:  d.fsys,
+		done:    make(chan struct{}),
+		count:   make(map[string]int),
+	}
+
+	ops, resumed := jrnl.resume(b.root)
+	if resumed {
+		log.Info("resuming from journal", "root", b.root)
+		c := make(chan syncOp, len(ops))
+		for _, op := range ops {
+			c <- op
+		}
+		close(c)
+		b.opc, b.resumed = c, true
+		return b, nil
+	}
+
+	// Destination must exist and be a directory
+	// In dry-run mode, --mkpath only reports the directories it would
+	// create, so everything is copied into the missing destination.
+	fi, err := d.fsys.Stat(ctx, d.path)
+	switch {
+	case errors.Is(err, vfs.ErrNotExist) && opt.mkpath && opt.dryrun:
+		fi = vfs.FileInfo{Path: d.path, Type: vfs.TypeDir}
+	case errors.Is(err, vfs.ErrNotExist):
+		return nil, fmt.Errorf("Destination \"%s\" does not exist (use --mkpath to create it)", d.path)
+	case err != nil:
+		return nil, err
+	}
+	// A single file can also be synced to an existing file, which is
+	// updated instead of a file of the same name inside it.
+	dstfile := ""
+	if !fi.IsDir() {
+		srcfi, err := srcvfs.Stat(ctx, srcpath)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsRegular() || !srcfi.IsRegular() {
+			return nil, fmt.Errorf("Destination \"%s\" is not a directory/folder", d.path)
+		}
+		dstfile = d.path
+	}
+	if !opt.dryrun {
+		if _, err = checkFreeSpace(ctx, d.fsys, d.path, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	events.emit(event{Event: evScanStart, Src: srcpath, Dst: d.path})
+	b.p, err = newPlanner(ctx, b.root, srcpath, d.path, srcvfs, d.fsys, state)
+	if err != nil {
+		return nil, err
+	}
+	b.p.dstfile = dstfile
+	return b, nil
+}
+
+// Start planning the operations of b for the files listed in paths.
+func (b *syncBranch) plan(ctx context.Context, srcpath string, srcvfs vfs.VFS, paths <-chan vfs.FileInfo, listerrc <-chan error) {
+	// There's nothing to hash ahead of a single file.
+	if b.p.dstfile == "" {
+		paths = hashAhead(ctx, srcpath, b.dstdir, srcvfs, b.dstvfs, paths, b.done)
+	}
+	b.opc, b.errc = planSync(b.p, paths, listerrc, b.done)
+}
+
+// Pass every file listed in paths to each of the branches, and the result of
+// the listing to all of them once it ends. Branches that stop (on errors) are
+// skipped, so they don't hold up the others.
+func teeListing(ctx context.Context, srcpath string, srcvfs vfs.VFS, branches []*syncBranch, paths <-chan vfs.FileInfo, listerrc <-chan error, done <-chan struct{}) {
+	outs := make([]chan vfs.FileInfo, len(branches))
+	errcs := make([]chan error, len(branches))
+	for i, b := range branches {
+		outs[i] = make(chan vfs.FileInfo, pipelineBuffer)
+		errcs[i] = make(chan error, 1)
+		b.plan(ctx, srcpath, srcvfs, outs[i], errcs[i])
+	}
+
+	go func() {
+		err := errWalkStopped
+		defer func() {
+			for i := range branches {
+				close(outs[i])
+				errcs[i] <- err
+			}
+		}()
+		for fi := range paths {
+			for i, b := range branches {
+				select {
+				case outs[i] <- fi:
+				case <-b.done:
+				case <-done:
+					return
+				}
+			}
+		}
+		err = <-listerrc
+	}()
+}
+
+// Hold the operations planned for b until planning ends, and report the
+// number of files and bytes to copy, and of files to delete, before anything
+// is executed (see --no-estimate). Copies from basis files (see --fuzzy)
+// transfer no data, and aren't counted.
+func (b *syncBranch) estimate() {
+	var (
+		ops                   []syncOp
+		files, bytes, deletes int64
+	)
+	for op := range b.opc {
+		ops = append(ops, op)
+		switch {
+		case op.Op == opCopy && op.From == "":
+			files++
+			if op.Size > 0 {
+				bytes += op.Size
+			}
+		case op.Op == opDelete || op.Op == opRemove:
+			deletes++
+		}
+	}
+	log.Info("estimated work", "root", b.root, "files", files, "bytes", bytes, "deletes", deletes)
+	events.estimate(b.srcpath, b.dstdir, files, bytes, deletes)
+
+	c := make(chan syncOp, len(ops))
+	for _, op := range ops {
+		c <- op
+	}
+	close(c)
+	b.opc = c
+}
+
+// Execute the operations planned for b, in order.
+//
+// Return:
+//   error
+func (b *syncBranch) execute(ctx context.Context, srcvfs vfs.VFS, jrnl *journal, state *stateDB, mf *manifest) error {
+	// Source files that could not be read. Further operations on them
+	// (like --remove-source-files) are skipped.
+	skipped := make(map[string]bool)
+
+	// The overall progress needs to know all the work in advance.
+	if events != nil && !opt.noEstimate {
+		b.estimate()
+	}
+
+	for op := range b.opc {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Maximum run duration (%v) exceeded", opt.maxDuration)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !b.resumed {
+			if err := jrnl.recordPlan(b.root, op); err != nil {
+				return err
+			}
+		}
+		if jrnl.completed(b.root, op) || skipped[op.Src] {
+			continue
+		}
+		skip, err := runOpRetries(ctx, op, srcvfs, b.dstvfs, mf)
+		var merr *mtimeError
+		if errors.As(err, &merr) {
+			mtimeFailed(b.root, merr, state)
+			err = nil
+		} else if err == nil && !skip && !opt.dryrun && (op.Op == opCopy || op.Op == opSetMtime) && vfs.CapabilitiesOf(b.dstvfs).SetMtime {
+			state.recordMtimeSuccess(b.root)
+		}
+		if err != nil {
+			events.error(op.Src, err)
+			if ctx.Err() != nil {
+				return err
+			}
+			// Files synced to a destination file are the destination itself.
+			rel := relPath(destPath("/", b.dstdir, ""), op.Dst)
+			if rel == "" {
+				rel = op.Rel
+			}
+			path := fileFailed(op, rel, err)
+			if opt.fileRetries < 1 || errors.Is(err, errNoFreeSpace) {
+				return err
+			}
+			// Give up on this file (and any further operations on it),
+			// but keep going. Its operation is left pending in the journal.
+			log.Error("giving up on file", "path", path, "attempts", opt.fileRetries, "error", err)
+			if op.Src != "" {
+				skipped[op.Src] = true
+			}
+			continue
+		}
+		if skip {
+			skipped[op.Src] = true
+			continue
+		}
+		b.count[op.Op]++
+		// Files with fixed mtimes (--times) are also in sync now.
+		if (op.Op == opCopy || op.Op == opMove || op.Op == opLink || op.Op == opSetMtime && op.Rel != "") && !opt.dryrun {
+			// Conflicting copies don't replace the destination, but the
+			// source version is now accounted for.
+			if op.Conflict {
+				err = state.updateSource(ctx, b.root, op.Rel, srcvfs, op.Src)
+			} else {
+				err = state.update(ctx, b.root, op.Rel, srcvfs, b.dstvfs, op.Src, op.Dst)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		err = jrnl.recordDone(b.root, op)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The plan is complete once listing and planning finish without errors.
+	if !b.resumed {
+		if err := <-b.errc; err != nil {
+			return err
+		}
+		if err := jrnl.recordPlanned(b.root); err != nil {
+			return err
+		}
+	}
 	return nil
 }
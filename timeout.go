@@ -0,0 +1,392 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// timeoutVfs wraps a vfs.VFS, failing any operation that takes longer than
+// the configured timeout (--timeout). Data transfers (WriteToFile) fail if no
+// data is transferred for the duration of the timeout. The context passed to
+// operations that time out is canceled, and operations ignoring it keep
+// running in the background.
+type timeoutVfs struct {
+	vfs.VFS
+	timeout time.Duration
+}
+
+// Return a new timeoutVfs wrapping fsys.
+func newTimeoutVfs(fsys vfs.VFS, timeout time.Duration) *timeoutVfs {
+	return &timeoutVfs{VFS: fsys, timeout: timeout}
+}
+
+// Run fn, returning an error if it does not complete within the timeout.
+func (t *timeoutVfs) run(ctx context.Context, name string, pathname string, fn func(context.Context) error) error {
+	_, err := t.runValue(ctx, name, pathname, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// Run fn like run, returning its result. The result is passed back through a
+// channel, so operations abandoned after timing out never touch the
+// variables of the caller.
+//
+// Return:
+//   interface{}: the value returned by fn (nil if fn timed out)
+//   error
+func (t *timeoutVfs) runValue(ctx context.Context, name string, pathname string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	tctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	type result struct {
+		val interface{}
+		err error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		val, err := fn(tctx)
+		resc <- result{val, err}
+	}()
+
+	select {
+	case r := <-resc:
+		return r.val, r.err
+	case <-tctx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%s \"%s\": timed out after %v", name, pathname, t.timeout)
+	}
+}
+
+// Capabilities returns the capabilities of the underlying VFS.
+func (t *timeoutVfs) Capabilities() vfs.Capabilities {
+	return vfs.CapabilitiesOf(t.VFS)
+}
+
+// Copy calls Copy in the underlying VFS with a timeout, if the VFS supports
+// server-side copies.
+func (t *timeoutVfs) Copy(ctx context.Context, srcpath string, dstpath string) error {
+	v, ok := t.VFS.(vfs.Copier)
+	if !ok {
+		return fmt.Errorf("Unable to copy \"%s\": server-side copies not supported", dstpath)
+	}
+	return t.run(ctx, "Copy", dstpath, func(ctx context.Context) error {
+		return v.Copy(ctx, srcpath, dstpath)
+	})
+}
+
+// ReadDir calls ReadDir in the underlying VFS with a timeout, if the VFS can
+// list single directories.
+func (t *timeoutVfs) ReadDir(ctx context.Context, fullpath string) ([]vfs.FileInfo, error) {
+	v, ok := t.VFS.(vfs.DirReader)
+	if !ok {
+		return nil, fmt.Errorf("Unable to list \"%s\": directory listings not supported", fullpath)
+	}
+	ret, err := t.runValue(ctx, "ReadDir", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.ReadDir(ctx, fullpath)
+	})
+	val, _ := ret.([]vfs.FileInfo)
+	return val, err
+}
+
+// Delete calls Delete in the underlying VFS with a timeout.
+func (t *timeoutVfs) Delete(ctx context.Context, fullpath string) error {
+	return t.run(ctx, "Delete", fullpath, func(ctx context.Context) error {
+		return t.VFS.Delete(ctx, fullpath)
+	})
+}
+
+// FileExists calls FileExists in the underlying VFS with a timeout.
+func (t *timeoutVfs) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	ret, err := t.runValue(ctx, "FileExists", fullpath, func(ctx context.Context) (interface{}, error) {
+		return t.VFS.FileExists(ctx, fullpath)
+	})
+	val, _ := ret.(bool)
+	return val, err
+}
+
+// FileID returns the ID of fullpath if the underlying VFS supports IDs, or an
+// empty string otherwise.
+func (t *timeoutVfs) FileID(ctx context.Context, fullpath string) (string, error) {
+	v, ok := t.VFS.(vfs.FileIDer)
+	if !ok {
+		return "", nil
+	}
+	ret, err := t.runValue(ctx, "FileID", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.FileID(ctx, fullpath)
+	})
+	val, _ := ret.(string)
+	return val, err
+}
+
+// Btime returns the creation time of fullpath if the underlying VFS supports
+// creation times, or the zero time otherwise.
+func (t *timeoutVfs) Btime(ctx context.Context, fullpath string) (time.Time, error) {
+	v, ok := t.VFS.(vfs.Btimer)
+	if !ok {
+		return time.Time{}, nil
+	}
+	ret, err := t.runValue(ctx, "Btime", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.Btime(ctx, fullpath)
+	})
+	val, _ := ret.(time.Time)
+	return val, err
+}
+
+// SetBtime sets the creation time of fullpath if the underlying VFS supports
+// creation times, and does nothing otherwise.
+func (t *timeoutVfs) SetBtime(ctx context.Context, fullpath string, btime time.Time) error {
+	v, ok := t.VFS.(vfs.Btimer)
+	if !ok {
+		return nil
+	}
+	return t.run(ctx, "SetBtime", fullpath, func(ctx context.Context) error {
+		return v.SetBtime(ctx, fullpath, btime)
+	})
+}
+
+// Link calls Link in the underlying VFS with a timeout, if the VFS supports
+// hard links.
+func (t *timeoutVfs) Link(ctx context.Context, oldpath string, newpath string) error {
+	v, ok := t.VFS.(vfs.Linker)
+	if !ok {
+		return fmt.Errorf("Unable to link \"%s\": hard links not supported", newpath)
+	}
+	return t.run(ctx, "Link", newpath, func(ctx context.Context) error {
+		return v.Link(ctx, oldpath, newpath)
+	})
+}
+
+// MD5 returns the MD5 checksum of fullpath if the underlying VFS supports
+// checksums, or an empty string otherwise.
+func (t *timeoutVfs) MD5(ctx context.Context, fullpath string) (string, error) {
+	v, ok := t.VFS.(vfs.MD5er)
+	if !ok {
+		return "", nil
+	}
+	ret, err := t.runValue(ctx, "MD5", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.MD5(ctx, fullpath)
+	})
+	val, _ := ret.(string)
+	return val, err
+}
+
+// IsEmptyDir calls IsEmptyDir in the underlying VFS with a timeout, if the
+// VFS can check directories. Otherwise, fullpath is reported as empty, since
+// listings of the VFS are complete.
+func (t *timeoutVfs) IsEmptyDir(ctx context.Context, fullpath string) (bool, error) {
+	v, ok := t.VFS.(vfs.EmptyDirChecker)
+	if !ok {
+		return true, nil
+	}
+	ret, err := t.runValue(ctx, "IsEmptyDir", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.IsEmptyDir(ctx, fullpath)
+	})
+	val, _ := ret.(bool)
+	return val, err
+}
+
+// FreeSpace returns the free space in the filesystem holding fullpath if the
+// underlying VFS knows it, or -1 otherwise.
+func (t *timeoutVfs) FreeSpace(ctx context.Context, fullpath string) (int64, error) {
+	v, ok := t.VFS.(vfs.FreeSpacer)
+	if !ok {
+		return -1, nil
+	}
+	ret, err := t.runValue(ctx, "FreeSpace", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.FreeSpace(ctx, fullpath)
+	})
+	val, ok := ret.(int64)
+	if !ok {
+		val = -1
+	}
+	return val, err
+}
+
+// MimeType returns the MIME type of fullpath if the underlying VFS keeps MIME
+// types, or an empty string otherwise.
+func (t *timeoutVfs) MimeType(ctx context.Context, fullpath string) (string, error) {
+	v, ok := t.VFS.(vfs.MimeTyper)
+	if !ok {
+		return "", nil
+	}
+	ret, err := t.runValue(ctx, "MimeType", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.MimeType(ctx, fullpath)
+	})
+	val, _ := ret.(string)
+	return val, err
+}
+
+// Revision returns the revision of fullpath if the underlying VFS supports
+// revisions, or an empty string otherwise.
+func (t *timeoutVfs) Revision(ctx context.Context, fullpath string) (string, error) {
+	v, ok := t.VFS.(vfs.Revisioner)
+	if !ok {
+		return "", nil
+	}
+	ret, err := t.runValue(ctx, "Revision", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.Revision(ctx, fullpath)
+	})
+	val, _ := ret.(string)
+	return val, err
+}
+
+// Metadata returns the metadata of fullpath if the underlying VFS supports
+// it, or nil otherwise.
+func (t *timeoutVfs) Metadata(ctx context.Context, fullpath string) (map[string]string, error) {
+	v, ok := t.VFS.(vfs.MetadataGetter)
+	if !ok {
+		return nil, nil
+	}
+	ret, err := t.runValue(ctx, "Metadata", fullpath, func(ctx context.Context) (interface{}, error) {
+		return v.Metadata(ctx, fullpath)
+	})
+	val, _ := ret.(map[string]string)
+	return val, err
+}
+
+// SetMetadata sets the metadata of fullpath if the underlying VFS supports
+// it, and does nothing otherwise.
+func (t *timeoutVfs) SetMetadata(ctx context.Context, fullpath string, meta map[string]string) error {
+	v, ok := t.VFS.(vfs.MetadataSetter)
+	if !ok {
+		return nil
+	}
+	return t.run(ctx, "SetMetadata", fullpath, func(ctx context.Context) error {
+		return v.SetMetadata(ctx, fullpath, meta)
+	})
+}
+
+// Mkdir calls Mkdir in the underlying VFS with a timeout.
+func (t *timeoutVfs) Mkdir(ctx context.Context, fullpath string) error {
+	return t.run(ctx, "Mkdir", fullpath, func(ctx context.Context) error {
+		return t.VFS.Mkdir(ctx, fullpath)
+	})
+}
+
+// Move calls Move in the underlying VFS with a timeout.
+func (t *timeoutVfs) Move(ctx context.Context, srcpath string, dstpath string) error {
+	return t.run(ctx, "Move", srcpath, func(ctx context.Context) error {
+		return t.VFS.Move(ctx, srcpath, dstpath)
+	})
+}
+
+// ReadFromFile calls ReadFromFile in the underlying VFS with a timeout.
+// Reading from the returned reader is not subject to the timeout, and must
+// not be canceled when ReadFromFile returns.
+func (t *timeoutVfs) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	ret, err := t.runValue(ctx, "ReadFromFile", fullpath, func(context.Context) (interface{}, error) {
+		return t.VFS.ReadFromFile(ctx, fullpath)
+	})
+	val, _ := ret.(io.ReadCloser)
+	return val, err
+}
+
+// SetMtime calls SetMtime in the underlying VFS with a timeout.
+func (t *timeoutVfs) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	return t.run(ctx, "SetMtime", fullpath, func(ctx context.Context) error {
+		return t.VFS.SetMtime(ctx, fullpath, mtime)
+	})
+}
+
+// Stat calls Stat in the underlying VFS with a timeout.
+func (t *timeoutVfs) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	ret, err := t.runValue(ctx, "Stat", fullpath, func(ctx context.Context) (interface{}, error) {
+		return t.VFS.Stat(ctx, fullpath)
+	})
+	val, _ := ret.(vfs.FileInfo)
+	return val, err
+}
+
+// activityReader wraps an io.Reader recording the time of the last read.
+type activityReader struct {
+	r    io.Reader
+	last int64
+}
+
+// Read reads from the underlying reader and records the time.
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	a.touch()
+	return n, err
+}
+
+// Record activity other than reads, like data being sent (see
+// vfs.WithProgress).
+func (a *activityReader) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// Return the time elapsed since the last read.
+func (a *activityReader) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// WriteToFile calls WriteToFile in the underlying VFS, failing if no data is
+// read from reader for longer than the timeout.
+func (t *timeoutVfs) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	return t.write(ctx, fullpath, reader, func(ctx context.Context, r io.Reader) error {
+		return t.VFS.WriteToFile(ctx, fullpath, r)
+	})
+}
+
+// WriteToFileResumable calls WriteToFileResumable in the underlying VFS if
+// supported (or WriteToFile and SetMtime otherwise), failing if no data is
+// read from reader for longer than the timeout.
+func (t *timeoutVfs) WriteToFileResumable(ctx context.Context, fullpath string, reader io.Reader, size int64, mtime time.Time) error {
+	v, ok := t.VFS.(vfs.ResumableWriter)
+	if !ok {
+		if err := t.WriteToFile(ctx, fullpath, reader); err != nil {
+			return err
+		}
+		return t.SetMtime(ctx, fullpath, mtime)
+	}
+	return t.write(ctx, fullpath, reader, func(ctx context.Context, r io.Reader) error {
+		return v.WriteToFileResumable(ctx, fullpath, r, size, mtime)
+	})
+}
+
+// Run the write operation fn with a reader wrapping reader, failing (and
+// canceling the context passed to fn) if no data is read or acknowledged (see
+// vfs.WithProgress) for longer than the timeout.
+func (t *timeoutVfs) write(ctx context.Context, fullpath string, reader io.Reader, fn func(context.Context, io.Reader) error) error {
+	ar := &activityReader{r: reader, last: time.Now().UnixNano()}
+	wctx, cancel := context.WithCancel(vfs.WithProgress(ctx, func(int) { ar.touch() }))
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn(wctx, ar)
+	}()
+
+	interval := t.timeout / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if ar.idle() > t.timeout {
+				return fmt.Errorf("WriteToFile \"%s\": no data transferred for %v", fullpath, t.timeout)
+			}
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+// Encryption of the OAuth token caches at rest (--token-encryption).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Values of --token-encryption: a passphrase, or the contents of a key
+	// file (as in "file:/path/to/key").
+	tokenPassphrase    = "passphrase"
+	tokenKeyFilePrefix = "file:"
+
+	// Environment variable holding the passphrase, for unattended runs.
+	tokenPassphraseEnv = "GSYNC_TOKEN_PASSPHRASE"
+)
+
+// Number of PBKDF2 iterations used to derive the key of new encrypted token
+// caches. Existing files record their own.
+var tokenKDFIterations = 600000
+
+// encryptedToken is the format of encrypted token cache files: the token
+// cache, encrypted with AES-256-GCM using a key derived from the passphrase
+// (or key file) with PBKDF2-HMAC-SHA256.
+type encryptedToken struct {
+	Version    int    `json:"gsyncEncryptedToken"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// tokenVault keeps the token caches used during the run encrypted on disk.
+// The OAuth libraries read and refresh token caches by file name, so each one
+// is decrypted into a private temporary directory when first used (see open)
+// and encrypted back over the original at the end of the run (see close). The
+// temporary directory is also removed if the run is interrupted by a signal.
+// All methods are safe to call on a nil tokenVault, in which case token caches
+// are used directly.
+type tokenVault struct {
+	spec   string
+	input  io.Reader
+	output io.Writer
+	secret []byte
+
+	// Temporary directory, and decrypted copies by token cache file.
+	dir   string
+	files map[string]string
+
+	// Signals removing dir (see removeOnSignal).
+	sigc chan os.Signal
+}
+
+// The token vault, if --token-encryption is set.
+var tokens *tokenVault
+
+// Return a tokenVault for the --token-encryption spec, or nil if spec is
+// empty. The passphrase is read from the environment or, failing that, asked
+// for on output and read from input, only when a token cache is first used.
+//
+// Return:
+//   *tokenVault
+//   error
+func newTokenVault(spec string, input io.Reader, output io.Writer) (*tokenVault, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if spec != tokenPassphrase && !strings.HasPrefix(spec, tokenKeyFilePrefix) {
+		return nil, fmt.Errorf("Invalid --token-encryption \"%s\": must be \"%s\" or \"%s\" followed by a key file", spec, tokenPassphrase, tokenKeyFilePrefix)
+	}
+	return &tokenVault{spec: spec, input: input, output: output, files: make(map[string]string)}, nil
+}
+
+// Return the secret used to encrypt the token caches, reading it on the first
+// call.
+//
+// Return:
+//   []byte
+//   error
+func (v *tokenVault) key() ([]byte, error) {
+	if v.secret != nil {
+		return v.secret, nil
+	}
+	var secret []byte
+	if strings.HasPrefix(v.spec, tokenKeyFilePrefix) {
+		fname := strings.TrimPrefix(v.spec, tokenKeyFilePrefix)
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read token key file \"%s\": %v", fname, err)
+		}
+		secret = bytes.TrimSpace(data)
+	} else if env := os.Getenv(tokenPassphraseEnv); env != "" {
+		secret = []byte(env)
+	} else {
+		line, err := prompt(bufio.NewReader(v.input), v.output, "Token cache passphrase", "", false)
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(line)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Empty token encryption passphrase or key")
+	}
+	v.secret = secret
+	return secret, nil
+}
+
+// Derive a key of keyLen bytes from secret and salt with PBKDF2-HMAC-SHA256
+// (RFC 8018).
+func pbkdf2Key(secret []byte, salt []byte, iter int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, secret)
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+// Return an AES-256-GCM cipher keyed by secret, salt and iter.
+//
+// Return:
+//   cipher.AEAD
+//   error
+func tokenAEAD(secret []byte, salt []byte, iter int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2Key(secret, salt, iter, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt the token cache contents in plain.
+//
+// Return:
+//   []byte
+//   error
+func (v *tokenVault) encrypt(plain []byte) ([]byte, error) {
+	secret, err := v.key()
+	if err != nil {
+		return nil, err
+	}
+	e := encryptedToken{Version: 1, Iterations: tokenKDFIterations, Salt: make([]byte, 16)}
+	if _, err = rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := tokenAEAD(secret, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Data = aead.Seal(nil, e.Nonce, plain, nil)
+	return json.Marshal(e)
+}
+
+// Decrypt the token cache fname, with contents data. Token caches that are
+// not encrypted are returned unchanged, so they get encrypted at the end of
+// the run.
+//
+// Return:
+//   []byte
+//   error
+func (v *tokenVault) decrypt(fname string, data []byte) ([]byte, error) {
+	var e encryptedToken
+	if json.Unmarshal(data, &e) != nil || e.Version == 0 {
+		log.Info("token cache is not encrypted; encrypting it", "file", fname)
+		return data, nil
+	}
+	if e.Version != 1 || e.Iterations < 1 {
+		return nil, fmt.Errorf("Unsupported encrypted token cache \"%s\"", fname)
+	}
+	secret, err := v.key()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := tokenAEAD(secret, e.Salt, e.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid encrypted token cache \"%s\"", fname)
+	}
+	plain, err := aead.Open(nil, e.Nonce, e.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt token cache \"%s\" (wrong passphrase or key?)", fname)
+	}
+	return plain, nil
+}
+
+// Return the name of the file the OAuth libraries should use as the token
+// cache cachefile: a decrypted copy in the temporary directory of the vault,
+// or cachefile itself for a nil vault.
+//
+// Return:
+//   string
+//   error
+func (v *tokenVault) open(cachefile string) (string, error) {
+	if v == nil {
+		return cachefile, nil
+	}
+	if tmp, ok := v.files[cachefile]; ok {
+		return tmp, nil
+	}
+	if v.dir == "" {
+		// XDG_RUNTIME_DIR is private to the user and usually not on disk.
+		dir, err := ioutil.TempDir(os.Getenv("XDG_RUNTIME_DIR"), "gsync-tokens-")
+		if err != nil {
+			return "", err
+		}
+		v.dir = dir
+		v.sigc = removeOnSignal(dir)
+	}
+	tmp := filepath.Join(v.dir, fmt.Sprintf("%d-%s", len(v.files), filepath.Base(cachefile)))
+
+	data, err := ioutil.ReadFile(cachefile)
+	switch {
+	case os.IsNotExist(err):
+		// Created by the first authorization.
+	case err != nil:
+		return "", err
+	default:
+		plain, err := v.decrypt(cachefile, data)
+		if err != nil {
+			return "", err
+		}
+		if err = ioutil.WriteFile(tmp, plain, 0600); err != nil {
+			return "", err
+		}
+	}
+	v.files[cachefile] = tmp
+	return tmp, nil
+}
+
+// Encrypt the decrypted copies of the token caches (possibly with refreshed
+// tokens) back over the original files, and remove the copies.
+//
+// Return:
+//   error
+func (v *tokenVault) close() error {
+	if v == nil || v.dir == "" {
+		return nil
+	}
+	defer func() {
+		signal.Stop(v.sigc)
+		close(v.sigc)
+		os.RemoveAll(v.dir)
+		v.dir, v.files, v.sigc = "", make(map[string]string), nil
+	}()
+
+	for cachefile, tmp := range v.files {
+		plain, err := ioutil.ReadFile(tmp)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, err := v.encrypt(plain)
+		if err != nil {
+			return err
+		}
+		// Replace the cache atomically, so it's never left truncated.
+		if err = ioutil.WriteFile(cachefile+".tmp", data, 0600); err != nil {
+			return fmt.Errorf("Unable to write token cache \"%s\": %v", cachefile, err)
+		}
+		if err = os.Rename(cachefile+".tmp", cachefile); err != nil {
+			return fmt.Errorf("Unable to write token cache \"%s\": %v", cachefile, err)
+		}
+	}
+	return nil
+}
+
+// Remove dir when the program is interrupted or terminated, since deferred
+// calls (and closeTokens) don't run then, and deliver the signal again to end
+// the program. Closing the returned channel (after signal.Stop) stops watching
+// for signals.
+//
+// Return:
+//   chan os.Signal
+func removeOnSignal(dir string) chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-c
+		if !ok {
+			return
+		}
+		os.RemoveAll(dir)
+		signal.Stop(c)
+		if p, err := os.FindProcess(os.Getpid()); err == nil && p.Signal(sig) == nil {
+			return
+		}
+		os.Exit(1)
+	}()
+	return c
+}
+
+// Encrypt the token caches back at the end of the run, logging any errors.
+func closeTokens() {
+	if err := tokens.close(); err != nil {
+		log.Error("unable to encrypt token caches", "error", err)
+	}
+}
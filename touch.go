@@ -0,0 +1,91 @@
+package main
+
+// Setting modification times (touch command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Layouts accepted for the time given to the touch command. Times without a
+// time zone are in local time.
+var touchLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// Parse the time given to the touch command.
+//
+// Return:
+//   time.Time
+//   error
+func parseTouchTime(s string) (time.Time, error) {
+	for _, layout := range touchLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time \"%s\" (use YYYY-MM-DD, YYYY-MM-DD HH:MM:SS or RFC3339)", s)
+}
+
+// Set the modification time of root in fsys to mtime. With recursive, the
+// same is done to every file and directory under root, except for excluded
+// paths (see --exclude); directories are set after their contents. In dry-run
+// mode, paths are only logged.
+//
+// Return:
+//   int: number of paths set
+//   error
+func touchTree(ctx context.Context, fsys vfs.VFS, root string, mtime time.Time, recursive bool) (int, error) {
+	if !vfs.CapabilitiesOf(fsys).SetMtime {
+		return 0, fmt.Errorf("Unable to set modification times in \"%s\": not supported", root)
+	}
+	fi, err := fsys.Stat(ctx, root)
+	if err != nil {
+		return 0, err
+	}
+	paths := []string{fi.Path}
+	if recursive && fi.IsDir() {
+		var dirs []string
+		paths = nil
+		err = fsys.Walk(ctx, root, func(fi vfs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if rel := relPath(root, fi.Path); rel != "" {
+				skip, err := excluded(rel)
+				if err != nil || skip {
+					return err
+				}
+			}
+			if fi.IsDir() {
+				dirs = append(dirs, fi.Path)
+			} else {
+				paths = append(paths, fi.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		// Walks list directories before their contents.
+		for ix := len(dirs) - 1; ix >= 0; ix-- {
+			paths = append(paths, dirs[ix])
+		}
+	}
+
+	for n, p := range paths {
+		log.Info("touch", "path", p, "mtime", mtime)
+		if opt.dryrun {
+			continue
+		}
+		if err = fsys.SetMtime(ctx, p, mtime); err != nil {
+			return n, err
+		}
+	}
+	return len(paths), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+// Tree-style listings (tree command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// treeNode is a file or directory in a tree listing, with its path relative
+// to the root of the tree. The size of directories is the total size of the
+// files under them, and -1 if any size is unknown.
+type treeNode struct {
+	name     string
+	rel      string
+	fi       vfs.FileInfo
+	size     int64
+	children []*treeNode
+}
+
+// Format size with a K, M, G or T suffix (powers of 1024), as "tree -h" does.
+// Unknown (negative) sizes are shown as "?".
+func humanSize(size int64) string {
+	if size < 0 {
+		return "?"
+	}
+	if size < 1024 {
+		return fmt.Sprint(size)
+	}
+	f := float64(size)
+	suffix := ' '
+	for _, s := range "KMGT" {
+		if f < 1024 {
+			break
+		}
+		f /= 1024
+		suffix = s
+	}
+	return fmt.Sprintf("%.1f%c", f, suffix)
+}
+
+// List root and everything under it in fsys as a tree, skipping excluded
+// paths. Children are sorted by name.
+//
+// Return:
+//   *treeNode
+//   error
+func buildTree(ctx context.Context, fsys vfs.VFS, root string) (*treeNode, error) {
+	var top *treeNode
+	nodes := make(map[string]*treeNode)
+
+	err := fsys.Walk(ctx, root, func(fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := relPath(root, fi.Path)
+		if rel == "" {
+			top = &treeNode{name: root, fi: fi, size: fi.Size}
+			nodes[rel] = top
+			return nil
+		}
+		skip, err := excluded(rel)
+		if err != nil || skip {
+			return err
+		}
+		parent := path.Dir(rel)
+		if parent == "." {
+			parent = ""
+		}
+		p, ok := nodes[parent]
+		if !ok {
+			return nil
+		}
+		n := &treeNode{name: path.Base(rel), rel: rel, fi: fi, size: fi.Size}
+		p.children = append(p.children, n)
+		nodes[rel] = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if top == nil {
+		return nil, fmt.Errorf("Unable to list \"%s\"", root)
+	}
+	top.total()
+	return top, nil
+}
+
+// Sort the children of n (recursively) and set the sizes of directories to
+// the total size of their files.
+//
+// Return:
+//   int64: the size of n
+func (n *treeNode) total() int64 {
+	if !n.fi.IsDir() {
+		return n.size
+	}
+	sort.Slice(n.children, func(i, j int) bool { return n.children[i].name < n.children[j].name })
+	n.size = 0
+	for _, c := range n.children {
+		size := c.total()
+		if size < 0 || n.size < 0 {
+			n.size = -1
+			continue
+		}
+		n.size += size
+	}
+	return n.size
+}
+
+// Return the label of n in tree listings: its size and name. Directories
+// are marked with a trailing slash.
+//
+// Return:
+//   string
+//   error
+func treeLabel(n *treeNode) (string, error) {
+	name := n.name
+	if n.fi.IsDir() && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return fmt.Sprintf("[%6s]  %s", humanSize(n.size), name), nil
+}
+
+// Return a function labeling tree nodes of fsys with format (see
+// parseListFormat). Node sizes replace the sizes of directories.
+func treeFormat(ctx context.Context, fsys vfs.VFS, format *template.Template) func(*treeNode) (string, error) {
+	return func(n *treeNode) (string, error) {
+		e, err := newLsEntry(ctx, fsys, n.fi, n.rel)
+		if err != nil {
+			return "", err
+		}
+		if n.rel == "" {
+			e.Path = n.name
+		}
+		e.Size = n.size
+		var b strings.Builder
+		if err = format.Execute(&b, e); err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(b.String(), "\n"), nil
+	}
+}
+
+// Print the tree under n to w, down to maxDepth levels below n (all levels if
+// maxDepth is 0), followed by a summary of all directories and files in the
+// tree. Each node is shown with the result of label (see treeLabel and
+// treeFormat).
+//
+// Return:
+//   error
+func printTree(w io.Writer, n *treeNode, maxDepth int, label func(*treeNode) (string, error)) error {
+	var dirs, files int
+	var walk func(n *treeNode, prefix string, depth int) error
+	walk = func(n *treeNode, prefix string, depth int) error {
+		for ix, c := range n.children {
+			if c.fi.IsDir() {
+				dirs++
+			} else {
+				files++
+			}
+			if maxDepth > 0 && depth > maxDepth {
+				if err := walk(c, "", depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+			branch, indent := "├── ", "│   "
+			if ix == len(n.children)-1 {
+				branch, indent = "└── ", "    "
+			}
+			s, err := label(c)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "%s%s%s\n", prefix, branch, s); err != nil {
+				return err
+			}
+			if err := walk(c, prefix+indent, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	s, err := label(n)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(w, s); err != nil {
+		return err
+	}
+	if err := walk(n, "", 1); err != nil {
+		return err
+	}
+	dirword, fileword := "directories", "files"
+	if dirs == 1 {
+		dirword = "directory"
+	}
+	if files == 1 {
+		fileword = "file"
+	}
+	_, err = fmt.Fprintf(w, "\n%d %s, %d %s, %s\n", dirs, dirword, files, fileword, humanSize(n.size))
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Look up the numeric ID of a user name on this machine.
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+// Look up the numeric ID of a group name on this machine.
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// Load a user or group map (see --usermap and --groupmap) from fname. Each
+// line holds the owner recorded in the source metadata (a name, a numeric
+// ID, or "*" for any other owner) and the owner on this machine (a name,
+// translated with lookup, or a numeric ID), separated by blanks. Blank lines
+// and lines starting with "#" are ignored. An empty fname returns a nil map.
+//
+// Return:
+//   localvfs.IDMap
+//   error
+func loadIDMap(fname string, lookup func(string) (string, error)) (localvfs.IDMap, error) {
+	if fname == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ID map from \"%s\": %v", fname, err)
+	}
+	defer f.Close()
+
+	m := localvfs.IDMap{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid mapping in \"%s\", line %d: expected \"from to\"", fname, line)
+		}
+		to := fields[1]
+		if _, err = strconv.Atoi(to); err != nil {
+			if to, err = lookup(to); err != nil {
+				return nil, fmt.Errorf("Invalid mapping in \"%s\", line %d: %v", fname, line, err)
+			}
+		}
+		id, err := strconv.Atoi(to)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("Invalid mapping in \"%s\", line %d: bad ID \"%s\"", fname, line, to)
+		}
+		m[fields[0]] = id
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read ID map from \"%s\": %v", fname, err)
+	}
+	return m, nil
+}
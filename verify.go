@@ -0,0 +1,69 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Maximum number of attempts to copy a file whose checksum doesn't match.
+const maxCopyAttempts = 3
+
+// checksumError is returned when the data read from a file does not match
+// the checksum reported by its VFS.
+type checksumError struct {
+	path string
+	want string
+	got  string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch reading \"%s\": expected MD5 %s, got %s", e.path, e.want, e.got)
+}
+
+// md5Reader computes the MD5 checksum of the data read through it and returns
+// a checksumError instead of io.EOF if it doesn't match the expected value.
+type md5Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+	path string
+}
+
+func (m *md5Reader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(m.h.Sum(nil)); got != m.want {
+			return n, &checksumError{path: m.path, want: m.want, got: got}
+		}
+	}
+	return n, err
+}
+
+// Return a reader verifying the data read from r against the MD5 checksum of
+// srcpath in srcvfs. If the checksum is not known, r is returned unchanged.
+//
+// Return:
+//   io.Reader
+//   error
+func verifyingReader(ctx context.Context, r io.Reader, srcvfs vfs.VFS, srcpath string) (io.Reader, error) {
+	v, ok := srcvfs.(vfs.MD5er)
+	if !ok {
+		return r, nil
+	}
+	sum, err := v.MD5(ctx, srcpath)
+	if err != nil || sum == "" {
+		return r, err
+	}
+	return &md5Reader{r: r, h: md5.New(), want: sum, path: srcpath}, nil
+}
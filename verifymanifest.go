@@ -0,0 +1,174 @@
+package main
+
+// Verification of checksum manifests (verify-manifest command).
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Manifest verification status values
+const (
+	verifyMissing   = "missing"
+	verifyChanged   = "changed"
+	verifyCorrupted = "corrupted"
+)
+
+// manifestEntry holds the checksums of a file in a manifest. MD5 is only set
+// when the companion MD5 file lists the file.
+type manifestEntry struct {
+	Path   string
+	SHA256 string
+	MD5    string
+}
+
+// Read the checksums of a file in the format used by sha256sum and md5sum
+// into sums, by path.
+//
+// Return:
+//   error
+func readChecksumFile(fname string, sums map[string]string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// Files read in binary mode are marked with "*" by *sum -b.
+		ix := strings.Index(line, " ")
+		if ix <= 0 || len(line) < ix+3 || (line[ix+1] != ' ' && line[ix+1] != '*') {
+			return fmt.Errorf("Invalid line %d in \"%s\"", n, fname)
+		}
+		sums[line[ix+2:]] = strings.ToLower(line[:ix])
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("Unable to read \"%s\": %v", fname, err)
+	}
+	return nil
+}
+
+// Read the manifest written by --write-manifest to fname, along with its
+// companion MD5 file, if any. Entries are sorted by path.
+//
+// Return:
+//   []manifestEntry
+//   error
+func readManifest(fname string) ([]manifestEntry, error) {
+	sha := make(map[string]string)
+	if err := readChecksumFile(fname, sha); err != nil {
+		return nil, err
+	}
+	md5s := make(map[string]string)
+	if err := readChecksumFile(fname+manifestMD5Suffix, md5s); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	entries := make([]manifestEntry, 0, len(sha))
+	for p, sum := range sha {
+		entries = append(entries, manifestEntry{Path: p, SHA256: sum, MD5: md5s[p]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// Compute the SHA256 checksum of fullpath in fsys.
+//
+// Return:
+//   string
+//   error
+func sha256File(ctx context.Context, fsys vfs.VFS, fullpath string) (string, error) {
+	r, err := fsys.ReadFromFile(ctx, fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("Unable to read \"%s\": %v", fullpath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check every file in entries against its current contents in fsys. With
+// useMD5, files whose MD5 checksum is known to both the manifest and fsys are
+// compared by MD5, without reading them. This is meant for remotes, where the
+// checksum is kept by the server: local checksums may come from a cache keyed
+// by modification time, which would hide corruption. Other files are read and
+// compared by SHA256. Files that no longer match are
+// reported as "changed" when modified after written (the time the manifest was
+// written), and as "corrupted" otherwise, since their contents changed without
+// a new modification time. Files that no longer exist are reported as
+// "missing". The Reason of changed and corrupted files is "type" (no longer a
+// file), "md5" or "sha256".
+//
+// Return:
+//   []diffEntry
+//   error
+func verifyManifest(ctx context.Context, fsys vfs.VFS, entries []manifestEntry, written time.Time, useMD5 bool) ([]diffEntry, error) {
+	var problems []diffEntry
+
+	md5er, _ := fsys.(vfs.MD5er)
+	for _, e := range entries {
+		fi, err := fsys.Stat(ctx, e.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, diffEntry{Path: e.Path, Status: verifyMissing})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsRegular() {
+			problems = append(problems, diffEntry{Path: e.Path, Status: verifyChanged, Reason: "type"})
+			continue
+		}
+		status := verifyCorrupted
+		if fi.Mtime.After(written) {
+			status = verifyChanged
+		}
+
+		if useMD5 && e.MD5 != "" && md5er != nil {
+			sum, err := md5er.MD5(ctx, e.Path)
+			if err != nil {
+				return nil, err
+			}
+			if sum != "" {
+				if sum != e.MD5 {
+					problems = append(problems, diffEntry{Path: e.Path, Status: status, Reason: "md5"})
+				}
+				log.Debug("verified", "path", e.Path, "hash", "md5")
+				continue
+			}
+		}
+		sum, err := sha256File(ctx, fsys, e.Path)
+		if err != nil {
+			return nil, err
+		}
+		if sum != e.SHA256 {
+			problems = append(problems, diffEntry{Path: e.Path, Status: status, Reason: "sha256"})
+		}
+		log.Debug("verified", "path", e.Path, "hash", "sha256")
+	}
+	log.Info("verified manifest", "files", len(entries), "problems", len(problems))
+	return problems, nil
+}
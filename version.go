@@ -0,0 +1,146 @@
+package main
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	// Import path of the Google Drive API client.
+	driveAPIModule = "code.google.com/p/google-api-go-client"
+
+	// GitHub API URL for the latest gsync release.
+	latestReleaseURL = "https://api.github.com/repos/marcopaganini/gsync/releases/latest"
+)
+
+// Build metadata. These can be set at build time with:
+//
+//   go build -ldflags "-X main.version=v1.2.3 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When not set, they are filled in from the information embedded by the Go
+// toolchain, if available.
+var (
+	version   = "devel"
+	gitCommit = ""
+	buildDate = ""
+)
+
+// buildInfo holds the version information shown by the version command.
+type buildInfo struct {
+	Version         string `json:"version"`
+	GitCommit       string `json:"gitCommit,omitempty"`
+	BuildDate       string `json:"buildDate,omitempty"`
+	GoVersion       string `json:"goVersion"`
+	DriveAPIVersion string `json:"driveAPIVersion,omitempty"`
+}
+
+// Return the build metadata for this binary.
+func getBuildInfo() buildInfo {
+	bi := buildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return bi
+	}
+	if bi.Version == "devel" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		bi.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && bi.GitCommit == "":
+			bi.GitCommit = s.Value
+		case s.Key == "vcs.time" && bi.BuildDate == "":
+			bi.BuildDate = s.Value
+		}
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == driveAPIModule {
+			bi.DriveAPIVersion = dep.Version
+			if dep.Replace != nil {
+				bi.DriveAPIVersion = dep.Replace.Version
+			}
+		}
+	}
+	return bi
+}
+
+// Print the build metadata to w, as text or JSON.
+//
+// Return:
+//   error
+func printVersion(w io.Writer, bi buildInfo, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(bi)
+	}
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	_, err := fmt.Fprintf(w, "gsync %s\ncommit: %s\nbuilt: %s\ngo: %s\ndrive api: %s\n",
+		bi.Version, unknown(bi.GitCommit), unknown(bi.BuildDate), bi.GoVersion, unknown(bi.DriveAPIVersion))
+	return err
+}
+
+// Query GitHub for the latest gsync release.
+//
+// Return:
+//   string: tag of the latest release
+//   string: URL of the release page
+//   error
+func latestRelease(url string) (string, string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to check for updates: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Unable to check for updates: %s", resp.Status)
+	}
+
+	var rel struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return "", "", fmt.Errorf("Unable to decode release information: %v", err)
+	}
+	return rel.TagName, rel.HTMLURL, nil
+}
+
+// Check whether a newer release than the running version exists and print the
+// result to w. Development builds are always considered out of date.
+//
+// Return:
+//   error
+func checkUpdate(w io.Writer, bi buildInfo, url string) error {
+	tag, relurl, err := latestRelease(url)
+	if err != nil {
+		return err
+	}
+	if strings.TrimPrefix(tag, "v") == strings.TrimPrefix(bi.Version, "v") {
+		_, err = fmt.Fprintf(w, "gsync %s is up to date\n", bi.Version)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "gsync %s is available (running %s): %s\n", tag, bi.Version, relurl)
+	return err
+}
@@ -0,0 +1,503 @@
+// Package archivevfs implements a gsync VFS that writes a tar or zip archive,
+// so a filtered source tree can be synced straight into a single file.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+package archivevfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Archive formats.
+const (
+	FormatTar = "tar"
+	FormatZip = "zip"
+)
+
+// Compression methods for tar archives.
+const (
+	compressNone = ""
+	compressGzip = "gzip"
+)
+
+// Suffix of the file holding the archive while it is being written.
+const partialSuffix = ".partial"
+
+// Extensions of tar archives compressed with unsupported methods.
+var unsupportedSuffixes = map[string]bool{
+	".bz2":  true,
+	".lz":   true,
+	".lz4":  true,
+	".lzma": true,
+	".tbz":  true,
+	".tbz2": true,
+	".tlz":  true,
+	".txz":  true,
+	".tzst": true,
+	".xz":   true,
+	".z":    true,
+	".zst":  true,
+}
+
+// compression returns the compression method for the tar archive fname,
+// according to its extension.
+//
+// Return:
+//   string
+//   error: if fname is compressed with an unsupported method.
+func compression(fname string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(fname))
+	switch {
+	case ext == ".gz" || ext == ".tgz":
+		return compressGzip, nil
+	case unsupportedSuffixes[ext]:
+		return "", fmt.Errorf("Unsupported compression \"%s\" for archive \"%s\": only gzip (.gz or .tgz) is supported", ext, fname)
+	}
+	return compressNone, nil
+}
+
+// entry is a file or directory added to the archive.
+type entry struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+	mode  int64
+	uid   int
+	gid   int
+	uname string
+	gname string
+
+	// Contents of a file not yet written to the archive.
+	spool *os.File
+}
+
+// fileInfo returns the vfs.FileInfo for e, found at fullpath.
+func (e *entry) fileInfo(fullpath string) vfs.FileInfo {
+	fi := vfs.FileInfo{Path: fullpath, Size: e.size, Mtime: e.mtime, Type: vfs.TypeRegular}
+	if e.dir {
+		fi.Type = vfs.TypeDir
+	}
+	return fi
+}
+
+// ArchiveFileSystem represents a tar or zip archive being created. Archives
+// are written sequentially: the contents of each file are kept in a temporary
+// file until gsync moves on to the next one (so its modification time and
+// metadata can still be set), and directories are added when the archive is
+// closed, with their final modification times. Files can't be read, deleted
+// or moved once added. The archive is written to a ".partial" file, renamed
+// to its final name by Close.
+type ArchiveFileSystem struct {
+	fname    string
+	format   string
+	compress string
+	log      *slog.Logger
+	mu       gosync.Mutex
+	entries  map[string]*entry
+	pending  *entry
+
+	// Output file, compressor (tar only) and archive writers. The output
+	// file is only created when the first file is added.
+	file *os.File
+	comp io.WriteCloser
+	tw   *tar.Writer
+	zw   *zip.Writer
+}
+
+// NewArchiveFileSystem creates a new ArchiveFileSystem writing an archive in
+// format (FormatTar or FormatZip) to fname. Tar archives are compressed with
+// gzip if fname ends in ".gz" or ".tgz". Other compression methods (like
+// ".xz") are not supported.
+func NewArchiveFileSystem(fname string, format string) (*ArchiveFileSystem, error) {
+	if format != FormatTar && format != FormatZip {
+		return nil, fmt.Errorf("Invalid archive format \"%s\"", format)
+	}
+	if fname == "" {
+		return nil, fmt.Errorf("Missing %s archive file name", format)
+	}
+	afs := &ArchiveFileSystem{
+		fname:   fname,
+		format:  format,
+		log:     vfs.DiscardLogger(),
+		entries: map[string]*entry{},
+	}
+	if format == FormatTar {
+		var err error
+		if afs.compress, err = compression(fname); err != nil {
+			return nil, err
+		}
+	}
+	return afs, nil
+}
+
+// entryName returns the name of fullpath inside the archive: a relative path
+// using forward slashes, or an empty string for the root of the archive.
+func entryName(fullpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(fullpath)), "/")
+}
+
+// open creates the output file and archive writers, if not done yet. Must be
+// called with mu held.
+func (afs *ArchiveFileSystem) open() error {
+	if afs.file != nil {
+		return nil
+	}
+	f, err := os.Create(afs.fname + partialSuffix)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = f
+	if afs.format == FormatZip {
+		afs.zw = zip.NewWriter(w)
+		afs.file = f
+		return nil
+	}
+	if afs.compress == compressGzip {
+		afs.comp = gzip.NewWriter(f)
+		w = afs.comp
+	}
+	afs.tw = tar.NewWriter(w)
+	afs.file = f
+	return nil
+}
+
+// write adds e to the archive. The contents of files are copied from (and
+// then removed with) their spool files. Must be called with mu held.
+func (afs *ArchiveFileSystem) write(e *entry) error {
+	if err := afs.open(); err != nil {
+		return err
+	}
+	name := e.name
+	if e.dir {
+		name += "/"
+	}
+
+	var w io.Writer
+	var err error
+	if afs.zw != nil {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: e.mtime}
+		mode := os.FileMode(e.mode).Perm()
+		if e.dir {
+			hdr.Method = zip.Store
+			mode |= os.ModeDir
+		}
+		hdr.SetMode(mode)
+		w, err = afs.zw.CreateHeader(hdr)
+	} else {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     e.size,
+			Mode:     e.mode,
+			Uid:      e.uid,
+			Gid:      e.gid,
+			Uname:    e.uname,
+			Gname:    e.gname,
+			ModTime:  e.mtime,
+			Format:   tar.FormatPAX,
+		}
+		if e.dir {
+			hdr.Typeflag, hdr.Size = tar.TypeDir, 0
+		}
+		err = afs.tw.WriteHeader(hdr)
+		w = afs.tw
+	}
+	if err != nil || e.spool == nil {
+		return err
+	}
+
+	defer func() {
+		e.spool.Close()
+		os.Remove(e.spool.Name())
+		e.spool = nil
+	}()
+	if _, err = e.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, e.spool)
+	return err
+}
+
+// flush writes the pending file, if any, to the archive. Must be called with
+// mu held.
+func (afs *ArchiveFileSystem) flush() error {
+	e := afs.pending
+	if e == nil {
+		return nil
+	}
+	afs.pending = nil
+	afs.log.Debug("adding file to archive", "name", e.name, "size", e.size)
+	return afs.write(e)
+}
+
+// Close adds all directories to the archive, finishes writing it and gives it
+// its final name. The archive is created even if no files were added.
+func (afs *ArchiveFileSystem) Close() error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+
+	if err := afs.flush(); err != nil {
+		return err
+	}
+	if err := afs.open(); err != nil {
+		return err
+	}
+
+	// Directories go last, so they carry their final modification times.
+	var dirs []string
+	for name, e := range afs.entries {
+		if e.dir {
+			dirs = append(dirs, name)
+		}
+	}
+	sort.Strings(dirs)
+	for _, name := range dirs {
+		if err := afs.write(afs.entries[name]); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if afs.zw != nil {
+		err = afs.zw.Close()
+	} else {
+		err = afs.tw.Close()
+		if afs.comp != nil && err == nil {
+			err = afs.comp.Close()
+		}
+	}
+	if err == nil {
+		err = afs.file.Sync()
+	}
+	if cerr := afs.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to write archive \"%s\": %v", afs.fname, err)
+	}
+	return os.Rename(afs.file.Name(), afs.fname)
+}
+
+// Capabilities returns the features supported by archives. Files only show up
+// in the archive once completely written.
+func (afs *ArchiveFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		SetMtime:     true,
+		AtomicRename: true,
+	}
+}
+
+// Delete always fails, since nothing can be removed from the archive.
+func (afs *ArchiveFileSystem) Delete(_ context.Context, fullpath string) error {
+	return fmt.Errorf("Unable to delete \"%s\": archives can't be modified", fullpath)
+}
+
+// FileExists returns true if fullpath was added to the archive.
+func (afs *ArchiveFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	_, err := afs.Stat(ctx, fullpath)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Mkdir adds a directory to the archive.
+func (afs *ArchiveFileSystem) Mkdir(_ context.Context, fullpath string) error {
+	name := entryName(fullpath)
+	if name == "" {
+		return nil
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if _, ok := afs.entries[name]; ok {
+		return fmt.Errorf("Unable to create \"%s\": already in the archive", fullpath)
+	}
+	afs.entries[name] = &entry{name: name, dir: true, mtime: time.Now(), mode: 0755}
+	return nil
+}
+
+// Move always fails, since nothing can be renamed in the archive.
+func (afs *ArchiveFileSystem) Move(_ context.Context, srcpath string, _ string) error {
+	return fmt.Errorf("Unable to move \"%s\": archives can't be modified", srcpath)
+}
+
+// ReadFromFile always fails, since archives are write-only.
+func (afs *ArchiveFileSystem) ReadFromFile(_ context.Context, fullpath string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("Unable to read \"%s\": archive is write-only", fullpath)
+}
+
+// modifiable returns the entry for fullpath, if its header can still be
+// changed: directories, and the file added last. Must be called with mu
+// held.
+//
+// Return:
+//   *entry
+//   error
+func (afs *ArchiveFileSystem) modifiable(fullpath string) (*entry, error) {
+	name := entryName(fullpath)
+	e, ok := afs.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("Archive \"%s\": %w", fullpath, vfs.ErrNotExist)
+	}
+	if !e.dir && e != afs.pending {
+		return nil, fmt.Errorf("Unable to modify \"%s\": already written to the archive", fullpath)
+	}
+	return e, nil
+}
+
+// SetLogger sets the logger used for debugging messages.
+func (afs *ArchiveFileSystem) SetLogger(l *slog.Logger) {
+	afs.log = l
+}
+
+// SetMetadata applies the permission bits, ownership and exact modification
+// time in metadata returned by the local filesystem (see localvfs.Metadata)
+// to fullpath. Zip archives do not keep ownership. Symbolic link targets are
+// ignored: archives contain the files links point to.
+func (afs *ArchiveFileSystem) SetMetadata(_ context.Context, fullpath string, meta map[string]string) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+
+	e, err := afs.modifiable(fullpath)
+	if err != nil {
+		return err
+	}
+	if mode, err := strconv.ParseUint(meta[localvfs.MetaMode], 8, 32); err == nil {
+		e.mode = int64(os.FileMode(mode).Perm())
+	}
+	uid, err1 := strconv.Atoi(meta[localvfs.MetaUID])
+	gid, err2 := strconv.Atoi(meta[localvfs.MetaGID])
+	if err1 == nil && err2 == nil {
+		e.uid, e.gid = uid, gid
+		e.uname, e.gname = meta[localvfs.MetaUser], meta[localvfs.MetaGroup]
+	}
+	if ns, err := strconv.ParseInt(meta[localvfs.MetaMtime], 10, 64); err == nil {
+		e.mtime = time.Unix(0, ns)
+	}
+	return nil
+}
+
+// SetMtime sets the modification time of fullpath. This only works for
+// directories and the file added last.
+func (afs *ArchiveFileSystem) SetMtime(_ context.Context, fullpath string, mtime time.Time) error {
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+
+	e, err := afs.modifiable(fullpath)
+	if err != nil {
+		return err
+	}
+	e.mtime = mtime
+	return nil
+}
+
+// SetWriteInPlace does nothing. Files are always added to the archive once
+// completely written.
+func (afs *ArchiveFileSystem) SetWriteInPlace(bool) {
+}
+
+// Stat returns information about fullpath, which must have been added to the
+// archive. The root of the archive is always a directory.
+func (afs *ArchiveFileSystem) Stat(_ context.Context, fullpath string) (vfs.FileInfo, error) {
+	name := entryName(fullpath)
+	if name == "" {
+		return vfs.FileInfo{Path: fullpath, Type: vfs.TypeDir}, nil
+	}
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	e, ok := afs.entries[name]
+	if !ok {
+		return vfs.FileInfo{}, fmt.Errorf("Archive \"%s\": %w", fullpath, vfs.ErrNotExist)
+	}
+	return e.fileInfo(fullpath), nil
+}
+
+// Walk calls walkFn for every file and directory added to the archive under
+// fullpath (but not fullpath itself), in lexical order.
+func (afs *ArchiveFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	prefix := entryName(fullpath)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	afs.mu.Lock()
+	var infos []vfs.FileInfo
+	for name, e := range afs.entries {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, e.fileInfo(path.Join(fullpath, strings.TrimPrefix(name, prefix))))
+		}
+	}
+	afs.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	for _, fi := range infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walkFn(fi, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteToFile reads all data from reader and adds it to the archive as
+// fullpath. The data is kept in a temporary file until the next file is
+// added (or the archive is closed), when its size, modification time and
+// metadata are final.
+func (afs *ArchiveFileSystem) WriteToFile(_ context.Context, fullpath string, reader io.Reader) error {
+	name := entryName(fullpath)
+	if name == "" {
+		return fmt.Errorf("Invalid file name \"%s\"", fullpath)
+	}
+
+	spool, err := os.CreateTemp("", "gsync-archive-")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return err
+	}
+
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if _, ok := afs.entries[name]; ok {
+		err = fmt.Errorf("Unable to replace \"%s\": already in the archive", fullpath)
+	} else {
+		err = afs.flush()
+	}
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return err
+	}
+	e := &entry{name: name, size: size, mtime: time.Now(), mode: 0644, spool: spool}
+	afs.entries[name] = e
+	afs.pending = e
+	return nil
+}
@@ -0,0 +1,240 @@
+package archivevfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+func TestCompression(t *testing.T) {
+	for _, tt := range []struct {
+		fname   string
+		want    string
+		wantErr bool
+	}{
+		{"a.tar", compressNone, false},
+		{"a.tar.gz", compressGzip, false},
+		{"A.TGZ", compressGzip, false},
+		{"backup", compressNone, false},
+		{"a.tar.xz", "", true},
+		{"a.tar.zst", "", true},
+		{"a.tar.bz2", "", true},
+		{"a.tar.Z", "", true},
+	} {
+		got, err := compression(tt.fname)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: Expected %q (error=%v), got %q (err=%v)", tt.fname, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+func TestNewArchiveFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		fname   string
+		format  string
+		wantErr string
+	}{
+		{"a.tar", FormatTar, ""},
+		{"a.zip", FormatZip, ""},
+		{"a.7z", "7z", "Invalid archive format"},
+		{"", FormatTar, "Missing tar archive file name"},
+		{"a.tar.xz", FormatTar, "Unsupported compression \".xz\""},
+		// Zip archives are never compressed by their name.
+		{"a.zip.xz", FormatZip, ""},
+	} {
+		fname := tt.fname
+		if fname != "" {
+			fname = filepath.Join(dir, fname)
+		}
+		_, err := NewArchiveFileSystem(fname, tt.format)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s (%s): Expected error %q, got %v", tt.fname, tt.format, tt.wantErr, err)
+		}
+	}
+}
+
+// Add a file with data, mtime and mode to afs.
+func addFile(t *testing.T, afs *ArchiveFileSystem, name string, data string, mtime time.Time, mode string) {
+	ctx := context.Background()
+	if err := afs.WriteToFile(ctx, name, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	meta := map[string]string{localvfs.MetaMode: mode, localvfs.MetaUID: "1000", localvfs.MetaGID: "100", localvfs.MetaUser: "me"}
+	if err := afs.SetMetadata(ctx, name, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := afs.SetMtime(ctx, name, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	ctx := context.Background()
+	fname := filepath.Join(t.TempDir(), "out.tgz")
+	afs, err := NewArchiveFileSystem(fname, FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err = afs.Mkdir(ctx, "/d"); err != nil {
+		t.Fatal(err)
+	}
+	addFile(t, afs, "/d/a", "aaa", mtime, "600")
+	addFile(t, afs, "/b", "b", mtime, "755")
+
+	// Only the file added last, and directories, can be changed.
+	if err = afs.SetMtime(ctx, "/d/a", mtime); err == nil {
+		t.Errorf("Expected an error changing a file already written")
+	}
+	if err = afs.SetMtime(ctx, "/d", mtime); err != nil {
+		t.Errorf("Unable to change a directory: %v", err)
+	}
+	if err = afs.WriteToFile(ctx, "/b", strings.NewReader("x")); err == nil {
+		t.Errorf("Expected an error replacing a file")
+	}
+	if err = afs.Mkdir(ctx, "/d"); err == nil {
+		t.Errorf("Expected an error creating a directory twice")
+	}
+	for name, err := range map[string]error{
+		"Delete":       afs.Delete(ctx, "/b"),
+		"Move":         afs.Move(ctx, "/b", "/c"),
+		"ReadFromFile": func() error { _, err := afs.ReadFromFile(ctx, "/b"); return err }(),
+	} {
+		if err == nil {
+			t.Errorf("%s: Expected an error", name)
+		}
+	}
+
+	// Files added are visible right away.
+	fi, err := afs.Stat(ctx, "/d/a")
+	if err != nil || fi.Size != 3 || fi.Type != vfs.TypeRegular || !fi.Mtime.Equal(mtime) {
+		t.Errorf("Unexpected info for /d/a: %+v (err=%v)", fi, err)
+	}
+	if exists, err := afs.FileExists(ctx, "/c"); exists || err != nil {
+		t.Errorf("Expected /c not to exist, got %v (err=%v)", exists, err)
+	}
+	var walked []string
+	err = afs.Walk(ctx, "/", func(fi vfs.FileInfo, err error) error {
+		walked = append(walked, fi.Path)
+		return err
+	})
+	if want := []string{"/b", "/d", "/d/a"}; err != nil || !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk: Expected %v, got %v (err=%v)", want, walked, err)
+	}
+
+	if _, err = os.Stat(fname + partialSuffix); err != nil {
+		t.Errorf("Expected a partial archive, got %v", err)
+	}
+	if err = afs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fname + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial archive to be renamed, got %v", err)
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, hdr.Name+":"+string(data))
+		if hdr.Typeflag == tar.TypeReg && (!hdr.ModTime.Equal(mtime) || hdr.Uid != 1000 || hdr.Gid != 100 || hdr.Uname != "me") {
+			t.Errorf("%s: Unexpected header %+v", hdr.Name, hdr)
+		}
+		if hdr.Name == "b" && hdr.Mode != 0755 {
+			t.Errorf("%s: Expected mode 755, got %o", hdr.Name, hdr.Mode)
+		}
+	}
+	// Directories go last.
+	if want := []string{"d/a:aaa", "b:b", "d/:"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected entries %v, got %v", want, got)
+	}
+}
+
+func TestArchiveZip(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "out.zip")
+	afs, err := NewArchiveFileSystem(fname, FormatZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	addFile(t, afs, "/d/a", "aaa", mtime, "600")
+	if err = afs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if len(zr.File) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(zr.File))
+	}
+	zf := zr.File[0]
+	if zf.Name != "d/a" || zf.Mode().Perm() != 0600 || !zf.Modified.Equal(mtime) {
+		t.Errorf("Unexpected entry %s, mode %v, mtime %v", zf.Name, zf.Mode(), zf.Modified)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := io.ReadAll(rc); err != nil || string(data) != "aaa" {
+		t.Errorf("Expected %q, got %q (err=%v)", "aaa", data, err)
+	}
+}
+
+// Empty archives are still created.
+func TestArchiveEmpty(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "out.tar")
+	afs, err := NewArchiveFileSystem(fname, FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = afs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = tar.NewReader(f).Next(); err != io.EOF {
+		t.Errorf("Expected an empty archive, got %v", err)
+	}
+}
@@ -0,0 +1,472 @@
+package archivevfs
+
+// Existing tar and zip archives, read as a sync source.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Maximum number of symbolic links followed when resolving a link.
+const maxSymlinks = 40
+
+// srcEntry is a file, directory or link found in the archive.
+type srcEntry struct {
+	name  string
+	typ   vfs.FileType
+	size  int64
+	mtime time.Time
+	mode  int64
+	uid   int
+	gid   int
+	uname string
+	gname string
+
+	// Target of symbolic and hard links (hard links are regular files
+	// sharing the data of their target).
+	link string
+	hard bool
+
+	// Position of the entry in the tar stream (-1 for directories not
+	// present in the archive), or the entry in a zip archive.
+	index int
+	zf    *zip.File
+}
+
+// ArchiveSourceFileSystem represents an existing tar or zip archive, read as
+// a sync source. The whole archive is scanned once when opened. Zip archives
+// are read at random, but tar archives (especially compressed ones) can only
+// be read sequentially, so Walk visits entries in the order they appear in
+// the archive. Reading files in that order (as gsync does) never reads the
+// archive more than once. Directories missing from the archive are created
+// as needed, with the modification time of the archive file.
+type ArchiveSourceFileSystem struct {
+	fname    string
+	format   string
+	compress string
+	mtime    time.Time
+	log      *slog.Logger
+	entries  []*srcEntry
+	byName   map[string]*srcEntry
+
+	// Zip archive, or sequential reader of a tar archive, positioned at the
+	// tar entry last returned by ReadFromFile. The mutex is held while that
+	// entry is being read.
+	zr     *zip.ReadCloser
+	mu     gosync.Mutex
+	cursor *tarCursor
+}
+
+// tarCursor is a tar.Reader positioned at the entry with index pos.
+type tarCursor struct {
+	tr     *tar.Reader
+	closer io.Closer
+	pos    int
+}
+
+// NewArchiveSourceFileSystem opens the archive in format (FormatTar or
+// FormatZip) named fname. Tar archives compressed with gzip are
+// recognized by their extension (see NewArchiveFileSystem).
+func NewArchiveSourceFileSystem(fname string, format string) (*ArchiveSourceFileSystem, error) {
+	if format != FormatTar && format != FormatZip {
+		return nil, fmt.Errorf("Invalid archive format \"%s\"", format)
+	}
+	var compress string
+	if format == FormatTar {
+		var err error
+		if compress, err = compression(fname); err != nil {
+			return nil, err
+		}
+	}
+	st, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	asf := &ArchiveSourceFileSystem{
+		fname:    fname,
+		format:   format,
+		compress: compress,
+		mtime:    st.ModTime(),
+		log:      vfs.DiscardLogger(),
+		byName:   map[string]*srcEntry{},
+	}
+
+	if format == FormatZip {
+		if asf.zr, err = zip.OpenReader(fname); err != nil {
+			return nil, fmt.Errorf("Unable to open archive \"%s\": %v", fname, err)
+		}
+		for _, f := range asf.zr.File {
+			asf.add(zipEntry(f))
+		}
+		return asf, nil
+	}
+
+	c, err := openTar(fname, compress)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closer.Close()
+	for i := 0; ; i++ {
+		hdr, err := c.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read archive \"%s\": %v", fname, err)
+		}
+		asf.add(tarEntry(hdr, i))
+	}
+	return asf, nil
+}
+
+// openTar opens the tar archive fname, decompressing it with the compression
+// method compress, and returns a tarCursor positioned before the first entry.
+func openTar(fname string, compress string) (*tarCursor, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = f
+	if compress == compressGzip {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to read archive \"%s\": %v", fname, err)
+		}
+		r = zr
+	}
+	return &tarCursor{tr: tar.NewReader(r), closer: f, pos: -1}, nil
+}
+
+// tarEntry returns the srcEntry for the tar header hdr, at position index.
+func tarEntry(hdr *tar.Header, index int) *srcEntry {
+	e := &srcEntry{
+		name:  entryName(hdr.Name),
+		typ:   vfs.TypeSpecial,
+		size:  hdr.Size,
+		mtime: hdr.ModTime,
+		mode:  hdr.Mode,
+		uid:   hdr.Uid,
+		gid:   hdr.Gid,
+		uname: hdr.Uname,
+		gname: hdr.Gname,
+		index: index,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		e.typ = vfs.TypeRegular
+	case tar.TypeDir:
+		e.typ = vfs.TypeDir
+	case tar.TypeSymlink:
+		e.typ, e.link = vfs.TypeSymlink, hdr.Linkname
+	case tar.TypeLink:
+		e.typ, e.link, e.hard = vfs.TypeRegular, hdr.Linkname, true
+	}
+	return e
+}
+
+// zipEntry returns the srcEntry for the zip file f.
+func zipEntry(f *zip.File) *srcEntry {
+	mode := f.Mode()
+	e := &srcEntry{
+		name:  entryName(f.Name),
+		typ:   vfs.TypeRegular,
+		size:  int64(f.UncompressedSize64),
+		mtime: f.Modified,
+		mode:  int64(mode.Perm()),
+		index: -1,
+		zf:    f,
+	}
+	switch {
+	case mode.IsDir():
+		e.typ, e.size = vfs.TypeDir, 0
+	case !mode.IsRegular():
+		e.typ = vfs.TypeSpecial
+	}
+	return e
+}
+
+// add adds e to the list of entries, along with any missing parent
+// directories. Entries found again replace the previous ones (as when
+// extracting), but keep their position.
+func (asf *ArchiveSourceFileSystem) add(e *srcEntry) {
+	if e.name == "" {
+		return
+	}
+	if dir := path.Dir(e.name); dir != "." {
+		if _, ok := asf.byName[dir]; !ok {
+			asf.add(&srcEntry{name: dir, typ: vfs.TypeDir, mtime: asf.mtime, mode: 0755, index: -1})
+		}
+	}
+	if old, ok := asf.byName[e.name]; ok {
+		*old = *e
+		return
+	}
+	asf.entries = append(asf.entries, e)
+	asf.byName[e.name] = e
+}
+
+// lookup returns the entry for fullpath, or an error matching
+// vfs.ErrNotExist.
+func (asf *ArchiveSourceFileSystem) lookup(fullpath string) (*srcEntry, error) {
+	e, ok := asf.byName[entryName(fullpath)]
+	if !ok {
+		return nil, fmt.Errorf("Archive \"%s\": \"%s\": %w", asf.fname, fullpath, vfs.ErrNotExist)
+	}
+	return e, nil
+}
+
+// resolve returns the entry holding the data of e, following symbolic and
+// hard links, or nil if a link is dangling or loops.
+func (asf *ArchiveSourceFileSystem) resolve(e *srcEntry) *srcEntry {
+	for i := 0; i < maxSymlinks; i++ {
+		switch {
+		case e.hard:
+			e = asf.byName[entryName(e.link)]
+		case e.typ == vfs.TypeSymlink:
+			target := e.link
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(e.name), target)
+			}
+			e = asf.byName[entryName(target)]
+		default:
+			return e
+		}
+		if e == nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// fileInfo returns the vfs.FileInfo for e, found at fullpath.
+func (asf *ArchiveSourceFileSystem) fileInfo(fullpath string, e *srcEntry) vfs.FileInfo {
+	fi := vfs.FileInfo{Path: fullpath, Size: e.size, Mtime: e.mtime, Type: e.typ}
+	if e.typ != vfs.TypeSymlink && !e.hard {
+		return fi
+	}
+	t := asf.resolve(e)
+	switch {
+	case t == nil && e.hard:
+		// Dangling hard links only happen in broken archives.
+		fi.Type = vfs.TypeSpecial
+	case t == nil:
+		fi.Target = vfs.TypeSymlink
+	case e.hard:
+		fi.Size = t.size
+	default:
+		fi.Target, fi.Size, fi.Mtime = t.typ, t.size, t.mtime
+	}
+	return fi
+}
+
+// readOnly returns the error for operations that would modify the archive.
+func (asf *ArchiveSourceFileSystem) readOnly(op string, fullpath string) error {
+	return fmt.Errorf("%s \"%s\": archive \"%s\" is read-only", op, fullpath, asf.fname)
+}
+
+// Capabilities returns the features supported by archives used as sources.
+// Archives can't be modified.
+func (asf *ArchiveSourceFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{}
+}
+
+// Close closes the archive.
+func (asf *ArchiveSourceFileSystem) Close() error {
+	asf.mu.Lock()
+	defer asf.mu.Unlock()
+	if asf.cursor != nil {
+		asf.cursor.closer.Close()
+		asf.cursor = nil
+	}
+	if asf.zr != nil {
+		return asf.zr.Close()
+	}
+	return nil
+}
+
+// Delete always fails, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) Delete(_ context.Context, fullpath string) error {
+	return asf.readOnly("Delete", fullpath)
+}
+
+// FileExists returns true if fullpath is in the archive.
+func (asf *ArchiveSourceFileSystem) FileExists(_ context.Context, fullpath string) (bool, error) {
+	if entryName(fullpath) == "" {
+		return true, nil
+	}
+	_, err := asf.lookup(fullpath)
+	return err == nil, nil
+}
+
+// Metadata returns the permission bits, ownership (tar only), exact
+// modification time and, for symbolic links, the link target of fullpath,
+// using the same keys as the local filesystem (see localvfs.Metadata).
+func (asf *ArchiveSourceFileSystem) Metadata(_ context.Context, fullpath string) (map[string]string, error) {
+	e, err := asf.lookup(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		localvfs.MetaMode:  strconv.FormatInt(e.mode&0777, 8),
+		localvfs.MetaMtime: strconv.FormatInt(e.mtime.UnixNano(), 10),
+	}
+	if t := asf.resolve(e); t != nil {
+		meta[localvfs.MetaMode] = strconv.FormatInt(t.mode&0777, 8)
+	}
+	// Directories missing from the archive have no owner.
+	if asf.format == FormatTar && e.index >= 0 {
+		meta[localvfs.MetaUID] = strconv.Itoa(e.uid)
+		meta[localvfs.MetaGID] = strconv.Itoa(e.gid)
+		if e.uname != "" {
+			meta[localvfs.MetaUser] = e.uname
+		}
+		if e.gname != "" {
+			meta[localvfs.MetaGroup] = e.gname
+		}
+	}
+	if e.typ == vfs.TypeSymlink {
+		meta[localvfs.MetaSymlink] = e.link
+	}
+	return meta, nil
+}
+
+// Mkdir always fails, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) Mkdir(_ context.Context, fullpath string) error {
+	return asf.readOnly("Mkdir", fullpath)
+}
+
+// Move always fails, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) Move(_ context.Context, srcpath string, _ string) error {
+	return asf.readOnly("Move", srcpath)
+}
+
+// ReadFromFile returns an io.ReadCloser with the contents of fullpath, which
+// must be closed before the next file can be read from a tar archive. Reading
+// a file that comes before the one read last means reading the archive again
+// from the start.
+func (asf *ArchiveSourceFileSystem) ReadFromFile(_ context.Context, fullpath string) (io.ReadCloser, error) {
+	e, err := asf.lookup(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	d := asf.resolve(e)
+	if d == nil || d.typ != vfs.TypeRegular {
+		return nil, fmt.Errorf("Unable to read \"%s\": not a regular file", fullpath)
+	}
+	if d.zf != nil {
+		return d.zf.Open()
+	}
+
+	asf.mu.Lock()
+	c := asf.cursor
+	if c == nil || c.pos >= d.index {
+		if c != nil {
+			c.closer.Close()
+			asf.log.Debug("reading archive again", "archive", asf.fname, "path", fullpath)
+		}
+		if c, err = openTar(asf.fname, asf.compress); err != nil {
+			asf.cursor = nil
+			asf.mu.Unlock()
+			return nil, err
+		}
+		asf.cursor = c
+	}
+	for c.pos < d.index {
+		if _, err = c.tr.Next(); err != nil {
+			asf.mu.Unlock()
+			return nil, fmt.Errorf("Unable to read archive \"%s\": %v", asf.fname, err)
+		}
+		c.pos++
+	}
+	return &entryReader{r: c.tr, unlock: asf.mu.Unlock}, nil
+}
+
+// entryReader reads the current entry of a tarCursor, releasing the cursor
+// when closed.
+type entryReader struct {
+	r      io.Reader
+	unlock func()
+	once   gosync.Once
+}
+
+func (r *entryReader) Read(p []byte) (int, error) { return r.r.Read(p) }
+
+func (r *entryReader) Close() error {
+	r.once.Do(r.unlock)
+	return nil
+}
+
+// SetLogger sets the logger used for debugging messages.
+func (asf *ArchiveSourceFileSystem) SetLogger(l *slog.Logger) {
+	asf.log = l
+}
+
+// SetMtime always fails, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) SetMtime(_ context.Context, fullpath string, _ time.Time) error {
+	return asf.readOnly("SetMtime", fullpath)
+}
+
+// SetWriteInPlace does nothing, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) SetWriteInPlace(bool) {
+}
+
+// Stat returns information about fullpath. The root of the archive is a
+// directory with the modification time of the archive file.
+func (asf *ArchiveSourceFileSystem) Stat(_ context.Context, fullpath string) (vfs.FileInfo, error) {
+	if entryName(fullpath) == "" {
+		return vfs.FileInfo{Path: fullpath, Mtime: asf.mtime, Type: vfs.TypeDir}, nil
+	}
+	e, err := asf.lookup(fullpath)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return asf.fileInfo(fullpath, e), nil
+}
+
+// Walk calls walkFn for every entry in the archive under fullpath (but not
+// fullpath itself), in the order they appear in the archive. Directories are
+// always visited before their contents.
+func (asf *ArchiveSourceFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	prefix := entryName(fullpath)
+	if prefix != "" {
+		prefix += "/"
+	}
+	for _, e := range asf.entries {
+		if !strings.HasPrefix(e.name, prefix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi := asf.fileInfo(path.Join(fullpath, strings.TrimPrefix(e.name, prefix)), e)
+		if err := walkFn(fi, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteToFile always fails, since archives are read-only.
+func (asf *ArchiveSourceFileSystem) WriteToFile(_ context.Context, fullpath string, _ io.Reader) error {
+	return asf.readOnly("WriteToFile", fullpath)
+}
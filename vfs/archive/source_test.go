@@ -0,0 +1,280 @@
+package archivevfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+	"github.com/marcopaganini/gsync/vfs/local"
+)
+
+// Write a gzipped tar archive named fname with hdrs, using the cleaned header
+// names as file contents.
+func writeTarGz(t *testing.T, fname string, hdrs []tar.Header) {
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		data := ""
+		if hdr.Typeflag == tar.TypeReg {
+			data = strings.TrimPrefix(hdr.Name, "./")
+			hdr.Size = int64(len(data))
+		}
+		if err = tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Read fullpath from asf.
+//
+// Return:
+//   string
+//   error
+func readFile(asf *ArchiveSourceFileSystem, fullpath string) (string, error) {
+	rc, err := asf.ReadFromFile(context.Background(), fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return string(data), err
+}
+
+func TestArchiveSourceTar(t *testing.T) {
+	ctx := context.Background()
+	fname := filepath.Join(t.TempDir(), "in.tar.gz")
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	writeTarGz(t, fname, []tar.Header{
+		{Typeflag: tar.TypeReg, Name: "d1/d2/bar", Mode: 0600, ModTime: mtime, Uid: 1000, Gid: 100, Uname: "me"},
+		{Typeflag: tar.TypeReg, Name: "./d1/foo", Mode: 0644, ModTime: mtime},
+		{Typeflag: tar.TypeDir, Name: "d1/", Mode: 0700, ModTime: mtime},
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "d1/foo", ModTime: mtime},
+		{Typeflag: tar.TypeSymlink, Name: "dangling", Linkname: "nowhere", ModTime: mtime},
+		{Typeflag: tar.TypeLink, Name: "hard", Linkname: "d1/d2/bar", ModTime: mtime},
+		{Typeflag: tar.TypeFifo, Name: "fifo", ModTime: mtime},
+	})
+	asf, err := NewArchiveSourceFileSystem(fname, FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asf.Close()
+
+	// Entries are walked in archive order, with missing directories before
+	// their contents.
+	var walked []string
+	err = asf.Walk(ctx, "/", func(fi vfs.FileInfo, err error) error {
+		walked = append(walked, fi.Path)
+		return err
+	})
+	want := []string{"/d1", "/d1/d2", "/d1/d2/bar", "/d1/foo", "/link", "/dangling", "/hard", "/fifo"}
+	if err != nil || !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk: Expected %v, got %v (err=%v)", want, walked, err)
+	}
+
+	// Targets are only set for symbolic links.
+	for _, tt := range []struct {
+		path   string
+		typ    vfs.FileType
+		target vfs.FileType
+		size   int64
+	}{
+		{"/", vfs.TypeDir, 0, 0},
+		{"/d1", vfs.TypeDir, 0, 0},
+		{"/d1/d2", vfs.TypeDir, 0, 0},
+		{"/d1/foo", vfs.TypeRegular, 0, 6},
+		{"/link", vfs.TypeSymlink, vfs.TypeRegular, 6},
+		{"/dangling", vfs.TypeSymlink, vfs.TypeSymlink, 0},
+		{"/hard", vfs.TypeRegular, 0, 9},
+		{"/fifo", vfs.TypeSpecial, 0, 0},
+	} {
+		fi, err := asf.Stat(ctx, tt.path)
+		if err != nil || fi.Type != tt.typ || fi.Target != tt.target || fi.Size != tt.size {
+			t.Errorf("%s: Expected type %v, target %v, size %d, got %+v (err=%v)", tt.path, tt.typ, tt.target, tt.size, fi, err)
+		}
+	}
+	if _, err = asf.Stat(ctx, "/nothing"); !errors.Is(err, vfs.ErrNotExist) {
+		t.Errorf("Expected vfs.ErrNotExist, got %v", err)
+	}
+
+	// Files can be read in any order, and through links.
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/d1/foo", "d1/foo"},
+		{"/d1/d2/bar", "d1/d2/bar"},
+		{"/link", "d1/foo"},
+		{"/hard", "d1/d2/bar"},
+	} {
+		if got, err := readFile(asf, tt.path); err != nil || got != tt.want {
+			t.Errorf("%s: Expected %q, got %q (err=%v)", tt.path, tt.want, got, err)
+		}
+	}
+	for _, name := range []string{"/dangling", "/fifo", "/d1"} {
+		if _, err = readFile(asf, name); err == nil {
+			t.Errorf("%s: Expected an error reading", name)
+		}
+	}
+
+	meta, err := asf.Metadata(ctx, "/d1/d2/bar")
+	wantMeta := map[string]string{
+		localvfs.MetaMode:  "600",
+		localvfs.MetaMtime: "1588334400000000000",
+		localvfs.MetaUID:   "1000",
+		localvfs.MetaGID:   "100",
+		localvfs.MetaUser:  "me",
+	}
+	if err != nil || !reflect.DeepEqual(meta, wantMeta) {
+		t.Errorf("Expected metadata %v, got %v (err=%v)", wantMeta, meta, err)
+	}
+	// Directories missing from the archive have no owner.
+	if meta, err = asf.Metadata(ctx, "/d1/d2"); err != nil || meta[localvfs.MetaUID] != "" {
+		t.Errorf("Unexpected metadata for /d1/d2: %v (err=%v)", meta, err)
+	}
+	if meta, err = asf.Metadata(ctx, "/link"); err != nil || meta[localvfs.MetaSymlink] != "d1/foo" {
+		t.Errorf("Unexpected metadata for /link: %v (err=%v)", meta, err)
+	}
+
+	for name, err := range map[string]error{
+		"Delete":      asf.Delete(ctx, "/d1/foo"),
+		"Mkdir":       asf.Mkdir(ctx, "/new"),
+		"Move":        asf.Move(ctx, "/d1/foo", "/new"),
+		"SetMtime":    asf.SetMtime(ctx, "/d1/foo", mtime),
+		"WriteToFile": asf.WriteToFile(ctx, "/new", strings.NewReader("x")),
+	} {
+		if err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Errorf("%s: Expected a read-only error, got %v", name, err)
+		}
+	}
+}
+
+func TestArchiveSourceZip(t *testing.T) {
+	ctx := context.Background()
+	fname := filepath.Join(t.TempDir(), "in.zip")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"d/", "d/a", "b"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			if _, err = w.Write([]byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	asf, err := NewArchiveSourceFileSystem(fname, FormatZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer asf.Close()
+	if fi, err := asf.Stat(ctx, "/d"); err != nil || fi.Type != vfs.TypeDir {
+		t.Errorf("Expected /d to be a directory, got %+v (err=%v)", fi, err)
+	}
+	for _, name := range []string{"b", "d/a"} {
+		if got, err := readFile(asf, "/"+name); err != nil || got != name {
+			t.Errorf("%s: Expected %q, got %q (err=%v)", name, name, got, err)
+		}
+	}
+	// Zip archives keep no ownership.
+	if meta, err := asf.Metadata(ctx, "/b"); err != nil || meta[localvfs.MetaUID] != "" {
+		t.Errorf("Unexpected metadata for /b: %v (err=%v)", meta, err)
+	}
+}
+
+func TestArchiveSourceErrors(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.tgz")
+	if err := os.WriteFile(garbage, []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xz := filepath.Join(dir, "in.tar.xz")
+	if err := os.WriteFile(xz, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		fname, format, wantErr string
+	}{
+		{filepath.Join(dir, "missing.tar"), FormatTar, "no such file"},
+		{garbage, FormatTar, "Unable to read archive"},
+		{garbage, FormatZip, "Unable to open archive"},
+		{xz, FormatTar, "Unsupported compression \".xz\""},
+		{xz, "rar", "Invalid archive format"},
+	} {
+		if _, err := NewArchiveSourceFileSystem(tt.fname, tt.format); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s (%s): Expected error %q, got %v", filepath.Base(tt.fname), tt.format, tt.wantErr, err)
+		}
+	}
+}
+
+// Archives written by ArchiveFileSystem can be read back.
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, format := range []string{FormatTar, FormatZip} {
+		fname := filepath.Join(t.TempDir(), "archive."+format)
+		afs, err := NewArchiveFileSystem(fname, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addFile(t, afs, "/d/a", "aaa", mtime, "640")
+		if err = afs.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		asf, err := NewArchiveSourceFileSystem(fname, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := asf.Stat(ctx, "/d/a")
+		if err != nil || fi.Size != 3 || !fi.Mtime.Equal(mtime) {
+			t.Errorf("%s: Unexpected info for /d/a: %+v (err=%v)", format, fi, err)
+		}
+		if got, err := readFile(asf, "/d/a"); err != nil || got != "aaa" {
+			t.Errorf("%s: Expected %q, got %q (err=%v)", format, "aaa", got, err)
+		}
+		if meta, err := asf.Metadata(ctx, "/d/a"); err != nil || meta[localvfs.MetaMode] != "640" {
+			t.Errorf("%s: Unexpected metadata %v (err=%v)", format, meta, err)
+		}
+		asf.Close()
+	}
+}
@@ -0,0 +1,785 @@
+// Package azblobvfs implements the gsync VFS on top of Azure Blob Storage.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+package azblobvfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Version of the Blob service REST API used in all requests.
+	apiVersion = "2020-10-02"
+
+	// Metadata key holding the modification time of blobs (RFC3339, with
+	// nanoseconds). Blobs without it use their last modified time.
+	mtimeKey = "mtime"
+
+	// Default size of the blocks used to upload large blobs.
+	defaultBlockSize = 8 << 20
+
+	// Interval between checks of a pending server-side copy.
+	copyPollInterval = time.Second
+)
+
+// AzblobFileSystem represents a virtual filesystem in an Azure Blob Storage
+// account. The first component of a path is the container name and the rest
+// is the blob name, as in "backups/2024/notes.txt". Blob storage has no real
+// directories: a directory exists while there are blobs under it. Directories
+// created by Mkdir only exist until the end of the run.
+type AzblobFileSystem struct {
+	client    *http.Client
+	endpoint  *url.URL
+	account   string
+	key       []byte
+	sas       url.Values
+	blockSize int
+	log       *slog.Logger
+
+	// Directories created by Mkdir.
+	mu   gosync.Mutex
+	dirs map[string]bool
+
+	// Options
+	optReadOnly bool
+}
+
+// NewAzblobFileSystem creates a new AzblobFileSystem object for the given
+// storage account. Requests are authorized with key (the base64 encoded
+// account key) or, if key is empty, with the shared access signature in sas.
+// If endpoint is empty, the public Azure endpoint of the account is used.
+func NewAzblobFileSystem(account string, key string, sas string, endpoint string) (*AzblobFileSystem, error) {
+	if account == "" {
+		return nil, fmt.Errorf("Azure storage account not set")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Azure endpoint \"%s\": %v", endpoint, err)
+	}
+
+	afs := &AzblobFileSystem{
+		client:    &http.Client{},
+		endpoint:  u,
+		account:   account,
+		blockSize: defaultBlockSize,
+		dirs:      map[string]bool{},
+		log:       vfs.DiscardLogger(),
+	}
+	switch {
+	case key != "":
+		afs.key, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure storage key: %v", err)
+		}
+	case sas != "":
+		afs.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure SAS token: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Azure storage key or SAS token not set")
+	}
+	return afs, nil
+}
+
+// checkWritable returns an error if the filesystem has been set read-only.
+func (afs *AzblobFileSystem) checkWritable(op string, fullpath string) error {
+	if afs.optReadOnly {
+		return fmt.Errorf("%s \"%s\": Azure storage is read-only", op, fullpath)
+	}
+	return nil
+}
+
+// splitPath returns the container and blob names for pathname. Both are
+// empty for the root of the account, and the blob name is empty for the top
+// of a container.
+//
+// Return:
+//   container
+//   blob
+func splitPath(pathname string) (string, string) {
+	var ret []string
+	for _, e := range strings.Split(pathname, "/") {
+		if e != "" {
+			ret = append(ret, e)
+		}
+	}
+	if len(ret) == 0 {
+		return "", ""
+	}
+	return ret[0], strings.Join(ret[1:], "/")
+}
+
+// blobURL returns the URL of blob in container. The URL of the container is
+// returned if blob is empty, and the URL of the account if both are empty.
+func (afs *AzblobFileSystem) blobURL(container string, blob string, query url.Values) *url.URL {
+	u := *afs.endpoint
+	rawpath := u.EscapedPath()
+	if container != "" {
+		u.Path += "/" + container
+		rawpath += "/" + url.PathEscape(container)
+	}
+	if blob != "" {
+		u.Path += "/" + blob
+		for _, e := range strings.Split(blob, "/") {
+			rawpath += "/" + url.PathEscape(e)
+		}
+	}
+	if u.Path == "" {
+		u.Path, rawpath = "/", "/"
+	}
+	u.RawPath = rawpath
+
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range afs.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+// do sends a request for blob in container (see blobURL), returning the
+// response. Responses with an error status are closed and returned as
+// errors, matching vfs.ErrNotExist if the object does not exist.
+func (afs *AzblobFileSystem) do(ctx context.Context, method string, container string, blob string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, afs.blobURL(container, blob, query).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+	if afs.key != nil {
+		sign(req, afs.account, afs.key)
+	}
+
+	afs.log.Debug("request", "method", method, "container", container, "blob", blob, "query", query.Encode())
+	resp, err := afs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	name := path.Join(container, blob)
+	code := resp.Header.Get("x-ms-error-code")
+	if code == "" {
+		code = resp.Status
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("Azure %s \"%s\": %s: %w", method, name, code, vfs.ErrNotExist)
+	}
+	return nil, fmt.Errorf("Azure %s \"%s\": %s", method, name, code)
+}
+
+// send works like do, but discards the body of the response.
+func (afs *AzblobFileSystem) send(ctx context.Context, method string, container string, blob string, query url.Values, header http.Header, body []byte) (http.Header, error) {
+	resp, err := afs.do(ctx, method, container, blob, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Header, nil
+}
+
+// listResult holds one page of the results of a List Blobs request.
+type listResult struct {
+	Blobs      []listBlob `xml:"Blobs>Blob"`
+	Prefixes   []string   `xml:"Blobs>BlobPrefix>Name"`
+	NextMarker string     `xml:"NextMarker"`
+}
+
+// listBlob describes one blob in a listResult.
+type listBlob struct {
+	Name         string `xml:"Name"`
+	LastModified string `xml:"Properties>Last-Modified"`
+	Size         int64  `xml:"Properties>Content-Length"`
+	Mtime        string `xml:"Metadata>mtime"`
+}
+
+// containerList holds one page of the results of a List Containers request.
+type containerList struct {
+	Names      []string `xml:"Containers>Container>Name"`
+	NextMarker string   `xml:"NextMarker"`
+}
+
+// list returns the blobs in container whose names start with prefix. If
+// delimiter is not empty, names are only listed up to the delimiter (after
+// the prefix), and grouped in prefixes. Up to max results are returned, or
+// all of them if max is zero.
+//
+// Return:
+//   listResult
+//   error
+func (afs *AzblobFileSystem) list(ctx context.Context, container string, prefix string, delimiter string, max int) (listResult, error) {
+	var ret listResult
+
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+		"include": {"metadata"},
+		"prefix":  {prefix},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if max > 0 {
+		query.Set("maxresults", strconv.Itoa(max))
+	}
+	for {
+		var page listResult
+		if err := afs.get(ctx, container, query, &page); err != nil {
+			return ret, err
+		}
+		ret.Blobs = append(ret.Blobs, page.Blobs...)
+		ret.Prefixes = append(ret.Prefixes, page.Prefixes...)
+		if page.NextMarker == "" || max > 0 {
+			return ret, nil
+		}
+		query.Set("marker", page.NextMarker)
+	}
+}
+
+// listContainers returns the names of all containers in the account.
+func (afs *AzblobFileSystem) listContainers(ctx context.Context) ([]string, error) {
+	var ret []string
+
+	query := url.Values{"comp": {"list"}}
+	for {
+		var page containerList
+		if err := afs.get(ctx, "", query, &page); err != nil {
+			return nil, err
+		}
+		ret = append(ret, page.Names...)
+		if page.NextMarker == "" {
+			return ret, nil
+		}
+		query.Set("marker", page.NextMarker)
+	}
+}
+
+// get sends a GET request for container and decodes the XML response into v.
+func (afs *AzblobFileSystem) get(ctx context.Context, container string, query url.Values, v interface{}) error {
+	resp, err := afs.do(ctx, "GET", container, "", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Unable to decode Azure listing of \"%s\": %v", container, err)
+	}
+	return nil
+}
+
+// parseMtime returns the modification time in the mtime metadata of a blob,
+// or lastModified (in HTTP date format) if the metadata is missing or
+// invalid.
+func parseMtime(mtime string, lastModified string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, mtime); err == nil {
+		return t, nil
+	}
+	return http.ParseTime(lastModified)
+}
+
+// isDir returns true if fullpath is a directory: the top of a container, a
+// directory created by Mkdir, or a prefix of existing blobs.
+func (afs *AzblobFileSystem) isDir(ctx context.Context, fullpath string) (bool, error) {
+	container, blob := splitPath(fullpath)
+	if blob == "" {
+		_, err := afs.send(ctx, "HEAD", container, "", url.Values{"restype": {"container"}}, nil, nil)
+		if errors.Is(err, vfs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	afs.mu.Lock()
+	ok := afs.dirs[path.Join(container, blob)]
+	afs.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	res, err := afs.list(ctx, container, blob+"/", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(res.Blobs) > 0, nil
+}
+
+// Capabilities returns the features supported by Azure Blob Storage. Blobs
+// are only replaced once an upload is complete.
+func (afs *AzblobFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		SetMtime:       true,
+		Checksum:       true,
+		ServerSideCopy: true,
+		ServerSideMove: true,
+		AtomicRename:   true,
+	}
+}
+
+// Copy copies srcpath to dstpath on the server side. Both must be in the same
+// storage account, but may be in different containers.
+func (afs *AzblobFileSystem) Copy(ctx context.Context, srcpath string, dstpath string) error {
+	if err := afs.checkWritable("Copy", dstpath); err != nil {
+		return err
+	}
+	return afs.copyBlob(ctx, srcpath, dstpath)
+}
+
+// copyBlob copies the blob srcpath to dstpath, waiting for the copy to
+// finish.
+func (afs *AzblobFileSystem) copyBlob(ctx context.Context, srcpath string, dstpath string) error {
+	srcContainer, srcBlob := splitPath(srcpath)
+	dstContainer, dstBlob := splitPath(dstpath)
+	if srcBlob == "" || dstBlob == "" {
+		return fmt.Errorf("Invalid copy from \"%s\" to \"%s\"", srcpath, dstpath)
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-copy-source", afs.blobURL(srcContainer, srcBlob, nil).String())
+	h, err := afs.send(ctx, "PUT", dstContainer, dstBlob, nil, header, nil)
+	if err != nil {
+		return err
+	}
+
+	// Copies within an account are usually synchronous, but large blobs
+	// may take a while.
+	for {
+		switch status := h.Get("x-ms-copy-status"); status {
+		case "", "success":
+			return nil
+		case "pending":
+		default:
+			return fmt.Errorf("Unable to copy \"%s\" to \"%s\": %s %s", srcpath, dstpath, status, h.Get("x-ms-copy-status-description"))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(copyPollInterval):
+		}
+		if h, err = afs.send(ctx, "HEAD", dstContainer, dstBlob, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// Delete removes the blob named fullpath, or the (empty) directory fullpath.
+func (afs *AzblobFileSystem) Delete(ctx context.Context, fullpath string) error {
+	if err := afs.checkWritable("Delete", fullpath); err != nil {
+		return err
+	}
+	container, blob := splitPath(fullpath)
+	if blob == "" {
+		return fmt.Errorf("Refusing to delete container \"%s\"", fullpath)
+	}
+	_, err := afs.send(ctx, "DELETE", container, blob, nil, nil, nil)
+	if !errors.Is(err, vfs.ErrNotExist) {
+		return err
+	}
+
+	// Not a blob. Directories are gone once they hold no blobs.
+	res, lerr := afs.list(ctx, container, blob+"/", "", 1)
+	if lerr != nil {
+		return lerr
+	}
+	if len(res.Blobs) > 0 {
+		return fmt.Errorf("Directory \"%s\" not empty", fullpath)
+	}
+	key := path.Join(container, blob)
+	afs.mu.Lock()
+	defer afs.mu.Unlock()
+	if afs.dirs[key] {
+		delete(afs.dirs, key)
+		return nil
+	}
+	return err
+}
+
+// FileExists returns true if fullpath exists.
+func (afs *AzblobFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	_, err := afs.Stat(ctx, fullpath)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MD5 returns the MD5 checksum of the blob fullpath, as a hex string. Blobs
+// uploaded by other programs may not have a checksum, in which case an empty
+// string is returned.
+func (afs *AzblobFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	container, blob := splitPath(fullpath)
+	h, err := afs.send(ctx, "HEAD", container, blob, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	sum, err := base64.StdEncoding.DecodeString(h.Get("Content-MD5"))
+	if err != nil {
+		return "", nil
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// Mkdir creates a directory. Directories at the top level are containers and
+// are created in the account. Other directories only exist in memory until
+// blobs are written under them.
+func (afs *AzblobFileSystem) Mkdir(ctx context.Context, fullpath string) error {
+	if err := afs.checkWritable("Mkdir", fullpath); err != nil {
+		return err
+	}
+	container, blob := splitPath(fullpath)
+	if container == "" {
+		return fmt.Errorf("Invalid directory \"%s\"", fullpath)
+	}
+	if blob == "" {
+		_, err := afs.send(ctx, "PUT", container, "", url.Values{"restype": {"container"}}, nil, nil)
+		return err
+	}
+	afs.mu.Lock()
+	afs.dirs[path.Join(container, blob)] = true
+	afs.mu.Unlock()
+	return nil
+}
+
+// Move renames srcpath to dstpath. Blob storage has no renames, so blobs are
+// copied on the server side and then deleted. Moving a directory moves all
+// blobs under it.
+func (afs *AzblobFileSystem) Move(ctx context.Context, srcpath string, dstpath string) error {
+	if err := afs.checkWritable("Move", srcpath); err != nil {
+		return err
+	}
+	container, blob := splitPath(srcpath)
+	if blob == "" {
+		return fmt.Errorf("Refusing to move container \"%s\"", srcpath)
+	}
+
+	err := afs.copyBlob(ctx, srcpath, dstpath)
+	if err == nil {
+		_, err = afs.send(ctx, "DELETE", container, blob, nil, nil, nil)
+		return err
+	}
+	if !errors.Is(err, vfs.ErrNotExist) {
+		return err
+	}
+
+	// Not a blob: move everything under the directory.
+	res, lerr := afs.list(ctx, container, blob+"/", "", 0)
+	if lerr != nil {
+		return lerr
+	}
+	key := path.Join(container, blob)
+	afs.mu.Lock()
+	dir := afs.dirs[key]
+	delete(afs.dirs, key)
+	afs.mu.Unlock()
+	if len(res.Blobs) == 0 && !dir {
+		return err
+	}
+	if dir {
+		if err = afs.Mkdir(ctx, dstpath); err != nil {
+			return err
+		}
+	}
+	for _, b := range res.Blobs {
+		dst := path.Join(dstpath, strings.TrimPrefix(b.Name, blob+"/"))
+		if err = afs.copyBlob(ctx, path.Join(container, b.Name), dst); err != nil {
+			return err
+		}
+		if _, err = afs.send(ctx, "DELETE", container, b.Name, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFromFile returns an io.ReadCloser with the contents of the blob
+// fullpath. The caller must close it.
+func (afs *AzblobFileSystem) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	container, blob := splitPath(fullpath)
+	if blob == "" {
+		return nil, fmt.Errorf("Unable to read \"%s\": is a directory", fullpath)
+	}
+	resp, err := afs.do(ctx, "GET", container, blob, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SetBufferSize sets the size of the blocks used to upload large blobs, which
+// bounds the memory used by each transfer.
+func (afs *AzblobFileSystem) SetBufferSize(size int) {
+	if size > 0 {
+		afs.blockSize = size
+	}
+}
+
+// SetLogger sets the logger used for debugging messages.
+func (afs *AzblobFileSystem) SetLogger(l *slog.Logger) {
+	afs.log = l
+}
+
+// SetMtime sets the modification time of the blob fullpath, keeping all other
+// metadata. Directories have no modification times, so this does nothing for
+// them.
+func (afs *AzblobFileSystem) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	if err := afs.checkWritable("SetMtime", fullpath); err != nil {
+		return err
+	}
+	container, blob := splitPath(fullpath)
+	if blob == "" {
+		return nil
+	}
+	h, err := afs.send(ctx, "HEAD", container, blob, nil, nil, nil)
+	if errors.Is(err, vfs.ErrNotExist) {
+		if dir, derr := afs.isDir(ctx, fullpath); dir || derr != nil {
+			return derr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Setting metadata replaces all of it.
+	header := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+			header[k] = v
+		}
+	}
+	header.Set("x-ms-meta-"+mtimeKey, mtime.UTC().Format(time.RFC3339Nano))
+	_, err = afs.send(ctx, "PUT", container, blob, url.Values{"comp": {"metadata"}}, header, nil)
+	return err
+}
+
+// SetReadOnly makes all operations that modify the filesystem fail.
+func (afs *AzblobFileSystem) SetReadOnly(f bool) {
+	afs.optReadOnly = f
+}
+
+// SetWriteInPlace does nothing. Blobs are always replaced atomically once an
+// upload is complete.
+func (afs *AzblobFileSystem) SetWriteInPlace(bool) {
+}
+
+// Stat returns information about fullpath.
+func (afs *AzblobFileSystem) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	dirInfo := vfs.FileInfo{Path: fullpath, Type: vfs.TypeDir}
+
+	container, blob := splitPath(fullpath)
+	if container == "" {
+		return dirInfo, nil
+	}
+	if blob != "" {
+		h, err := afs.send(ctx, "HEAD", container, blob, nil, nil, nil)
+		if err == nil {
+			size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+			mtime, err := parseMtime(h.Get("x-ms-meta-"+mtimeKey), h.Get("Last-Modified"))
+			return vfs.FileInfo{Path: fullpath, Size: size, Mtime: mtime, Type: vfs.TypeRegular}, err
+		}
+		if !errors.Is(err, vfs.ErrNotExist) {
+			return vfs.FileInfo{}, err
+		}
+	}
+
+	dir, err := afs.isDir(ctx, fullpath)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	if !dir {
+		return vfs.FileInfo{}, fmt.Errorf("Azure \"%s\": %w", fullpath, vfs.ErrNotExist)
+	}
+	return dirInfo, nil
+}
+
+// Walk calls walkFn for every blob and directory under fullpath (but not
+// fullpath itself). Entries inside a directory are visited in lexical order,
+// and directories are visited before their contents. Directories that can't
+// be listed are passed to walkFn along with the error. If walkFn returns an
+// error, the walk stops and Walk returns that error.
+func (afs *AzblobFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	container, blob := splitPath(fullpath)
+	if container != "" {
+		prefix := ""
+		if blob != "" {
+			prefix = blob + "/"
+		}
+		return afs.walkDir(ctx, container, prefix, walkFn)
+	}
+
+	// Account root: walk all containers.
+	names, err := afs.listContainers(ctx)
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: "/"}, err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = walkFn(vfs.FileInfo{Path: name, Type: vfs.TypeDir}, nil); err != nil {
+			return err
+		}
+		if err = afs.walkDir(ctx, name, "", walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkDir recursively walks the blobs in container under prefix (which is
+// empty or ends in a slash), calling walkFn for each entry.
+func (afs *AzblobFileSystem) walkDir(ctx context.Context, container string, prefix string, walkFn vfs.WalkFunc) error {
+	dir := path.Join(container, prefix)
+	res, err := afs.list(ctx, container, prefix, "/", 0)
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: dir}, err)
+	}
+
+	// Merge blobs and directories in a single sorted list.
+	type entry struct {
+		name string
+		blob *listBlob
+	}
+	var entries []entry
+	for i, b := range res.Blobs {
+		// Skip directory marker blobs created by other tools.
+		if strings.HasSuffix(b.Name, "/") {
+			continue
+		}
+		entries = append(entries, entry{b.Name, &res.Blobs[i]})
+	}
+	for _, p := range res.Prefixes {
+		entries = append(entries, entry{strings.TrimSuffix(p, "/"), nil})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	for _, e := range entries {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		fullpath := path.Join(container, e.name)
+		if e.blob == nil {
+			if err = walkFn(vfs.FileInfo{Path: fullpath, Type: vfs.TypeDir}, nil); err != nil {
+				return err
+			}
+			if err = afs.walkDir(ctx, container, e.name+"/", walkFn); err != nil {
+				return err
+			}
+			continue
+		}
+		mtime, err := parseMtime(e.blob.Mtime, e.blob.LastModified)
+		fi := vfs.FileInfo{Path: fullpath, Size: e.blob.Size, Mtime: mtime, Type: vfs.TypeRegular}
+		if err = walkFn(fi, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteToFile reads all data from reader and writes it to the blob fullpath.
+// Data is read in blocks of the configured buffer size (see SetBufferSize).
+// Small files are written with a single request, and larger files are
+// uploaded one block at a time and committed at the end, so memory use is
+// bounded regardless of the file size.
+func (afs *AzblobFileSystem) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	if err := afs.checkWritable("WriteToFile", fullpath); err != nil {
+		return err
+	}
+	container, blob := splitPath(fullpath)
+	if blob == "" {
+		return fmt.Errorf("Invalid file name \"%s\"", fullpath)
+	}
+
+	buf := vfs.Buffers.Get(afs.blockSize)
+	defer vfs.Buffers.Put(buf)
+	n, err := io.ReadFull(reader, buf)
+	switch err {
+	case nil:
+		// More data may follow.
+		return afs.writeBlocks(ctx, container, blob, buf, reader)
+	case io.EOF, io.ErrUnexpectedEOF:
+	default:
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	_, err = afs.send(ctx, "PUT", container, blob, nil, header, buf[:n])
+	return err
+}
+
+// writeBlocks uploads blob in blocks, starting with the (full) block in buf
+// and followed by the data in reader, and then commits the list of blocks.
+func (afs *AzblobFileSystem) writeBlocks(ctx context.Context, container string, blob string, buf []byte, reader io.Reader) error {
+	var ids []string
+
+	sum := md5.New()
+	n := len(buf)
+	for {
+		// Block IDs must all have the same length.
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		if _, err := afs.send(ctx, "PUT", container, blob, query, nil, buf[:n]); err != nil {
+			return err
+		}
+		sum.Write(buf[:n])
+		ids = append(ids, id)
+
+		var err error
+		n, err = io.ReadFull(reader, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+
+	header := http.Header{}
+	header.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(sum.Sum(nil)))
+	_, err := afs.send(ctx, "PUT", container, blob, url.Values{"comp": {"blocklist"}}, header, list.Bytes())
+	return err
+}
@@ -0,0 +1,86 @@
+package azblobvfs
+
+// Shared Key authorization for Azure Blob Storage requests.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// signedHeaders are the standard headers included, in this order, in the
+// string to sign.
+var signedHeaders = []string{
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-MD5",
+	"Content-Type",
+	"Date",
+	"If-Modified-Since",
+	"If-Match",
+	"If-None-Match",
+	"If-Unmodified-Since",
+	"Range",
+}
+
+// sign adds a Shared Key Authorization header to req, which must already
+// carry all x-ms-* headers.
+func sign(req *http.Request, account string, key []byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign(req, account)))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", "SharedKey "+account+":"+sig)
+}
+
+// stringToSign returns the string signed to authorize req for account. See
+// "Authorize with Shared Key" in the Azure Storage documentation for its
+// format.
+func stringToSign(req *http.Request, account string) string {
+	lines := []string{req.Method}
+	for _, h := range signedHeaders {
+		v := req.Header.Get(h)
+		// Zero lengths are signed as empty strings.
+		if h == "Content-Length" {
+			v = ""
+			if req.ContentLength > 0 {
+				v = strconv.FormatInt(req.ContentLength, 10)
+			}
+		}
+		lines = append(lines, v)
+	}
+
+	// Canonicalized headers: all x-ms-* headers, lowercase and sorted.
+	var xms []string
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-ms-") {
+			xms = append(xms, k+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(xms)
+	lines = append(lines, xms...)
+
+	// Canonicalized resource: account, path and sorted query parameters.
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for k, v := range query {
+		sort.Strings(v)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(v, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+	lines = append(lines, resource)
+	return strings.Join(lines, "\n")
+}
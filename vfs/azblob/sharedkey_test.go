@@ -0,0 +1,96 @@
+package azblobvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The well-known account key of the Azure Storage emulator.
+const emulatorKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFTTOtr/KBHBeksoGMGw=="
+
+// Return a request for method and url, with body and the given headers.
+func newSignedRequest(t *testing.T, method string, url string, body string, header map[string]string) *http.Request {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestStringToSign(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		header map[string]string
+		want   string
+	}{
+		{
+			// The example in "Authorize with Shared Key".
+			name:   "Documented example",
+			method: http.MethodGet,
+			url:    "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata&timeout=20",
+			header: map[string]string{"x-ms-date": "Sun, 11 Oct 2009 21:49:13 GMT", "x-ms-version": "2009-09-19"},
+			want:   "GET\n\n\n\n\n\n\n\n\n\n\n\nx-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\nx-ms-version:2009-09-19\n/myaccount/mycontainer\ncomp:metadata\nrestype:container\ntimeout:20",
+		},
+		{
+			name:   "Standard headers in order",
+			method: http.MethodPut,
+			url:    "https://myaccount.blob.core.windows.net/c/dir/my%20blob",
+			body:   "abc",
+			header: map[string]string{
+				"Range":          "bytes=0-2",
+				"Content-Type":   "text/plain",
+				"Content-MD5":    "kAFQmDzST7DWlj99KOF/cg==",
+				"If-Match":       "\"0x8D\"",
+				"X-Ms-Meta-Name": " value ",
+				"x-ms-blob-type": "BlockBlob",
+			},
+			want: "PUT\n\n\n3\nkAFQmDzST7DWlj99KOF/cg==\ntext/plain\n\n\n\"0x8D\"\n\n\nbytes=0-2\nx-ms-blob-type:BlockBlob\nx-ms-meta-name:value\n/myaccount/c/dir/my%20blob",
+		},
+		{
+			name:   "Empty body",
+			method: http.MethodPut,
+			url:    "https://myaccount.blob.core.windows.net/c/empty",
+			header: map[string]string{"Content-Length": "0"},
+			want:   "PUT\n\n\n\n\n\n\n\n\n\n\n\n/myaccount/c/empty",
+		},
+		{
+			name:   "Query parameters",
+			method: http.MethodGet,
+			url:    "https://myaccount.blob.core.windows.net/c?Restype=container&comp=list&prefix=a%2Fb&include=snapshots&include=metadata",
+			want:   "GET\n\n\n\n\n\n\n\n\n\n\n\n/myaccount/c\ncomp:list\ninclude:metadata,snapshots\nprefix:a/b\nrestype:container",
+		},
+	} {
+		req := newSignedRequest(t, tt.method, tt.url, tt.body, tt.header)
+		if got := stringToSign(req, "myaccount"); got != tt.want {
+			t.Errorf("%s: Expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString(emulatorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newSignedRequest(t, http.MethodGet, "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata&timeout=20", "",
+		map[string]string{"x-ms-date": "Sun, 11 Oct 2009 21:49:13 GMT", "x-ms-version": "2009-09-19"})
+	sign(req, "myaccount", key)
+
+	// HMAC-SHA256 of the documented string to sign with the emulator key.
+	want := "SharedKey myaccount:tckkM76xXIiYARrsq8jgZEDUHkzL9ZTnSXpPpXhM8yU="
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
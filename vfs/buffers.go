@@ -0,0 +1,104 @@
+package vfs
+
+// Shared pool of transfer buffers.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// BufferPool hands out the byte slices used to move data in transfers,
+// reusing released ones, and keeps track of the memory held by the buffers in
+// use. Buffers are grouped by size (rounded up to a power of two), so
+// transfers with different buffer sizes can share a pool.
+//
+// Buffers a transfer needs to make progress are always granted (see Get),
+// while read-ahead buffers are only granted while the memory in use is below
+// the limit (see TryGet). This bounds the memory used by transfers without
+// any risk of them waiting on each other for buffers. A BufferPool is safe
+// for concurrent use.
+type BufferPool struct {
+	mu    sync.Mutex
+	max   int64
+	inUse int64
+	pools [64]sync.Pool
+}
+
+// Buffers is the pool shared by all backends and the sync engine. It has no
+// memory limit until SetMax is called.
+var Buffers = &BufferPool{}
+
+// SetMax sets the memory, in bytes, that buffers in use may hold before
+// TryGet starts failing. Zero means no limit.
+func (p *BufferPool) SetMax(max int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.max = max
+}
+
+// InUse returns the memory held by the buffers in use.
+func (p *BufferPool) InUse() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inUse
+}
+
+// sizeClass returns the log2 of the capacity of buffers holding size bytes.
+func sizeClass(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// Get returns a buffer of size bytes, whether or not the memory limit has
+// been reached. Use it for the buffers without which a transfer can't go on.
+// The buffer must be returned with Put.
+func (p *BufferPool) Get(size int) []byte {
+	c := sizeClass(size)
+	p.mu.Lock()
+	p.inUse += 1 << c
+	p.mu.Unlock()
+	return p.get(c, size)
+}
+
+// TryGet returns a buffer of size bytes, or nil if that would take the
+// memory in use above the limit. Use it for buffers that only speed up
+// transfers, like read-ahead buffers. The buffer must be returned with Put.
+func (p *BufferPool) TryGet(size int) []byte {
+	c := sizeClass(size)
+	p.mu.Lock()
+	if p.max > 0 && p.inUse+1<<c > p.max {
+		p.mu.Unlock()
+		return nil
+	}
+	p.inUse += 1 << c
+	p.mu.Unlock()
+	return p.get(c, size)
+}
+
+// get returns a buffer of class c, reusing a released one if possible.
+func (p *BufferPool) get(c int, size int) []byte {
+	if b, ok := p.pools[c].Get().(*[]byte); ok {
+		return (*b)[:size]
+	}
+	return make([]byte, size, 1<<c)
+}
+
+// Put returns buf, obtained from Get or TryGet, to the pool. The buffer must
+// not be used afterwards. Putting a nil buffer does nothing.
+func (p *BufferPool) Put(buf []byte) {
+	if buf == nil {
+		return
+	}
+	c := sizeClass(cap(buf))
+	p.mu.Lock()
+	p.inUse -= 1 << c
+	p.mu.Unlock()
+	buf = buf[:cap(buf)]
+	p.pools[c].Put(&buf)
+}
@@ -0,0 +1,428 @@
+package gdrivevfs
+
+// Google Drive appDataFolder abstractions for gsync
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+	gdp "github.com/marcopaganini/gdrive_path"
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// ID alias of the application data folder in Drive.
+	appDataFolderID = "appDataFolder"
+
+	// Mime type of Drive folders.
+	folderMimeType = "application/vnd.google-apps.folder"
+)
+
+// AppDataFileSystem represents a virtual filesystem in the hidden application
+// data folder (appDataFolder) of Google Drive. This folder is private to the
+// application and invisible in the Drive UI. GdrivePath only handles paths
+// starting at the Drive root, so this filesystem talks to the Drive API
+// directly.
+type AppDataFileSystem struct {
+	svc    *drive.Service
+	client *http.Client
+	log    *slog.Logger
+
+	// Cache of folder paths to Drive IDs.
+	mu      gosync.Mutex
+	folders map[string]string
+
+	// Options
+	optReadOnly bool
+}
+
+// NewAppDataFileSystem creates a new AppDataFileSystem object. The token in
+// cachefile must have been issued for a scope including drive.DriveAppdataScope.
+func NewAppDataFileSystem(clientID string, clientSecret string, code string, cachefile string) (*AppDataFileSystem, error) {
+	// GdrivePath takes care of the authorization dance and token caching.
+	_, err := gdp.NewGdrivePath(clientID, clientSecret, code, drive.DriveAppdataScope, cachefile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to initialize GdrivePath: %v", err)
+	}
+
+	afs := &AppDataFileSystem{
+		folders: map[string]string{"": appDataFolderID},
+		log:     vfs.DiscardLogger(),
+	}
+	afs.svc, afs.client, err = newDriveService(clientID, clientSecret, drive.DriveAppdataScope, cachefile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to initialize Drive service: %v", err)
+	}
+	return afs, nil
+}
+
+// checkWritable returns an error if the filesystem has been set read-only.
+func (afs *AppDataFileSystem) checkWritable(op string, fullpath string) error {
+	if afs.optReadOnly {
+		return fmt.Errorf("%s \"%s\": Google Drive is read-only", op, fullpath)
+	}
+	return nil
+}
+
+// listFolder returns all objects inside the folder with the given ID. If
+// title is not empty, only objects with that title are returned.
+func (afs *AppDataFileSystem) listFolder(id string, title string) ([]*drive.File, error) {
+	var ret []*drive.File
+
+	q := fmt.Sprintf("'%s' in parents and trashed = false", id)
+	if title != "" {
+		q += fmt.Sprintf(" and title = '%s'", strings.Replace(title, "'", "\\'", -1))
+	}
+
+	call := afs.svc.Files.List().Spaces("appDataFolder").Q(q)
+	for {
+		flist, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, flist.Items...)
+		if flist.NextPageToken == "" {
+			break
+		}
+		call = call.PageToken(flist.NextPageToken)
+	}
+	return ret, nil
+}
+
+// folderID returns the ID of the folder named dir, resolving and caching
+// each path component.
+func (afs *AppDataFileSystem) folderID(dir string) (string, error) {
+	afs.mu.Lock()
+	id, ok := afs.folders[dir]
+	afs.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	parent, name, _ := splitPath(dir)
+	parentID, err := afs.folderID(parent)
+	if err != nil {
+		return "", err
+	}
+	flist, err := afs.listFolder(parentID, name)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range flist {
+		if f.MimeType == folderMimeType {
+			afs.mu.Lock()
+			afs.folders[dir] = f.Id
+			afs.mu.Unlock()
+			afs.log.Debug("resolved appDataFolder folder", "path", dir, "id", f.Id)
+			return f.Id, nil
+		}
+	}
+	return "", fmt.Errorf("Folder \"%s\" not found in appDataFolder: %w", dir, vfs.ErrNotExist)
+}
+
+// stat returns the drive.File for fullpath, or nil if it does not exist.
+func (afs *AppDataFileSystem) stat(fullpath string) (*drive.File, error) {
+	dir, name, pathname := splitPath(fullpath)
+	if pathname == "" {
+		return afs.svc.Files.Get(appDataFolderID).Do()
+	}
+	// Files in missing folders don't exist either, but other errors
+	// (authentication, network) must not be mistaken for that.
+	parentID, err := afs.folderID(dir)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	flist, err := afs.listFolder(parentID, name)
+	if err != nil || len(flist) == 0 {
+		return nil, err
+	}
+	return flist[0], nil
+}
+
+// mustStat returns the drive.File for fullpath, or an error if it does not
+// exist.
+func (afs *AppDataFileSystem) mustStat(fullpath string) (*drive.File, error) {
+	driveFile, err := afs.stat(fullpath)
+	if err == nil && driveFile == nil {
+		err = fmt.Errorf("\"%s\" not found in appDataFolder: %w", fullpath, vfs.ErrNotExist)
+	}
+	return driveFile, err
+}
+
+// Capabilities returns the features supported by the application data folder.
+func (afs *AppDataFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		SetMtime:       true,
+		Checksum:       true,
+		ServerSideMove: true,
+		AtomicRename:   true,
+	}
+}
+
+// Delete permanently removes the object named 'fullpath'.
+func (afs *AppDataFileSystem) Delete(ctx context.Context, fullpath string) error {
+	if err := afs.checkWritable("Delete", fullpath); err != nil {
+		return err
+	}
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return err
+	}
+	afs.mu.Lock()
+	delete(afs.folders, strings.Trim(fullpath, "/"))
+	afs.mu.Unlock()
+	return afs.svc.Files.Delete(driveFile.Id).Do()
+}
+
+// FileExists returns true if a file/directory exists. False otherwise.
+func (afs *AppDataFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	driveFile, err := afs.stat(fullpath)
+	return driveFile != nil, err
+}
+
+// FileID returns the Drive file ID of the object named 'fullpath'.
+func (afs *AppDataFileSystem) FileID(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.Id, nil
+}
+
+// MD5 returns the MD5 checksum of fullpath as computed by Drive.
+func (afs *AppDataFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.Md5Checksum, nil
+}
+
+// MimeType returns the MIME type of fullpath, as kept by Drive.
+func (afs *AppDataFileSystem) MimeType(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.MimeType, nil
+}
+
+// Revision returns the ID of the current revision of the contents of
+// fullpath (its head revision ID).
+func (afs *AppDataFileSystem) Revision(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.HeadRevisionId, nil
+}
+
+// Mkdir creates a directory named 'path'
+func (afs *AppDataFileSystem) Mkdir(ctx context.Context, path string) error {
+	if err := afs.checkWritable("Mkdir", path); err != nil {
+		return err
+	}
+	dir, name, _ := splitPath(path)
+	parentID, err := afs.folderID(dir)
+	if err != nil {
+		return err
+	}
+	folder := &drive.File{
+		Title:    name,
+		MimeType: folderMimeType,
+		Parents:  []*drive.ParentReference{{Id: parentID}},
+	}
+	_, err = afs.svc.Files.Insert(folder).Do()
+	return err
+}
+
+// Move moves srcpath to dstpath on the server side.
+func (afs *AppDataFileSystem) Move(ctx context.Context, srcpath string, dstpath string) error {
+	if err := afs.checkWritable("Move", srcpath); err != nil {
+		return err
+	}
+	driveFile, err := afs.mustStat(srcpath)
+	if err != nil {
+		return err
+	}
+	srcdir, _, _ := splitPath(srcpath)
+	dstdir, dstname, _ := splitPath(dstpath)
+	oldParent, err := afs.folderID(srcdir)
+	if err != nil {
+		return err
+	}
+	newParent, err := afs.folderID(dstdir)
+	if err != nil {
+		return err
+	}
+
+	call := afs.svc.Files.Patch(driveFile.Id, &drive.File{Title: dstname})
+	if oldParent != newParent {
+		call = call.AddParents(newParent).RemoveParents(oldParent)
+	}
+	_, err = call.Do()
+	return err
+}
+
+// ReadFromFile returns an io.ReadCloser pointing to fullpath. The caller must
+// close the returned reader.
+func (afs *AppDataFileSystem) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", driveFile.DownloadUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := afs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unable to download \"%s\": %s", fullpath, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// SetMtime sets the 'modification time' of fullpath to mtime
+func (afs *AppDataFileSystem) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	if err := afs.checkWritable("SetMtime", fullpath); err != nil {
+		return err
+	}
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return err
+	}
+	f := &drive.File{ModifiedDate: mtime.UTC().Format(time.RFC3339Nano)}
+	_, err = afs.svc.Files.Patch(driveFile.Id, f).SetModifiedDate(true).Do()
+	return err
+}
+
+// SetReadOnly sets the 'read only' option. This will cause any operation that
+// modifies Google Drive to fail immediately with an error.
+func (afs *AppDataFileSystem) SetReadOnly(f bool) {
+	afs.optReadOnly = f
+}
+
+// SetLogger sets the logger used for diagnostic messages. By default,
+// messages are discarded.
+func (afs *AppDataFileSystem) SetLogger(l *slog.Logger) {
+	afs.log = l
+}
+
+// SetWriteInPlace is a no-op. Uploads to Drive always replace the file
+// contents atomically.
+func (afs *AppDataFileSystem) SetWriteInPlace(_ bool) {
+}
+
+// Stat returns information about fullpath. The appDataFolder itself is a
+// directory.
+func (afs *AppDataFileSystem) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	driveFile, err := afs.mustStat(fullpath)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return appDataFileInfo(fullpath, driveFile)
+}
+
+// appDataFileInfo returns the vfs.FileInfo for driveFile, found at fullpath.
+func appDataFileInfo(fullpath string, driveFile *drive.File) (vfs.FileInfo, error) {
+	mtime, err := gdp.ModifiedDate(driveFile)
+	if err != nil {
+		return vfs.FileInfo{Path: fullpath}, err
+	}
+	fi := vfs.FileInfo{
+		Path:  fullpath,
+		Size:  driveFile.FileSize,
+		Mtime: mtime,
+		Type:  vfs.TypeRegular,
+	}
+	if driveFile.MimeType == folderMimeType || driveFile.Id == appDataFolderID {
+		fi.Type = vfs.TypeDir
+	}
+	return fi, nil
+}
+
+// Walk calls walkFn for every file/directory under fullpath (but not fullpath
+// itself), in the same order as GdriveFileSystem.Walk.
+func (afs *AppDataFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	_, _, pathname := splitPath(fullpath)
+	id, err := afs.folderID(pathname)
+	if err != nil {
+		return err
+	}
+	return afs.walkDir(ctx, pathname, id, walkFn)
+}
+
+// walkDir recursively walks the folder dir with the given ID.
+func (afs *AppDataFileSystem) walkDir(ctx context.Context, dir string, id string, walkFn vfs.WalkFunc) error {
+	flist, err := afs.listFolder(id, "")
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: dir}, err)
+	}
+	sort.Sort(byTitle(flist))
+
+	for _, driveFile := range flist {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		fullpath := filepath.Join(dir, driveFile.Title)
+		fi, err := appDataFileInfo(fullpath, driveFile)
+		if err = walkFn(fi, err); err != nil {
+			return err
+		}
+		if driveFile.MimeType == folderMimeType {
+			if err = afs.walkDir(ctx, fullpath, driveFile.Id, walkFn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteToFile reads all data from reader and write to file fullpath,
+// replacing the contents of the file if it already exists.
+func (afs *AppDataFileSystem) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
+	if err := afs.checkWritable("WriteToFile", fullpath); err != nil {
+		return err
+	}
+	driveFile, err := afs.stat(fullpath)
+	if err != nil {
+		return err
+	}
+	if driveFile != nil {
+		_, err = afs.svc.Files.Update(driveFile.Id, &drive.File{}).Media(reader).Do()
+		return err
+	}
+
+	dir, name, _ := splitPath(fullpath)
+	parentID, err := afs.folderID(dir)
+	if err != nil {
+		return err
+	}
+	f := &drive.File{
+		Title:   name,
+		Parents: []*drive.ParentReference{{Id: parentID}},
+	}
+	_, err = afs.svc.Files.Insert(f).Media(reader).Do()
+	return err
+}
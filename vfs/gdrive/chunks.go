@@ -0,0 +1,142 @@
+package gdrivevfs
+
+// Chunk reader for uploads to Google Drive
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// SetUploadConcurrency sets the number of upload chunks held in memory at
+// once. Drive only accepts the chunks of a resumable upload in order, so with
+// more than one chunk the next chunks are read from the source while the
+// current chunk is being sent, instead of in between requests.
+func (gfs *GdriveFileSystem) SetUploadConcurrency(n int) {
+	gfs.uploadConcurrency = n
+}
+
+// uploadChunk is a chunk of data read from the source of an upload. Last is
+// set for the final chunk. Chunks not backed by a buffer of the chunkReader
+// are marked as copied.
+type uploadChunk struct {
+	data   []byte
+	last   bool
+	err    error
+	copied bool
+}
+
+// chunkReader reads the data to be uploaded in chunks of a fixed size. With
+// more than one buffer, chunks are read ahead by a separate goroutine, and
+// each buffer must be released once sent.
+type chunkReader struct {
+	r      io.Reader
+	buf    []byte
+	bufs   [][]byte
+	ch     chan uploadChunk
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// newChunkReader returns a chunkReader reading r in chunks of size bytes,
+// using up to nbufs buffers from the shared pool. Only the first buffer is
+// guaranteed, so fewer chunks are read ahead when the pool is at its limit.
+// The reader must be closed to return the buffers.
+func newChunkReader(r io.Reader, size int, nbufs int) *chunkReader {
+	cr := &chunkReader{r: r}
+	if nbufs <= 1 {
+		cr.buf = vfs.Buffers.Get(size)
+		return cr
+	}
+
+	cr.bufs = append(cr.bufs, vfs.Buffers.Get(size))
+	for ix := 1; ix < nbufs; ix++ {
+		buf := vfs.Buffers.TryGet(size)
+		if buf == nil {
+			break
+		}
+		cr.bufs = append(cr.bufs, buf)
+	}
+	cr.ch = make(chan uploadChunk, len(cr.bufs))
+	cr.free = make(chan []byte, len(cr.bufs))
+	cr.done = make(chan struct{})
+	cr.exited = make(chan struct{})
+	for _, buf := range cr.bufs {
+		cr.free <- buf
+	}
+	go cr.fill()
+	return cr
+}
+
+// read reads a single chunk into buf.
+func (cr *chunkReader) read(buf []byte) uploadChunk {
+	n, err := io.ReadFull(cr.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return uploadChunk{data: buf[:n], last: n < len(buf), err: err}
+}
+
+// fill reads chunks into free buffers until the end of the data, an error or
+// a call to close.
+func (cr *chunkReader) fill() {
+	defer close(cr.exited)
+	defer close(cr.ch)
+	for {
+		var buf []byte
+		select {
+		case buf = <-cr.free:
+		case <-cr.done:
+			return
+		}
+		c := cr.read(buf)
+		select {
+		case cr.ch <- c:
+		case <-cr.done:
+			return
+		}
+		if c.last || c.err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next chunk.
+func (cr *chunkReader) next() uploadChunk {
+	if cr.ch == nil {
+		return cr.read(cr.buf)
+	}
+	c, ok := <-cr.ch
+	if !ok {
+		return uploadChunk{err: fmt.Errorf("Read past the end of the upload")}
+	}
+	return c
+}
+
+// release returns the buffer of chunk c to the reader.
+func (cr *chunkReader) release(c uploadChunk) {
+	if cr.free != nil && !c.copied {
+		cr.free <- c.data[:cap(c.data)]
+	}
+}
+
+// close stops reading ahead, waits for the read in progress (if any) to
+// return and returns the buffers to the pool. The source reader is not used
+// once close returns. Chunks must not be used afterwards.
+func (cr *chunkReader) close() {
+	if cr.done == nil {
+		vfs.Buffers.Put(cr.buf)
+		return
+	}
+	close(cr.done)
+	<-cr.exited
+	for _, buf := range cr.bufs {
+		vfs.Buffers.Put(buf)
+	}
+}
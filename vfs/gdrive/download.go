@@ -0,0 +1,183 @@
+package gdrivevfs
+
+// Parallel ranged downloads for gsync.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// SetDownloadStreams sets the number of concurrent ranged requests used to
+// download a single large file. Files are split in parts of the buffer size
+// (see SetBufferSize), so each stream holds one part in memory. Values below
+// 2 disable parallel downloads.
+func (gfs *GdriveFileSystem) SetDownloadStreams(n int) {
+	gfs.downloadStreams = n
+}
+
+// downloadPart holds the data (or error) of a part of a file.
+type downloadPart struct {
+	data []byte
+	err  error
+}
+
+// rangeReader reassembles the parts of a file downloaded concurrently. Parts
+// are queued in order, and each one is fetched by its own goroutine into a
+// buffer from the shared pool.
+type rangeReader struct {
+	parts  chan chan downloadPart
+	ntaken int64 // Parts taken by Read (atomic)
+	taken  chan struct{}
+	buf    []byte
+	cur    []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		vfs.Buffers.Put(r.buf)
+		r.buf = nil
+		ch, ok := <-r.parts
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		// Wake up the queue, which may be waiting for a buffer.
+		atomic.AddInt64(&r.ntaken, 1)
+		select {
+		case r.taken <- struct{}{}:
+		default:
+		}
+		part := <-ch
+		r.buf, r.cur, r.err = part.data, part.data, part.err
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close aborts all downloads in progress. Their buffers go back to the pool
+// as the downloads finish.
+func (r *rangeReader) Close() error {
+	r.cancel()
+	go func() {
+		vfs.Buffers.Put(r.buf)
+		for ch := range r.parts {
+			part := <-ch
+			vfs.Buffers.Put(part.data)
+		}
+	}()
+	return nil
+}
+
+// partBuffer returns a buffer for part number n of the download r. Parts
+// ahead of the reader only get a buffer while the pool is below its limit, so
+// downloads slow down to one part at a time (instead of waiting on each
+// other) when the pool is full.
+func (r *rangeReader) partBuffer(ctx context.Context, n int64, size int) ([]byte, error) {
+	for {
+		if buf := vfs.Buffers.TryGet(size); buf != nil {
+			return buf, nil
+		}
+		if atomic.LoadInt64(&r.ntaken) >= n {
+			return vfs.Buffers.Get(size), nil
+		}
+		select {
+		case <-r.taken:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// useParallelDownload returns true if driveFile is large enough to be
+// downloaded with multiple concurrent requests.
+func (gfs *GdriveFileSystem) useParallelDownload(driveFile *drive.File) bool {
+	return gfs.downloadStreams > 1 && driveFile.DownloadUrl != "" && driveFile.FileSize > int64(gfs.chunkSize)
+}
+
+// parallelDownload returns an io.ReadCloser with the contents of driveFile,
+// fetched in parts with up to downloadStreams concurrent ranged requests.
+func (gfs *GdriveFileSystem) parallelDownload(ctx context.Context, fullpath string, driveFile *drive.File) (io.ReadCloser, error) {
+	gfs.log.Debug("parallel download", "path", fullpath, "size", driveFile.FileSize, "streams", gfs.downloadStreams)
+	ctx, cancel := context.WithCancel(ctx)
+	r := &rangeReader{
+		parts:  make(chan chan downloadPart, gfs.downloadStreams-1),
+		taken:  make(chan struct{}, 1),
+		cancel: cancel,
+	}
+
+	// Queue all parts in order. The size of the queue limits the number of
+	// parts being fetched (and held in memory) at any time.
+	go func() {
+		defer close(r.parts)
+		size, partSize := driveFile.FileSize, int64(gfs.chunkSize)
+		for off := int64(0); off < size; off += partSize {
+			end := off + partSize
+			if end > size {
+				end = size
+			}
+			ch := make(chan downloadPart, 1)
+			select {
+			case r.parts <- ch:
+			case <-ctx.Done():
+				return
+			}
+			buf, err := r.partBuffer(ctx, off/partSize, int(end-off))
+			if err != nil {
+				ch <- downloadPart{nil, err}
+				return
+			}
+			go func(off int64, buf []byte) {
+				if err := gfs.downloadRange(ctx, fullpath, driveFile.DownloadUrl, off, buf); err != nil {
+					vfs.Buffers.Put(buf)
+					ch <- downloadPart{nil, err}
+					return
+				}
+				ch <- downloadPart{buf, nil}
+			}(off, buf)
+		}
+	}()
+	return r, nil
+}
+
+// downloadRange reads len(data) bytes, starting at offset start, of the
+// file at url into data.
+//
+// Return:
+//   error
+func (gfs *GdriveFileSystem) downloadRange(ctx context.Context, fullpath string, url string, start int64, data []byte) error {
+	end := start + int64(len(data))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Unable to download \"%s\" (bytes %d-%d): %s", fullpath, start, end-1, resp.Status)
+	}
+
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return fmt.Errorf("Unable to download \"%s\" (bytes %d-%d): %v", fullpath, start, end-1, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gdrivevfs
+
+// Export of native Google files (Docs, Sheets, etc)
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+	gdp "github.com/marcopaganini/gdrive_path"
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Prefix of the mime types of native Google files.
+const nativeMimePrefix = "application/vnd.google-apps."
+
+// Native Google file types that can't be downloaded or exported in any
+// format, and the name used for them in messages.
+var unexportableTypes = map[string]string{
+	nativeMimePrefix + "form":        "form",
+	nativeMimePrefix + "site":        "site",
+	nativeMimePrefix + "map":         "map",
+	nativeMimePrefix + "fusiontable": "fusion table",
+	nativeMimePrefix + "shortcut":    "shortcut",
+}
+
+// Prefix of the mime types of shortcuts to third-party applications.
+const thirdPartyMimePrefix = nativeMimePrefix + "drive-sdk."
+
+// UnexportableKind returns a short description of the kind of native Google
+// file with the given mime type (as in "form"), if files of that type can't
+// be downloaded or exported, or an empty string otherwise.
+func UnexportableKind(mimeType string) string {
+	if strings.HasPrefix(mimeType, thirdPartyMimePrefix) {
+		return "third-party shortcut"
+	}
+	return unexportableTypes[mimeType]
+}
+
+// SetSkipFunc sets a function called by Walk for each native Google file
+// skipped because it can't be downloaded or exported (see UnexportableKind),
+// with the path and mime type of the file.
+func (gfs *GdriveFileSystem) SetSkipFunc(fn func(fullpath string, mimeType string)) {
+	gfs.skipFn = fn
+}
+
+// ExportFormat describes how native Google files of a given mime type are
+// downloaded: MimeType is the format requested from Drive, and Extension
+// (without the leading dot) is appended to the file title.
+type ExportFormat struct {
+	MimeType  string
+	Extension string
+}
+
+// SetExportFormats sets the mapping from native Google mime types (e.g.
+// "application/vnd.google-apps.spreadsheet") to export formats. Native files
+// with a mime type not present in the map are skipped by Walk, since they
+// cannot be downloaded.
+func (gfs *GdriveFileSystem) SetExportFormats(formats map[string]ExportFormat) {
+	gfs.exportFormats = formats
+}
+
+// isNative returns true if driveFile is a native Google file (other than a
+// folder) that has to be exported in order to be downloaded.
+func isNative(driveFile *drive.File) bool {
+	return strings.HasPrefix(driveFile.MimeType, nativeMimePrefix) && !gdp.IsDir(driveFile)
+}
+
+// exportFormat returns the export format for driveFile and true, or false if
+// driveFile is not a native file with a configured export format.
+func (gfs *GdriveFileSystem) exportFormat(driveFile *drive.File) (ExportFormat, bool) {
+	if !isNative(driveFile) {
+		return ExportFormat{}, false
+	}
+	f, ok := gfs.exportFormats[driveFile.MimeType]
+	return f, ok
+}
+
+// exportName returns the name under which driveFile is presented by this VFS
+// (the title plus the export extension, for native files), or an empty string
+// if the file cannot be downloaded.
+func (gfs *GdriveFileSystem) exportName(driveFile *drive.File) string {
+	if !isNative(driveFile) {
+		return driveFile.Title
+	}
+	f, ok := gfs.exportFormat(driveFile)
+	if !ok {
+		return ""
+	}
+	return driveFile.Title + "." + f.Extension
+}
+
+// stat returns the drive.File for fullpath. Native files are found by the
+// name with the export extension appended (see exportName). Errors for
+// objects not found match vfs.ErrNotExist. Results (including objects not
+// found) are kept for a short time in the stat cache.
+func (gfs *GdriveFileSystem) stat(fullpath string) (*drive.File, error) {
+	if e, ok := gfs.cache.get(fullpath); ok {
+		return e.driveFile, e.err
+	}
+	driveFile, err := gfs.statExport(fullpath)
+	if err != nil && gdp.IsObjectNotFound(err) {
+		err = fmt.Errorf("%v: %w", err, vfs.ErrNotExist)
+		gfs.cache.put(fullpath, nil, err)
+		return nil, err
+	}
+	if err == nil {
+		gfs.cache.put(fullpath, driveFile, nil)
+	}
+	return driveFile, err
+}
+
+// statExport returns the drive.File for fullpath, trying the name without
+// the export extension if needed.
+func (gfs *GdriveFileSystem) statExport(fullpath string) (*drive.File, error) {
+	driveFile, err := gfs.g.Stat(fullpath)
+	if err == nil || !gdp.IsObjectNotFound(err) || len(gfs.exportFormats) == 0 {
+		return driveFile, err
+	}
+
+	// Try again without the extension, and make sure we found a native
+	// file exported with that extension.
+	ext := path.Ext(fullpath)
+	if ext == "" {
+		return nil, err
+	}
+	nf, nerr := gfs.g.Stat(strings.TrimSuffix(fullpath, ext))
+	if nerr != nil {
+		return nil, err
+	}
+	if f, ok := gfs.exportFormat(nf); !ok || "."+f.Extension != ext {
+		return nil, err
+	}
+	return nf, nil
+}
+
+// export returns an io.ReadCloser with the contents of the native file
+// driveFile, converted to the configured export format.
+func (gfs *GdriveFileSystem) export(ctx context.Context, fullpath string, driveFile *drive.File) (io.ReadCloser, error) {
+	f, _ := gfs.exportFormat(driveFile)
+	gfs.log.Debug("exporting native file", "path", fullpath, "mimeType", f.MimeType)
+	url, ok := driveFile.ExportLinks[f.MimeType]
+	if !ok {
+		return nil, fmt.Errorf("Unable to export \"%s\": format \"%s\" not available", fullpath, f.MimeType)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Unable to export \"%s\": %s", fullpath, resp.Status)
+	}
+	return resp.Body, nil
+}
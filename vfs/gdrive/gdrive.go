@@ -7,38 +7,76 @@ package gdrivevfs
 // (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"path/filepath"
 	"sort"
 	"strings"
-
 	"time"
 
+	"code.google.com/p/goauth2/oauth"
 	"code.google.com/p/google-api-go-client/drive/v2"
 	gdp "github.com/marcopaganini/gdrive_path"
+	"github.com/marcopaganini/gsync/vfs"
 )
 
+// Drive API v3 files endpoint, for fields not writable in v2.
+const filesV3URL = "https://www.googleapis.com/drive/v3/files"
+
 // GdriveFileSystem represents a virtual filesystem in Google Drive.
 type GdriveFileSystem struct {
 	g            *gdp.Gdrive
+	svc          *drive.Service
+	client       *http.Client
 	clientID     string
 	clientSecret string
 	cachefile    string
 	code         string
-	fileSlice    []string
+	scope        string
+
+	log *slog.Logger
+
+	// Directory holding resumable upload sessions, and upload chunk size.
+	sessionDir string
+	chunkSize  int
+
+	// Concurrent requests used to download large files, and number of
+	// chunks prepared ahead for uploads.
+	downloadStreams   int
+	uploadConcurrency int
+
+	// Export formats for native Google files, by mime type, and the
+	// function called for native files that can't be downloaded.
+	exportFormats map[string]ExportFormat
+	skipFn        func(string, string)
+
+	// Recent stat results, by path.
+	cache *statCache
 
 	// Options
+	optReadOnly     bool
 	optWriteInPlace bool
 }
 
-// NewGdriveFileSystem creates a new GdriveFileSystem object
-func NewGdriveFileSystem(clientID string, clientSecret string, code string, cachefile string) (*GdriveFileSystem, error) {
+// NewGdriveFileSystem creates a new GdriveFileSystem object. Scope is the OAuth
+// scope to request (e.g. drive.DriveScope). With restricted scopes like
+// drive.DriveFileScope, only objects created by this application are visible.
+func NewGdriveFileSystem(clientID string, clientSecret string, code string, scope string, cachefile string) (*GdriveFileSystem, error) {
 	gfs := &GdriveFileSystem{
 		clientID:     clientID,
 		clientSecret: clientSecret,
 		code:         code,
-		cachefile:    cachefile}
+		scope:        scope,
+		cachefile:    cachefile,
+		chunkSize:    defaultChunkSize,
+		cache:        newStatCache(),
+		log:          vfs.DiscardLogger()}
 
 	err := gfs.init()
 	return gfs, err
@@ -49,128 +87,482 @@ func (gfs *GdriveFileSystem) init() error {
 	var err error
 
 	// Initialize GdrivePath
-	gfs.g, err = gdp.NewGdrivePath(gfs.clientID, gfs.clientSecret, gfs.code, drive.DriveScope, gfs.cachefile)
+	gfs.g, err = gdp.NewGdrivePath(gfs.clientID, gfs.clientSecret, gfs.code, gfs.scope, gfs.cachefile)
 	if err != nil {
 		return fmt.Errorf("Unable to initialize GdrivePath: %v", err)
 	}
 
+	// Raw Drive service for operations not offered by GdrivePath. It
+	// shares the token cache populated by GdrivePath above.
+	gfs.svc, gfs.client, err = newDriveService(gfs.clientID, gfs.clientSecret, gfs.scope, gfs.cachefile)
+	if err != nil {
+		return fmt.Errorf("Unable to initialize Drive service: %v", err)
+	}
+
 	return nil
 }
 
-// FileExists returns true if a file/directory exists. False otherwise.
-func (gfs *GdriveFileSystem) FileExists(fullpath string) (bool, error) {
-	_, err := gfs.g.Stat(fullpath)
-	// Only return error on a real error condition. For file not found, return
-	// false, nil. This makes it easier for the caller to test for real errors.
+// checkWritable returns an error if the filesystem has been set read-only.
+func (gfs *GdriveFileSystem) checkWritable(op string, fullpath string) error {
+	if gfs.optReadOnly {
+		return fmt.Errorf("%s \"%s\": Google Drive is read-only", op, fullpath)
+	}
+	return nil
+}
+
+// newDriveService returns a drive.Service and the underlying http.Client,
+// authenticated with the token stored in cachefile.
+func newDriveService(clientID string, clientSecret string, scope string, cachefile string) (*drive.Service, *http.Client, error) {
+	config := &oauth.Config{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		AuthURL:      "https://accounts.google.com/o/oauth2/auth",
+		TokenURL:     "https://accounts.google.com/o/oauth2/token",
+		TokenCache:   oauth.CacheFile(cachefile),
+	}
+	token, err := config.TokenCache.Token()
 	if err != nil {
-		if gdp.IsObjectNotFound(err) {
-			return false, nil
-		}
-		return false, err
+		return nil, nil, err
 	}
-	return true, nil
+	transport := &oauth.Transport{Config: config, Token: token}
+	client := transport.Client()
+	svc, err := drive.New(client)
+	return svc, client, err
 }
 
-// FileTree returns a slice containing all files/directories under fullpath.
-func (gfs *GdriveFileSystem) FileTree(fullpath string) ([]string, error) {
-	// sanitize
-	_, _, pathname := splitPath(fullpath)
+// Btime returns the creation time of fullpath in Drive, or the zero time if
+// unknown.
+func (gfs *GdriveFileSystem) Btime(ctx context.Context, fullpath string) (time.Time, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if driveFile.CreatedDate == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, driveFile.CreatedDate)
+}
 
-	// We iterate over all objects inside 'pathname'. If they're a
-	// directory, we append them to dirs. The loop below will finish
-	// when no more directories to be processed exist.
+// SetBtime sets the creation time of fullpath. The creation time is read-only
+// in version 2 of the Drive API, so this uses the equivalent field (createdTime)
+// of version 3.
+func (gfs *GdriveFileSystem) SetBtime(ctx context.Context, fullpath string, btime time.Time) error {
+	if err := gfs.checkWritable("SetBtime", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(map[string]string{"createdTime": btime.UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PATCH", filesV3URL+"/"+driveFile.Id, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to set creation time of \"%s\": %s", fullpath, resp.Status)
+	}
+	return nil
+}
 
-	dirs := []string{pathname}
-	idx := 0
+// Capabilities returns the features supported by Google Drive. Uploads only
+// replace the existing file when complete, unless writing in place.
+func (gfs *GdriveFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		SetMtime:       true,
+		Checksum:       true,
+		ServerSideCopy: true,
+		ServerSideMove: true,
+		AtomicRename:   !gfs.optWriteInPlace,
+		ReadDir:        true,
+	}
+}
 
-	for idx < len(dirs) {
-		dir := dirs[idx]
+// Copy copies srcpath to dstpath on the server side. No data is transferred.
+// An existing dstpath is moved to the trash once the copy is complete.
+func (gfs *GdriveFileSystem) Copy(ctx context.Context, srcpath string, dstpath string) error {
+	if err := gfs.checkWritable("Copy", dstpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(dstpath)
+	driveFile, err := gfs.stat(srcpath)
+	if err != nil {
+		return err
+	}
+	dstdir, dstname, _ := splitPath(dstpath)
+	if dstname == "" {
+		return fmt.Errorf("Invalid destination path \"%s\"", dstpath)
+	}
+	parent, err := gfs.g.Stat(dstdir)
+	if err != nil {
+		return err
+	}
+	old, err := gfs.stat(dstpath)
+	if err != nil && !errors.Is(err, vfs.ErrNotExist) {
+		return err
+	}
 
-		flist, err := gfs.g.ListDir(dir, "")
-		if err != nil {
-			return nil, err
-		}
+	dst := &drive.File{Title: dstname, Parents: []*drive.ParentReference{{Id: parent.Id}}}
+	if _, err = gfs.svc.Files.Copy(driveFile.Id, dst).Do(); err != nil {
+		return err
+	}
+	if old != nil {
+		_, err = gfs.svc.Files.Trash(old.Id).Do()
+	}
+	return err
+}
 
-		for _, driveFile := range flist {
-			fullpath := filepath.Join(dir, driveFile.Title)
-			gfs.fileSlice = append(gfs.fileSlice, fullpath)
-			// Append to the list of dirs to process if directory
-			if gdp.IsDir(driveFile) {
-				dirs = append(dirs, fullpath)
-			}
+// Delete moves the object named 'fullpath' to the Drive trash. Trashed
+// objects can still be recovered using the Drive UI.
+func (gfs *GdriveFileSystem) Delete(ctx context.Context, fullpath string) error {
+	if err := gfs.checkWritable("Delete", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return err
+	}
+	_, err = gfs.svc.Files.Trash(driveFile.Id).Do()
+	return err
+}
+
+// IsEmptyDir returns true if the folder fullpath holds no objects (outside
+// the trash), including those skipped by Walk and ReadDir.
+func (gfs *GdriveFileSystem) IsEmptyDir(ctx context.Context, fullpath string) (bool, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return false, err
+	}
+	q := fmt.Sprintf("'%s' in parents and trashed = false", driveFile.Id)
+	flist, err := gfs.svc.Files.List().Q(q).MaxResults(1).Do()
+	if err != nil {
+		return false, err
+	}
+	return len(flist.Items) == 0, nil
+}
+
+// FileExists returns true if a file/directory exists. False otherwise.
+func (gfs *GdriveFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	_, err := gfs.stat(fullpath)
+	// Only return error on a real error condition. For file not found, return
+	// false, nil. This makes it easier for the caller to test for real errors.
+	if err != nil {
+		if errors.Is(err, vfs.ErrNotExist) {
+			return false, nil
 		}
-		idx++
+		return false, err
 	}
+	return true, nil
+}
 
-	// Create sorted list so dirs appear before files inside them.
-	sort.Strings(gfs.fileSlice)
-	return gfs.fileSlice, nil
+// FileID returns the Drive file ID of the object named 'fullpath'.
+func (gfs *GdriveFileSystem) FileID(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	return driveFile.Id, nil
+}
 
+// MD5 returns the MD5 checksum of fullpath as computed by Drive.
+func (gfs *GdriveFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	// Exported files have no checksum.
+	return driveFile.Md5Checksum, nil
 }
 
-// IsDir returns true if fullpath is a directory, false if it isn't or if the
-// file doesn't exist.
-func (gfs *GdriveFileSystem) IsDir(fullpath string) (bool, error) {
-	driveFile, err := gfs.g.Stat(fullpath)
+// MimeType returns the MIME type of fullpath, as kept by Drive. Native Google
+// files have their native type, not the type of the format they are exported
+// to.
+func (gfs *GdriveFileSystem) MimeType(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := gfs.stat(fullpath)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	return gdp.IsDir(driveFile), nil
+	return driveFile.MimeType, nil
 }
 
-// IsRegular returns true if fullpath is a regular file, false if it isn't or
-// if the file doesn't exist.
-func (gfs *GdriveFileSystem) IsRegular(fullpath string) (bool, error) {
-	isdir, err := gfs.IsDir(fullpath)
-	return !isdir, err
+// Revision returns the ID of the current revision of the contents of
+// fullpath (its head revision ID).
+func (gfs *GdriveFileSystem) Revision(ctx context.Context, fullpath string) (string, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	// Google Docs have no head revision.
+	return driveFile.HeadRevisionId, nil
 }
 
 // Mkdir creates a directory named 'path'
-func (gfs *GdriveFileSystem) Mkdir(path string) error {
+func (gfs *GdriveFileSystem) Mkdir(ctx context.Context, path string) error {
+	if err := gfs.checkWritable("Mkdir", path); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(path)
 	_, err := gfs.g.Mkdir(path)
 	return err
 }
 
-// Mtime returns the local file's Modified Time (mtime) truncated to the
-// nearest second (no nano information).
-func (gfs *GdriveFileSystem) Mtime(fullpath string) (time.Time, error) {
-	driveFile, err := gfs.g.Stat(fullpath)
+// Move moves srcpath to dstpath on the server side by changing the parent
+// folder and title of the existing object. No data is transferred.
+func (gfs *GdriveFileSystem) Move(ctx context.Context, srcpath string, dstpath string) error {
+	if err := gfs.checkWritable("Move", srcpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(dstpath)
+	defer gfs.cache.forget(srcpath)
+	driveFile, err := gfs.stat(srcpath)
 	if err != nil {
-		return time.Time{}, err
+		return err
+	}
+	dstdir, dstname, _ := splitPath(dstpath)
+	if dstname == "" {
+		return fmt.Errorf("Invalid destination path \"%s\"", dstpath)
 	}
-	return gdp.ModifiedDate(driveFile)
+	parent, err := gfs.g.Stat(dstdir)
+	if err != nil {
+		return err
+	}
+
+	call := gfs.svc.Files.Patch(driveFile.Id, &drive.File{Title: dstname})
+
+	// Only touch the parents if the object is changing folders.
+	var oldParents []string
+	sameParent := false
+	for _, p := range driveFile.Parents {
+		if p.Id == parent.Id {
+			sameParent = true
+			break
+		}
+		oldParents = append(oldParents, p.Id)
+	}
+	if !sameParent {
+		call = call.AddParents(parent.Id).RemoveParents(strings.Join(oldParents, ","))
+	}
+	_, err = call.Do()
+	return err
 }
 
-// ReadFromFile returns an io.Reader pointing to fullpath in the local filesystem.
-func (gfs *GdriveFileSystem) ReadFromFile(fullpath string) (io.Reader, error) {
+// ReadFromFile returns an io.ReadCloser pointing to fullpath in Google Drive.
+// Native Google files are exported in the configured format. The caller must
+// close the returned reader.
+func (gfs *GdriveFileSystem) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	if kind := UnexportableKind(driveFile.MimeType); kind != "" {
+		return nil, fmt.Errorf("Unable to download \"%s\": Google %s files can't be downloaded or exported", fullpath, kind)
+	}
+	if isNative(driveFile) {
+		return gfs.export(ctx, fullpath, driveFile)
+	}
+	if gfs.useParallelDownload(driveFile) {
+		return gfs.parallelDownload(ctx, fullpath, driveFile)
+	}
 	return gfs.g.Download(fullpath)
 }
 
 // SetMtime sets the 'modification time' of fullpath to mtime
-func (gfs *GdriveFileSystem) SetMtime(fullpath string, mtime time.Time) error {
+func (gfs *GdriveFileSystem) SetMtime(ctx context.Context, fullpath string, mtime time.Time) error {
+	if err := gfs.checkWritable("SetMtime", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
 	_, err := gfs.g.SetModifiedDate(fullpath, mtime)
 	return err
 }
 
+// SetReadOnly sets the 'read only' option. This will cause any operation that
+// modifies Google Drive to fail immediately with an error.
+func (gfs *GdriveFileSystem) SetReadOnly(f bool) {
+	gfs.optReadOnly = f
+}
+
+// SetLogger sets the logger used for diagnostic messages. By default,
+// messages are discarded.
+func (gfs *GdriveFileSystem) SetLogger(l *slog.Logger) {
+	gfs.log = l
+}
+
 // SetWriteInPlace sets the 'write in place' option. This will cause write operations
 // to not use an intermediate temporary file and an atomic rename.
 func (gfs *GdriveFileSystem) SetWriteInPlace(f bool) {
 	gfs.optWriteInPlace = f
 }
 
-// Size returns the size of the file pointed by fullpath, in bytes.
-func (gfs *GdriveFileSystem) Size(fullpath string) (int64, error) {
-	driveFile, err := gfs.g.Stat(fullpath)
+// Stat returns information about fullpath. Everything that is not a folder
+// is considered a regular file. The size of native Google files is not known
+// before they are exported, and is returned as -1.
+func (gfs *GdriveFileSystem) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	driveFile, err := gfs.stat(fullpath)
 	if err != nil {
-		return 0, err
+		return vfs.FileInfo{}, err
 	}
-	return driveFile.FileSize, nil
+	return fileInfo(fullpath, driveFile)
 }
 
-// WriteToFile reads all data from reader and write to file fullpath.
-func (gfs *GdriveFileSystem) WriteToFile(fullpath string, reader io.Reader) error {
+// fileInfo returns the vfs.FileInfo for driveFile, found at fullpath.
+func fileInfo(fullpath string, driveFile *drive.File) (vfs.FileInfo, error) {
+	mtime, err := gdp.ModifiedDate(driveFile)
+	if err != nil {
+		return vfs.FileInfo{Path: fullpath}, err
+	}
+	fi := vfs.FileInfo{
+		Path:  fullpath,
+		Size:  driveFile.FileSize,
+		Mtime: mtime,
+		Type:  vfs.TypeRegular,
+	}
+	if gdp.IsDir(driveFile) {
+		fi.Type = vfs.TypeDir
+	}
+	if isNative(driveFile) {
+		fi.Size = -1
+	}
+	return fi, nil
+}
+
+// Walk calls walkFn for every file/directory under fullpath (but not fullpath
+// itself). Entries inside a folder are visited in lexical order, and folders
+// are visited before their contents. Folders are only listed when the walk
+// reaches them, so entries are produced incrementally. Folders that can't be
+// listed are passed to walkFn along with the error. If walkFn returns an
+// error, the walk stops and Walk returns that error.
+func (gfs *GdriveFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	// sanitize
+	_, _, pathname := splitPath(fullpath)
+	return gfs.walkDir(ctx, pathname, walkFn)
+}
+
+// walkDir recursively walks the folder dir, calling walkFn for each entry.
+func (gfs *GdriveFileSystem) walkDir(ctx context.Context, dir string, walkFn vfs.WalkFunc) error {
+	flist, err := gfs.g.ListDir(dir, "")
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: dir}, err)
+	}
+	sort.Sort(byTitle(flist))
+
+	for _, driveFile := range flist {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name := gfs.listedName(dir, driveFile, true)
+		if name == "" {
+			continue
+		}
+		fullpath := filepath.Join(dir, name)
+		gfs.cache.put(fullpath, driveFile, nil)
+		fi, err := fileInfo(fullpath, driveFile)
+		if err = walkFn(fi, err); err != nil {
+			return err
+		}
+		if gdp.IsDir(driveFile) {
+			if err = gfs.walkDir(ctx, fullpath, walkFn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadDir returns information about the files and folders in fullpath, sorted
+// by name. Google files that can't be downloaded are skipped, as in Walk, but
+// not reported.
+func (gfs *GdriveFileSystem) ReadDir(ctx context.Context, fullpath string) ([]vfs.FileInfo, error) {
+	_, _, dir := splitPath(fullpath)
+	flist, err := gfs.g.ListDir(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byTitle(flist))
+
+	var ret []vfs.FileInfo
+	for _, driveFile := range flist {
+		name := gfs.listedName(dir, driveFile, false)
+		if name == "" {
+			continue
+		}
+		fullpath := filepath.Join(dir, name)
+		gfs.cache.put(fullpath, driveFile, nil)
+		fi, err := fileInfo(fullpath, driveFile)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fi)
+	}
+	return ret, nil
+}
+
+// listedName returns the name under which driveFile, in the folder dir, is
+// listed: its title, or the name of its export. Native files that can't be
+// downloaded at all, and those without an export format, are skipped with an
+// empty name, and logged (and passed to the skip function) if report is set.
+func (gfs *GdriveFileSystem) listedName(dir string, driveFile *drive.File, report bool) string {
+	if kind := UnexportableKind(driveFile.MimeType); kind != "" {
+		if report {
+			skipped := filepath.Join(dir, driveFile.Title)
+			gfs.log.Info("skipping Google file that can't be downloaded", "path", skipped, "kind", kind, "mimeType", driveFile.MimeType)
+			if gfs.skipFn != nil {
+				gfs.skipFn(skipped, driveFile.MimeType)
+			}
+		}
+		return ""
+	}
+	name := gfs.exportName(driveFile)
+	if name == "" && report {
+		gfs.log.Debug("skipping native file without export format", "path", filepath.Join(dir, driveFile.Title), "mimeType", driveFile.MimeType)
+	}
+	return name
+}
+
+// byTitle sorts a slice of drive.File objects by title.
+type byTitle []*drive.File
+
+func (b byTitle) Len() int           { return len(b) }
+func (b byTitle) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTitle) Less(i, j int) bool { return b[i].Title < b[j].Title }
+
+// WriteToFile reads all data from reader and write to file fullpath. Data is
+// read in chunks of the configured buffer size (see SetBufferSize), and files
+// larger than one chunk are streamed to Drive one chunk at a time, so memory
+// use is bounded regardless of the file size.
+func (gfs *GdriveFileSystem) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
 	var err error
 
+	if err = gfs.checkWritable("WriteToFile", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
+
+	head := vfs.Buffers.Get(gfs.chunkSize)
+	defer vfs.Buffers.Put(head)
+	n, err := io.ReadFull(reader, head)
+	switch err {
+	case nil:
+		// More data may follow.
+		return gfs.writeStreaming(ctx, fullpath, head, reader)
+	case io.EOF, io.ErrUnexpectedEOF:
+		reader = bytes.NewReader(head[:n])
+	default:
+		return err
+	}
+
 	if gfs.optWriteInPlace {
 		_, err = gfs.g.InsertInPlace(fullpath, reader)
 	} else {
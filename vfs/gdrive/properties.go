@@ -0,0 +1,63 @@
+package gdrivevfs
+
+// Custom file properties
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"strings"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+)
+
+const (
+	// Prefix of the keys of the custom properties holding gsync metadata.
+	propertyPrefix = "gsync_"
+
+	// Private properties are only visible to the application that set them.
+	propertyVisibility = "PRIVATE"
+)
+
+// Metadata returns the metadata stored in the custom properties of fullpath by
+// SetMetadata, or an empty map if there's none.
+func (gfs *GdriveFileSystem) Metadata(ctx context.Context, fullpath string) (map[string]string, error) {
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string)
+	for _, p := range driveFile.Properties {
+		if p.Visibility == propertyVisibility && strings.HasPrefix(p.Key, propertyPrefix) {
+			meta[strings.TrimPrefix(p.Key, propertyPrefix)] = p.Value
+		}
+	}
+	return meta, nil
+}
+
+// SetMetadata stores meta (like mode bits and ownership of the original file)
+// as private custom properties of fullpath, so it can be restored later. The
+// modification date of the file is kept.
+func (gfs *GdriveFileSystem) SetMetadata(ctx context.Context, fullpath string, meta map[string]string) error {
+	if err := gfs.checkWritable("SetMetadata", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
+	if len(meta) == 0 {
+		return nil
+	}
+	driveFile, err := gfs.stat(fullpath)
+	if err != nil {
+		return err
+	}
+
+	var props []*drive.Property
+	for k, v := range meta {
+		props = append(props, &drive.Property{Key: propertyPrefix + k, Value: v, Visibility: propertyVisibility})
+	}
+	f := &drive.File{Properties: props, ModifiedDate: driveFile.ModifiedDate}
+	_, err = gfs.svc.Files.Patch(driveFile.Id, f).SetModifiedDate(driveFile.ModifiedDate != "").Do()
+	return err
+}
@@ -0,0 +1,386 @@
+package gdrivevfs
+
+// Resumable uploads to Google Drive
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+	gdp "github.com/marcopaganini/gdrive_path"
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+const (
+	// Base URL for uploads.
+	uploadURL = "https://www.googleapis.com/upload/drive/v2/files"
+
+	// Default size of each chunk sent in a resumable upload (see
+	// SetBufferSize). Files smaller than this are uploaded in a single
+	// request.
+	defaultChunkSize = 8 * 1024 * 1024
+
+	// Chunk sizes must be a multiple of this.
+	chunkGranularity = 256 * 1024
+
+	// HTTP status used by Drive to indicate an incomplete resumable upload.
+	statusResumeIncomplete = 308
+)
+
+// uploadSession is the state of a resumable upload. Sessions for files of
+// known size are saved in the session directory (see SetUploadSessionDir) and
+// reused if the same file (same destination, size and mtime) is uploaded again
+// before the session expires. A negative size means the size is not known
+// until the last chunk is read.
+type uploadSession struct {
+	URI    string    `json:"uri"`
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	Offset int64     `json:"offset"`
+}
+
+// SetBufferSize sets the size of the chunks used for uploads, which bounds the
+// memory used by each transfer. The size is rounded up to a multiple of
+// 256KiB.
+func (gfs *GdriveFileSystem) SetBufferSize(size int) {
+	if size < chunkGranularity {
+		size = chunkGranularity
+	}
+	gfs.chunkSize = (size + chunkGranularity - 1) / chunkGranularity * chunkGranularity
+}
+
+// SetUploadSessionDir sets the directory where resumable upload sessions are
+// saved. An empty string disables resumable uploads.
+func (gfs *GdriveFileSystem) SetUploadSessionDir(dir string) {
+	gfs.sessionDir = dir
+}
+
+// sessionFile returns the name of the file holding the session for uploads
+// to fullpath.
+func (gfs *GdriveFileSystem) sessionFile(fullpath string) string {
+	_, _, pathname := splitPath(fullpath)
+	sum := sha1.Sum([]byte(gfs.cachefile + "\x00" + pathname))
+	return filepath.Join(gfs.sessionDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadSession returns the saved session for fullpath, or nil if there's no
+// saved session or it was created for a different version of the file.
+func (gfs *GdriveFileSystem) loadSession(fullpath string, size int64, mtime time.Time) *uploadSession {
+	j, err := ioutil.ReadFile(gfs.sessionFile(fullpath))
+	if err != nil {
+		return nil
+	}
+	s := &uploadSession{}
+	if json.Unmarshal(j, s) != nil || s.Size != size || !s.Mtime.Equal(mtime) {
+		return nil
+	}
+	return s
+}
+
+// saveSession saves the session s atomically.
+func (gfs *GdriveFileSystem) saveSession(s *uploadSession) error {
+	if err := os.MkdirAll(gfs.sessionDir, 0700); err != nil {
+		return err
+	}
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	fname := gfs.sessionFile(s.Path)
+	tmp := fname + ".tmp"
+	if err = ioutil.WriteFile(tmp, j, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// removeSession removes the saved session for fullpath.
+func (gfs *GdriveFileSystem) removeSession(fullpath string) {
+	os.Remove(gfs.sessionFile(fullpath))
+}
+
+// startSession creates a new resumable upload session for fullpath. If the
+// file already exists, its contents are replaced. A negative size means the
+// size is not known, and a zero mtime leaves the modification time alone.
+func (gfs *GdriveFileSystem) startSession(ctx context.Context, fullpath string, size int64, mtime time.Time) (*uploadSession, error) {
+	dir, name, _ := splitPath(fullpath)
+
+	params := "?uploadType=resumable"
+	meta := &drive.File{Title: name}
+	if !mtime.IsZero() {
+		params += "&setModifiedDate=true"
+		meta.ModifiedDate = mtime.UTC().Format(time.RFC3339Nano)
+	}
+	method, url := "POST", uploadURL+params
+
+	driveFile, err := gfs.g.Stat(fullpath)
+	switch {
+	case err == nil:
+		method, url = "PUT", uploadURL+"/"+driveFile.Id+params
+	case gdp.IsObjectNotFound(err):
+		parent, err := gfs.g.Stat(dir)
+		if err != nil {
+			return nil, err
+		}
+		meta.Parents = []*drive.ParentReference{{Id: parent.Id}}
+	default:
+		return nil, err
+	}
+
+	j, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to start upload of \"%s\": %s", fullpath, resp.Status)
+	}
+	uri := resp.Header.Get("Location")
+	if uri == "" {
+		return nil, fmt.Errorf("Unable to start upload of \"%s\": no session URI returned", fullpath)
+	}
+	return &uploadSession{URI: uri, Path: fullpath, Size: size, Mtime: mtime}, nil
+}
+
+// rangeEnd returns the offset following the last byte in the Range header of
+// an incomplete upload response (zero if no bytes were received).
+func rangeEnd(resp *http.Response) (int64, error) {
+	r := resp.Header.Get("Range")
+	if r == "" {
+		return 0, nil
+	}
+	idx := strings.LastIndex(r, "-")
+	if idx < 0 {
+		return 0, fmt.Errorf("Invalid Range header \"%s\"", r)
+	}
+	last, err := strconv.ParseInt(r[idx+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid Range header \"%s\"", r)
+	}
+	return last + 1, nil
+}
+
+// sessionOffset asks Drive how many bytes of the session s have been
+// received. It returns true if the upload is already complete, and an error
+// if the session has expired.
+func (gfs *GdriveFileSystem) sessionOffset(ctx context.Context, s *uploadSession) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.URI, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", s.Size))
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return s.Size, true, nil
+	case statusResumeIncomplete:
+		offset, err := rangeEnd(resp)
+		return offset, false, err
+	}
+	return 0, false, fmt.Errorf("Upload session for \"%s\" no longer valid: %s", s.Path, resp.Status)
+}
+
+// sendChunk sends chunk, starting at offset, to the session s. If the size of
+// the upload is not known, last indicates that this is the last chunk. It
+// returns the offset of the next byte expected by Drive and true if the upload
+// is complete.
+func (gfs *GdriveFileSystem) sendChunk(ctx context.Context, s *uploadSession, chunk []byte, offset int64, last bool) (int64, bool, error) {
+	total := "*"
+	switch {
+	case s.Size >= 0:
+		total = strconv.FormatInt(s.Size, 10)
+	case last:
+		total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+	}
+	crange := fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, total)
+	if len(chunk) == 0 {
+		// Only used to finish uploads of unknown size.
+		crange = "bytes */" + total
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.URI, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, false, err
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Range", crange)
+	resp, err := gfs.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return offset + int64(len(chunk)), true, nil
+	case statusResumeIncomplete:
+		next, err := rangeEnd(resp)
+		return next, false, err
+	}
+	return 0, false, fmt.Errorf("Upload of \"%s\" failed at offset %d: %s", s.Path, offset, resp.Status)
+}
+
+// upload sends the data in reader to the session s, starting at offset, in
+// chunks of the configured size. This bounds the memory used by the transfer
+// to one chunk per buffer (see SetUploadConcurrency). Progress is reported
+// as Drive acknowledges each chunk. If persist is set, the
+// session is saved before each chunk, and removed if reading the source fails.
+func (gfs *GdriveFileSystem) upload(ctx context.Context, s *uploadSession, reader io.Reader, offset int64, persist bool) error {
+	cr := newChunkReader(reader, gfs.chunkSize, gfs.uploadConcurrency)
+	defer cr.close()
+
+	var pending *uploadChunk
+	for {
+		if persist {
+			s.Offset = offset
+			if err := gfs.saveSession(s); err != nil {
+				return err
+			}
+		}
+		var c uploadChunk
+		if pending != nil {
+			c, pending = *pending, nil
+		} else {
+			c = cr.next()
+		}
+		if c.err != nil {
+			// The data already sent came from a source that failed (for
+			// instance, on a checksum mismatch) and can't be trusted, so a
+			// retry must not resume this session.
+			if persist {
+				gfs.removeSession(s.Path)
+			}
+			return c.err
+		}
+		n := len(c.data)
+		if n == 0 && s.Size >= 0 {
+			return fmt.Errorf("Upload of \"%s\": source ended at offset %d of %d", s.Path, offset, s.Size)
+		}
+		next, complete, err := gfs.sendChunk(ctx, s, c.data, offset, c.last)
+		if err != nil {
+			return err
+		}
+		// Data received by Drive counts as progress of the transfer (see
+		// vfs.WithProgress). Resent data is only counted once.
+		if complete {
+			vfs.Progress(ctx, n)
+			return nil
+		}
+		if next > offset {
+			vfs.Progress(ctx, int(next-offset))
+		}
+		if c.last && s.Size < 0 && next == offset+int64(n) {
+			return fmt.Errorf("Upload of \"%s\" not finished by Drive at offset %d", s.Path, next)
+		}
+		// Drive may accept less than the full chunk. Resend the remainder
+		// as the next chunk.
+		if next < offset+int64(n) {
+			rest := append([]byte(nil), c.data[next-offset:]...)
+			pending = &uploadChunk{data: rest, last: c.last, copied: true}
+		}
+		cr.release(c)
+		offset = next
+	}
+}
+
+// WriteToFileResumable reads size bytes from reader and writes them to
+// fullpath using a resumable upload, setting the modification time of the
+// file to mtime. The upload session is saved in the session directory before
+// each chunk, so an interrupted upload of the same file (same size and mtime)
+// continues where it stopped, even after a restart. Data already received by
+// Drive is read from reader and discarded. Small files, and all files when no
+// session directory is set, are written with WriteToFile.
+func (gfs *GdriveFileSystem) WriteToFileResumable(ctx context.Context, fullpath string, reader io.Reader, size int64, mtime time.Time) error {
+	if err := gfs.checkWritable("WriteToFile", fullpath); err != nil {
+		return err
+	}
+	defer gfs.cache.forget(fullpath)
+	if gfs.sessionDir == "" || size < int64(gfs.chunkSize) {
+		if err := gfs.WriteToFile(ctx, fullpath, reader); err != nil {
+			return err
+		}
+		return gfs.SetMtime(ctx, fullpath, mtime)
+	}
+
+	var (
+		offset int64
+		done   bool
+		err    error
+	)
+
+	s := gfs.loadSession(fullpath, size, mtime)
+	if s != nil {
+		offset, done, err = gfs.sessionOffset(ctx, s)
+		if err != nil {
+			gfs.log.Info("discarding upload session", "path", fullpath, "error", err)
+			gfs.removeSession(fullpath)
+			s = nil
+		} else {
+			gfs.log.Info("resuming upload", "path", fullpath, "offset", offset, "size", size)
+		}
+	}
+	if s == nil {
+		offset = 0
+		if s, err = gfs.startSession(ctx, fullpath, size, mtime); err != nil {
+			return err
+		}
+	}
+
+	if !done {
+		// Skip the data Drive already has.
+		if _, err = io.CopyN(ioutil.Discard, reader, offset); err != nil {
+			return err
+		}
+		if err = gfs.upload(ctx, s, reader, offset, true); err != nil {
+			return err
+		}
+	}
+	gfs.removeSession(fullpath)
+	return nil
+}
+
+// writeStreaming writes the data in reader to fullpath with a resumable
+// upload of unknown size, reading and sending one chunk at a time. Head holds
+// data already read from reader.
+func (gfs *GdriveFileSystem) writeStreaming(ctx context.Context, fullpath string, head []byte, reader io.Reader) error {
+	s, err := gfs.startSession(ctx, fullpath, -1, time.Time{})
+	if err != nil {
+		return err
+	}
+	return gfs.upload(ctx, s, io.MultiReader(bytes.NewReader(head), reader), 0, false)
+}
@@ -0,0 +1,147 @@
+package gdrivevfs
+
+// Short-lived cache of Drive stat results for gsync.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/google-api-go-client/drive/v2"
+)
+
+// statCacheTTL is how long a cached stat result stays valid. Entries are
+// also dropped as soon as gsync modifies the path, so this only bounds how
+// long changes made by others on Drive can go unnoticed.
+const statCacheTTL = time.Minute
+
+// statCacheEntry holds the result of one stat: the drive.File found, or the
+// error returned when the object does not exist.
+type statCacheEntry struct {
+	driveFile *drive.File
+	err       error
+	expires   time.Time
+}
+
+// statCache caches the results of stat by path. The same path is usually
+// looked up several times while syncing a single file (existence, type,
+// size, mtime), and every lookup costs one or more Drive API calls. Paths
+// are also indexed by their parent folder (in children), including folders
+// not cached themselves, so everything under a path can be found without
+// scanning the whole cache. A nil statCache caches nothing.
+type statCache struct {
+	mu       sync.Mutex
+	entries  map[string]statCacheEntry
+	children map[string]map[string]bool
+}
+
+// newStatCache returns an empty statCache.
+func newStatCache() *statCache {
+	return &statCache{
+		entries:  map[string]statCacheEntry{},
+		children: map[string]map[string]bool{},
+	}
+}
+
+// cacheKey returns the normalized form of fullpath used as the cache key.
+func cacheKey(fullpath string) string {
+	_, _, key := splitPath(fullpath)
+	return key
+}
+
+// parentKey returns the cache key of the parent folder of key.
+func parentKey(key string) string {
+	if ix := strings.LastIndex(key, "/"); ix >= 0 {
+		return key[:ix]
+	}
+	return ""
+}
+
+// get returns the cached result for fullpath, if present and not expired.
+//
+// Return:
+//   statCacheEntry, bool (true if found in the cache)
+func (c *statCache) get(fullpath string) (statCacheEntry, bool) {
+	if c == nil {
+		return statCacheEntry{}, false
+	}
+	key := cacheKey(fullpath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return statCacheEntry{}, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return statCacheEntry{}, false
+	}
+	return e, true
+}
+
+// put stores the result of a stat on fullpath.
+func (c *statCache) put(fullpath string, driveFile *drive.File, err error) {
+	if c == nil {
+		return
+	}
+	key := cacheKey(fullpath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = statCacheEntry{
+		driveFile: driveFile,
+		err:       err,
+		expires:   time.Now().Add(statCacheTTL),
+	}
+	for k := key; k != ""; k = parentKey(k) {
+		parent := parentKey(k)
+		if c.children[parent][k] {
+			break
+		}
+		if c.children[parent] == nil {
+			c.children[parent] = map[string]bool{}
+		}
+		c.children[parent][k] = true
+	}
+}
+
+// forget removes fullpath, everything under it and all its parent folders
+// from the cache. Parents are included since writes may create them. It must
+// be called whenever an object is created, modified, moved or removed.
+func (c *statCache) forget(fullpath string) {
+	if c == nil {
+		return
+	}
+	key := cacheKey(fullpath)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.forgetTree(key)
+	for k := key; k != ""; {
+		k = parentKey(k)
+		delete(c.entries, k)
+	}
+}
+
+// forgetTree removes key and everything under it from the cache. The caller
+// must hold c.mu.
+func (c *statCache) forgetTree(key string) {
+	delete(c.entries, key)
+	for child := range c.children[key] {
+		c.forgetTree(child)
+	}
+	delete(c.children, key)
+	if key != "" {
+		parent := parentKey(key)
+		delete(c.children[parent], key)
+		if len(c.children[parent]) == 0 {
+			delete(c.children, parent)
+		}
+	}
+}
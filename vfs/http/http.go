@@ -0,0 +1,547 @@
+// Package httpvfs implements a read-only gsync VFS over HTTP(S), so published
+// files and directory listings can be used as a sync source.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+package httpvfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Maximum size of index pages.
+const maxIndexSize = 16 << 20
+
+// hrefRegex matches the targets of links in index pages.
+var hrefRegex = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']+)["']`)
+
+// object holds what is known about a file or directory: its URL, the
+// information returned by Stat and, for files, the MD5 checksum sent by the
+// server (if any).
+type object struct {
+	url *url.URL
+	fi  vfs.FileInfo
+	md5 string
+}
+
+// HTTPFileSystem represents a read-only tree of files published over HTTP.
+// The tree is either a directory listing (an index page, as generated by most
+// web servers, whose links to files and subdirectories are followed) or a
+// fixed list of URLs, all at the top level. Paths are relative to the top of
+// the tree, which is always a directory.
+type HTTPFileSystem struct {
+	client *http.Client
+	log    *slog.Logger
+
+	// URL of the top index page, or nil for fixed lists.
+	base *url.URL
+
+	// Objects found so far, by path. Fixed lists are known from the start.
+	mu      gosync.Mutex
+	objects map[string]*object
+	listed  map[string]bool
+}
+
+// NewHTTPFileSystem creates a new HTTPFileSystem for rawurl. URLs ending in a
+// slash are directory listings. Any other URL is a single file, found at the
+// top of the tree under its base name.
+func NewHTTPFileSystem(rawurl string) (*HTTPFileSystem, error) {
+	u, err := parseURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		hfs := newHTTPFileSystem()
+		hfs.base = u
+		return hfs, nil
+	}
+	return NewHTTPListFileSystem(map[string]string{path.Base(u.Path): rawurl})
+}
+
+// NewHTTPListFileSystem creates a new HTTPFileSystem holding the URLs in
+// files, by name. Names are relative paths, using forward slashes.
+func NewHTTPListFileSystem(files map[string]string) (*HTTPFileSystem, error) {
+	hfs := newHTTPFileSystem()
+	for name, rawurl := range files {
+		u, err := parseURL(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		name = cleanPath(name)
+		if name == "/" {
+			return nil, fmt.Errorf("Invalid name for \"%s\"", rawurl)
+		}
+		hfs.objects[name] = &object{url: u}
+	}
+	// Directories holding the files.
+	now := time.Now()
+	for name := range hfs.objects {
+		for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+			if o, ok := hfs.objects[dir]; ok && o.url != nil {
+				return nil, fmt.Errorf("Name \"%s\" used for both a file and a directory", dir)
+			}
+			hfs.objects[dir] = &object{fi: vfs.FileInfo{Path: dir, Type: vfs.TypeDir, Mtime: now}}
+		}
+	}
+	return hfs, nil
+}
+
+// ReadManifest reads a list of URLs from r, one per line, optionally followed
+// by whitespace and the name of the file (which may include directories).
+// The name defaults to the base name of the URL. Empty lines and lines
+// starting with "#" are ignored.
+//
+// Return:
+//   map[string]string: URLs by name
+//   error
+func ReadManifest(r io.Reader) (map[string]string, error) {
+	files := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rawurl, name := fields[0], ""
+		switch len(fields) {
+		case 1:
+			u, err := parseURL(rawurl)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", n, err)
+			}
+			name = path.Base(u.Path)
+		case 2:
+			name = fields[1]
+		default:
+			return nil, fmt.Errorf("Line %d: expected a URL and an optional name", n)
+		}
+		name = cleanPath(name)
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("Line %d: duplicate name \"%s\"", n, name)
+		}
+		files[name] = rawurl
+	}
+	return files, scanner.Err()
+}
+
+func newHTTPFileSystem() *HTTPFileSystem {
+	return &HTTPFileSystem{
+		client:  &http.Client{},
+		log:     vfs.DiscardLogger(),
+		objects: map[string]*object{},
+		listed:  map[string]bool{},
+	}
+}
+
+// parseURL parses rawurl, which must be an HTTP or HTTPS URL.
+func parseURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL \"%s\": %v", rawurl, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid URL \"%s\": must be an http or https URL", rawurl)
+	}
+	return u, nil
+}
+
+// cleanPath returns the canonical form of pathname: absolute, using forward
+// slashes and without trailing slashes.
+func cleanPath(pathname string) string {
+	return path.Clean("/" + pathname)
+}
+
+// statusError is returned for responses with an error status. Missing
+// objects match vfs.ErrNotExist.
+type statusError struct {
+	method string
+	url    string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s \"%s\": %s", e.method, e.url, e.status)
+}
+
+func (e *statusError) Unwrap() error {
+	if e.code == http.StatusNotFound || e.code == http.StatusGone {
+		return vfs.ErrNotExist
+	}
+	return nil
+}
+
+// get sends a request for u and returns the response. Error statuses are
+// returned as a *statusError.
+func (hfs *HTTPFileSystem) get(ctx context.Context, method string, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	hfs.log.Debug("request", "method", method, "url", u.String())
+	resp, err := hfs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, &statusError{method: method, url: u.String(), code: resp.StatusCode, status: resp.Status}
+}
+
+// head returns the headers of u. Servers that do not support HEAD requests
+// get a GET request instead, whose body is discarded.
+func (hfs *HTTPFileSystem) head(ctx context.Context, u *url.URL) (*http.Response, error) {
+	resp, err := hfs.get(ctx, "HEAD", u)
+	var serr *statusError
+	if errors.As(err, &serr) && (serr.code == http.StatusMethodNotAllowed || serr.code == http.StatusNotImplemented) {
+		resp, err = hfs.get(ctx, "GET", u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// lastModified returns the time in the Last-Modified header of resp. The
+// Unix epoch is used if the header is missing or invalid, so copies of
+// these files keep comparing equal on later runs.
+func lastModified(resp *http.Response) time.Time {
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Unix(0, 0)
+	}
+	return t
+}
+
+// responseMD5 returns the MD5 checksum of the body of resp, as a hex string,
+// if the server sent it (in the Content-MD5, Digest or X-Goog-Hash headers).
+func responseMD5(resp *http.Response) string {
+	var values []string
+	if v := resp.Header.Get("Content-MD5"); v != "" {
+		values = append(values, v)
+	}
+	for _, h := range []string{"Digest", "X-Goog-Hash"} {
+		for _, v := range resp.Header.Values(h) {
+			for _, d := range strings.Split(v, ",") {
+				if kv := strings.SplitN(strings.TrimSpace(d), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "md5") {
+					values = append(values, kv[1])
+				}
+			}
+		}
+	}
+	for _, v := range values {
+		if sum, err := base64.StdEncoding.DecodeString(v); err == nil && len(sum) == 16 {
+			return hex.EncodeToString(sum)
+		}
+	}
+	return ""
+}
+
+// statFile fills in the information about the file object o at pathname,
+// if not known yet.
+func (hfs *HTTPFileSystem) statFile(ctx context.Context, pathname string, o *object) error {
+	hfs.mu.Lock()
+	known := o.fi.Path != ""
+	hfs.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	resp, err := hfs.head(ctx, o.url)
+	if err != nil {
+		return err
+	}
+	size := resp.ContentLength
+	if size < 0 || resp.Header.Get("Content-Encoding") != "" {
+		size = -1
+	}
+
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	o.fi = vfs.FileInfo{Path: pathname, Size: size, Mtime: lastModified(resp), Type: vfs.TypeRegular}
+	o.md5 = responseMD5(resp)
+	return nil
+}
+
+// list fetches the index page of the directory dir, adding the files and
+// subdirectories linked from it to the list of objects. Only links to
+// objects directly inside the directory are considered, so links to parent
+// directories, sorting options and other sites are ignored.
+func (hfs *HTTPFileSystem) list(ctx context.Context, dir string) error {
+	hfs.mu.Lock()
+	done := hfs.listed[dir] || hfs.base == nil
+	hfs.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	u := hfs.dirURL(dir)
+	resp, err := hfs.get(ctx, "GET", u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexSize))
+	if err != nil {
+		return err
+	}
+
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	hfs.objects[dir] = &object{url: u, fi: vfs.FileInfo{Path: dir, Mtime: lastModified(resp), Type: vfs.TypeDir}}
+	if resp.Header.Get("Last-Modified") == "" {
+		// Without a date, use the time of the listing.
+		hfs.objects[dir].fi.Mtime = time.Now()
+	}
+	for _, m := range hrefRegex.FindAllSubmatch(page, -1) {
+		ref, err := url.Parse(string(m[1]))
+		if err != nil || ref.RawQuery != "" {
+			continue
+		}
+		link := u.ResolveReference(ref)
+		if link.Scheme != u.Scheme || link.Host != u.Host || !strings.HasPrefix(link.Path, u.Path) {
+			continue
+		}
+		name := strings.TrimPrefix(link.Path, u.Path)
+		isDir := strings.HasSuffix(name, "/")
+		name = strings.TrimSuffix(name, "/")
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			continue
+		}
+		pathname := path.Join(dir, name)
+		if _, ok := hfs.objects[pathname]; ok {
+			continue
+		}
+		link.Fragment = ""
+		o := &object{url: link}
+		if isDir {
+			o.fi = vfs.FileInfo{Path: pathname, Type: vfs.TypeDir}
+		}
+		hfs.objects[pathname] = o
+	}
+	hfs.listed[dir] = true
+	return nil
+}
+
+// dirURL returns the URL of the index page of dir.
+func (hfs *HTTPFileSystem) dirURL(dir string) *url.URL {
+	if dir == "/" {
+		return hfs.base
+	}
+	rel := &url.URL{Path: strings.TrimPrefix(dir, "/") + "/"}
+	return hfs.base.ResolveReference(rel)
+}
+
+// lookup returns the object for pathname, listing its parent directories as
+// needed.
+func (hfs *HTTPFileSystem) lookup(ctx context.Context, pathname string) (*object, error) {
+	if pathname != "/" {
+		if _, err := hfs.lookup(ctx, path.Dir(pathname)); err != nil {
+			return nil, err
+		}
+		if err := hfs.list(ctx, path.Dir(pathname)); err != nil {
+			return nil, err
+		}
+	}
+
+	hfs.mu.Lock()
+	o, ok := hfs.objects[pathname]
+	hfs.mu.Unlock()
+	switch {
+	case ok:
+		return o, nil
+	case pathname == "/" && hfs.base == nil:
+		return &object{fi: vfs.FileInfo{Path: "/", Type: vfs.TypeDir, Mtime: time.Now()}}, nil
+	case pathname == "/":
+		return &object{url: hfs.base, fi: vfs.FileInfo{Path: "/", Type: vfs.TypeDir}}, nil
+	}
+	return nil, fmt.Errorf("HTTP \"%s\": %w", pathname, vfs.ErrNotExist)
+}
+
+// readOnly returns the error for operations that would modify the tree.
+func readOnly(op string, fullpath string) error {
+	return fmt.Errorf("%s \"%s\": HTTP sources are read-only", op, fullpath)
+}
+
+// Capabilities returns the features supported by HTTP sources. Checksums
+// are only available if the server sends them.
+func (hfs *HTTPFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{Checksum: true}
+}
+
+// Delete always fails, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) Delete(_ context.Context, fullpath string) error {
+	return readOnly("Delete", fullpath)
+}
+
+// FileExists returns true if fullpath exists.
+func (hfs *HTTPFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	_, err := hfs.Stat(ctx, fullpath)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MD5 returns the MD5 checksum of fullpath, as a hex string, if the server
+// sends it. Otherwise, an empty string is returned.
+func (hfs *HTTPFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	pathname := cleanPath(fullpath)
+	o, err := hfs.lookup(ctx, pathname)
+	if err != nil {
+		return "", err
+	}
+	if o.fi.IsDir() {
+		return "", nil
+	}
+	if err = hfs.statFile(ctx, pathname, o); err != nil {
+		return "", err
+	}
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	return o.md5, nil
+}
+
+// Mkdir always fails, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) Mkdir(_ context.Context, fullpath string) error {
+	return readOnly("Mkdir", fullpath)
+}
+
+// Move always fails, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) Move(_ context.Context, srcpath string, _ string) error {
+	return readOnly("Move", srcpath)
+}
+
+// ReadFromFile returns an io.ReadCloser with the contents of fullpath. The
+// caller must close it.
+func (hfs *HTTPFileSystem) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	o, err := hfs.lookup(ctx, cleanPath(fullpath))
+	if err != nil {
+		return nil, err
+	}
+	if o.fi.IsDir() {
+		return nil, fmt.Errorf("Unable to read \"%s\": is a directory", fullpath)
+	}
+	resp, err := hfs.get(ctx, "GET", o.url)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// SetLogger sets the logger used for debugging messages.
+func (hfs *HTTPFileSystem) SetLogger(l *slog.Logger) {
+	hfs.log = l
+}
+
+// SetMtime always fails, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) SetMtime(_ context.Context, fullpath string, _ time.Time) error {
+	return readOnly("SetMtime", fullpath)
+}
+
+// SetWriteInPlace does nothing, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) SetWriteInPlace(bool) {
+}
+
+// Stat returns information about fullpath. The size of files is -1 if the
+// server does not send it (or compresses the data), and the modification time
+// comes from the Last-Modified header (the Unix epoch if missing).
+func (hfs *HTTPFileSystem) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	pathname := cleanPath(fullpath)
+	o, err := hfs.lookup(ctx, pathname)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	if o.fi.IsDir() {
+		// Listing the directory gives its modification time.
+		err = hfs.list(ctx, pathname)
+	} else {
+		err = hfs.statFile(ctx, pathname, o)
+	}
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	hfs.mu.Lock()
+	defer hfs.mu.Unlock()
+	if o.fi.IsDir() {
+		o = hfs.objects[pathname]
+	}
+	if o == nil {
+		o = &object{fi: vfs.FileInfo{Type: vfs.TypeDir, Mtime: time.Now()}}
+	}
+	fi := o.fi
+	fi.Path = fullpath
+	return fi, nil
+}
+
+// Walk calls walkFn for every file and directory under fullpath (but not
+// fullpath itself). Entries inside a directory are visited in lexical order,
+// and directories are visited before their contents. Directories that can't
+// be listed and files that can't be reached are passed to walkFn along with
+// the error. If walkFn returns an error, the walk stops and Walk returns that
+// error.
+func (hfs *HTTPFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	dir := cleanPath(fullpath)
+	if err := hfs.list(ctx, dir); err != nil {
+		return walkFn(vfs.FileInfo{Path: fullpath}, err)
+	}
+
+	hfs.mu.Lock()
+	var names []string
+	for pathname := range hfs.objects {
+		if pathname != dir && path.Dir(pathname) == dir {
+			names = append(names, pathname)
+		}
+	}
+	hfs.mu.Unlock()
+	sort.Strings(names)
+
+	for _, pathname := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := path.Join(fullpath, path.Base(pathname))
+		fi, err := hfs.Stat(ctx, pathname)
+		fi.Path = p
+		if err != nil {
+			fi = vfs.FileInfo{Path: p}
+		}
+		if err = walkFn(fi, err); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err = hfs.Walk(ctx, p, walkFn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteToFile always fails, since HTTP sources are read-only.
+func (hfs *HTTPFileSystem) WriteToFile(_ context.Context, fullpath string, _ io.Reader) error {
+	return readOnly("WriteToFile", fullpath)
+}
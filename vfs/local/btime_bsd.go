@@ -0,0 +1,36 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Btime returns the creation (birth) time of fullpath.
+func (fs *LocalFileSystem) Btime(_ context.Context, fullpath string) (time.Time, error) {
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return time.Unix(st.Birthtimespec.Unix()), nil
+}
+
+// SetBtime sets the creation (birth) time of fullpath. There's no direct way
+// to do this, but setting the modification time to a time before the birth
+// time moves the birth time back as well. This changes the modification time
+// of the file, so SetMtime must be called after SetBtime.
+func (fs *LocalFileSystem) SetBtime(_ context.Context, fullpath string, btime time.Time) error {
+	return os.Chtimes(fullpath, time.Now(), btime)
+}
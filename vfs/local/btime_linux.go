@@ -0,0 +1,38 @@
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Btime returns the creation (birth) time of fullpath, or the zero time if the
+// filesystem does not record it. Linux only reports birth times through
+// statx(2), on kernels and filesystems that support it.
+func (fs *LocalFileSystem) Btime(_ context.Context, fullpath string) (time.Time, error) {
+	var stx unix.Statx_t
+
+	err := unix.Statx(unix.AT_FDCWD, fullpath, 0, unix.STATX_BTIME, &stx)
+	if err != nil {
+		if err == unix.ENOSYS {
+			return time.Time{}, nil
+		}
+		return time.Time{}, &os.PathError{Op: "statx", Path: fullpath, Err: err}
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), nil
+}
+
+// SetBtime does nothing, since Linux has no way to change the birth time of
+// a file.
+func (fs *LocalFileSystem) SetBtime(_ context.Context, _ string, _ time.Time) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+// +build !linux,!darwin,!freebsd,!netbsd,!windows
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"time"
+)
+
+// Btime always returns the zero time, since creation times are not supported
+// on this platform.
+func (fs *LocalFileSystem) Btime(_ context.Context, _ string) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+// SetBtime does nothing, since creation times are not supported on this
+// platform.
+func (fs *LocalFileSystem) SetBtime(_ context.Context, _ string, _ time.Time) error {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Btime returns the creation time of fullpath.
+func (fs *LocalFileSystem) Btime(_ context.Context, fullpath string) (time.Time, error) {
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	attr, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, attr.CreationTime.Nanoseconds()), nil
+}
+
+// SetBtime sets the creation time of fullpath.
+func (fs *LocalFileSystem) SetBtime(_ context.Context, fullpath string, btime time.Time) error {
+	p, err := syscall.UTF16PtrFromString(fullpath)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return &os.PathError{Op: "SetBtime", Path: fullpath, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+
+	ctime := syscall.NsecToFiletime(btime.UnixNano())
+	if err = syscall.SetFileTime(h, &ctime, nil, nil); err != nil {
+		return &os.PathError{Op: "SetBtime", Path: fullpath, Err: err}
+	}
+	return nil
+}
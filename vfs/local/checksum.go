@@ -0,0 +1,108 @@
+package localvfs
+
+// MD5 checksums of local files.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HashKey identifies the contents of a local file for checksum caching. A
+// file whose absolute path, size, modification time and inode number are the
+// same as when its checksum was computed is assumed to be unchanged.
+type HashKey struct {
+	Path  string
+	Size  int64
+	Mtime time.Time
+	Inode uint64
+}
+
+// HashCache stores the checksums of local files, so they don't need to be
+// computed again. Implementations must be safe for concurrent use.
+type HashCache interface {
+	// Lookup returns the checksum stored for key, and true if found.
+	Lookup(key HashKey) (string, bool)
+
+	// Store records the checksum of the file identified by key.
+	Store(key HashKey, sum string)
+}
+
+// SetChecksum enables MD5 checksums. Computing a checksum requires reading
+// the whole file, so checksums are only returned (and the Checksum capability
+// set) when enabled. Checksums are cached in the HashCache, if set.
+func (fs *LocalFileSystem) SetChecksum(f bool) {
+	fs.optChecksum = f
+}
+
+// SetHashCache sets the cache used to store checksums of local files.
+func (fs *LocalFileSystem) SetHashCache(c HashCache) {
+	fs.hashCache = c
+}
+
+// MD5 returns the MD5 checksum of fullpath, as a hex string. An empty string
+// is returned if checksums are not enabled (see SetChecksum) or fullpath is
+// not a regular file.
+func (fs *LocalFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	if !fs.optChecksum {
+		return "", nil
+	}
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil
+	}
+	abspath, err := filepath.Abs(fullpath)
+	if err != nil {
+		return "", err
+	}
+	key := HashKey{Path: abspath, Size: fi.Size(), Mtime: fi.ModTime(), Inode: inode(fi)}
+	if fs.hashCache != nil {
+		if sum, ok := fs.hashCache.Lookup(key); ok {
+			return sum, nil
+		}
+	}
+
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err = io.Copy(h, &ctxReader{ctx: ctx, r: f}); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	fs.log.Debug("computed checksum", "path", fullpath, "md5", sum)
+
+	// Files modified while being read are not cached.
+	if fs.hashCache != nil {
+		if after, err := f.Stat(); err == nil && after.Size() == key.Size && after.ModTime().Equal(key.Mtime) {
+			fs.hashCache.Store(key, sum)
+		}
+	}
+	return sum, nil
+}
+
+// ctxReader stops reading from r when ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceID returns the ID of the device holding the file described by fi, and
+// true if the ID is available.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// canChown returns true if the process is allowed to change the ownership of
+// files to arbitrary users.
+func canChown() bool {
+	return os.Geteuid() == 0
+}
+
+// owner returns the user and group IDs of the owner of the file described by
+// fi, and true if they are available.
+func owner(fi os.FileInfo) (uint32, uint32, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
+
+// inode returns the inode number of the file described by fi, or zero if not
+// available.
+func inode(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(st.Ino)
+}
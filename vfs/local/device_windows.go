@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"os"
+)
+
+// deviceID is not supported on Windows. Walks never stop at filesystem
+// boundaries.
+func deviceID(_ os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// canChown returns false, since ownership is not supported on Windows.
+func canChown() bool {
+	return false
+}
+
+// owner is not supported on Windows.
+func owner(_ os.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
+
+// inode is not supported on Windows.
+func inode(_ os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,32 @@
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace returns the space available to the current user, in bytes, in
+// the filesystem holding fullpath, or -1 if not supported on this platform.
+// Paths that don't exist yet are looked up in their closest existing parent
+// directory.
+func (fs *LocalFileSystem) FreeSpace(_ context.Context, fullpath string) (int64, error) {
+	dir := fullpath
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return 0, err
+		}
+		dir = parent
+	}
+	return freeSpace(dir)
+}
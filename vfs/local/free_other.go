@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+// freeSpace always returns -1, since the free space is not known on this
+// platform.
+func freeSpace(_ string) (int64, error) {
+	return -1, nil
+}
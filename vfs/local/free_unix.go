@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the space available to unprivileged users in the
+// filesystem holding the existing path name.
+func freeSpace(name string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: name, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -7,126 +7,278 @@ package localvfs
 // (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"sort"
+	"sync"
 	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
 )
 
+// Default size of the buffer used to copy data into files.
+const defaultBufferSize = 32 * 1024
+
 // LocalFileSystem holds state on an instance of LocalFileSystem.
 type LocalFileSystem struct {
-	optWriteInPlace bool
+	log        *slog.Logger
+	bufferSize int
+	hashCache  HashCache
+
+	// Owner translation (see SetIDMaps), and cache of owner names.
+	userMap    IDMap
+	groupMap   IDMap
+	ownerNames sync.Map
+
+	// Options
+	optChecksum      bool
+	optLocking       bool
+	optOneFileSystem bool
+	optSymlinks      bool
+	optWriteInPlace  bool
 }
 
 // NewLocalFileSystem creates a new LocalFileSystem object
 func NewLocalFileSystem() *LocalFileSystem {
-	fs := &LocalFileSystem{}
+	fs := &LocalFileSystem{
+		log:        vfs.DiscardLogger(),
+		bufferSize: defaultBufferSize,
+	}
 	return fs
 }
 
-// FileExists returns true if a file/directory exists. False otherwise.
-func (fs *LocalFileSystem) FileExists(fullpath string) (bool, error) {
-	_, err := os.Stat(fullpath)
-	if err != nil {
-		return false, nil
+// Capabilities returns the features supported by the local filesystem.
+// Files are written atomically, unless writing in place. Checksums are only
+// available when enabled with SetChecksum.
+func (fs *LocalFileSystem) Capabilities() vfs.Capabilities {
+	return vfs.Capabilities{
+		SetMtime:       true,
+		Checksum:       fs.optChecksum,
+		ServerSideMove: true,
+		AtomicRename:   !fs.optWriteInPlace,
+		ReadDir:        true,
 	}
-	return true, nil
 }
 
-// FileTree returns a slice containing all files/directories under fullpath.
-func (fs *LocalFileSystem) FileTree(fullpath string) ([]string, error) {
-	// Use a map so duplicates are removed automatically
-	pathMap := make(map[string]bool)
-	err := filepath.Walk(fullpath, func(srcpath string, _ os.FileInfo, err error) error {
-		pathMap[srcpath] = true
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	// Create sorted list
-	pathSlice := []string{}
-	for k := range pathMap {
-		pathSlice = append(pathSlice, k)
-	}
-	sort.Strings(pathSlice)
-	return pathSlice, nil
+// Delete removes the file or empty directory named 'fullpath'.
+func (fs *LocalFileSystem) Delete(_ context.Context, fullpath string) error {
+	return os.Remove(fullpath)
 }
 
-// IsDir returns true if fullpath is a directory, false if it isn't or if the
-// file doesn't exist.
-func (fs *LocalFileSystem) IsDir(fullpath string) (bool, error) {
-	fi, err := os.Stat(fullpath)
+// FileExists returns true if a file/directory (or a symbolic link, even if
+// dangling) exists, and false if it doesn't. Other errors, like permission
+// errors, are returned.
+func (fs *LocalFileSystem) FileExists(_ context.Context, fullpath string) (bool, error) {
+	_, err := os.Lstat(fullpath)
 	if os.IsNotExist(err) {
 		return false, nil
 	}
+	return err == nil, err
+}
+
+// Link creates newpath as a hard link to oldpath, atomically replacing
+// newpath if it exists.
+func (fs *LocalFileSystem) Link(_ context.Context, oldpath string, newpath string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(newpath), filepath.Base(newpath))
 	if err != nil {
-		return false, err
+		return err
 	}
-	return fi.Mode().IsDir(), nil
-}
+	tmpFile := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpFile)
 
-// IsRegular returns true if fullpath is a regular file, false if it isn't or
-// if the file doesn't exist.
-func (fs *LocalFileSystem) IsRegular(fullpath string) (bool, error) {
-	fi, err := os.Stat(fullpath)
-	if os.IsNotExist(err) {
-		return false, nil
+	if err = os.Link(oldpath, tmpFile); err != nil {
+		return err
 	}
-	if err != nil {
-		return false, err
+	if err = os.Rename(tmpFile, newpath); err != nil {
+		os.Remove(tmpFile)
+		return err
 	}
-	return fi.Mode().IsRegular(), nil
+	return nil
 }
 
 // Mkdir creates a directory named 'path'
-func (fs *LocalFileSystem) Mkdir(path string) error {
+func (fs *LocalFileSystem) Mkdir(_ context.Context, path string) error {
 	err := os.Mkdir(path, 0755)
 	return err
 }
 
-// Mtime returns the local file's Modified Time (mtime) truncated to the
-// nearest second (no nano information).
-func (fs *LocalFileSystem) Mtime(fullpath string) (time.Time, error) {
-	fi, err := os.Stat(fullpath)
-	if err != nil {
-		return time.Time{}, err
-	}
-	return fi.ModTime(), nil
+// Move renames srcpath to dstpath.
+func (fs *LocalFileSystem) Move(_ context.Context, srcpath string, dstpath string) error {
+	return os.Rename(srcpath, dstpath)
 }
 
-// ReadFromFile returns an io.Reader pointing to fullpath in the local filesystem.
-func (fs *LocalFileSystem) ReadFromFile(fullpath string) (io.Reader, error) {
-	return os.Open(fullpath)
+// ReadFromFile returns an io.ReadCloser pointing to fullpath in the local
+// filesystem. The caller must close the returned reader.
+func (fs *LocalFileSystem) ReadFromFile(_ context.Context, fullpath string) (io.ReadCloser, error) {
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 // SetMtime sets the 'modification time' of fullpath to mtime
-func (fs *LocalFileSystem) SetMtime(fullpath string, mtime time.Time) error {
+func (fs *LocalFileSystem) SetMtime(_ context.Context, fullpath string, mtime time.Time) error {
 	atime := time.Now()
 	return os.Chtimes(fullpath, atime, mtime)
 }
 
+// SetBufferSize sets the size of the buffer used when writing files.
+func (fs *LocalFileSystem) SetBufferSize(size int) {
+	if size > 0 {
+		fs.bufferSize = size
+	}
+}
+
+// SetLogger sets the logger used for diagnostic messages. By default,
+// messages are discarded.
+func (fs *LocalFileSystem) SetLogger(l *slog.Logger) {
+	fs.log = l
+}
+
+// SetOneFileSystem sets the 'one file system' option. This will cause Walk to
+// not descend into directories on a different filesystem than the starting
+// path (mount points are still visited, but not their contents).
+func (fs *LocalFileSystem) SetOneFileSystem(f bool) {
+	fs.optOneFileSystem = f
+}
+
+// SetLocking sets the 'locking' option. Files being written are then held
+// with an exclusive advisory lock (flock), released only after the file is
+// complete and in place, so other processes taking a shared lock before
+// reading never see partial files. Not supported on Windows.
+func (fs *LocalFileSystem) SetLocking(f bool) {
+	fs.optLocking = f
+}
+
+// SetSymlinks sets the 'symlinks' option. SetMetadata then restores the
+// symbolic links recorded in the metadata. Link targets come from wherever the
+// metadata was recorded, so they are only trusted when asked for.
+func (fs *LocalFileSystem) SetSymlinks(f bool) {
+	fs.optSymlinks = f
+}
+
 // SetWriteInPlace sets the 'write in place' option. This will cause write operations
 // to not use an intermediate temporary file and an atomic rename.
 func (fs *LocalFileSystem) SetWriteInPlace(f bool) {
 	fs.optWriteInPlace = f
 }
 
-// Size returns the size of the file pointed by fullpath, in bytes.
-func (fs *LocalFileSystem) Size(fullpath string) (int64, error) {
-	fi, err := os.Stat(fullpath)
+// Stat returns information about fullpath. Symbolic links are reported as
+// such, along with the type, size and modification time of their targets.
+// Links that can't be followed (dangling or looping) have a target of type
+// vfs.TypeSymlink.
+func (fs *LocalFileSystem) Stat(_ context.Context, fullpath string) (vfs.FileInfo, error) {
+	lfi, err := os.Lstat(fullpath)
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	return fileInfo(fullpath, lfi), nil
+}
+
+// Return the vfs.FileInfo for fullpath, given the result of os.Lstat.
+func fileInfo(fullpath string, lfi os.FileInfo) vfs.FileInfo {
+	ret := vfs.FileInfo{
+		Path:  fullpath,
+		Size:  lfi.Size(),
+		Mtime: lfi.ModTime(),
+		Type:  fileType(lfi.Mode()),
+	}
+	if ret.Type != vfs.TypeSymlink {
+		return ret
+	}
+
+	ret.Target = vfs.TypeSymlink
+	if fi, err := os.Stat(fullpath); err == nil {
+		ret.Size, ret.Mtime, ret.Target = fi.Size(), fi.ModTime(), fileType(fi.Mode())
+	}
+	return ret
+}
+
+// Return the vfs.FileType for a file with the given mode.
+func fileType(mode os.FileMode) vfs.FileType {
+	switch {
+	case mode.IsRegular():
+		return vfs.TypeRegular
+	case mode.IsDir():
+		return vfs.TypeDir
+	case mode&os.ModeSymlink != 0:
+		return vfs.TypeSymlink
+	}
+	return vfs.TypeSpecial
+}
+
+// ReadDir returns information about the files and directories in fullpath,
+// sorted by name.
+func (fs *LocalFileSystem) ReadDir(_ context.Context, fullpath string) ([]vfs.FileInfo, error) {
+	list, err := ioutil.ReadDir(fullpath)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	ret := make([]vfs.FileInfo, 0, len(list))
+	for _, lfi := range list {
+		ret = append(ret, fileInfo(filepath.Join(fullpath, lfi.Name()), lfi))
 	}
-	return fi.Size(), nil
+	return ret, nil
+}
+
+// Walk calls walkFn for fullpath and every file/directory under it. Entries
+// inside a directory are visited in lexical order, and directories are visited
+// before their contents. Symbolic links are not followed, except when fullpath
+// itself is a link to a directory. Paths that can't be read are passed to
+// walkFn along with the error (directories may be passed a second time, if
+// their contents can't be read). If walkFn returns an error or ctx is
+// canceled, the walk stops and Walk returns that error.
+func (fs *LocalFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	var (
+		rootDev  uint64
+		checkDev bool
+	)
+	if fs.optOneFileSystem {
+		fi, err := os.Stat(fullpath)
+		if err != nil {
+			return err
+		}
+		rootDev, checkDev = deviceID(fi)
+	}
+
+	// A trailing separator makes filepath.Walk descend into a link.
+	root := fullpath
+	if fi, err := os.Lstat(fullpath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		root = fullpath + string(filepath.Separator)
+	}
+
+	return filepath.Walk(root, func(srcpath string, fi os.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if srcpath == root {
+			srcpath = fullpath
+		}
+		if err != nil {
+			return walkFn(vfs.FileInfo{Path: srcpath}, err)
+		}
+		if err := walkFn(fileInfo(srcpath, fi), nil); err != nil {
+			return err
+		}
+		// Don't descend into directories in other filesystems.
+		if checkDev && fi != nil && fi.IsDir() {
+			if dev, ok := deviceID(fi); ok && dev != rootDev {
+				fs.log.Debug("not crossing filesystem boundary", "path", srcpath)
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
 }
 
 // WriteToFile reads all data from reader and write to file fullpath.
-func (fs *LocalFileSystem) WriteToFile(fullpath string, reader io.Reader) error {
+func (fs *LocalFileSystem) WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error {
 	var (
 		outWriter *os.File
 		tmpFile   string
@@ -166,11 +318,32 @@ func (fs *LocalFileSystem) WriteToFile(fullpath string, reader io.Reader) error
 		defer os.Remove(tmpFile)
 	}
 
-	_, err = io.Copy(outWriter, reader)
+	// Locked files stay open (and locked) until renamed.
+	locked := false
+	if fs.optLocking {
+		if locked, err = lockFile(ctx, outWriter); err != nil {
+			return fmt.Errorf("Unable to lock \"%s\": %v", outWriter.Name(), err)
+		}
+	}
+
+	buf := vfs.Buffers.Get(fs.bufferSize)
+	defer vfs.Buffers.Put(buf)
+	// Hide the ReadFrom method of *os.File, which would make CopyBuffer
+	// ignore buf and use a buffer of its own.
+	_, err = io.CopyBuffer(struct{ io.Writer }{outWriter}, reader, buf)
 	if err != nil {
 		return err
 	}
-	outWriter.Close()
+	// Write errors may be delayed until the data is flushed (on NFS, or
+	// full disks), and must keep the file from being published as complete.
+	if err = outWriter.Sync(); err != nil {
+		return fmt.Errorf("Unable to write \"%s\": %v", fullpath, err)
+	}
+	if !locked {
+		if err = outWriter.Close(); err != nil {
+			return fmt.Errorf("Unable to write \"%s\": %v", fullpath, err)
+		}
+	}
 
 	if !fs.optWriteInPlace {
 		err = os.Rename(tmpFile, fullpath)
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"os"
+)
+
+// lockFile does nothing, since advisory locks are not supported on this
+// platform (locks on Windows are mandatory, and would block readers).
+func lockFile(_ context.Context, _ *os.File) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,155 @@
+package localvfs
+
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// IDMap translates the owners (users or groups) of files when restoring their
+// metadata, for machines where the same users have different IDs. Keys are
+// the user or group names, or numeric IDs, recorded in the metadata. The "*"
+// key matches any owner not matched otherwise. Values are numeric IDs on this
+// machine.
+type IDMap map[string]int
+
+// translate returns the ID mapped to the owner with the given name and id,
+// or id if there's no mapping.
+func (m IDMap) translate(name string, id int) int {
+	if n, ok := m[name]; ok && name != "" {
+		return n
+	}
+	if n, ok := m[strconv.Itoa(id)]; ok {
+		return n
+	}
+	if n, ok := m["*"]; ok {
+		return n
+	}
+	return id
+}
+
+// SetIDMaps sets the maps translating the user and group owners of files
+// restored with SetMetadata. Nil maps keep the IDs in the metadata.
+func (fs *LocalFileSystem) SetIDMaps(users IDMap, groups IDMap) {
+	fs.userMap, fs.groupMap = users, groups
+}
+
+// ownerName returns the user (or, with group set, group) name for id, or an
+// empty string if unknown. Names are looked up once.
+func (fs *LocalFileSystem) ownerName(id uint32, group bool) string {
+	key := strconv.FormatUint(uint64(id), 10)
+	if group {
+		key = "g" + key
+	}
+	if name, ok := fs.ownerNames.Load(key); ok {
+		return name.(string)
+	}
+	var name string
+	if group {
+		if g, err := user.LookupGroupId(strconv.FormatUint(uint64(id), 10)); err == nil {
+			name = g.Name
+		}
+	} else if u, err := user.LookupId(strconv.FormatUint(uint64(id), 10)); err == nil {
+		name = u.Username
+	}
+	fs.ownerNames.Store(key, name)
+	return name
+}
+
+// Metadata keys returned by Metadata.
+const (
+	MetaMode    = "mode"    // Permission bits, in octal
+	MetaUID     = "uid"     // Numeric user ID of the owner
+	MetaGID     = "gid"     // Numeric group ID of the owner
+	MetaUser    = "user"    // User name of the owner, if known
+	MetaGroup   = "group"   // Group name of the owner, if known
+	MetaMtime   = "mtime"   // Modification time, in nanoseconds since the epoch
+	MetaSymlink = "symlink" // Target, if fullpath is a symbolic link
+)
+
+// Metadata returns the metadata of fullpath that is not preserved by copying
+// its contents: permission bits, ownership (IDs and names, where supported),
+// the exact modification time and, for symbolic links, the link target.
+// Symbolic links are followed for everything but the target.
+func (fs *LocalFileSystem) Metadata(_ context.Context, fullpath string) (map[string]string, error) {
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{
+		MetaMode:  strconv.FormatUint(uint64(fi.Mode().Perm()), 8),
+		MetaMtime: strconv.FormatInt(fi.ModTime().UnixNano(), 10),
+	}
+	if uid, gid, ok := owner(fi); ok {
+		meta[MetaUID] = strconv.FormatUint(uint64(uid), 10)
+		meta[MetaGID] = strconv.FormatUint(uint64(gid), 10)
+		if name := fs.ownerName(uid, false); name != "" {
+			meta[MetaUser] = name
+		}
+		if name := fs.ownerName(gid, true); name != "" {
+			meta[MetaGroup] = name
+		}
+	}
+
+	lfi, err := os.Lstat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	if lfi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullpath)
+		if err != nil {
+			return nil, err
+		}
+		meta[MetaSymlink] = target
+	}
+	return meta, nil
+}
+
+// SetMetadata applies metadata returned by Metadata (possibly on a different
+// machine) to fullpath. If the symlinks option is set (see SetSymlinks), a
+// symbolic link target replaces fullpath with a link to that target, and
+// nothing else is applied. Otherwise, the permission bits
+// and the exact modification time are set. Ownership is only changed when
+// running as root, translated by the ID maps, if set (see SetIDMaps). Keys
+// that are missing or invalid are ignored.
+func (fs *LocalFileSystem) SetMetadata(_ context.Context, fullpath string, meta map[string]string) error {
+	if target, ok := meta[MetaSymlink]; ok && target != "" && fs.optSymlinks {
+		if err := os.Remove(fullpath); err != nil {
+			return err
+		}
+		return os.Symlink(target, fullpath)
+	}
+
+	if v, ok := meta[MetaMode]; ok {
+		if mode, err := strconv.ParseUint(v, 8, 32); err == nil {
+			if err = os.Chmod(fullpath, os.FileMode(mode).Perm()); err != nil {
+				return err
+			}
+		}
+	}
+
+	uid, err1 := strconv.Atoi(meta[MetaUID])
+	gid, err2 := strconv.Atoi(meta[MetaGID])
+	if err1 == nil && err2 == nil && canChown() {
+		uid = fs.userMap.translate(meta[MetaUser], uid)
+		gid = fs.groupMap.translate(meta[MetaGroup], gid)
+		if err := os.Chown(fullpath, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := meta[MetaMtime]; ok {
+		if ns, err := strconv.ParseInt(v, 10, 64); err == nil {
+			if err = os.Chtimes(fullpath, time.Now(), time.Unix(0, ns)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
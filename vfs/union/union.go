@@ -0,0 +1,354 @@
+// Package unionvfs implements a read-only gsync VFS overlaying several
+// directory trees (members) into a single tree, so they can be synced to one
+// destination together.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+package unionvfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marcopaganini/gsync/vfs"
+)
+
+// Precedence rules, deciding which member provides a path found in more than
+// one member.
+const (
+	// PrecedenceFirst picks the first member holding the path.
+	PrecedenceFirst = "first"
+	// PrecedenceLast picks the last member holding the path.
+	PrecedenceLast = "last"
+	// PrecedenceNewest picks the most recently modified file. Directories
+	// (and files colliding with directories) are picked as with
+	// PrecedenceFirst.
+	PrecedenceNewest = "newest"
+)
+
+// Precedences lists the valid precedence rules.
+var Precedences = []string{PrecedenceFirst, PrecedenceLast, PrecedenceNewest}
+
+// Member is one of the trees in a union: the directory Root in FS. FS must
+// implement vfs.DirReader, and use the path conventions of the operating
+// system (as local filesystems do).
+type Member struct {
+	FS   vfs.VFS
+	Root string
+}
+
+// UnionFileSystem represents a read-only union of several trees. Paths are
+// relative to the top of the union, which is always a directory. Directories
+// found in several members are merged, and the contents of files found in
+// several members (or files and directories sharing a path) come from a
+// single member, chosen by the precedence rule.
+type UnionFileSystem struct {
+	log        *slog.Logger
+	members    []Member
+	precedence string
+}
+
+// entry is a path found in a member.
+type entry struct {
+	member int
+	fi     vfs.FileInfo
+}
+
+// NewUnionFileSystem creates a new UnionFileSystem overlaying members, with
+// paths found in more than one member resolved by the precedence rule.
+func NewUnionFileSystem(members []Member, precedence string) (*UnionFileSystem, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("A union needs at least one member")
+	}
+	valid := false
+	for _, p := range Precedences {
+		valid = valid || p == precedence
+	}
+	if !valid {
+		return nil, fmt.Errorf("Invalid union precedence \"%s\" (must be one of %v)", precedence, Precedences)
+	}
+	for _, m := range members {
+		if _, ok := m.FS.(vfs.DirReader); !ok || !vfs.CapabilitiesOf(m.FS).ReadDir {
+			return nil, fmt.Errorf("Union member \"%s\" can't list directories", m.Root)
+		}
+	}
+	return &UnionFileSystem{
+		log:        vfs.DiscardLogger(),
+		members:    members,
+		precedence: precedence,
+	}, nil
+}
+
+// cleanPath returns fullpath relative to the top of the union, without
+// leading or trailing slashes.
+func cleanPath(fullpath string) string {
+	return strings.Trim(path.Clean("/"+filepath.ToSlash(fullpath)), "/")
+}
+
+// memberPath returns the path of rel (as returned by cleanPath) in member m.
+func (ufs *UnionFileSystem) memberPath(m int, rel string) string {
+	return filepath.Join(ufs.members[m].Root, filepath.FromSlash(rel))
+}
+
+// order returns the indexes of the members, in order of precedence.
+func (ufs *UnionFileSystem) order() []int {
+	ret := make([]int, len(ufs.members))
+	for i := range ret {
+		ret[i] = i
+		if ufs.precedence == PrecedenceLast {
+			ret[i] = len(ret) - 1 - i
+		}
+	}
+	return ret
+}
+
+// pick returns the entry that provides a path found in entries, which are in
+// order of precedence.
+func (ufs *UnionFileSystem) pick(entries []entry) entry {
+	ret := entries[0]
+	if ufs.precedence != PrecedenceNewest || ret.fi.IsDir() {
+		return ret
+	}
+	for _, e := range entries[1:] {
+		if !e.fi.IsDir() && e.fi.Mtime.After(ret.fi.Mtime) {
+			ret = e
+		}
+	}
+	return ret
+}
+
+// lookup returns the entry providing rel, and the entries of all members
+// holding it, in order of precedence. An error matching vfs.ErrNotExist is
+// returned if no member holds rel.
+func (ufs *UnionFileSystem) lookup(ctx context.Context, rel string) (entry, []entry, error) {
+	var found []entry
+	for _, m := range ufs.order() {
+		fi, err := ufs.members[m].FS.Stat(ctx, ufs.memberPath(m, rel))
+		if errors.Is(err, vfs.ErrNotExist) || (err != nil && ufs.shadowed(ctx, m, rel)) {
+			continue
+		}
+		if err != nil {
+			return entry{}, nil, err
+		}
+		found = append(found, entry{m, fi})
+	}
+	if len(found) == 0 {
+		return entry{}, nil, fmt.Errorf("Union \"%s\": %w", rel, vfs.ErrNotExist)
+	}
+	e := ufs.pick(found)
+	if len(found) > 1 {
+		ufs.log.Debug("path found in several union members", "path", rel, "using", ufs.memberPath(e.member, rel))
+	}
+	return e, found, nil
+}
+
+// shadowed returns true if a parent of rel is a file in member m, so m can't
+// hold rel. Members may disagree on whether a path is a file or a directory,
+// and looking up paths under a file fails with errors other than
+// vfs.ErrNotExist in some filesystems.
+func (ufs *UnionFileSystem) shadowed(ctx context.Context, m int, rel string) bool {
+	for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+		fi, err := ufs.members[m].FS.Stat(ctx, ufs.memberPath(m, d))
+		if err == nil {
+			return !fi.IsDir()
+		}
+	}
+	return false
+}
+
+// readOnly returns the error for operations that would modify the tree.
+func readOnly(op string, fullpath string) error {
+	return fmt.Errorf("%s \"%s\": unions are read-only", op, fullpath)
+}
+
+// Capabilities returns the features supported by the union. Checksums are
+// available if all members provide them.
+func (ufs *UnionFileSystem) Capabilities() vfs.Capabilities {
+	caps := vfs.Capabilities{Checksum: true, ReadDir: true}
+	for _, m := range ufs.members {
+		caps.Checksum = caps.Checksum && vfs.CapabilitiesOf(m.FS).Checksum
+	}
+	return caps
+}
+
+// Delete always fails, since unions are read-only.
+func (ufs *UnionFileSystem) Delete(_ context.Context, fullpath string) error {
+	return readOnly("Delete", fullpath)
+}
+
+// FileExists returns true if fullpath exists in any member.
+func (ufs *UnionFileSystem) FileExists(ctx context.Context, fullpath string) (bool, error) {
+	_, err := ufs.Stat(ctx, fullpath)
+	if errors.Is(err, vfs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MD5 returns the MD5 checksum of fullpath in the member providing it, if
+// the member provides checksums. Otherwise, an empty string is returned.
+func (ufs *UnionFileSystem) MD5(ctx context.Context, fullpath string) (string, error) {
+	rel := cleanPath(fullpath)
+	e, _, err := ufs.lookup(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	v, ok := ufs.members[e.member].FS.(vfs.MD5er)
+	if !ok || e.fi.IsDir() {
+		return "", nil
+	}
+	return v.MD5(ctx, ufs.memberPath(e.member, rel))
+}
+
+// Metadata returns the metadata of fullpath in the member providing it, if
+// the member keeps any.
+func (ufs *UnionFileSystem) Metadata(ctx context.Context, fullpath string) (map[string]string, error) {
+	rel := cleanPath(fullpath)
+	e, _, err := ufs.lookup(ctx, rel)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := ufs.members[e.member].FS.(vfs.MetadataGetter)
+	if !ok {
+		return nil, nil
+	}
+	return v.Metadata(ctx, ufs.memberPath(e.member, rel))
+}
+
+// Mkdir always fails, since unions are read-only.
+func (ufs *UnionFileSystem) Mkdir(_ context.Context, fullpath string) error {
+	return readOnly("Mkdir", fullpath)
+}
+
+// Move always fails, since unions are read-only.
+func (ufs *UnionFileSystem) Move(_ context.Context, srcpath string, _ string) error {
+	return readOnly("Move", srcpath)
+}
+
+// ReadDir returns information about the files and directories in fullpath,
+// sorted by name: the contents of fullpath in all members where it is a
+// directory, with paths found in several members resolved by the precedence
+// rule.
+func (ufs *UnionFileSystem) ReadDir(ctx context.Context, fullpath string) ([]vfs.FileInfo, error) {
+	rel := cleanPath(fullpath)
+	e, found, err := ufs.lookup(ctx, rel)
+	if err != nil {
+		return nil, err
+	}
+	if !e.fi.IsDir() {
+		return nil, fmt.Errorf("Unable to list \"%s\": not a directory", fullpath)
+	}
+
+	names := make(map[string][]entry)
+	for _, f := range found {
+		if !f.fi.IsDir() {
+			continue
+		}
+		list, err := ufs.members[f.member].FS.(vfs.DirReader).ReadDir(ctx, ufs.memberPath(f.member, rel))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range list {
+			name := filepath.Base(fi.Path)
+			names[name] = append(names[name], entry{f.member, fi})
+		}
+	}
+
+	ret := make([]vfs.FileInfo, 0, len(names))
+	for name, entries := range names {
+		fi := ufs.pick(entries).fi
+		fi.Path = path.Join(fullpath, name)
+		ret = append(ret, fi)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, nil
+}
+
+// ReadFromFile returns an io.ReadCloser with the contents of fullpath in the
+// member providing it. The caller must close it.
+func (ufs *UnionFileSystem) ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error) {
+	rel := cleanPath(fullpath)
+	e, _, err := ufs.lookup(ctx, rel)
+	if err != nil {
+		return nil, err
+	}
+	return ufs.members[e.member].FS.ReadFromFile(ctx, ufs.memberPath(e.member, rel))
+}
+
+// SetLogger sets the logger used for debugging messages.
+func (ufs *UnionFileSystem) SetLogger(l *slog.Logger) {
+	ufs.log = l
+}
+
+// SetMtime always fails, since unions are read-only.
+func (ufs *UnionFileSystem) SetMtime(_ context.Context, fullpath string, _ time.Time) error {
+	return readOnly("SetMtime", fullpath)
+}
+
+// SetWriteInPlace does nothing, since unions are read-only.
+func (ufs *UnionFileSystem) SetWriteInPlace(bool) {
+}
+
+// Stat returns information about fullpath, as found in the member providing
+// it.
+func (ufs *UnionFileSystem) Stat(ctx context.Context, fullpath string) (vfs.FileInfo, error) {
+	e, _, err := ufs.lookup(ctx, cleanPath(fullpath))
+	if err != nil {
+		return vfs.FileInfo{}, err
+	}
+	fi := e.fi
+	fi.Path = fullpath
+	return fi, nil
+}
+
+// Walk calls walkFn for fullpath and every file and directory under it.
+// Entries inside a directory are visited in lexical order, and directories are
+// visited before their contents. Directories that can't be listed are passed
+// to walkFn along with the error. If walkFn returns an error, the walk stops
+// and Walk returns that error.
+func (ufs *UnionFileSystem) Walk(ctx context.Context, fullpath string, walkFn vfs.WalkFunc) error {
+	fi, err := ufs.Stat(ctx, fullpath)
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: fullpath}, err)
+	}
+	if err = walkFn(fi, nil); err != nil || !fi.IsDir() {
+		return err
+	}
+	return ufs.walkDir(ctx, fullpath, walkFn)
+}
+
+// walkDir calls walkFn for every entry under dir, recursively.
+func (ufs *UnionFileSystem) walkDir(ctx context.Context, dir string, walkFn vfs.WalkFunc) error {
+	list, err := ufs.ReadDir(ctx, dir)
+	if err != nil {
+		return walkFn(vfs.FileInfo{Path: dir}, err)
+	}
+	for _, fi := range list {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = walkFn(fi, nil); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err = ufs.walkDir(ctx, fi.Path, walkFn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteToFile always fails, since unions are read-only.
+func (ufs *UnionFileSystem) WriteToFile(_ context.Context, fullpath string, _ io.Reader) error {
+	return readOnly("WriteToFile", fullpath)
+}
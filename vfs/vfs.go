@@ -0,0 +1,304 @@
+// Package vfs defines the virtual filesystem (VFS) interface used by gsync to
+// access local filesystems, Google Drive and other storage backends.
+//
+// Backends implement VFS, and optionally any of the smaller interfaces below.
+// The sync engine checks for those with type assertions and makes use of them
+// when available. All methods take a context, which backends should honor to
+// abandon operations that are no longer needed.
+//
+// This file is part of gsync, a Google Drive syncer in Go.
+// See instructions in the README.md file that accompanies this program.
+// (C) 2015 by Marco Paganini <paganini AT paganini DOT net>
+package vfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// ErrNotExist is returned (possibly wrapped) by Stat and other methods when
+// a file or directory does not exist. Check with errors.Is.
+var ErrNotExist = fs.ErrNotExist
+
+// FileType classifies the objects found in a VFS.
+type FileType int
+
+// File types.
+const (
+	TypeRegular FileType = iota // Regular file
+	TypeDir                     // Directory
+	TypeSymlink                 // Symbolic link
+	TypeSpecial                 // Anything else (devices, sockets, etc)
+)
+
+// FileInfo describes a file or directory.
+type FileInfo struct {
+	// Path of the file, as given to Stat.
+	Path string
+
+	// Size in bytes, or -1 if not known (as with Google Docs, whose size
+	// is only known after they are exported).
+	Size int64
+
+	// Modification time.
+	Mtime time.Time
+
+	// Type of the object. Symbolic links are not followed.
+	Type FileType
+
+	// Type of the object a symbolic link points to, after following all
+	// links, or TypeSymlink if the link is dangling. Size and Mtime
+	// describe that object. Not used for other types.
+	Target FileType
+}
+
+// resolved returns the type of fi, following symbolic links.
+func (fi FileInfo) resolved() FileType {
+	if fi.Type == TypeSymlink {
+		return fi.Target
+	}
+	return fi.Type
+}
+
+// IsDir returns true if fi is a directory or a link to a directory.
+func (fi FileInfo) IsDir() bool {
+	return fi.resolved() == TypeDir
+}
+
+// IsRegular returns true if fi is a regular file or a link to one.
+func (fi FileInfo) IsRegular() bool {
+	return fi.resolved() == TypeRegular
+}
+
+// IsSymlink returns true if fi is a symbolic link.
+func (fi FileInfo) IsSymlink() bool {
+	return fi.Type == TypeSymlink
+}
+
+// WalkFunc is called by Walk for each file or directory visited, with the
+// same information returned by Stat, so callers don't need to Stat every
+// entry again. If a path (or the contents of a directory) could not be read,
+// err holds the reason and only fi.Path is set. In that case, walkFn decides
+// whether to continue (returning nil) or stop the walk (returning an error).
+// The contents of unreadable directories are skipped.
+type WalkFunc func(fi FileInfo, err error) error
+
+// VFS is the interface implemented by all backends. Paths use forward slashes
+// as separators, except for local paths, which use the conventions of the
+// operating system.
+type VFS interface {
+	// Delete removes a file or empty directory.
+	Delete(ctx context.Context, fullpath string) error
+
+	// FileExists returns true if a file or directory exists.
+	FileExists(ctx context.Context, fullpath string) (bool, error)
+
+	// Mkdir creates a directory. The parent directory must exist.
+	Mkdir(ctx context.Context, fullpath string) error
+
+	// Move renames srcpath to dstpath.
+	Move(ctx context.Context, srcpath string, dstpath string) error
+
+	// ReadFromFile returns a reader with the contents of a file. The
+	// caller must close it.
+	ReadFromFile(ctx context.Context, fullpath string) (io.ReadCloser, error)
+
+	// SetMtime sets the modification time of a file or directory.
+	SetMtime(ctx context.Context, fullpath string, mtime time.Time) error
+
+	// SetWriteInPlace makes WriteToFile write directly to the destination
+	// file, instead of writing to a temporary file and renaming it.
+	SetWriteInPlace(bool)
+
+	// Stat returns information about a file or directory. An error
+	// matching ErrNotExist is returned if it does not exist.
+	Stat(ctx context.Context, fullpath string) (FileInfo, error)
+
+	// Walk calls walkFn for fullpath and every file and directory under
+	// it. Directories are visited before their contents. If walkFn returns
+	// an error, the walk stops and Walk returns that error.
+	Walk(ctx context.Context, fullpath string, walkFn WalkFunc) error
+
+	// WriteToFile writes all data in reader to a file, replacing it if it
+	// exists.
+	WriteToFile(ctx context.Context, fullpath string, reader io.Reader) error
+}
+
+// FileIDer is implemented by backends that assign persistent IDs to objects.
+// An empty ID means the ID is not known.
+type FileIDer interface {
+	FileID(ctx context.Context, fullpath string) (string, error)
+}
+
+// MD5er is implemented by backends that can cheaply return MD5 checksums, as
+// hex strings. An empty checksum means the checksum is not known.
+type MD5er interface {
+	MD5(ctx context.Context, fullpath string) (string, error)
+}
+
+// Revisioner is implemented by backends that identify each revision of the
+// contents of a file. The revision changes whenever the contents change, but
+// not when only metadata (like the modification time) does. An empty revision
+// means the revision is not known.
+type Revisioner interface {
+	Revision(ctx context.Context, fullpath string) (string, error)
+}
+
+// MimeTyper is implemented by backends that keep the MIME type of files. An
+// empty type means the type is not known.
+type MimeTyper interface {
+	MimeType(ctx context.Context, fullpath string) (string, error)
+}
+
+// ResumableWriter is implemented by backends that can resume interrupted
+// writes of a file with known size and modification time. The modification
+// time of the file is set to mtime.
+type ResumableWriter interface {
+	WriteToFileResumable(ctx context.Context, fullpath string, reader io.Reader, size int64, mtime time.Time) error
+}
+
+// Btimer is implemented by backends that keep creation (birth) times. A zero
+// time means the creation time is not known. SetBtime may change the
+// modification time, so it must be called before SetMtime.
+type Btimer interface {
+	Btime(ctx context.Context, fullpath string) (time.Time, error)
+	SetBtime(ctx context.Context, fullpath string, btime time.Time) error
+}
+
+// MetadataGetter is implemented by backends that can return metadata not
+// preserved by copying file contents (like mode bits and ownership) as
+// key/value pairs.
+type MetadataGetter interface {
+	Metadata(ctx context.Context, fullpath string) (map[string]string, error)
+}
+
+// MetadataSetter is implemented by backends that can store or apply metadata
+// returned by a MetadataGetter.
+type MetadataSetter interface {
+	SetMetadata(ctx context.Context, fullpath string, meta map[string]string) error
+}
+
+// Linker is implemented by backends that can create hard links. Link
+// replaces newpath if it exists.
+type Linker interface {
+	Link(ctx context.Context, oldpath string, newpath string) error
+}
+
+// DirReader is implemented by backends that can list the contents of a
+// single directory, without walking its subdirectories.
+type DirReader interface {
+	ReadDir(ctx context.Context, fullpath string) ([]FileInfo, error)
+}
+
+// EmptyDirChecker is implemented by backends whose listings may omit objects
+// (like Google files that can't be downloaded), so directories that look
+// empty when walked may still hold data. IsEmptyDir returns true only if the
+// directory fullpath holds nothing at all.
+type EmptyDirChecker interface {
+	IsEmptyDir(ctx context.Context, fullpath string) (bool, error)
+}
+
+// FreeSpacer is implemented by backends that can report the space available
+// for new files, in bytes, in the filesystem holding fullpath. Fullpath need
+// not exist. A negative value means the free space is not known.
+type FreeSpacer interface {
+	FreeSpace(ctx context.Context, fullpath string) (int64, error)
+}
+
+// Copier is implemented by backends that can copy files without transferring
+// their data through gsync (server-side copies).
+type Copier interface {
+	Copy(ctx context.Context, srcpath string, dstpath string) error
+}
+
+// Capabilities describes the features supported by a backend, so the sync
+// engine can adapt its strategy instead of failing at runtime.
+type Capabilities struct {
+	// SetMtime is set if the modification times of files can be set.
+	SetMtime bool
+
+	// Checksum is set if MD5 checksums are available (see MD5er).
+	Checksum bool
+
+	// ServerSideCopy is set if files can be copied within the backend
+	// without transferring their data (see Copier).
+	ServerSideCopy bool
+
+	// ServerSideMove is set if Move renames files without transferring
+	// their data.
+	ServerSideMove bool
+
+	// AtomicRename is set if WriteToFile writes to a temporary file and
+	// renames it into place, so failed writes never leave partial files
+	// behind.
+	AtomicRename bool
+
+	// ReadDir is set if single directories can be listed (see DirReader).
+	ReadDir bool
+}
+
+// Capabler is implemented by backends that describe their capabilities.
+type Capabler interface {
+	Capabilities() Capabilities
+}
+
+// CapabilitiesOf returns the capabilities of fsys. Backends that do not
+// implement Capabler are assumed to set modification times and move files
+// on the server side, but not to write files atomically. Checksums,
+// server-side copies and directory listings are assumed to be available if
+// fsys implements MD5er, Copier and DirReader.
+func CapabilitiesOf(fsys VFS) Capabilities {
+	if v, ok := fsys.(Capabler); ok {
+		return v.Capabilities()
+	}
+	_, md5 := fsys.(MD5er)
+	_, copier := fsys.(Copier)
+	_, lister := fsys.(DirReader)
+	return Capabilities{
+		SetMtime:       true,
+		Checksum:       md5,
+		ServerSideCopy: copier,
+		ServerSideMove: true,
+		ReadDir:        lister,
+	}
+}
+
+// Logger discarding all messages, shared by all backends.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// DiscardLogger returns a logger that discards all messages, used by backends
+// until their callers set a logger of their own.
+func DiscardLogger() *slog.Logger {
+	return discardLogger
+}
+
+// progressKey is the context key of the function set by WithProgress.
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx carrying fn, which backends call (see
+// Progress) as the destination acknowledges data already read from the
+// source of a write, like the chunks of an upload. Each byte is reported
+// once, even if sent again. Callers watching for stalled transfers use it to
+// tell slow sends apart from stalls. Functions set in ctx by earlier calls
+// are called too.
+func WithProgress(ctx context.Context, fn func(n int)) context.Context {
+	if prev, ok := ctx.Value(progressKey{}).(func(int)); ok {
+		next := fn
+		fn = func(n int) {
+			next(n)
+			prev(n)
+		}
+	}
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// Progress reports that n bytes of a write were sent, to the function set in
+// ctx by WithProgress, if any.
+func Progress(ctx context.Context, n int) {
+	if fn, ok := ctx.Value(progressKey{}).(func(int)); ok {
+		fn(n)
+	}
+}